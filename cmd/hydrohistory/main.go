@@ -0,0 +1,129 @@
+// The hydrohistory command prints a summary of the relay history
+// stored by hydroserver.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+var (
+	fromFlag = flag.String("from", "", "start of the time window (RFC3339; default 24h before -to)")
+	toFlag   = flag.String("to", "", "end of the time window (RFC3339; default now)")
+	utcFlag  = flag.Bool("utc", false, "print times in UTC rather than local time")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: hydrohistory [flags] historyfile\n")
+		fmt.Fprintf(os.Stderr, "Prints the relay transitions recorded in the given history file and the total time each relay was on within a time window.\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if err := main1(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "hydrohistory: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func main1(path string) error {
+	t1 := time.Now()
+	if *toFlag != "" {
+		t, err := time.Parse(time.RFC3339, *toFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -to time: %v", err)
+		}
+		t1 = t
+	}
+	t0 := t1.Add(-24 * time.Hour)
+	if *fromFlag != "" {
+		t, err := time.Parse(time.RFC3339, *fromFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -from time: %v", err)
+		}
+		t0 = t
+	}
+	if t1.Before(t0) {
+		return fmt.Errorf("end time %v is before start time %v", t1, t0)
+	}
+	tz := time.Local
+	if *utcFlag {
+		tz = time.UTC
+	}
+	// NewDiskStore creates the file if it doesn't exist,
+	// which we don't want for a read-only tool.
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	store, err := history.NewDiskStore(path, t0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return writeSummary(os.Stdout, store, t0, t1, tz)
+}
+
+// writeSummary writes to w the relay events in store that
+// occur within the time range [t0, t1] and the total
+// duration that each relay was on within that range.
+// Relays with no events and no on time are omitted.
+// Times are printed in the given time zone.
+func writeSummary(w io.Writer, store history.Store, t0, t1 time.Time, tz *time.Location) error {
+	db, err := history.New(store)
+	if err != nil {
+		return err
+	}
+	// Gather the events for each relay. The store iterates
+	// backwards in time, so reverse them afterwards.
+	events := make([][]history.Event, hydroctl.MaxRelayCount)
+	iter := store.ReverseIter()
+	for iter.Next() {
+		e := iter.Item()
+		if e.Time.Before(t0) || e.Time.After(t1) {
+			continue
+		}
+		events[e.Relay] = append(events[e.Relay], e)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for _, es := range events {
+		for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+			es[i], es[j] = es[j], es[i]
+		}
+	}
+	fmt.Fprintf(w, "from %s to %s\n", timeFmt(t0, tz), timeFmt(t1, tz))
+	for relay, es := range events {
+		onDuration := db.OnDuration(relay, t0, t1)
+		if len(es) == 0 && onDuration == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "relay %d\n", relay)
+		for _, e := range es {
+			state := "off"
+			if e.On {
+				state = "on"
+			}
+			if e.Override {
+				state += " (override)"
+			}
+			fmt.Fprintf(w, "\t%s %s\n", timeFmt(e.Time, tz), state)
+		}
+		fmt.Fprintf(w, "\ttotal on %v\n", onDuration)
+	}
+	return nil
+}
+
+func timeFmt(t time.Time, tz *time.Location) string {
+	return t.In(tz).Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/history"
+)
+
+func TestWriteSummary(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	ms := func(d time.Duration) string {
+		return fmt.Sprint(t0.Add(d).UnixNano() / 1e6)
+	}
+	path := filepath.Join(c.Mkdir(), "history")
+	err := ioutil.WriteFile(path, []byte(""+
+		// Relay 0 turns on before the window and off within it.
+		"0 1 "+ms(-time.Hour)+"\n"+
+		"0 0 "+ms(30*time.Minute)+"\n"+
+		// Relay 2 turns on and off twice within the window
+		// and is still on at the end.
+		"2 1 "+ms(time.Hour)+"\n"+
+		"2 0 "+ms(90*time.Minute)+"\n"+
+		"2 1 "+ms(3*time.Hour)+"\n"+
+		// Relay 3 turns on and off after the window.
+		"3 1 "+ms(5*time.Hour)+"\n"+
+		"3 0 "+ms(6*time.Hour)+"\n",
+	), 0666)
+	c.Assert(err, qt.IsNil)
+	store, err := history.NewDiskStore(path, time.Time{})
+	c.Assert(err, qt.IsNil)
+	defer store.Close()
+	var buf bytes.Buffer
+	err = writeSummary(&buf, store, t0, t0.Add(4*time.Hour), time.UTC)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `
+from 2020-01-02 10:00:00 to 2020-01-02 14:00:00
+relay 0
+	2020-01-02 10:30:00 off
+	total on 30m0s
+relay 2
+	2020-01-02 11:00:00 on
+	2020-01-02 11:30:00 off
+	2020-01-02 13:00:00 on
+	total on 1h30m0s
+`[1:])
+}
@@ -0,0 +1,120 @@
+// The hydroreplay command replays the relay decisions recorded
+// by hydroserver in its decision log through the current control
+// algorithm and prints any decisions that would be made differently.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rogpeppe/hydro/decisionlog"
+	"github.com/rogpeppe/hydro/hydroconfig"
+)
+
+var (
+	fromFlag = flag.String("from", "", "start of the time window (RFC3339; default the start of the log)")
+	toFlag   = flag.String("to", "", "end of the time window (RFC3339; default the end of the log)")
+	utcFlag  = flag.Bool("utc", false, "print times in UTC rather than local time")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: hydroreplay [flags] configfile decisiondir\n")
+		fmt.Fprintf(os.Stderr, "Replays the decisions in the given decision log directory using the relay configuration in configfile and prints those that are decided differently.\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+	}
+	ndiffs, err := main1(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hydroreplay: %v\n", err)
+		os.Exit(1)
+	}
+	if ndiffs > 0 {
+		os.Exit(1)
+	}
+}
+
+func main1(configPath, dir string) (int, error) {
+	var t0, t1 time.Time
+	if *fromFlag != "" {
+		t, err := time.Parse(time.RFC3339, *fromFlag)
+		if err != nil {
+			return 0, fmt.Errorf("invalid -from time: %v", err)
+		}
+		t0 = t
+	}
+	if *toFlag != "" {
+		t, err := time.Parse(time.RFC3339, *toFlag)
+		if err != nil {
+			return 0, fmt.Errorf("invalid -to time: %v", err)
+		}
+		t1 = t
+	}
+	tz := time.Local
+	if *utcFlag {
+		tz = time.UTC
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return 0, err
+	}
+	cfg, err := hydroconfig.Parse(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse relay configuration: %v", err)
+	}
+	decisions, err := decisionlog.Read(dir, t0, t1)
+	if err != nil {
+		return 0, err
+	}
+	diffs, err := decisionlog.Replay(cfg.CtlConfig(), decisions)
+	if err != nil {
+		return 0, err
+	}
+	writeDiffs(os.Stdout, diffs, len(decisions), tz)
+	return len(diffs), nil
+}
+
+// writeDiffs writes a description of the given differences to w,
+// followed by a summary line. The total argument holds the number
+// of decisions that were replayed.
+func writeDiffs(w io.Writer, diffs []decisionlog.Difference, total int, tz *time.Location) {
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "%s\n", timeFmt(diff.Recorded.Time, tz))
+		fmt.Fprintf(w, "\trecorded %s\n", outcomeString(diff.Recorded))
+		fmt.Fprintf(w, "\treplayed %s\n", outcomeString(diff.Replayed))
+	}
+	fmt.Fprintf(w, "%d of %d decisions differ\n", len(diffs), total)
+}
+
+// outcomeString returns a string describing the
+// relay state in d and the reasons for it.
+func outcomeString(d decisionlog.Decision) string {
+	s := d.Relays.String()
+	if len(d.Blocked) == 0 {
+		return s
+	}
+	relays := make([]int, 0, len(d.Blocked))
+	for r := range d.Blocked {
+		relays = append(relays, r)
+	}
+	sort.Ints(relays)
+	blocked := make([]string, len(relays))
+	for i, r := range relays {
+		blocked[i] = fmt.Sprintf("%d: %s", r, d.Blocked[r])
+	}
+	return s + " (blocked " + strings.Join(blocked, ", ") + ")"
+}
+
+func timeFmt(t time.Time, tz *time.Location) string {
+	return t.In(tz).Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/decisionlog"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+func TestWriteDiffs(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	writeDiffs(&buf, []decisionlog.Difference{{
+		Recorded: decisionlog.Decision{
+			Time:   t0,
+			Relays: 1 << 0,
+			Blocked: map[int]hydroctl.Blocker{
+				3: hydroctl.BlockPower,
+				1: hydroctl.BlockTurnOnDelay,
+			},
+		},
+		Replayed: decisionlog.Decision{
+			Time:   t0,
+			Relays: 1<<0 | 1<<1,
+			Blocked: map[int]hydroctl.Blocker{
+				3: hydroctl.BlockPower,
+			},
+		},
+	}}, 10, time.UTC)
+	c.Assert(buf.String(), qt.Equals, `
+2020-01-02 10:00:00
+	recorded [0] (blocked 1: turn-on-delay, 3: power)
+	replayed [0 1] (blocked 3: power)
+1 of 10 decisions differ
+`[1:])
+}
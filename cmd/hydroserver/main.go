@@ -5,29 +5,120 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/rogpeppe/rjson"
 	errgo "gopkg.in/errgo.v1"
 
+	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
 	"github.com/rogpeppe/hydro/hydroserver"
+	"github.com/rogpeppe/hydro/meterworker"
 )
 
 type Config struct {
 	ListenAddr string
 	StateDir   string
+	// PollMeters specifies that meter samples should be
+	// gathered by polling the meters rather than by
+	// reading their energy logs.
+	PollMeters bool
+	// MACSampleDirs specifies that meter samples should be
+	// stored in directories named after the meters' MAC
+	// addresses so that they're not lost when a meter's
+	// IP address changes.
+	MACSampleDirs bool
+	// PowerSmoothing, if non-zero, holds the smoothing factor
+	// (between 0 and 1) of a moving average applied to meter
+	// power readings before they're used to decide which
+	// relays to turn on, so that brief spikes are ignored.
+	// Smaller values give more smoothing.
+	PowerSmoothing float64
+	// GeneratorPowerBounds, NeighbourPowerBounds and
+	// HerePowerBounds, if non-nil, hold the range of plausible
+	// power readings (in W) for the meters at each location.
+	// Readings outside the range are treated as failed reads.
+	GeneratorPowerBounds *meterworker.PowerBounds
+	NeighbourPowerBounds *meterworker.PowerBounds
+	HerePowerBounds      *meterworker.PowerBounds
+	// Heartbeat holds the interval at which relay changes
+	// are assessed, in time.ParseDuration format (for example "5s").
+	// If it's empty, a default of one second is used.
+	Heartbeat string
+	// ControlPassword holds the password that clients
+	// must provide to see sensitive information such
+	// as the relay controller address, including on the
+	// config page and in backups. If it's empty,
+	// all clients can see everything.
+	ControlPassword string
+	// RequireAuth specifies that clients must provide
+	// ControlPassword to receive updates at all.
+	RequireAuth bool
+	// CertFile and KeyFile hold the paths to a TLS
+	// certificate and its private key. If they're set,
+	// the server is served over HTTPS rather than HTTP.
+	CertFile string
+	KeyFile  string
+	// VerifyRelays specifies that the relay state should be
+	// read back from the relay controller after it's set,
+	// so that relays that fail to switch are noticed.
+	VerifyRelays bool
+	// RelayRefreshInterval, RelayRefreshJitter and
+	// RelayActiveRefreshInterval control how often the relay
+	// state is read from the relay controller, in
+	// time.ParseDuration format. See hydroserver.Params
+	// for details.
+	RelayRefreshInterval       string
+	RelayRefreshJitter         string
+	RelayActiveRefreshInterval string
+	// ShutdownRelays, if non-nil, holds the relays that
+	// are turned on when the server shuts down; all other
+	// relays are turned off. If it's nil, the relays are
+	// left as they are.
+	ShutdownRelays *[]int
+	// RelayWatchdogTimeout, if non-empty, holds the length
+	// of time, in time.ParseDuration format, for which the
+	// relay control loop may stall before the relays are set
+	// to ShutdownRelays (or all off if that's not set).
+	RelayWatchdogTimeout string
+	// DecisionLog specifies that a durable record of relay
+	// decisions should be kept in the "decisions" directory
+	// inside StateDir.
+	DecisionLog bool
+	// ExpectedMaxRoundTrip, if non-empty, holds the longest
+	// time, in time.ParseDuration format, that a meter request
+	// might normally be expected to take before the meters'
+	// actual round trip times are known. See
+	// hydroserver.Params for details.
+	ExpectedMaxRoundTrip string
+	// FileMode and DirMode, if non-empty, hold the permissions,
+	// in octal, used when creating files and directories
+	// inside StateDir. By default only the owner can
+	// access them.
+	FileMode string
+	DirMode  string
 }
 
+var versionFlag = flag.Bool("version", false, "print the version and exit")
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: hydroserver [config-file]\n")
+		fmt.Fprintf(os.Stderr, "usage: hydroserver [-version] [config-file]\n")
 		fmt.Fprintf(os.Stderr, "If config-file is not specified, ./hydro.cfg will be used\n")
 		os.Exit(2)
 	}
 	flag.Parse()
+	if *versionFlag {
+		fmt.Println(hydroserver.BuildVersion())
+		return
+	}
 	if flag.NArg() > 1 {
 		flag.Usage()
 	}
@@ -44,22 +135,131 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	heartbeat := parseDuration(cfg.Heartbeat, "heartbeat")
+	var decisionLogDir string
+	if cfg.DecisionLog {
+		decisionLogDir = filepath.Join(cfg.StateDir, "decisions")
+	}
+	var shutdownState *hydroctl.RelayState
+	if cfg.ShutdownRelays != nil {
+		var state hydroctl.RelayState
+		for _, r := range *cfg.ShutdownRelays {
+			if r < 0 || r >= hydroctl.MaxRelayCount {
+				log.Fatalf("shutdown relay %d out of range", r)
+			}
+			state.Set(r, true)
+		}
+		shutdownState = &state
+	}
 	h, err := hydroserver.New(hydroserver.Params{
-		RelayAddrPath:   filepath.Join(cfg.StateDir, "relayaddr"),
-		ConfigPath:      filepath.Join(cfg.StateDir, "relayconfig"),
-		MeterConfigPath: filepath.Join(cfg.StateDir, "meterconfig"),
-		HistoryPath:     filepath.Join(cfg.StateDir, "history"),
-		SampleDirPath:   filepath.Join(cfg.StateDir, "samples"),
-		TZ:              tz,
+		RelayAddrPath:       filepath.Join(cfg.StateDir, "relayaddr"),
+		ConfigPath:          filepath.Join(cfg.StateDir, "relayconfig"),
+		MeterConfigPath:     filepath.Join(cfg.StateDir, "meterconfig"),
+		HistoryPath:         filepath.Join(cfg.StateDir, "history"),
+		DisabledCohortsPath: filepath.Join(cfg.StateDir, "disabledcohorts"),
+		SampleDirPath:       filepath.Join(cfg.StateDir, "samples"),
+		TZ:                  tz,
+		PollMeters:          cfg.PollMeters,
+		MACSampleDirs:       cfg.MACSampleDirs,
+		PowerSmoothing:      cfg.PowerSmoothing,
+		PowerBounds:         powerBounds(cfg),
+		Heartbeat:           heartbeat,
+		ControlPassword:     cfg.ControlPassword,
+		RequireAuth:         cfg.RequireAuth,
+		VerifyRelays:        cfg.VerifyRelays,
+
+		RelayRefreshInterval:       parseDuration(cfg.RelayRefreshInterval, "relay refresh interval"),
+		RelayRefreshJitter:         parseDuration(cfg.RelayRefreshJitter, "relay refresh jitter"),
+		RelayActiveRefreshInterval: parseDuration(cfg.RelayActiveRefreshInterval, "relay active refresh interval"),
+		ShutdownRelayState:         shutdownState,
+		RelayWatchdogTimeout:       parseDuration(cfg.RelayWatchdogTimeout, "relay watchdog timeout"),
+		DecisionLogDir:             decisionLogDir,
+		ExpectedMaxRoundTrip:       parseDuration(cfg.ExpectedMaxRoundTrip, "expected max round trip"),
+		FileMode:                   parseFileMode(cfg.FileMode, "file mode"),
+		DirMode:                    parseFileMode(cfg.DirMode, "directory mode"),
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("listening on http://%s\n", cfg.ListenAddr)
-	err = http.ListenAndServe(cfg.ListenAddr, h)
+	go closeOnSignal(h)
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = serve(lis, cfg, h)
 	log.Fatal(err)
 }
 
+// parseDuration parses the configuration value s, which
+// holds the given kind of duration. It returns zero if s
+// is empty.
+func parseDuration(s string, what string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("invalid %s in configuration: %v", what, err)
+	}
+	return d
+}
+
+// parseFileMode parses the configuration value s, which
+// holds the given kind of permissions in octal. It returns
+// zero if s is empty.
+func parseFileMode(s string, what string) os.FileMode {
+	if s == "" {
+		return 0
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		log.Fatalf("invalid %s %q in configuration", what, s)
+	}
+	return os.FileMode(m)
+}
+
+// closeOnSignal closes h and exits when the process
+// is interrupted or terminated, so that the relays
+// can be left in a safe state.
+func closeOnSignal(h *hydroserver.Handler) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigc
+	log.Printf("received %v; shutting down", sig)
+	h.Close()
+	os.Exit(1)
+}
+
+// serve serves h on the given listener, using TLS
+// if it's configured.
+func serve(lis net.Listener, cfg *Config, h http.Handler) error {
+	srv := &http.Server{
+		Handler: h,
+	}
+	if cfg.CertFile != "" {
+		log.Printf("listening on https://%s\n", lis.Addr())
+		return srv.ServeTLS(lis, cfg.CertFile, cfg.KeyFile)
+	}
+	log.Printf("listening on http://%s\n", lis.Addr())
+	return srv.Serve(lis)
+}
+
+// powerBounds returns the meter power bounds
+// specified in the configuration, keyed by location.
+func powerBounds(cfg *Config) map[hydroreport.MeterLocation]meterworker.PowerBounds {
+	bounds := make(map[hydroreport.MeterLocation]meterworker.PowerBounds)
+	for loc, b := range map[hydroreport.MeterLocation]*meterworker.PowerBounds{
+		hydroreport.LocGenerator: cfg.GeneratorPowerBounds,
+		hydroreport.LocNeighbour: cfg.NeighbourPowerBounds,
+		hydroreport.LocHere:      cfg.HerePowerBounds,
+	} {
+		if b != nil {
+			bounds[loc] = *b
+		}
+	}
+	return bounds
+}
+
 func readConfig(f string) (*Config, error) {
 	data, err := ioutil.ReadFile(f)
 	if err != nil && !os.IsNotExist(err) {
@@ -78,6 +278,9 @@ func readConfig(f string) (*Config, error) {
 	if _, err := os.Stat(cfg.StateDir); err != nil {
 		return nil, errgo.Notef(err, "bad state directory")
 	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errgo.Newf("CertFile and KeyFile must be specified together")
+	}
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":8080"
 	}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+func TestServeTLS(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	certPEM := writeTestCert(c, dir)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	cfg := &Config{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	done := make(chan error)
+	go func() {
+		done <- serve(lis, cfg, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+	}()
+	defer func() {
+		lis.Close()
+		<-done
+	}()
+
+	pool := x509.NewCertPool()
+	c.Assert(pool.AppendCertsFromPEM(certPEM), qt.IsTrue)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: pool,
+			},
+		},
+	}
+	resp, err := client.Get("https://" + lis.Addr().String() + "/")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.TLS, qt.Not(qt.IsNil))
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, "hello")
+
+	// Plain HTTP isn't served.
+	resp, err = http.Get("http://" + lis.Addr().String() + "/")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func TestReadConfigCertWithoutKey(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	cfgPath := filepath.Join(dir, "hydro.cfg")
+	err := ioutil.WriteFile(cfgPath, []byte(`{StateDir: "`+dir+`", CertFile: "cert.pem"}`), 0666)
+	c.Assert(err, qt.IsNil)
+	_, err = readConfig(cfgPath)
+	c.Assert(err, qt.ErrorMatches, `CertFile and KeyFile must be specified together`)
+}
+
+func TestReadConfigPowerBounds(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	cfgPath := filepath.Join(dir, "hydro.cfg")
+	err := ioutil.WriteFile(cfgPath, []byte(`{
+		StateDir: "`+dir+`"
+		GeneratorPowerBounds: {Min: -500, Max: 200000}
+		HerePowerBounds: {Min: 0}
+	}`), 0666)
+	c.Assert(err, qt.IsNil)
+	cfg, err := readConfig(cfgPath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(powerBounds(cfg), qt.DeepEquals, map[hydroreport.MeterLocation]meterworker.PowerBounds{
+		hydroreport.LocGenerator: {Min: -500, Max: 200000},
+		hydroreport.LocHere:      {Min: 0},
+	})
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1
+// and its key to cert.pem and key.pem in dir and returns
+// the PEM-encoded certificate.
+func writeTestCert(c *qt.C, dir string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hydro test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, qt.IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, qt.IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0666)
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600)
+	c.Assert(err, qt.IsNil)
+	return certPEM
+}
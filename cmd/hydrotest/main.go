@@ -19,15 +19,22 @@ import (
 
 // bhttp put http://localhost:44442/v/ap 'v==98654'
 // bhttp put http://localhost:44442/delay 'delay=25'		# in seconds
+// bhttp put http://localhost:44440/simulate < scenario.json	# see scenario
 
 const portBase = 44440
 
+var versionFlag = flag.Bool("version", false, "print the version and exit")
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: hydrotest [dir]\n")
+		fmt.Fprintf(os.Stderr, "usage: hydrotest [-version] [dir]\n")
 		os.Exit(2)
 	}
 	flag.Parse()
+	if *versionFlag {
+		fmt.Println(hydroserver.BuildVersion())
+		return
+	}
 	if flag.NArg() > 2 {
 		flag.Usage()
 	}
@@ -47,12 +54,14 @@ func main() {
 		log.Fatal(err)
 	}
 	fmt.Printf("relay %v\n", srv.Addr)
-	for i := 0; i < 4; i++ {
+	meters := make([]*ndmetertest.Server, 4)
+	for i := range meters {
 		srv, err := ndmetertest.NewServer(fmt.Sprintf("localhost:%d", portBase+2+i))
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Printf("meter %d %v\n", i, srv.Addr)
+		meters[i] = srv
 	}
 	tz, err := time.LoadLocation("Europe/London")
 	if err != nil {
@@ -70,9 +79,12 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	mux := http.NewServeMux()
+	mux.Handle("/simulate", newSimulator(meters))
+	mux.Handle("/", h)
 	addr := fmt.Sprintf("localhost:%d", portBase)
 	fmt.Printf("listening on http://%s\n", addr)
-	err = http.ListenAndServe(addr, h)
+	err = http.ListenAndServe(addr, mux)
 	if err != nil {
 		log.Fatal(err)
 	}
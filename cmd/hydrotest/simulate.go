@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/rogpeppe/hydro/ndmetertest"
+)
+
+// scenario holds a timed sequence of meter values that
+// can be played across the fake meters, as sent to
+// the simulate endpoint. For example, this ramps the
+// generator (meter 0) up and then down again while
+// the local meter (meter 2) shows a constant load:
+//
+//	{
+//		"Steps": [
+//			{"Duration": "1m", "Power": {"0": 0, "2": 500}},
+//			{"Duration": "1m", "Power": {"0": 3000}},
+//			{"Duration": "1m", "Power": {"0": 6000}},
+//			{"Duration": "1m", "Power": {"0": 3000}},
+//			{"Power": {"0": 0}}
+//		]
+//	}
+type scenario struct {
+	// Steps holds the steps of the scenario, played in order.
+	Steps []scenarioStep
+	// Repeat specifies that the scenario starts again from
+	// the first step when the last step has finished.
+	Repeat bool
+}
+
+// scenarioStep holds one step of a scenario.
+type scenarioStep struct {
+	// Duration holds how long the step lasts before
+	// the next step is played, in time.ParseDuration format.
+	Duration string
+	// Power holds the power, in W, to set on meters, keyed by
+	// meter number. Meters without an entry are left unchanged.
+	Power map[int]float64
+	// Energy holds the total energy, in Wh, to set on meters, keyed
+	// by meter number. Meters without an entry are left unchanged.
+	Energy map[int]float64
+
+	duration time.Duration
+}
+
+// simulateStatus holds the status of the simulator as
+// returned by the simulate endpoint.
+type simulateStatus struct {
+	// Running holds whether a scenario is currently being played.
+	Running bool
+	// Step holds the index of the step that was most recently
+	// played, or -1 if no step has been played.
+	Step int
+}
+
+// simulator plays scenarios across a set of fake meters.
+// It implements http.Handler to provide an endpoint
+// for controlling it.
+type simulator struct {
+	meters  []*ndmetertest.Server
+	handler http.Handler
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	status simulateStatus
+	// stop is closed to stop the scenario that's currently running.
+	stop chan struct{}
+	// done is closed when the scenario that's currently
+	// running has stopped.
+	done chan struct{}
+}
+
+// newSimulator returns a simulator that controls the given meters,
+// numbered by their position in the slice.
+func newSimulator(meters []*ndmetertest.Server) *simulator {
+	sim := &simulator{
+		meters: meters,
+		status: simulateStatus{
+			Step: -1,
+		},
+	}
+	router := httprouter.New()
+	for _, h := range reqServer.Handlers(sim.newHandler) {
+		router.Handle(h.Method, h.Path, h.Handle)
+	}
+	sim.handler = router
+	return sim
+}
+
+var reqServer = &httprequest.Server{}
+
+// ServeHTTP implements http.Handler by serving the
+// /simulate endpoint.
+func (sim *simulator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sim.handler.ServeHTTP(w, req)
+}
+
+func (sim *simulator) newHandler(p httprequest.Params) (simulateHandler, context.Context, error) {
+	return simulateHandler{sim}, p.Context, nil
+}
+
+// Play starts playing the given scenario, stopping any
+// scenario that's already running. The first step has
+// been applied by the time it returns.
+func (sim *simulator) Play(s scenario) error {
+	if err := sim.check(&s); err != nil {
+		return err
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.stopLocked()
+	sim.status = simulateStatus{
+		Running: true,
+	}
+	sim.applyStep(s, 0)
+	stop, done := make(chan struct{}), make(chan struct{})
+	sim.stop, sim.done = stop, done
+	go func() {
+		defer close(done)
+		sim.play(s, stop)
+	}()
+	return nil
+}
+
+// Stop stops any running scenario. The meters are
+// left with their current values.
+func (sim *simulator) Stop() {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.stopLocked()
+}
+
+// stopLocked stops any running scenario. It's called with
+// sim.mu held, but releases it while waiting for the scenario
+// to stop, so it loops in case another scenario has been
+// started in the meantime. When it returns, no scenario is running.
+func (sim *simulator) stopLocked() {
+	for sim.stop != nil {
+		stop, done := sim.stop, sim.done
+		sim.stop, sim.done = nil, nil
+		sim.mu.Unlock()
+		close(stop)
+		<-done
+		sim.mu.Lock()
+	}
+}
+
+// Status returns the current status of the simulator.
+func (sim *simulator) Status() simulateStatus {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.status
+}
+
+// check checks that the scenario is valid and
+// parses the step durations.
+func (sim *simulator) check(s *scenario) error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps in scenario")
+	}
+	total := time.Duration(0)
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.Duration != "" {
+			d, err := time.ParseDuration(step.Duration)
+			if err != nil {
+				return fmt.Errorf("invalid duration in step %d: %v", i, err)
+			}
+			if d < 0 {
+				return fmt.Errorf("negative duration in step %d", i)
+			}
+			step.duration = d
+			total += d
+		}
+		for _, vals := range []map[int]float64{step.Power, step.Energy} {
+			for m := range vals {
+				if m < 0 || m >= len(sim.meters) {
+					return fmt.Errorf("meter %d out of range in step %d", m, i)
+				}
+			}
+		}
+	}
+	if s.Repeat && total == 0 {
+		return fmt.Errorf("repeated scenario must have a non-zero duration")
+	}
+	return nil
+}
+
+// play plays the scenario, starting after the first step
+// has been applied, until it finishes or the stop channel
+// is closed.
+func (sim *simulator) play(s scenario, stop <-chan struct{}) {
+	defer func() {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		sim.status.Running = false
+	}()
+	for i := 0; ; {
+		if d := s.Steps[i].duration; d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-stop:
+				t.Stop()
+				return
+			}
+		}
+		i++
+		if i == len(s.Steps) {
+			if !s.Repeat {
+				return
+			}
+			i = 0
+		}
+		sim.mu.Lock()
+		sim.applyStep(s, i)
+		sim.mu.Unlock()
+	}
+}
+
+// applyStep sets the meter values for the given
+// step of the scenario. It's called with sim.mu held.
+func (sim *simulator) applyStep(s scenario, i int) {
+	step := &s.Steps[i]
+	for m, power := range step.Power {
+		sim.meters[m].SetPower(power)
+	}
+	for m, energy := range step.Energy {
+		sim.meters[m].SetEnergy(energy)
+	}
+	sim.status.Step = i
+}
+
+type simulateHandler struct {
+	sim *simulator
+}
+
+type playReq struct {
+	httprequest.Route `httprequest:"PUT /simulate"`
+	Scenario          scenario `httprequest:",body"`
+}
+
+// Play starts playing a scenario.
+func (h simulateHandler) Play(req *playReq) error {
+	if err := h.sim.Play(req.Scenario); err != nil {
+		return httprequest.Errorf(httprequest.CodeBadRequest, "%v", err)
+	}
+	return nil
+}
+
+type stopReq struct {
+	httprequest.Route `httprequest:"DELETE /simulate"`
+}
+
+// Stop stops the currently running scenario.
+func (h simulateHandler) Stop(*stopReq) {
+	h.sim.Stop()
+}
+
+type statusReq struct {
+	httprequest.Route `httprequest:"GET /simulate"`
+}
+
+// Status returns the current simulator status.
+func (h simulateHandler) Status(*statusReq) (simulateStatus, error) {
+	return h.sim.Status(), nil
+}
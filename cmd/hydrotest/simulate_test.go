@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/eth8020"
+	"github.com/rogpeppe/hydro/eth8020test"
+	"github.com/rogpeppe/hydro/hydroserver"
+	"github.com/rogpeppe/hydro/ndmetertest"
+)
+
+func TestSimulateScenario(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+	meters := make([]*ndmetertest.Server, 3)
+	for i := range meters {
+		srv, err := ndmetertest.NewServer("localhost:0")
+		c.Assert(err, qt.IsNil)
+		defer srv.Close()
+		meters[i] = srv
+	}
+	dir := c.Mkdir()
+	for name, contents := range map[string]string{
+		"relayaddr": fmt.Sprintf(`{"Addr": %q}`, relaySrv.Addr),
+		"meterconfig": fmt.Sprintf(`{"Meters": [
+			{"Name": "generator", "Location": 1, "Addr": %q},
+			{"Name": "neighbour", "Location": 2, "Addr": %q},
+			{"Name": "here", "Location": 3, "Addr": %q}
+		]}`, meters[0].Addr, meters[1].Addr, meters[2].Addr),
+		"relayconfig": `
+relay 0 is heater
+relay 0 has max power 1kw
+heater on for at most 20h
+`,
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	h, err := hydroserver.New(hydroserver.Params{
+		RelayAddrPath:   filepath.Join(dir, "relayaddr"),
+		ConfigPath:      filepath.Join(dir, "relayconfig"),
+		MeterConfigPath: filepath.Join(dir, "meterconfig"),
+		HistoryPath:     filepath.Join(dir, "history"),
+		TZ:              time.UTC,
+		Heartbeat:       10 * time.Millisecond,
+	})
+	c.Assert(err, qt.IsNil)
+	defer h.Close()
+
+	sim := newSimulator(meters)
+	defer sim.Stop()
+	// Generation ramps up enough to power the heater and then
+	// goes away again. The relay isn't turned off again within the
+	// scenario because the meters must settle for
+	// hydroctl.DefaultMeterReactionDuration after it's turned on.
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/simulate", strings.NewReader(`{
+		"Steps": [
+			{"Duration": "500ms", "Power": {"0": 0, "2": 500}},
+			{"Duration": "1s", "Power": {"0": 5000}},
+			{"Duration": "500ms", "Power": {"0": 0}}
+		]
+	}`))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	sim.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+
+	// Record the relay state whenever it changes, along with
+	// the scenario step at the time, until the scenario has finished.
+	type change struct {
+		Step  int
+		State eth8020.State
+	}
+	var timeline []change
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := sim.Status()
+		if !status.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("scenario did not finish")
+		}
+		state := relaySrv.State()
+		if len(timeline) == 0 || state != timeline[len(timeline)-1].State {
+			timeline = append(timeline, change{status.Step, state})
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Assert(timeline, qt.DeepEquals, []change{{0, 0}, {1, 1}})
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/simulate", nil)
+	c.Assert(err, qt.IsNil)
+	sim.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var status simulateStatus
+	err = json.Unmarshal(rec.Body.Bytes(), &status)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.DeepEquals, simulateStatus{
+		Running: false,
+		Step:    2,
+	})
+}
+
+var simulateErrorTests = []struct {
+	testName    string
+	scenario    string
+	expectError string
+}{{
+	testName:    "no-steps",
+	scenario:    `{}`,
+	expectError: `no steps in scenario`,
+}, {
+	testName:    "bad-duration",
+	scenario:    `{"Steps": [{"Duration": "soon"}]}`,
+	expectError: `invalid duration in step 0: time: invalid duration "soon"`,
+}, {
+	testName:    "meter-out-of-range",
+	scenario:    `{"Steps": [{"Power": {"0": 100}}, {"Energy": {"3": 100}}]}`,
+	expectError: `meter 3 out of range in step 1`,
+}, {
+	testName:    "repeat-without-duration",
+	scenario:    `{"Steps": [{"Power": {"0": 100}}], "Repeat": true}`,
+	expectError: `repeated scenario must have a non-zero duration`,
+}}
+
+func TestSimulateError(t *testing.T) {
+	c := qt.New(t)
+	sim := newSimulator(make([]*ndmetertest.Server, 3))
+	for _, test := range simulateErrorTests {
+		c.Run(test.testName, func(c *qt.C) {
+			rec := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", "/simulate", strings.NewReader(test.scenario))
+			c.Assert(err, qt.IsNil)
+			req.Header.Set("Content-Type", "application/json")
+			sim.ServeHTTP(rec, req)
+			c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+			var resp struct {
+				Message string
+			}
+			err = json.Unmarshal(rec.Body.Bytes(), &resp)
+			c.Assert(err, qt.IsNil)
+			c.Assert(resp.Message, qt.Equals, test.expectError)
+			c.Assert(sim.Status().Running, qt.IsFalse)
+		})
+	}
+}
+
+func TestSimulateConcurrentPlay(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	sim := newSimulator([]*ndmetertest.Server{srv})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sim.Play(scenario{
+				Steps: []scenarioStep{{
+					Duration: "1ms",
+					Power:    map[int]float64{0: 100},
+				}, {
+					Duration: "1ms",
+					Power:    map[int]float64{0: 200},
+				}},
+				Repeat: true,
+			})
+			c.Check(err, qt.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(sim.Status().Running, qt.IsTrue)
+	// Only one scenario is left running, so
+	// stopping it stops everything.
+	sim.Stop()
+	c.Assert(sim.Status().Running, qt.IsFalse)
+	step := sim.Status().Step
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(sim.Status().Step, qt.Equals, step)
+}
@@ -0,0 +1,219 @@
+// Package decisionlog provides a durable record of the relay
+// decisions made by the worker, for later analysis.
+//
+// Decisions are stored as JSON, one per line, in append-only files
+// in a single directory. A new file is started each day.
+package decisionlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+// Decision records a single relay decision.
+type Decision struct {
+	// Time holds the time of the assessment.
+	Time time.Time
+	// PowerUse holds the meter readings used for the assessment.
+	PowerUse hydroctl.PowerUseSample
+	// MetersFailedSince holds the time from which the meters
+	// had been unreadable, or zero if they were readable.
+	MetersFailedSince time.Time
+	// Previous holds the relay state before the assessment.
+	Previous hydroctl.RelayState
+	// Relays holds the assessed relay state.
+	Relays hydroctl.RelayState
+	// Overridden holds the relays whose state in Relays
+	// was forced by a manual override rather than assessed.
+	Overridden hydroctl.RelayState `json:",omitempty"`
+	// Blocked holds the reason that each relay that isn't in
+	// the state its configuration asks for isn't in that state,
+	// indexed by relay number.
+	Blocked map[int]hydroctl.Blocker `json:",omitempty"`
+}
+
+// SameOutcome reports whether d and d1 have the
+// same assessed relay state for the same reasons.
+func (d Decision) SameOutcome(d1 Decision) bool {
+	if d.Relays != d1.Relays || d.Overridden != d1.Overridden || len(d.Blocked) != len(d1.Blocked) {
+		return false
+	}
+	for r, b := range d.Blocked {
+		if d1.Blocked[r] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Blocked returns the blockers from the given explanations
+// indexed by relay number, or nil if there are none.
+// The result is suitable for Decision.Blocked.
+func Blocked(explanations []hydroctl.RelayExplanation) map[int]hydroctl.Blocker {
+	var m map[int]hydroctl.Blocker
+	for _, e := range explanations {
+		if e.Blocker == hydroctl.BlockNone {
+			continue
+		}
+		if m == nil {
+			m = make(map[int]hydroctl.Blocker)
+		}
+		m[e.Relay] = e.Blocker
+	}
+	return m
+}
+
+// fileSuffix holds the suffix of the decision log files.
+// The rest of the name is the date in dateFormat.
+const (
+	fileSuffix = ".decisions"
+	dateFormat = "2006-01-02"
+)
+
+// Writer writes decisions to a directory.
+type Writer struct {
+	dir      string
+	tz       *time.Location
+	fileMode os.FileMode
+
+	mu sync.Mutex
+	// f holds the currently open file, and day holds
+	// the date that it's for.
+	f   *os.File
+	day string
+}
+
+// NewWriter returns a Writer that writes decisions to files in
+// the given directory, which is created if it doesn't exist.
+// Day boundaries are determined in the given time zone
+// (UTC if it's nil).
+func NewWriter(dir string, tz *time.Location) (*Writer, error) {
+	return NewWriterWithMode(dir, tz, 0666, 0777)
+}
+
+// NewWriterWithMode is like NewWriter except that the directory
+// and log files are created with the given permissions.
+func NewWriterWithMode(dir string, tz *time.Location, fileMode, dirMode os.FileMode) (*Writer, error) {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("cannot create decision log directory: %v", err)
+	}
+	if tz == nil {
+		tz = time.UTC
+	}
+	return &Writer{
+		dir:      dir,
+		tz:       tz,
+		fileMode: fileMode,
+	}, nil
+}
+
+// Write appends the given decision to the file
+// for the day of its time.
+func (w *Writer) Write(d Decision) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("cannot marshal decision: %v", err)
+	}
+	data = append(data, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	day := d.Time.In(w.tz).Format(dateFormat)
+	if w.f == nil || day != w.day {
+		if w.f != nil {
+			if err := w.f.Close(); err != nil {
+				log.Printf("failed to close decision log file %q: %v", w.f.Name(), err)
+			}
+			w.f = nil
+		}
+		f, err := os.OpenFile(filepath.Join(w.dir, day+fileSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND, w.fileMode)
+		if err != nil {
+			return fmt.Errorf("cannot open decision log file: %v", err)
+		}
+		w.f, w.day = f, day
+	}
+	if n, err := w.f.Write(data); err != nil {
+		if n > 0 {
+			log.Printf("warning: decision log file partially written (%d/%d bytes)", n, len(data))
+		}
+		return fmt.Errorf("cannot write decision: %v", err)
+	}
+	return nil
+}
+
+// Close closes the Writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Read reads all the decisions in the given directory with times
+// in the range [t0, t1), in time order. A zero t1 means that there's
+// no upper limit. Invalid lines are logged and ignored.
+func Read(dir string, t0, t1 time.Time) ([]Decision, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read decision log directory: %v", err)
+	}
+	var decisions []Decision
+	for _, name := range names {
+		day, err := time.Parse(dateFormat, strings.TrimSuffix(filepath.Base(name), fileSuffix))
+		if err != nil {
+			continue
+		}
+		// The file's day is in the writer's time zone, which we
+		// don't know, so allow a day's leeway either side.
+		if day.AddDate(0, 0, 2).Before(t0) || (!t1.IsZero() && day.AddDate(0, 0, -1).After(t1)) {
+			continue
+		}
+		ds, err := readFile(name, t0, t1)
+		if err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, ds...)
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Time.Before(decisions[j].Time)
+	})
+	return decisions, nil
+}
+
+func readFile(path string, t0, t1 time.Time) ([]Decision, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open decision log file: %v", err)
+	}
+	defer f.Close()
+	var decisions []Decision
+	scan := bufio.NewScanner(f)
+	for line := 1; scan.Scan(); line++ {
+		var d Decision
+		if err := json.Unmarshal(scan.Bytes(), &d); err != nil {
+			log.Printf("%s:%d invalid decision: %v", path, line, err)
+			continue
+		}
+		if d.Time.Before(t0) || (!t1.IsZero() && !d.Time.Before(t1)) {
+			continue
+		}
+		decisions = append(decisions, d)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read decision log file: %v", err)
+	}
+	return decisions, nil
+}
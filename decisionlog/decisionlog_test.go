@@ -0,0 +1,162 @@
+package decisionlog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rogpeppe/hydro/decisionlog"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+var epoch = time.Date(2020, 3, 1, 22, 0, 0, 0, time.UTC)
+
+var decisions = []decisionlog.Decision{{
+	Time: epoch,
+	PowerUse: hydroctl.PowerUseSample{
+		PowerUse: hydroctl.PowerUse{
+			Generated: 3000,
+			Here:      100,
+		},
+		T0: epoch.Add(-time.Second),
+		T1: epoch,
+	},
+	Previous: 0,
+	Relays:   1 << 0,
+	Blocked: map[int]hydroctl.Blocker{
+		1: hydroctl.BlockTurnOnDelay,
+	},
+}, {
+	Time: epoch.Add(time.Hour),
+	PowerUse: hydroctl.PowerUseSample{
+		PowerUse: hydroctl.PowerUse{
+			Generated: 3000,
+			Here:      2100,
+		},
+		T0: epoch.Add(time.Hour - time.Second),
+		T1: epoch.Add(time.Hour),
+	},
+	Previous: 1 << 0,
+	Relays:   1<<0 | 1<<1,
+}, {
+	Time: epoch.Add(3 * time.Hour),
+	PowerUse: hydroctl.PowerUseSample{
+		PowerUse: hydroctl.PowerUse{
+			Generated: 500,
+			Here:      4100,
+		},
+		T0: epoch.Add(3*time.Hour - time.Second),
+		T1: epoch.Add(3 * time.Hour),
+	},
+	Previous: 1<<0 | 1<<1,
+	Relays:   0,
+	Blocked: map[int]hydroctl.Blocker{
+		0: hydroctl.BlockPower,
+		1: hydroctl.BlockPower,
+	},
+}}
+
+var timeEqual = cmp.Comparer(func(t0, t1 time.Time) bool {
+	return t0.Equal(t1)
+})
+
+func TestWriteRead(t *testing.T) {
+	c := qt.New(t)
+	dir := filepath.Join(c.Mkdir(), "decisions")
+	w, err := decisionlog.NewWriter(dir, time.UTC)
+	c.Assert(err, qt.IsNil)
+	for _, d := range decisions {
+		err := w.Write(d)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(w.Close(), qt.IsNil)
+
+	// A new file is started each day.
+	c.Assert(readDirNames(c, dir), qt.DeepEquals, []string{
+		"2020-03-01.decisions",
+		"2020-03-02.decisions",
+	})
+
+	got, err := decisionlog.Read(dir, time.Time{}, time.Time{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(timeEqual), decisions)
+
+	got, err = decisionlog.Read(dir, epoch.Add(time.Hour), epoch.Add(3*time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(timeEqual), decisions[1:2])
+}
+
+func TestWriterAppends(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	for _, d := range decisions[0:2] {
+		// Open a new writer each time as if the
+		// server had been restarted.
+		w, err := decisionlog.NewWriter(dir, time.UTC)
+		c.Assert(err, qt.IsNil)
+		err = w.Write(d)
+		c.Assert(err, qt.IsNil)
+		c.Assert(w.Close(), qt.IsNil)
+	}
+	got, err := decisionlog.Read(dir, time.Time{}, time.Time{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(timeEqual), decisions[0:2])
+}
+
+func TestWriterTimeZone(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	tz := time.FixedZone("X", 3*60*60)
+	w, err := decisionlog.NewWriter(dir, tz)
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	// 22:00 UTC is the next day in the writer's time zone.
+	err = w.Write(decisions[0])
+	c.Assert(err, qt.IsNil)
+	c.Assert(readDirNames(c, dir), qt.DeepEquals, []string{
+		"2020-03-02.decisions",
+	})
+	got, err := decisionlog.Read(dir, epoch, epoch.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(timeEqual), decisions[0:1])
+}
+
+func TestReadIgnoresInvalidLines(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	w, err := decisionlog.NewWriter(dir, time.UTC)
+	c.Assert(err, qt.IsNil)
+	err = w.Write(decisions[0])
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+
+	f, err := os.OpenFile(filepath.Join(dir, "2020-03-01.decisions"), os.O_WRONLY|os.O_APPEND, 0666)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteString("{bad\n")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	// Files with other names are ignored.
+	err = ioutil.WriteFile(filepath.Join(dir, "other.decisions"), []byte("{bad\n"), 0666)
+	c.Assert(err, qt.IsNil)
+
+	got, err := decisionlog.Read(dir, time.Time{}, time.Time{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.CmpEquals(timeEqual), decisions[0:1])
+}
+
+func readDirNames(c *qt.C, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,76 @@
+package decisionlog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+// Difference records a decision that's assessed
+// differently when replayed.
+type Difference struct {
+	// Recorded holds the decision as recorded.
+	Recorded Decision
+	// Replayed holds the decision as made by Replay.
+	Replayed Decision
+}
+
+// Replay assesses the relays again for each of the given decisions,
+// which must be in time order, using the given configuration and
+// the recorded inputs, and returns any decisions that come out
+// differently.
+//
+// The relay history used for the assessments is reconstructed
+// from the recorded decisions. Relays that were on before the first
+// decision are treated as having been turned on just before it, so
+// there may be spurious differences caused by that shortly afterwards.
+// The worker doesn't record assessments that left the relays
+// alone with the same inputs (other than the time) and outcome
+// as the previously recorded decision, so a changed configuration
+// that would have changed the relays between recorded decisions
+// is only noticed at the next recorded decision.
+// Any generation forecast that was in use when the decisions were
+// made isn't taken into account. Relays that were manually
+// overridden are given their recorded state, because the override
+// isn't part of the configuration.
+func Replay(cfg *hydroctl.Config, decisions []Decision) ([]Difference, error) {
+	store := &history.MemStore{}
+	hdb, err := history.New(store)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []Difference
+	for i, d := range decisions {
+		if i == 0 {
+			hdb.RecordState(d.Previous, d.Time.Add(-time.Nanosecond))
+		} else if !d.Time.After(decisions[i-1].Time) {
+			return nil, fmt.Errorf("decision at %v is out of order", d.Time)
+		}
+		relays, explanations := hydroctl.AssessExplain(hydroctl.AssessParams{
+			Config:            cfg,
+			CurrentState:      d.Previous,
+			History:           hdb,
+			PowerUseSample:    d.PowerUse,
+			Now:               d.Time,
+			MetersFailedSince: d.MetersFailedSince,
+		})
+		replayed := d
+		replayed.Relays = relays&^d.Overridden | d.Relays&d.Overridden
+		replayed.Blocked = Blocked(explanations)
+		if !replayed.SameOutcome(d) {
+			diffs = append(diffs, Difference{
+				Recorded: d,
+				Replayed: replayed,
+			})
+		}
+		// Continue with what actually happened rather
+		// than with what the replay would have done.
+		hdb.RecordOverriddenState(d.Relays, d.Overridden, d.Time)
+		if err := store.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,159 @@
+package decisionlog_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/decisionlog"
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+var replayConfig = &hydroctl.Config{
+	Relays: []hydroctl.RelayConfig{{
+		Mode:     hydroctl.AlwaysOn,
+		MaxPower: 100,
+	}, {
+		Mode:     hydroctl.AlwaysOn,
+		MaxPower: 100,
+	}},
+}
+
+// replayTimes holds the times of the decisions
+// used to test Replay, as offsets from epoch.
+var replayTimes = []time.Duration{
+	0,
+	time.Second,
+	11 * time.Second,
+	12 * time.Second,
+}
+
+func TestReplaySameConfig(t *testing.T) {
+	c := qt.New(t)
+	decisions := makeDecisions(c, replayConfig, 0)
+	// Sanity check that the decisions are what we expect.
+	var states []hydroctl.RelayState
+	for _, d := range decisions {
+		states = append(states, d.Relays)
+	}
+	c.Assert(states, qt.DeepEquals, []hydroctl.RelayState{
+		1 << 0,
+		1 << 0,
+		1<<0 | 1<<1,
+		1<<0 | 1<<1,
+	})
+	diffs, err := decisionlog.Replay(replayConfig, decisions)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diffs, qt.HasLen, 0)
+}
+
+func TestReplayChangedConfig(t *testing.T) {
+	c := qt.New(t)
+	decisions := makeDecisions(c, replayConfig, 0)
+	cfg := &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			replayConfig.Relays[0],
+			{Mode: hydroctl.AlwaysOff},
+		},
+	}
+	diffs, err := decisionlog.Replay(cfg, decisions)
+	c.Assert(err, qt.IsNil)
+	type outcome struct {
+		Time    time.Time
+		Relays  hydroctl.RelayState
+		Blocked map[int]hydroctl.Blocker
+	}
+	var got []outcome
+	for _, d := range diffs {
+		c.Assert(d.Recorded.Time, qt.Equals, d.Replayed.Time)
+		got = append(got, outcome{
+			Time:    d.Replayed.Time,
+			Relays:  d.Replayed.Relays,
+			Blocked: d.Replayed.Blocked,
+		})
+	}
+	c.Assert(got, qt.DeepEquals, []outcome{{
+		// Relay 1 no longer wants to be on,
+		// so it's not waiting to turn on.
+		Time:   epoch,
+		Relays: 1 << 0,
+	}, {
+		Time:   epoch.Add(time.Second),
+		Relays: 1 << 0,
+	}, {
+		Time:   epoch.Add(11 * time.Second),
+		Relays: 1 << 0,
+	}, {
+		// Relay 1 was actually turned on, so it
+		// can't be turned off again immediately.
+		Time:   epoch.Add(12 * time.Second),
+		Relays: 1<<0 | 1<<1,
+		Blocked: map[int]hydroctl.Blocker{
+			1: hydroctl.BlockTooSoon,
+		},
+	}})
+}
+
+func TestReplayOverridden(t *testing.T) {
+	c := qt.New(t)
+	// Relay 1 is forced off throughout, so it's never
+	// turned on even though the configuration says it
+	// should be.
+	decisions := makeDecisions(c, replayConfig, 1<<1)
+	for _, d := range decisions {
+		c.Assert(d.Relays, qt.Equals, hydroctl.RelayState(1<<0))
+	}
+	diffs, err := decisionlog.Replay(replayConfig, decisions)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diffs, qt.HasLen, 0)
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+	c := qt.New(t)
+	decisions := makeDecisions(c, replayConfig, 0)
+	decisions[1], decisions[2] = decisions[2], decisions[1]
+	_, err := decisionlog.Replay(replayConfig, decisions)
+	c.Assert(err, qt.ErrorMatches, `decision at .* is out of order`)
+}
+
+// makeDecisions returns the decisions made with the given
+// configuration at replayTimes, as the worker would make them,
+// with the relays in overridden forced off.
+func makeDecisions(c *qt.C, cfg *hydroctl.Config, overridden hydroctl.RelayState) []decisionlog.Decision {
+	store := &history.MemStore{}
+	hdb, err := history.New(store)
+	c.Assert(err, qt.IsNil)
+	var decisions []decisionlog.Decision
+	var state hydroctl.RelayState
+	for _, offset := range replayTimes {
+		now := epoch.Add(offset)
+		d := decisionlog.Decision{
+			Time: now,
+			PowerUse: hydroctl.PowerUseSample{
+				PowerUse: hydroctl.PowerUse{
+					Generated: 10000,
+				},
+				T0: now,
+				T1: now,
+			},
+			Previous: state,
+		}
+		relays, explanations := hydroctl.AssessExplain(hydroctl.AssessParams{
+			Config:         cfg,
+			CurrentState:   state,
+			History:        hdb,
+			PowerUseSample: d.PowerUse,
+			Now:            now,
+		})
+		d.Relays = relays &^ overridden
+		d.Overridden = overridden
+		d.Blocked = decisionlog.Blocked(explanations)
+		decisions = append(decisions, d)
+		hdb.RecordOverriddenState(d.Relays, overridden, now)
+		c.Assert(store.Commit(), qt.IsNil)
+		state = d.Relays
+	}
+	return decisions
+}
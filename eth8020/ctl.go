@@ -22,6 +22,9 @@ const DefaultPort = 17494
 // NumRelays holds the number of relays on the device.
 const NumRelays = 20
 
+// AllOn holds the state with all the relays on the device turned on.
+const AllOn State = 1<<NumRelays - 1
+
 // Conn represents a control connection to the device.
 type Conn struct {
 	buf      []byte
@@ -148,6 +151,9 @@ func (c *Conn) Pulse(relay int, on bool, duration time.Duration) error {
 
 // SetOutputs sets the state of all the relays.
 func (c *Conn) SetOutputs(s State) error {
+	if s&^AllOn != 0 {
+		return fmt.Errorf("invalid relay state %#x (the device has only %d relays)", s, NumRelays)
+	}
 	c.start(CmdDigitalSetOutputs)
 	c.buf = c.buf[0:4]
 
@@ -163,10 +169,11 @@ func (c *Conn) GetOutputs() (State, error) {
 	if err := c.cmd(3); err != nil {
 		return 0, err
 	}
-	return State(c.buf[0])<<0 +
-			State(c.buf[1])<<8 +
-			State(c.buf[2])<<16,
-		nil
+	s := State(c.buf[0])<<0 +
+		State(c.buf[1])<<8 +
+		State(c.buf[2])<<16
+	// Ignore any bits that don't correspond to relays.
+	return s & AllOn, nil
 }
 
 // Volts returns the voltage of the low voltage power
@@ -31,3 +31,27 @@ func TestGetSetOutputs(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 	c.Assert(state, qt.Equals, eth8020.State(0xcaa55))
 }
+
+func TestSetOutputsOutOfRange(t *testing.T) {
+	c := qt.New(t)
+	srv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	netc, err := net.Dial("tcp", srv.Addr)
+	c.Assert(err, qt.IsNil)
+	conn := eth8020.NewConn(netc)
+	defer conn.Close()
+
+	err = conn.SetOutputs(eth8020.AllOn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.State(), qt.Equals, eth8020.AllOn)
+
+	err = conn.SetOutputs(1 << eth8020.NumRelays)
+	c.Assert(err, qt.ErrorMatches, `invalid relay state 0x100000 \(the device has only 20 relays\)`)
+	c.Assert(srv.State(), qt.Equals, eth8020.AllOn)
+
+	// The connection is still usable.
+	state, err := conn.GetOutputs()
+	c.Assert(err, qt.IsNil)
+	c.Assert(state, qt.Equals, eth8020.AllOn)
+}
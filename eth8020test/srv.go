@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"gopkg.in/errgo.v1"
 
@@ -18,6 +19,18 @@ type Server struct {
 
 	mu    sync.Mutex
 	state eth8020.State
+	// stuck holds the relays that don't change state.
+	stuck eth8020.State
+	// pulses holds all the pulses requested so far.
+	pulses []Pulse
+}
+
+// Pulse records a request to change the state of
+// a relay temporarily.
+type Pulse struct {
+	Relay    int
+	On       bool
+	Duration time.Duration
 }
 
 func NewServer(addr string) (*Server, error) {
@@ -55,6 +68,23 @@ func (srv *Server) State() eth8020.State {
 	return srv.state
 }
 
+// SetStuck makes the relays in the given state stay as they are
+// when the outputs are set, simulating a controller that silently
+// fails to switch them.
+func (srv *Server) SetStuck(stuck eth8020.State) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.stuck = stuck
+}
+
+// Pulses returns all the relay pulses that have
+// been requested, in order.
+func (srv *Server) Pulses() []Pulse {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]Pulse(nil), srv.pulses...)
+}
+
 func (srv *Server) Close() error {
 	return srv.lis.Close()
 }
@@ -85,12 +115,39 @@ func (srv *Server) processCmd(c eth8020.Cmd, r *bufio.Reader, conn net.Conn) err
 			return errgo.Mask(err)
 		}
 		srv.mu.Lock()
-		srv.state = eth8020.State(buf[0])<<0 +
+		state := eth8020.State(buf[0])<<0 +
 			eth8020.State(buf[1])<<8 +
 			eth8020.State(buf[2])<<16
+		srv.state = state&^srv.stuck | srv.state&srv.stuck
 		log.Printf("relay state set to %0*b", eth8020.NumRelays, srv.state)
 		srv.mu.Unlock()
 		conn.Write(success)
+	case eth8020.CmdDigitalActive, eth8020.CmdDigitalInactive:
+		if _, err := io.ReadFull(r, buf[0:2]); err != nil {
+			return errgo.Mask(err)
+		}
+		relay, duration := int(buf[0])-1, time.Duration(buf[1])*100*time.Millisecond
+		if relay < 0 || relay >= eth8020.NumRelays {
+			conn.Write(failure)
+			return nil
+		}
+		on := c == eth8020.CmdDigitalActive
+		srv.mu.Lock()
+		srv.setRelay(relay, on)
+		if duration > 0 {
+			srv.pulses = append(srv.pulses, Pulse{
+				Relay:    relay,
+				On:       on,
+				Duration: duration,
+			})
+			time.AfterFunc(duration, func() {
+				srv.mu.Lock()
+				defer srv.mu.Unlock()
+				srv.setRelay(relay, !on)
+			})
+		}
+		srv.mu.Unlock()
+		conn.Write(success)
 	case eth8020.CmdDigitalGetOutputs:
 		srv.mu.Lock()
 		conn.Write([]byte{
@@ -104,3 +161,17 @@ func (srv *Server) processCmd(c eth8020.Cmd, r *bufio.Reader, conn net.Conn) err
 	}
 	return nil
 }
+
+// setRelay sets the state of a single relay.
+// It's called with srv.mu held.
+func (srv *Server) setRelay(relay int, on bool) {
+	bit := eth8020.State(1) << uint(relay)
+	if srv.stuck&bit != 0 {
+		return
+	}
+	if on {
+		srv.state |= bit
+	} else {
+		srv.state &^= bit
+	}
+}
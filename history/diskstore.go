@@ -2,6 +2,7 @@ package history
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"os"
@@ -29,7 +30,14 @@ type DiskStore struct {
 // holds in memory all events after the given earliest
 // time.
 func NewDiskStore(path string, earliest time.Time) (*DiskStore, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0666)
+	return NewDiskStoreWithMode(path, earliest, 0666)
+}
+
+// NewDiskStoreWithMode is like NewDiskStore except that
+// the file is created with the given permissions
+// if it doesn't already exist.
+func NewDiskStoreWithMode(path string, earliest time.Time, mode os.FileMode) (*DiskStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, mode)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open disk store: %v", err)
 	}
@@ -143,7 +151,7 @@ func (s *DiskStore) ReverseIter() Iterator {
 	}
 }
 
-const eventSize = 2 + 1 + 1 + 1 + 20
+const eventSize = 2 + 1 + 1 + 1 + 20 + 2
 
 func (e *Event) appendEvent(buf []byte) []byte {
 	buf = strconv.AppendInt(buf, int64(e.Relay), 10)
@@ -155,6 +163,9 @@ func (e *Event) appendEvent(buf []byte) []byte {
 	}
 	buf = append(buf, ' ')
 	buf = strconv.AppendInt(buf, e.Time.UnixNano()/1e6, 10)
+	if e.Override {
+		buf = append(buf, " o"...)
+	}
 	return buf
 }
 
@@ -164,6 +175,11 @@ func (e *Event) UnmarshalText(buf []byte) error {
 		on    bool
 		etime int64
 	)
+	override := false
+	if bytes.HasSuffix(buf, []byte(" o")) {
+		override = true
+		buf = buf[:len(buf)-2]
+	}
 	if _, err := fmt.Sscanln(string(buf), &relay, &on, &etime); err != nil {
 		return fmt.Errorf("cannot parse event %q", buf)
 	}
@@ -171,9 +187,10 @@ func (e *Event) UnmarshalText(buf []byte) error {
 		return fmt.Errorf("invalid relay number %d in event", relay)
 	}
 	*e = Event{
-		Relay: relay,
-		On:    on,
-		Time:  time.Unix(etime/1000, etime%1000*1e6),
+		Relay:    relay,
+		On:       on,
+		Time:     time.Unix(etime/1000, etime%1000*1e6),
+		Override: override,
 	}
 	return nil
 }
@@ -53,6 +53,10 @@ type Event struct {
 	// On holds whether the relay turned on or off
 	// at that time.
 	On bool
+	// Override holds whether the change was caused
+	// by a manual override of the relay rather than
+	// by the relay's configuration.
+	Override bool
 }
 
 // DB represents a store of historical events.
@@ -101,12 +105,19 @@ func reverse(a []Event) {
 // the given time by appending events to the store. It does not
 // commit the new events to the store.
 func (h *DB) RecordState(relays hydroctl.RelayState, now time.Time) {
+	h.RecordOverriddenState(relays, 0, now)
+}
+
+// RecordOverriddenState is like RecordState except that
+// any changes to the relays in overridden are marked
+// as caused by a manual override.
+func (h *DB) RecordOverriddenState(relays, overridden hydroctl.RelayState, now time.Time) {
 	for i := 0; i < hydroctl.MaxRelayCount; i++ {
-		h.addEvent(i, relays.IsSet(i), now)
+		h.addEvent(i, relays.IsSet(i), overridden.IsSet(i), now)
 	}
 }
 
-func (h *DB) addEvent(relay int, on bool, now time.Time) {
+func (h *DB) addEvent(relay int, on, override bool, now time.Time) {
 	lastOn, t := h.LatestChange(relay)
 	if !now.After(t) {
 		panic("cannot add out of order event")
@@ -124,13 +135,15 @@ func (h *DB) addEvent(relay int, on bool, now time.Time) {
 		h.relays = relays
 	}
 	h.relays[relay] = append(h.relays[relay], Event{
-		On:   on,
-		Time: now,
+		On:       on,
+		Time:     now,
+		Override: override,
 	})
 	h.store.Append(Event{
-		Relay: relay,
-		Time:  now,
-		On:    on,
+		Relay:    relay,
+		Time:     now,
+		On:       on,
+		Override: override,
 	})
 }
 
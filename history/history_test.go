@@ -2,6 +2,7 @@ package history_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -220,6 +221,50 @@ func TestDiskStoreCreate(t *testing.T) {
 	}})
 }
 
+func TestRecordOverriddenState(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "history")
+	store, err := history.NewDiskStore(path, time.Time{})
+	c.Assert(err, qt.IsNil)
+	h, err := history.New(store)
+	c.Assert(err, qt.IsNil)
+
+	t0 := time.Unix(1000, 0)
+	h.RecordState(mkRelays(1), t0)
+	h.RecordOverriddenState(mkRelays(1, 2), mkRelays(1, 2), t0.Add(time.Second))
+	h.RecordState(mkRelays(1), t0.Add(2*time.Second))
+	err = store.Commit()
+	c.Assert(err, qt.IsNil)
+	store.Close()
+
+	// Only the changes caused by the override are marked.
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, `
+1 1 1000000
+2 1 1001000 o
+2 0 1002000
+`[1:])
+
+	store, err = history.NewDiskStore(path, time.Time{})
+	c.Assert(err, qt.IsNil)
+	defer store.Close()
+	c.Assert(allEvents(store), qt.DeepEquals, []history.Event{{
+		Relay: 1,
+		On:    true,
+		Time:  t0,
+	}, {
+		Relay:    2,
+		On:       true,
+		Time:     t0.Add(time.Second),
+		Override: true,
+	}, {
+		Relay: 2,
+		On:    false,
+		Time:  t0.Add(2 * time.Second),
+	}})
+}
+
 func allEvents(store history.Store) []history.Event {
 	iter := store.ReverseIter()
 	defer iter.Close()
@@ -237,3 +282,14 @@ func mkRelays(relays ...uint) hydroctl.RelayState {
 	}
 	return state
 }
+
+func TestDiskStoreWithMode(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "history")
+	store, err := history.NewDiskStoreWithMode(path, time.Now(), 0640)
+	c.Assert(err, qt.IsNil)
+	defer store.Close()
+	info, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0640))
+}
@@ -0,0 +1,120 @@
+// Package historytest provides helpers for constructing
+// relay histories in tests.
+package historytest
+
+import (
+	"time"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+// Builder builds a relay history from a sequence of relay
+// transitions. For example, this builds a history in which relay 0
+// was on from t1 to t3 and relay 1 has been on since t2:
+//
+//	db := historytest.New().
+//		At(t1).On(0).
+//		At(t2).On(1).
+//		At(t3).Off(0).
+//		DB()
+//
+// All the transitions made at a given time are recorded
+// together as a single relay state.
+type Builder struct {
+	store history.MemStore
+	db    *history.DB
+
+	// t holds the time of the pending transitions.
+	t time.Time
+	// state holds the relay state including any
+	// pending transitions.
+	state hydroctl.RelayState
+	// pending holds whether there are transitions
+	// at time t that have not yet been recorded.
+	pending bool
+}
+
+// New returns a new Builder holding an empty history.
+func New() *Builder {
+	b := &Builder{}
+	db, err := history.New(&b.store)
+	if err != nil {
+		// This can't happen because the store is empty.
+		panic(err)
+	}
+	b.db = db
+	return b
+}
+
+// At sets the time of subsequent transitions.
+// It panics if t is before the time of any
+// earlier transitions.
+func (b *Builder) At(t time.Time) *Builder {
+	if t.Equal(b.t) {
+		return b
+	}
+	if t.Before(b.t) {
+		panic("historytest: transitions out of order")
+	}
+	b.flush()
+	b.t = t
+	return b
+}
+
+// On turns on the given relays.
+func (b *Builder) On(relays ...int) *Builder {
+	return b.set(true, relays)
+}
+
+// Off turns off the given relays.
+func (b *Builder) Off(relays ...int) *Builder {
+	return b.set(false, relays)
+}
+
+// State sets the state of all the relays.
+func (b *Builder) State(state hydroctl.RelayState) *Builder {
+	b.state = state
+	b.pending = true
+	return b
+}
+
+func (b *Builder) set(on bool, relays []int) *Builder {
+	for _, r := range relays {
+		b.state.Set(r, on)
+	}
+	b.pending = true
+	return b
+}
+
+// CurrentState returns the relay state after
+// all the transitions so far.
+func (b *Builder) CurrentState() hydroctl.RelayState {
+	return b.state
+}
+
+// DB records any pending transitions and returns the history.
+func (b *Builder) DB() *history.DB {
+	b.flush()
+	return b.db
+}
+
+// Store records any pending transitions and returns
+// the store that holds the history's events.
+func (b *Builder) Store() *history.MemStore {
+	b.flush()
+	return &b.store
+}
+
+// flush records any pending transitions.
+func (b *Builder) flush() {
+	if !b.pending {
+		return
+	}
+	if b.t.IsZero() {
+		panic("historytest: no time set for transition")
+	}
+	b.db.RecordState(b.state, b.t)
+	b.store.Commit()
+	b.pending = false
+}
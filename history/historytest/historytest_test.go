@@ -0,0 +1,69 @@
+package historytest_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/history/historytest"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+var epoch = time.Date(2000, 01, 01, 0, 0, 0, 0, time.UTC)
+
+func T(i int) time.Time {
+	return epoch.Add(time.Duration(i) * time.Hour)
+}
+
+func TestBuilder(t *testing.T) {
+	c := qt.New(t)
+	b := historytest.New().
+		At(T(1)).On(0, 2).
+		At(T(2)).On(1).
+		At(T(3)).Off(0).On(3).
+		At(T(5)).Off(1, 3)
+	c.Assert(b.CurrentState(), qt.Equals, mkRelays(2))
+	c.Assert(b.Store().Events, qt.DeepEquals, []history.Event{
+		{Relay: 0, Time: T(1), On: true},
+		{Relay: 2, Time: T(1), On: true},
+		{Relay: 1, Time: T(2), On: true},
+		{Relay: 0, Time: T(3), On: false},
+		{Relay: 3, Time: T(3), On: true},
+		{Relay: 1, Time: T(5), On: false},
+		{Relay: 3, Time: T(5), On: false},
+	})
+	db := b.DB()
+	c.Assert(db.OnDuration(0, T(0), T(10)), qt.Equals, 2*time.Hour)
+	c.Assert(db.OnDuration(2, T(0), T(10)), qt.Equals, 9*time.Hour)
+	on, t0 := db.LatestChange(3)
+	c.Assert(on, qt.IsFalse)
+	c.Assert(t0, qt.DeepEquals, T(5))
+}
+
+func TestBuilderState(t *testing.T) {
+	c := qt.New(t)
+	db := historytest.New().
+		At(T(1)).State(mkRelays(0, 1)).
+		At(T(2)).State(mkRelays(1)).
+		DB()
+	c.Assert(db.OnDuration(0, T(0), T(3)), qt.Equals, time.Hour)
+	c.Assert(db.OnDuration(1, T(0), T(3)), qt.Equals, 2*time.Hour)
+}
+
+func TestBuilderOutOfOrder(t *testing.T) {
+	c := qt.New(t)
+	b := historytest.New().At(T(2)).On(0)
+	c.Assert(func() {
+		b.At(T(1))
+	}, qt.PanicMatches, `historytest: transitions out of order`)
+}
+
+func mkRelays(relays ...int) hydroctl.RelayState {
+	var state hydroctl.RelayState
+	for _, r := range relays {
+		state.Set(r, true)
+	}
+	return state
+}
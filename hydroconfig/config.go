@@ -3,7 +3,7 @@ package hydroconfig
 
 import (
 	"fmt"
-	"sort"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +12,7 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
 )
 
 // Config represents a control system configuration as specified
@@ -20,6 +21,13 @@ type Config struct {
 	Cohorts []Cohort
 	Relays  map[int]Relay
 	Attrs   Attrs
+	// Meters holds any meters declared in the configuration,
+	// in the order they were declared.
+	Meters []Meter
+	// Warnings holds any problems found in the configuration
+	// that don't stop it being used, such as a slot duration
+	// that can never be satisfied.
+	Warnings []ParseError
 }
 
 // Attrs holds configuration attributes.
@@ -32,6 +40,28 @@ type Attrs struct {
 // Relay holds information specific to a relay.
 type Relay struct {
 	MaxPower int // maximum power that this relay can draw in watts.
+	// Note holds any free-form notes on the relay, one per line.
+	Note string
+	// Invert holds whether the relay's output is inverted
+	// (for example because it's wired normally-closed).
+	Invert bool
+	// Position, if non-nil, holds the physical
+	// position of the relay.
+	Position *hydroctl.RelayPosition
+}
+
+// Meter holds information on a meter declared in the configuration.
+type Meter struct {
+	// Addr holds the host:port address of the meter.
+	Addr string
+	// Location holds where the meter is.
+	Location hydroreport.MeterLocation
+	// AllowedLag holds the maximum allowed lag of
+	// the meter's readings, if specified.
+	AllowedLag time.Duration
+	// TZ holds the name of the time zone that the
+	// meter's clock is set to, if specified.
+	TZ string
 }
 
 // Cohort represents a configured set of relays associated with the
@@ -42,6 +72,10 @@ type Cohort struct {
 	Mode          hydroctl.RelayMode
 	InUseSlots    []*hydroctl.Slot
 	NotInUseSlots []*hydroctl.Slot
+	// ShedTogether holds whether all the relays in the
+	// cohort must be turned off together when shedding
+	// load, for example because they drive a 3-phase load.
+	ShedTogether bool
 }
 
 // CtlConfig returns the hydroctl configuration that derives
@@ -63,6 +97,16 @@ func (c *Config) CtlConfig() *hydroctl.Config {
 				NotInUse: cohort.NotInUseSlots,
 				Cohort:   cohort.Name,
 			}
+			if cohort.ShedTogether {
+				relays[r].ShedGroup = cohort.Name
+			}
+		}
+	}
+	for r, info := range c.Relays {
+		if r >= 0 && r < hydroctl.MaxRelayCount {
+			relays[r].Note = info.Note
+			relays[r].Invert = info.Invert
+			relays[r].Position = info.Position
 		}
 	}
 	return &hydroctl.Config{
@@ -81,20 +125,52 @@ func (c *Config) CtlConfig() *hydroctl.Config {
 //
 //	relay 4 has max power 300w
 //	relays 0, 7, 8 have max power 5kw
+//	relay 3 has inverted output
+//	relay 3 has position board 1 terminal 4
 //
 //	dining room on from 14:30 to 20:45 for at least 20m
 //	bedrooms on from 17:00 to 20:00
+//	bedrooms shed together
 //
 //	config cycle 5m
 //	config reaction 10s
 //
-// If the time range is omitted, the slot lasts all day.
+//	meter 192.168.1.5:80 is generator
+//	meters 192.168.1.6:80, 192.168.1.7:80 are here
+//	meter 192.168.1.8:80 is neighbour
+//	meter 192.168.1.5:80 has max lag 2s
+//	meter 192.168.1.8:80 has time zone Europe/Paris
+//
+// If the time range is omitted, the slot lasts all day. The
+// duration of an "at least" or exact slot may not be longer
+// than the slot itself, because it could never be satisfied.
+//
+// A relay with an inverted output has its output on the relay
+// controller turned off when the relay is on and vice versa.
+//
+// A relay's position gives the board and terminal numbers,
+// as labelled on the hardware, that it's wired to. This is
+// for information only. No two relays may have the same position.
+//
+// When a cohort is "shed together", all its relays are turned
+// off at the same time when there's not enough power.
+//
+// A meter's location must be one of "generator", "here"
+// or "neighbour".
+//
+// A comment of the form
+//
+//	# note relay 4: east immersion, serviced 2021
+//
+// attaches a note to a relay. If there's more than one note
+// for a relay, they're joined with newlines.
 func Parse(s string) (*Config, error) {
 	// TODO in use/not in use
 	// TODO maxpower
 	p := &configParser{
 		relayInfo:      make(map[int]Relay),
 		assignedRelays: make(map[int]string),
+		meterIndexes:   make(map[string]int),
 		shortNames:     make(map[string]int),
 	}
 	for t := newText(s); t.s != ""; {
@@ -108,42 +184,44 @@ func Parse(s string) (*Config, error) {
 			Errors: p.errors,
 		}
 	}
-	for i := range p.cohorts {
-		cohort := &p.cohorts[i]
-		// TODO what should we do when we implement not-in-use support?
-		// The AlwaysOn mode doesn't seem to make much sense then, perhaps.
-		if len(cohort.InUseSlots) == 1 && *cohort.InUseSlots[0] == allDaySlot {
-			cohort.InUseSlots = nil
-			cohort.Mode = hydroctl.AlwaysOn
-		}
-	}
-	sort.Sort(cohortsByName(p.cohorts))
+	normalizeCohorts(p.cohorts)
 	if len(p.relayInfo) == 0 {
 		// Make tests a little easier.
 		p.relayInfo = nil
 	}
 	return &Config{
-		Cohorts: p.cohorts,
-		Relays:  p.relayInfo,
-		Attrs:   p.attrs,
+		Cohorts:  p.cohorts,
+		Relays:   p.relayInfo,
+		Attrs:    p.attrs,
+		Meters:   p.meters,
+		Warnings: p.warnings,
 	}, nil
 }
 
 type configParser struct {
-	cohorts []Cohort
-	errors  []ParseError
+	cohorts  []Cohort
+	errors   []ParseError
+	warnings []ParseError
 	// assignedRelays maps relay numbers to the
 	// cohort name that the relay is assigned to.
 	assignedRelays map[int]string
 	relayInfo      map[int]Relay
 	shortNames     map[string]int
 	attrs          Attrs
+	meters         []Meter
+	// meterIndexes maps meter addresses to
+	// their index in meters.
+	meterIndexes map[string]int
 }
 
 func (p *configParser) addLine(t text) {
 	t = t.trimSpace()
-	// Ignore comment lines.
+	// Ignore comment lines, apart from notes on relays.
 	if strings.HasPrefix(t.s, "#") {
+		// "# note relay 4: east immersion, serviced 2021"
+		if rest, ok := t.slice(1, len(t.s)).trimPrefix("note relay"); ok {
+			p.maybeAddNote(rest)
+		}
 		return
 	}
 	// Trim off any final full stop.
@@ -158,8 +236,10 @@ func (p *configParser) addLine(t text) {
 	// "relays 0, 4, 5 are bedrooms"
 	// "relay 5 has max power 500w"
 	// "relays 0, 4, 5 have max power 2kw"
+	// "relay 3 has inverted output"
+	// "relay 3 has position board 1 terminal 4"
 	if word.eq("relay") || word.eq("relays") {
-		p.addCohortOrMaxPower(rest)
+		p.addCohortOrRelayInfo(rest)
 		return
 	}
 
@@ -168,6 +248,15 @@ func (p *configParser) addLine(t text) {
 		return
 	}
 
+	// "meter 192.168.1.5:80 is generator"
+	// "meters 192.168.1.6:80, 192.168.1.7:80 are here"
+	// "meter 192.168.1.5:80 has max lag 2s"
+	// "meter 192.168.1.5:80 has time zone Europe/Paris"
+	if word.eq("meter") || word.eq("meters") {
+		p.addMeterOrMaxLag(rest)
+		return
+	}
+
 	// "dining room on from 14:30 to 20:45 for at least 20m"
 	// "bedrooms on from 17:00 to 20:00"
 	var found *Cohort
@@ -192,6 +281,15 @@ func (p *configParser) addLine(t text) {
 		p.errorf(t, "line must start with 'relay' or relay cohort name")
 		return
 	}
+	// "bedrooms shed together"
+	if rest, ok := t.trimPrefix("shed together"); ok {
+		if word, _ := rest.word(); word.s != "" {
+			p.errorf(word, "unexpected extra text")
+			return
+		}
+		found.ShedTogether = true
+		return
+	}
 	if slot := p.parseSlot(t); slot != nil {
 		for _, oldSlot := range found.InUseSlots {
 			if oldSlot.Overlaps(slot) {
@@ -300,6 +398,11 @@ func (p *configParser) parseSlot(t text) *hydroctl.Slot {
 		p.errorf(t, "invalid duration: %v", err)
 		return nil
 	}
+	if err := checkSlotDuration(&slot, dur); err != nil {
+		// This is only a warning so that existing configurations
+		// holding such a slot can still be loaded.
+		p.warnf(word, "%v", err)
+	}
 	t = rest
 	slot.Duration = dur
 	if word, _ := t.word(); word.s != "" {
@@ -309,6 +412,20 @@ func (p *configParser) parseSlot(t text) *hydroctl.Slot {
 	return &slot
 }
 
+// checkSlotDuration checks that the given duration can be
+// satisfied within the slot. A relay can't be on for longer
+// than the slot lasts, so a longer duration is almost
+// certainly a mistake.
+func checkSlotDuration(slot *hydroctl.Slot, dur time.Duration) error {
+	if slot.Kind != hydroctl.AtLeast && slot.Kind != hydroctl.Exactly {
+		return nil
+	}
+	if length := slot.Length(); dur > length {
+		return errgo.Newf("duration %v is longer than the slot (%v)", dur, length)
+	}
+	return nil
+}
+
 var timeFormats = []string{
 	"15:04",
 	"3pm",
@@ -328,13 +445,18 @@ func (p *configParser) parseTimeOfDay(t text) (hydroctl.TimeOfDay, text, bool) {
 	return td, rest, true
 }
 
-func (p *configParser) addCohortOrMaxPower(t text) {
+func (p *configParser) addCohortOrRelayInfo(t text) {
 	// "1 is dining room"
 	// "2, 3, 4 are bedrooms"
+	// "5 has max power 500w"
+	// "3 has inverted output"
+	// "3 has position board 1 terminal 4"
 
 	whole := t
 	var relays []int
 	isNewCohort := false
+	isInvert := false
+	isPosition := false
 relayNumbers:
 	for {
 		word, rest := t.word()
@@ -360,7 +482,22 @@ relayNumbers:
 				t = rest
 				break relayNumbers
 			}
-			p.errorf(t, "expected max power setting")
+			if rest, ok := t.trimPrefix("inverted output"); ok {
+				t = rest
+				isInvert = true
+				break relayNumbers
+			}
+			if rest, ok := t.trimPrefix("inverted outputs"); ok {
+				t = rest
+				isInvert = true
+				break relayNumbers
+			}
+			if rest, ok := t.trimPrefix("position"); ok {
+				t = rest
+				isPosition = true
+				break relayNumbers
+			}
+			p.errorf(t, "expected max power, inverted output or position setting")
 			return
 		}
 		s := strings.TrimSuffix(word.s, ",")
@@ -382,6 +519,22 @@ relayNumbers:
 		p.addCohort(t, relays)
 		return
 	}
+	if isInvert {
+		if t = t.trimSpace(); t.s != "" {
+			p.errorf(t, "unexpected text after inverted output")
+			return
+		}
+		for _, r := range relays {
+			info := p.relayInfo[r]
+			info.Invert = true
+			p.relayInfo[r] = info
+		}
+		return
+	}
+	if isPosition {
+		p.addRelayPosition(whole, t, relays)
+		return
+	}
 	word, rest := t.word()
 	if word.s == "" {
 		p.errorf(t, "expected power value")
@@ -409,6 +562,83 @@ relayNumbers:
 	}
 }
 
+// addRelayPosition adds the position described by t
+// (for example "board 1 terminal 4") to the given relays.
+func (p *configParser) addRelayPosition(whole, t text, relays []int) {
+	if len(relays) != 1 {
+		p.errorf(whole.trimSpace(), "position must be given for a single relay")
+		return
+	}
+	var pos hydroctl.RelayPosition
+	for _, f := range []struct {
+		name string
+		n    *int
+	}{
+		{"board", &pos.Board},
+		{"terminal", &pos.Terminal},
+	} {
+		rest, ok := t.trimPrefix(f.name)
+		if !ok {
+			p.errorf(t.trimSpace(), "expected %q", f.name)
+			return
+		}
+		word, rest := rest.word()
+		n, err := strconv.Atoi(word.s)
+		if err != nil || n < 0 {
+			p.errorf(word, "invalid %s number", f.name)
+			return
+		}
+		*f.n = n
+		t = rest
+	}
+	if t = t.trimSpace(); t.s != "" {
+		p.errorf(t, "unexpected text after position")
+		return
+	}
+	for r, info := range p.relayInfo {
+		if r != relays[0] && info.Position != nil && *info.Position == pos {
+			p.errorf(whole.trimSpace(), "relay %d has the same position as relay %d", relays[0], r)
+			return
+		}
+	}
+	info := p.relayInfo[relays[0]]
+	info.Position = &pos
+	p.relayInfo[relays[0]] = info
+}
+
+// maybeAddNote adds a note on a relay if t, the rest of a
+// "# note relay" comment, holds a relay number followed by
+// a colon. Otherwise the comment is ignored.
+func (p *configParser) maybeAddNote(t text) {
+	t = t.trimSpace()
+	i := strings.Index(t.s, ":")
+	if i == -1 {
+		// It's an ordinary comment.
+		return
+	}
+	word, rest := t.slice(0, i).trimSpace(), t.slice(i+1, len(t.s))
+	relay, err := strconv.Atoi(word.s)
+	if err != nil {
+		// It's an ordinary comment.
+		return
+	}
+	if relay < 0 || relay >= hydroctl.MaxRelayCount {
+		p.errorf(word, "relay number out of bounds")
+		return
+	}
+	note := rest.trimSpace()
+	if note.s == "" {
+		p.errorf(rest, "empty note")
+		return
+	}
+	info := p.relayInfo[relay]
+	if info.Note != "" {
+		info.Note += "\n"
+	}
+	info.Note += note.s
+	p.relayInfo[relay] = info
+}
+
 func parsePower(s string) (int, error) {
 	i := strings.LastIndexFunc(s, isDigit)
 	if i == -1 {
@@ -484,6 +714,126 @@ func (p *configParser) addCohort(t text, relays []int) {
 	})
 }
 
+func (p *configParser) addMeterOrMaxLag(t text) {
+	var addrs []text
+	isNewMeter, isTZ, badAddr := false, false, false
+meterAddrs:
+	for {
+		word, rest := t.word()
+		if word.s == "" {
+			p.errorf(t, "expected meter address")
+			return
+		}
+		t = rest
+		switch {
+		case word.eq("is"), word.eq("are"):
+			isNewMeter = true
+			break meterAddrs
+		case word.eq("has"), word.eq("have"):
+			if rest, ok := t.trimPrefix("max lag"); ok {
+				t = rest
+				break meterAddrs
+			}
+			if rest, ok := t.trimPrefix("time zone"); ok {
+				t = rest
+				isTZ = true
+				break meterAddrs
+			}
+			p.errorf(t, "expected max lag or time zone setting")
+			return
+		}
+		addr := word
+		if strings.HasSuffix(addr.s, ",") {
+			addr = addr.slice(0, len(addr.s)-1)
+		}
+		if addr.s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr.s); err != nil {
+			p.errorf(addr, "invalid meter address (must be of the form host:port)")
+			badAddr = true
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		if !badAddr {
+			p.errorf(t, "no meter addresses found")
+		}
+		return
+	}
+	word, rest := t.word()
+	if word.s == "" {
+		switch {
+		case isNewMeter:
+			p.errorf(t, "expected meter location")
+		case isTZ:
+			p.errorf(t, "expected time zone")
+		default:
+			p.errorf(t, "expected duration")
+		}
+		return
+	}
+	if w, _ := rest.word(); w.s != "" {
+		p.errorf(w, "unexpected extra text")
+		return
+	}
+	if isNewMeter {
+		loc, ok := parseMeterLocation(word.s)
+		if !ok {
+			p.errorf(word, `unknown meter location (need "generator", "here" or "neighbour")`)
+			return
+		}
+		for _, addr := range addrs {
+			if _, ok := p.meterIndexes[addr.s]; ok {
+				p.errorf(addr, "duplicate meter")
+				continue
+			}
+			p.meterIndexes[addr.s] = len(p.meters)
+			p.meters = append(p.meters, Meter{
+				Addr:     addr.s,
+				Location: loc,
+			})
+		}
+		return
+	}
+	if isTZ {
+		if _, err := time.LoadLocation(word.s); err != nil {
+			p.errorf(word, "unknown time zone")
+			return
+		}
+	}
+	var lag time.Duration
+	if !isTZ {
+		lag = p.duration(word)
+	}
+	for _, addr := range addrs {
+		i, ok := p.meterIndexes[addr.s]
+		if !ok {
+			p.errorf(addr, "undeclared meter")
+			continue
+		}
+		if isTZ {
+			p.meters[i].TZ = word.s
+		} else {
+			p.meters[i].AllowedLag = lag
+		}
+	}
+}
+
+func parseMeterLocation(s string) (hydroreport.MeterLocation, bool) {
+	for _, loc := range []hydroreport.MeterLocation{
+		hydroreport.LocGenerator,
+		hydroreport.LocHere,
+		hydroreport.LocNeighbour,
+	} {
+		if strings.EqualFold(s, loc.String()) {
+			return loc, true
+		}
+	}
+	return hydroreport.LocUnknown, false
+}
+
 func isSpaceOrDigit(r rune) bool {
 	return unicode.IsSpace(r) || '0' <= r && r <= '9'
 }
@@ -496,6 +846,15 @@ func (p *configParser) errorf(t text, f string, a ...interface{}) {
 	})
 }
 
+// warnf records a warning about the given text.
+func (p *configParser) warnf(t text, f string, a ...interface{}) {
+	p.warnings = append(p.warnings, ParseError{
+		P0:      t.p0,
+		P1:      t.p1,
+		Message: fmt.Sprintf(f, a...),
+	})
+}
+
 type ConfigParseError struct {
 	Config string
 	Errors []ParseError
@@ -8,6 +8,7 @@ import (
 
 	"github.com/rogpeppe/hydro/hydroconfig"
 	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
 )
 
 var parseTests = []struct {
@@ -179,9 +180,9 @@ Bedrooms are on from 12:00 to 1pm
 			}},
 		}},
 		Relays: map[int]hydroconfig.Relay{
-			6: {100},
-			7: {100},
-			8: {5678},
+			6: {MaxPower: 100},
+			7: {MaxPower: 100},
+			8: {MaxPower: 5678},
 		},
 	},
 }, {
@@ -228,6 +229,73 @@ more for 12h
 			}},
 		}},
 	},
+}, {
+	testName: "at-least-longer-than-slot",
+	config: `
+relay 1 is heater
+heater on from 01:00 to 02:00 for at least 3h
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "heater",
+			Relays: []int{1},
+			Mode:   hydroctl.InUse,
+			InUseSlots: []*hydroctl.Slot{{
+				Start:    TD("01:00"),
+				End:      TD("02:00"),
+				Kind:     hydroctl.AtLeast,
+				Duration: 3 * time.Hour,
+			}},
+		}},
+		Warnings: []hydroconfig.ParseError{{
+			P0:      62,
+			P1:      64,
+			Message: "duration 3h0m0s is longer than the slot (1h0m0s)",
+		}},
+	},
+}, {
+	testName: "exactly-longer-than-slot-over-midnight",
+	config: `
+relay 1 is heater
+heater on from 23:00 to 01:00 for 150m
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "heater",
+			Relays: []int{1},
+			Mode:   hydroctl.InUse,
+			InUseSlots: []*hydroctl.Slot{{
+				Start:    TD("23:00"),
+				End:      TD("01:00"),
+				Kind:     hydroctl.Exactly,
+				Duration: 150 * time.Minute,
+			}},
+		}},
+		Warnings: []hydroconfig.ParseError{{
+			P0:      53,
+			P1:      57,
+			Message: "duration 2h30m0s is longer than the slot (2h0m0s)",
+		}},
+	},
+}, {
+	testName: "at-most-longer-than-slot",
+	config: `
+relay 1 is heater
+heater on from 01:00 to 02:00 for at most 3h
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "heater",
+			Relays: []int{1},
+			Mode:   hydroctl.InUse,
+			InUseSlots: []*hydroctl.Slot{{
+				Start:    TD("01:00"),
+				End:      TD("02:00"),
+				Kind:     hydroctl.AtMost,
+				Duration: 3 * time.Hour,
+			}},
+		}},
+	},
 }, {
 	testName: "overlapping-time-slot",
 	config: `
@@ -238,6 +306,33 @@ bedrooms on from 11am to 1pm
 bedrooms on from 12pm to 3pm
 `,
 	expectError: `error at " on from 12pm to 3pm": time slot overlaps slot from 11:00 to 13:00`,
+}, {
+	testName: "shed-together",
+	config: `
+relays 1, 2, 3 are heater
+heater on from 10am to 2pm
+heater shed together
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "heater",
+			Relays: []int{1, 2, 3},
+			Mode:   hydroctl.InUse,
+			InUseSlots: []*hydroctl.Slot{{
+				Start: TD("10:00"),
+				End:   TD("14:00"),
+				Kind:  hydroctl.Continuous,
+			}},
+			ShedTogether: true,
+		}},
+	},
+}, {
+	testName: "shed-together-with-extra-text",
+	config: `
+relays 1, 2, 3 are heater
+heater shed together now
+`,
+	expectError: `error at "now": unexpected extra text`,
 }, {
 	testName: "empty-config",
 	config:   "",
@@ -256,6 +351,217 @@ config cycle 20m
 			CycleDuration:         20 * time.Minute,
 		},
 	},
+}, {
+	testName: "meters",
+	config: `
+meter 192.168.1.5:80 is generator
+meters 192.168.1.6:80, 192.168.1.7:80 are Here
+meter meter.local:8080 is neighbour.
+meters 192.168.1.5:80, meter.local:8080 have max lag 2s
+`,
+	expect: &hydroconfig.Config{
+		Meters: []hydroconfig.Meter{{
+			Addr:       "192.168.1.5:80",
+			Location:   hydroreport.LocGenerator,
+			AllowedLag: 2 * time.Second,
+		}, {
+			Addr:     "192.168.1.6:80",
+			Location: hydroreport.LocHere,
+		}, {
+			Addr:     "192.168.1.7:80",
+			Location: hydroreport.LocHere,
+		}, {
+			Addr:       "meter.local:8080",
+			Location:   hydroreport.LocNeighbour,
+			AllowedLag: 2 * time.Second,
+		}},
+	},
+}, {
+	testName: "meter-with-unknown-location",
+	config: `
+meter 192.168.1.5:80 is shed
+`,
+	expectError: `error at "shed": unknown meter location \(need "generator", "here" or "neighbour"\)`,
+}, {
+	testName: "meter-with-invalid-address",
+	config: `
+meter 192.168.1.5 is generator
+`,
+	expectError: `error at "192.168.1.5": invalid meter address \(must be of the form host:port\)`,
+}, {
+	testName: "duplicate-meter",
+	config: `
+meter 192.168.1.5:80 is generator
+meter 192.168.1.5:80 is here
+`,
+	expectError: `error at "192.168.1.5:80": duplicate meter`,
+}, {
+	testName: "meter-time-zone",
+	config: `
+meter 192.168.1.5:80 is generator
+meter 192.168.1.6:80 is here
+meter 192.168.1.6:80 has time zone Europe/Paris
+`,
+	expect: &hydroconfig.Config{
+		Meters: []hydroconfig.Meter{{
+			Addr:     "192.168.1.5:80",
+			Location: hydroreport.LocGenerator,
+		}, {
+			Addr:     "192.168.1.6:80",
+			Location: hydroreport.LocHere,
+			TZ:       "Europe/Paris",
+		}},
+	},
+}, {
+	testName: "meter-unknown-time-zone",
+	config: `
+meter 192.168.1.5:80 is generator
+meter 192.168.1.5:80 has time zone Nowhere/Special
+`,
+	expectError: `error at "Nowhere/Special": unknown time zone`,
+}, {
+	testName: "max-lag-for-undeclared-meter",
+	config: `
+meter 192.168.1.5:80 has max lag 1s
+`,
+	expectError: `error at "192.168.1.5:80": undeclared meter`,
+}, {
+	testName: "relay-notes",
+	config: `
+relays 4, 5 are immersion
+# note relay 4: east immersion, serviced 2021.
+#note relay 4:element replaced 2022
+# note relay 9: not wired up
+# note to self: this is an ordinary comment
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "immersion",
+			Relays: []int{4, 5},
+			Mode:   hydroctl.InUse,
+		}},
+		Relays: map[int]hydroconfig.Relay{
+			4: {Note: "east immersion, serviced 2021.\nelement replaced 2022"},
+			9: {Note: "not wired up"},
+		},
+	},
+}, {
+	testName: "relay-note-comments",
+	config: `
+# note relay 4 east immersion
+# note relay x: something
+# note relay 4 and 5: are wired together
+`,
+	expect: &hydroconfig.Config{},
+}, {
+	testName: "relay-note-with-out-of-bounds-relay",
+	config: `
+# note relay 99: something
+`,
+	expectError: `error at "99": relay number out of bounds`,
+}, {
+	testName: "empty-relay-note",
+	config: `
+# note relay 4:
+`,
+	expectError: `error at "": empty note`,
+}, {
+	testName: "meter-with-extra-text",
+	config: `
+meter 192.168.1.5:80 is generator today
+`,
+	expectError: `error at "today": unexpected extra text`,
+}, {
+	testName: "inverted-relays",
+	config: `
+relays 4, 5 are immersion
+relay 4 has max power 3kw
+relay 4 has inverted output
+relays 5, 9 have inverted outputs
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "immersion",
+			Relays: []int{4, 5},
+			Mode:   hydroctl.InUse,
+		}},
+		Relays: map[int]hydroconfig.Relay{
+			4: {MaxPower: 3000, Invert: true},
+			5: {Invert: true},
+			9: {Invert: true},
+		},
+	},
+}, {
+	testName: "inverted-relay-with-extra-text",
+	config: `
+relay 4 has inverted output sometimes
+`,
+	expectError: `error at "sometimes": unexpected text after inverted output`,
+}, {
+	testName: "relay-has-unknown-setting",
+	config: `
+relay 4 has something
+`,
+	expectError: `error at " something": expected max power, inverted output or position setting`,
+}, {
+	testName: "relay-positions",
+	config: `
+relays 4, 5 are immersion
+relay 4 has inverted output
+relay 4 has position board 1 terminal 3
+relay 5 has position board 1 terminal 4
+relay 12 has position board 2 terminal 3
+`,
+	expect: &hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "immersion",
+			Relays: []int{4, 5},
+			Mode:   hydroctl.InUse,
+		}},
+		Relays: map[int]hydroconfig.Relay{
+			4: {
+				Invert:   true,
+				Position: &hydroctl.RelayPosition{Board: 1, Terminal: 3},
+			},
+			5: {
+				Position: &hydroctl.RelayPosition{Board: 1, Terminal: 4},
+			},
+			12: {
+				Position: &hydroctl.RelayPosition{Board: 2, Terminal: 3},
+			},
+		},
+	},
+}, {
+	testName: "relay-position-for-several-relays",
+	config: `
+relays 4, 5 have position board 1 terminal 3
+`,
+	expectError: `error at "4, 5 have position board 1 terminal 3": position must be given for a single relay`,
+}, {
+	testName: "relay-position-without-terminal",
+	config: `
+relay 4 has position board 1
+`,
+	expectError: `error at "": expected "terminal"`,
+}, {
+	testName: "relay-position-with-bad-number",
+	config: `
+relay 4 has position board one terminal 3
+`,
+	expectError: `error at "one": invalid board number`,
+}, {
+	testName: "relay-position-with-extra-text",
+	config: `
+relay 4 has position board 1 terminal 3 left
+`,
+	expectError: `error at "left": unexpected text after position`,
+}, {
+	testName: "duplicate-relay-position",
+	config: `
+relay 4 has position board 1 terminal 3
+relay 5 has position board 1 terminal 3
+`,
+	expectError: `error at "5 has position board 1 terminal 3": relay 5 has the same position as relay 4`,
 }}
 
 // awkward failing test for now.
@@ -296,10 +602,10 @@ var ctlConfigTests = []struct {
 }{{
 	cfg: hydroconfig.Config{
 		Relays: map[int]hydroconfig.Relay{
-			1: {500},
-			2: {1000},
-			4: {600},
-			5: {2000},
+			1: {MaxPower: 500},
+			2: {MaxPower: 1000},
+			4: {MaxPower: 600},
+			5: {MaxPower: 2000},
 		},
 		Cohorts: []hydroconfig.Cohort{{
 			Name:   "one",
@@ -371,6 +677,102 @@ var ctlConfigTests = []struct {
 			},
 		}),
 	},
+}, {
+	cfg: hydroconfig.Config{
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "one",
+			Relays: []int{1, 2},
+			Mode:   hydroctl.AlwaysOn,
+		}, {
+			Name:         "two",
+			Relays:       []int{3, 4},
+			Mode:         hydroctl.AlwaysOn,
+			ShedTogether: true,
+		}},
+	},
+	expect: hydroctl.Config{
+		Relays: mkSlots([hydroctl.MaxRelayCount]hydroctl.RelayConfig{
+			1: {
+				Cohort: "one",
+				Mode:   hydroctl.AlwaysOn,
+			},
+			2: {
+				Cohort: "one",
+				Mode:   hydroctl.AlwaysOn,
+			},
+			3: {
+				Cohort:    "two",
+				ShedGroup: "two",
+				Mode:      hydroctl.AlwaysOn,
+			},
+			4: {
+				Cohort:    "two",
+				ShedGroup: "two",
+				Mode:      hydroctl.AlwaysOn,
+			},
+		}),
+	},
+}, {
+	cfg: hydroconfig.Config{
+		Relays: map[int]hydroconfig.Relay{
+			1: {Note: "east immersion"},
+			3: {Note: "not wired up"},
+		},
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "one",
+			Relays: []int{1},
+			Mode:   hydroctl.AlwaysOn,
+		}},
+	},
+	expect: hydroctl.Config{
+		Relays: mkSlots([hydroctl.MaxRelayCount]hydroctl.RelayConfig{
+			1: {
+				Cohort: "one",
+				Mode:   hydroctl.AlwaysOn,
+				Note:   "east immersion",
+			},
+			3: {
+				Note: "not wired up",
+			},
+		}),
+	},
+}, {
+	cfg: hydroconfig.Config{
+		Relays: map[int]hydroconfig.Relay{
+			1: {Invert: true},
+			2: {Invert: true},
+		},
+		Cohorts: []hydroconfig.Cohort{{
+			Name:   "one",
+			Relays: []int{1},
+			Mode:   hydroctl.AlwaysOn,
+		}},
+	},
+	expect: hydroctl.Config{
+		Relays: mkSlots([hydroctl.MaxRelayCount]hydroctl.RelayConfig{
+			1: {
+				Cohort: "one",
+				Mode:   hydroctl.AlwaysOn,
+				Invert: true,
+			},
+			2: {
+				Invert: true,
+			},
+		}),
+	},
+}, {
+	cfg: hydroconfig.Config{
+		Relays: map[int]hydroconfig.Relay{
+			3: {Position: &hydroctl.RelayPosition{Board: 1, Terminal: 4}},
+		},
+	},
+	expect: hydroctl.Config{
+		Relays: mkSlots([hydroctl.MaxRelayCount]hydroctl.RelayConfig{
+			3: {
+				Position: &hydroctl.RelayPosition{Board: 1, Terminal: 4},
+			},
+		}),
+	},
 }}
 
 func mkSlots(slots [hydroctl.MaxRelayCount]hydroctl.RelayConfig) []hydroctl.RelayConfig {
@@ -0,0 +1,319 @@
+package hydroconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+// jsonConfig holds the structured form of a configuration
+// as read by ParseJSON.
+type jsonConfig struct {
+	Cohorts []jsonCohort
+	Relays  map[int]jsonRelay
+	Attrs   jsonAttrs
+	Meters  []jsonMeter
+}
+
+type jsonCohort struct {
+	Name         string
+	Relays       []int
+	Slots        []jsonSlot
+	ShedTogether bool
+}
+
+type jsonSlot struct {
+	Start    *hydroctl.TimeOfDay
+	End      *hydroctl.TimeOfDay
+	Kind     string
+	Duration string
+}
+
+type jsonRelay struct {
+	MaxPower int
+	Note     string
+	Invert   bool
+	Position *hydroctl.RelayPosition
+}
+
+type jsonAttrs struct {
+	Cycle    string
+	Reaction string
+	Fastest  string
+}
+
+type jsonMeter struct {
+	Addr     string
+	Location string
+	MaxLag   string
+	TZ       string
+}
+
+// ParseJSON parses a configuration held in a structured
+// JSON form, which is more convenient than the text format
+// for configurations generated by other programs. The
+// resulting Config is the same as the one that Parse
+// returns for the equivalent text.
+//
+// The JSON equivalent of the sample config in the Parse
+// documentation (without the meters) is:
+//
+//	{
+//		"Cohorts": [{
+//			"Name": "dining room",
+//			"Relays": [6],
+//			"Slots": [{
+//				"Start": "14:30",
+//				"End": "20:45",
+//				"Kind": "AtLeast",
+//				"Duration": "20m"
+//			}]
+//		}, {
+//			"Name": "bedrooms",
+//			"Relays": [0, 4, 5],
+//			"Slots": [{"Start": "17:00", "End": "20:00"}],
+//			"ShedTogether": true
+//		}],
+//		"Relays": {
+//			"3": {"Invert": true, "Position": {"Board": 1, "Terminal": 4}},
+//			"4": {"MaxPower": 300}
+//		},
+//		"Attrs": {"Cycle": "5m", "Reaction": "10s"}
+//	}
+//
+// A slot's Kind is one of "AtLeast", "AtMost" or "Exactly"; if
+// it's omitted, the relays are on for the whole slot. If a slot's
+// Start and End are omitted, it lasts all day. Relay max power is
+// in watts. Meters are specified as a list of objects with Addr,
+// Location, MaxLag and TZ fields, for example:
+//
+//	{"Addr": "192.168.1.8:80", "Location": "neighbour", "TZ": "Europe/Paris"}
+//
+// Unlike the text format, there are no short cohort names.
+func ParseJSON(data []byte) (*Config, error) {
+	var jcfg jsonConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jcfg); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal configuration")
+	}
+	var cfg Config
+	assignedRelays := make(map[int]string)
+	for _, jc := range jcfg.Cohorts {
+		cohort, err := jc.cohort(&cfg, assignedRelays)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid cohort %q", jc.Name)
+		}
+		cfg.Cohorts = append(cfg.Cohorts, *cohort)
+	}
+	if len(jcfg.Relays) > 0 {
+		cfg.Relays = make(map[int]Relay)
+	}
+	for r, jr := range jcfg.Relays {
+		if err := checkRelay(r); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if jr.MaxPower < 0 {
+			return nil, errgo.Newf("negative max power for relay %d", r)
+		}
+		if _, ok := assignedRelays[r]; !ok && jr.MaxPower != 0 {
+			return nil, errgo.Newf("max power for unassigned relay %d", r)
+		}
+		if jr.Position != nil {
+			if jr.Position.Board < 0 || jr.Position.Terminal < 0 {
+				return nil, errgo.Newf("invalid position for relay %d", r)
+			}
+			for r1, info := range cfg.Relays {
+				if info.Position != nil && *info.Position == *jr.Position {
+					return nil, errgo.Newf("relay %d has the same position as relay %d", r, r1)
+				}
+			}
+		}
+		cfg.Relays[r] = Relay{
+			MaxPower: jr.MaxPower,
+			Note:     jr.Note,
+			Invert:   jr.Invert,
+			Position: jr.Position,
+		}
+	}
+	var err error
+	for _, a := range []struct {
+		name string
+		val  string
+		d    *time.Duration
+	}{
+		{"cycle", jcfg.Attrs.Cycle, &cfg.Attrs.CycleDuration},
+		{"reaction", jcfg.Attrs.Reaction, &cfg.Attrs.MeterReactionDuration},
+		{"fastest", jcfg.Attrs.Fastest, &cfg.Attrs.MinimumChangeDuration},
+	} {
+		if *a.d, err = parseJSONDuration(a.val); err != nil {
+			return nil, errgo.Notef(err, "invalid %s attribute", a.name)
+		}
+	}
+	seenMeters := make(map[string]bool)
+	for _, jm := range jcfg.Meters {
+		m, err := jm.meter()
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid meter %q", jm.Addr)
+		}
+		if seenMeters[m.Addr] {
+			return nil, errgo.Newf("duplicate meter %q", m.Addr)
+		}
+		seenMeters[m.Addr] = true
+		cfg.Meters = append(cfg.Meters, *m)
+	}
+	normalizeCohorts(cfg.Cohorts)
+	return &cfg, nil
+}
+
+// cohort returns the cohort described by jc, checking that
+// it doesn't conflict with any of the cohorts already in cfg.
+// The cohort's relays are added to assignedRelays.
+func (jc *jsonCohort) cohort(cfg *Config, assignedRelays map[int]string) (*Cohort, error) {
+	if jc.Name == "" {
+		return nil, errgo.New("empty cohort name")
+	}
+	for _, c := range cfg.Cohorts {
+		if strings.EqualFold(c.Name, jc.Name) {
+			return nil, errgo.New("duplicate cohort name")
+		}
+	}
+	for _, r := range jc.Relays {
+		if err := checkRelay(r); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if dupe, ok := assignedRelays[r]; ok {
+			return nil, errgo.Newf("duplicate relay %d also in %q", r, dupe)
+		}
+		assignedRelays[r] = jc.Name
+	}
+	cohort := &Cohort{
+		Name:         jc.Name,
+		Mode:         hydroctl.InUse,
+		Relays:       jc.Relays,
+		ShedTogether: jc.ShedTogether,
+	}
+	for _, js := range jc.Slots {
+		slot, err := js.slot()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, oldSlot := range cohort.InUseSlots {
+			if oldSlot.Overlaps(slot) {
+				return nil, errgo.Newf("time slot from %v to %v overlaps slot from %v to %v", slot.Start, slot.End, oldSlot.Start, oldSlot.End)
+			}
+		}
+		cohort.InUseSlots = append(cohort.InUseSlots, slot)
+	}
+	return cohort, nil
+}
+
+func (js *jsonSlot) slot() (*hydroctl.Slot, error) {
+	slot := allDaySlot
+	if (js.Start == nil) != (js.End == nil) {
+		return nil, errgo.New("slot must have both start and end times or neither")
+	}
+	if js.Start != nil {
+		slot.Start, slot.End = *js.Start, *js.End
+	}
+	if js.Kind == "" {
+		if js.Duration != "" {
+			return nil, errgo.New("slot duration specified without kind")
+		}
+		return &slot, nil
+	}
+	kind, ok := parseSlotKind(js.Kind)
+	if !ok {
+		return nil, errgo.Newf(`unknown slot kind %q (need "AtLeast", "AtMost" or "Exactly")`, js.Kind)
+	}
+	slot.Kind = kind
+	if js.Duration == "" {
+		return nil, errgo.New("expected slot duration")
+	}
+	d, err := time.ParseDuration(js.Duration)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid slot duration")
+	}
+	if err := checkSlotDuration(&slot, d); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	slot.Duration = d
+	return &slot, nil
+}
+
+func (jm *jsonMeter) meter() (*Meter, error) {
+	if _, _, err := net.SplitHostPort(jm.Addr); err != nil {
+		return nil, errgo.New("invalid meter address (must be of the form host:port)")
+	}
+	loc, ok := parseMeterLocation(jm.Location)
+	if !ok {
+		return nil, errgo.Newf(`unknown meter location %q (need "generator", "here" or "neighbour")`, jm.Location)
+	}
+	lag, err := parseJSONDuration(jm.MaxLag)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid max lag")
+	}
+	if jm.TZ != "" {
+		if _, err := time.LoadLocation(jm.TZ); err != nil {
+			return nil, errgo.Newf("unknown time zone %q", jm.TZ)
+		}
+	}
+	return &Meter{
+		Addr:       jm.Addr,
+		Location:   loc,
+		AllowedLag: lag,
+		TZ:         jm.TZ,
+	}, nil
+}
+
+func parseSlotKind(s string) (hydroctl.SlotKind, bool) {
+	for _, kind := range []hydroctl.SlotKind{
+		hydroctl.AtLeast,
+		hydroctl.AtMost,
+		hydroctl.Exactly,
+	} {
+		if strings.EqualFold(s, kind.String()) {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// parseJSONDuration parses a duration in time.ParseDuration
+// format, returning zero if s is empty.
+func parseJSONDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func checkRelay(r int) error {
+	if r < 0 || r >= hydroctl.MaxRelayCount {
+		return errgo.Newf("relay number %d out of bounds", r)
+	}
+	return nil
+}
+
+// normalizeCohorts puts cohorts into canonical form:
+// cohorts that are on all day are made AlwaysOn
+// and the cohorts are sorted by name.
+func normalizeCohorts(cohorts []Cohort) {
+	for i := range cohorts {
+		cohort := &cohorts[i]
+		// TODO what should we do when we implement not-in-use support?
+		// The AlwaysOn mode doesn't seem to make much sense then, perhaps.
+		if len(cohort.InUseSlots) == 1 && *cohort.InUseSlots[0] == allDaySlot {
+			cohort.InUseSlots = nil
+			cohort.Mode = hydroctl.AlwaysOn
+		}
+	}
+	sort.Sort(cohortsByName(cohorts))
+}
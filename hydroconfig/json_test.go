@@ -0,0 +1,188 @@
+package hydroconfig_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroconfig"
+)
+
+var parseJSONTests = []struct {
+	testName string
+	json     string
+	// text holds the text configuration that's
+	// equivalent to json.
+	text string
+}{{
+	testName: "empty",
+	json:     `{}`,
+	text:     ``,
+}, {
+	testName: "original-example",
+	json: `{
+	"Cohorts": [{
+		"Name": "dining room",
+		"Relays": [6],
+		"Slots": [{"Start": "14:30", "End": "20:45", "Kind": "AtLeast", "Duration": "20m"}]
+	}, {
+		"Name": "bedrooms",
+		"Relays": [0, 4, 5],
+		"Slots": [{"Start": "17:00", "End": "20:00"}]
+	}]
+}`,
+	text: `
+relay 6 is dining room
+relays 0, 4, 5 are bedrooms
+
+dining room on from 14:30 to 20:45 for at least 20m
+bedrooms on from 17:00 to 20:00
+`,
+}, {
+	testName: "everything",
+	json: `{
+	"Cohorts": [{
+		"Name": "bedrooms",
+		"Relays": [0, 4, 5],
+		"Slots": [
+			{"Start": "01:00", "End": "03:00", "Kind": "exactly", "Duration": "1h"},
+			{"Start": "17:00", "End": "20:00", "Kind": "AtMost", "Duration": "2h"}
+		],
+		"ShedTogether": true
+	}, {
+		"Name": "heater",
+		"Relays": [3],
+		"Slots": [{}]
+	}, {
+		"Name": "spare",
+		"Relays": [7]
+	}],
+	"Relays": {
+		"3": {"Invert": true, "Position": {"Board": 1, "Terminal": 4}, "Note": "east immersion\nserviced 2021"},
+		"4": {"MaxPower": 300},
+		"5": {"MaxPower": 5000}
+	},
+	"Attrs": {"Cycle": "5m", "Reaction": "10s", "Fastest": "1s"},
+	"Meters": [
+		{"Addr": "192.168.1.5:80", "Location": "generator", "MaxLag": "2s"},
+		{"Addr": "192.168.1.6:80", "Location": "here"},
+		{"Addr": "192.168.1.8:80", "Location": "neighbour", "TZ": "Europe/Paris"}
+	]
+}`,
+	text: `
+relays 0, 4, 5 are bedrooms
+relay 3 is heater
+relay 7 is spare
+
+relay 3 has inverted output
+relay 3 has position board 1 terminal 4
+# note relay 3: east immersion
+# note relay 3: serviced 2021
+relay 4 has max power 300w
+relay 5 has max power 5kw
+
+bedrooms on from 01:00 to 03:00 for 1h
+bedrooms on from 17:00 to 20:00 for at most 2h
+bedrooms shed together
+heater on
+
+config cycle 5m
+config reaction 10s
+config fastest 1s
+
+meter 192.168.1.5:80 is generator
+meter 192.168.1.6:80 is here
+meter 192.168.1.8:80 is neighbour
+meter 192.168.1.5:80 has max lag 2s
+meter 192.168.1.8:80 has time zone Europe/Paris
+`,
+}}
+
+func TestParseJSON(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseJSONTests {
+		c.Run(test.testName, func(c *qt.C) {
+			expect, err := hydroconfig.Parse(test.text)
+			c.Assert(err, qt.IsNil)
+			cfg, err := hydroconfig.ParseJSON([]byte(test.json))
+			c.Assert(err, qt.IsNil)
+			c.Assert(cfg, qt.DeepEquals, expect)
+		})
+	}
+}
+
+var parseJSONErrorTests = []struct {
+	testName    string
+	json        string
+	expectError string
+}{{
+	testName:    "unknown-field",
+	json:        `{"Cohort": []}`,
+	expectError: `cannot unmarshal configuration: json: unknown field "Cohort"`,
+}, {
+	testName:    "relay-out-of-bounds",
+	json:        `{"Cohorts": [{"Name": "x", "Relays": [32]}]}`,
+	expectError: `invalid cohort "x": relay number 32 out of bounds`,
+}, {
+	testName:    "duplicate-relay",
+	json:        `{"Cohorts": [{"Name": "x", "Relays": [1]}, {"Name": "y", "Relays": [1]}]}`,
+	expectError: `invalid cohort "y": duplicate relay 1 also in "x"`,
+}, {
+	testName:    "duplicate-cohort",
+	json:        `{"Cohorts": [{"Name": "x", "Relays": [1]}, {"Name": "X", "Relays": [2]}]}`,
+	expectError: `invalid cohort "X": duplicate cohort name`,
+}, {
+	testName:    "bad-slot-kind",
+	json:        `{"Cohorts": [{"Name": "x", "Slots": [{"Kind": "sometimes", "Duration": "1h"}]}]}`,
+	expectError: `invalid cohort "x": unknown slot kind "sometimes" \(need "AtLeast", "AtMost" or "Exactly"\)`,
+}, {
+	testName:    "missing-end",
+	json:        `{"Cohorts": [{"Name": "x", "Slots": [{"Start": "10:00"}]}]}`,
+	expectError: `invalid cohort "x": slot must have both start and end times or neither`,
+}, {
+	testName:    "duration-longer-than-slot",
+	json:        `{"Cohorts": [{"Name": "x", "Slots": [{"Start": "01:00", "End": "02:00", "Kind": "AtLeast", "Duration": "3h"}]}]}`,
+	expectError: `invalid cohort "x": duration 3h0m0s is longer than the slot \(1h0m0s\)`,
+}, {
+	testName: "overlapping-slots",
+	json: `{"Cohorts": [{"Name": "x", "Slots": [
+		{"Start": "10:00", "End": "12:00"},
+		{"Start": "11:00", "End": "13:00"}
+	]}]}`,
+	expectError: `invalid cohort "x": time slot from 11:00 to 13:00 overlaps slot from 10:00 to 12:00`,
+}, {
+	testName:    "max-power-unassigned",
+	json:        `{"Relays": {"4": {"MaxPower": 300}}}`,
+	expectError: `max power for unassigned relay 4`,
+}, {
+	testName:    "duplicate-position",
+	json:        `{"Relays": {"1": {"Position": {"Board": 1, "Terminal": 2}}, "2": {"Position": {"Board": 1, "Terminal": 2}}}}`,
+	expectError: `relay [12] has the same position as relay [12]`,
+}, {
+	testName:    "bad-attr",
+	json:        `{"Attrs": {"Cycle": "often"}}`,
+	expectError: `invalid cycle attribute: time: invalid duration "often"`,
+}, {
+	testName:    "bad-meter-location",
+	json:        `{"Meters": [{"Addr": "x:80", "Location": "elsewhere"}]}`,
+	expectError: `invalid meter "x:80": unknown meter location "elsewhere" \(need "generator", "here" or "neighbour"\)`,
+}, {
+	testName:    "duplicate-meter",
+	json:        `{"Meters": [{"Addr": "x:80", "Location": "here"}, {"Addr": "x:80", "Location": "generator"}]}`,
+	expectError: `duplicate meter "x:80"`,
+}, {
+	testName:    "bad-meter-tz",
+	json:        `{"Meters": [{"Addr": "x:80", "Location": "here", "TZ": "Nowhere/Special"}]}`,
+	expectError: `invalid meter "x:80": unknown time zone "Nowhere/Special"`,
+}}
+
+func TestParseJSONError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseJSONErrorTests {
+		c.Run(test.testName, func(c *qt.C) {
+			cfg, err := hydroconfig.ParseJSON([]byte(test.json))
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(cfg, qt.IsNil)
+		})
+	}
+}
@@ -53,6 +53,32 @@ type Config struct {
 	CycleDuration         time.Duration
 	MeterReactionDuration time.Duration
 	MinimumChangeDuration time.Duration
+
+	// ChangeDurationPerKW holds an additional length of time,
+	// proportional to the maximum power of the most recently
+	// switched-on relay, that we wait before turning on another
+	// relay. This gives large loads longer to settle than small
+	// ones. For example, if it's 2s, we'll wait an extra 10s
+	// after turning on a 5kW load.
+	ChangeDurationPerKW time.Duration
+
+	// MaxConcurrentRelays holds the maximum number of relays
+	// using discretionary power that may be on at the same time.
+	// If it's zero, there is no limit.
+	MaxConcurrentRelays int
+
+	// MeterFailSafeDuration holds the length of time for which
+	// the meters may be unreadable before all relays using
+	// discretionary power are turned off, because we can no
+	// longer tell whether we're importing power.
+	// If it's zero, the relays are left as they are.
+	MeterFailSafeDuration time.Duration
+
+	// ImportAllowance holds the amount of imported power,
+	// in watts, that's tolerated before relays are turned off.
+	// Relays will only be turned on if the resulting import
+	// is expected to stay within the allowance.
+	ImportAllowance float64
 }
 
 // RelayConfig holds the configuration for a given relay.
@@ -71,8 +97,63 @@ type RelayConfig struct {
 	// Cohort holds the cohort that this relay is a part
 	// of. This is for informational purposes only.
 	Cohort string
+
+	// Note holds any notes on the relay made by the user.
+	// This is for informational purposes only.
+	Note string `json:",omitempty"`
+
+	// Invert holds whether the relay's output on the relay
+	// controller is the inverse of its state, for example
+	// because the relay is wired normally-closed.
+	// The relay state itself is unaffected.
+	Invert bool `json:",omitempty"`
+
+	// Position, if non-nil, holds the physical position
+	// of the relay. This is for informational purposes only.
+	Position *RelayPosition `json:",omitempty"`
+
+	// ShedGroup, if non-empty, names a group of relays
+	// that must all be turned off together when
+	// shedding load. See Assess for details.
+	ShedGroup string
+
+	// Phase holds the supply phase (1, 2 or 3) that the
+	// relay's load is connected to, or zero if it's unknown.
+	// Other values are treated as unknown.
+	// See Assess for details.
+	Phase int
+}
+
+// RelayPosition holds the physical position of a relay,
+// numbered as labelled on the hardware. This is independent
+// of the relay number used by the control system.
+type RelayPosition struct {
+	// Board holds the number of the relay board.
+	Board int
+	// Terminal holds the number of the terminal on the board.
+	Terminal int
+}
+
+func (p RelayPosition) String() string {
+	return fmt.Sprintf("board %d terminal %d", p.Board, p.Terminal)
+}
+
+// InvertedRelays returns the set of relays
+// that have inverted outputs.
+func (c *Config) InvertedRelays() RelayState {
+	var state RelayState
+	for i, r := range c.Relays {
+		if r.Invert && i < MaxRelayCount {
+			state.Set(i, true)
+		}
+	}
+	return state
 }
 
+// MaxPhase holds the highest phase number that
+// can be used in RelayConfig.Phase.
+const MaxPhase = 3
+
 // At returns the slot that is applicable to the given time
 // and the absolute time of the start and end of the slot.
 // If there is no slot for the given time, it returns nil.
@@ -96,6 +177,59 @@ func (c *RelayConfig) At(t time.Time) (slot *Slot, start, end time.Time) {
 	return nil, time.Time{}, time.Time{}
 }
 
+// NextTransition returns the earliest time after t at which
+// one of the relay's slots starts or ends, and the slot
+// that's active from that time, or nil if there is none.
+// If the relay's schedule never changes (for example
+// because it's AlwaysOn), it returns the zero time.
+func (c *RelayConfig) NextTransition(t time.Time) (next time.Time, slot *Slot) {
+	var slots []*Slot
+	switch c.Mode {
+	case InUse:
+		slots = c.InUse
+	case NotInUse:
+		slots = c.NotInUse
+	}
+	for _, slot := range slots {
+		for dayOffset := -1; dayOffset <= 1; dayOffset++ {
+			start, end := slot.bounds(t, dayOffset)
+			for _, b := range []time.Time{start, end} {
+				if b.After(t) && (next.IsZero() || b.Before(next)) {
+					next = b
+				}
+			}
+		}
+	}
+	if next.IsZero() {
+		return time.Time{}, nil
+	}
+	slot, _, _ = c.At(next)
+	return next, slot
+}
+
+// Transition holds a scheduled change to the slot
+// that's active for a relay.
+type Transition struct {
+	// Time holds the time of the change. It's zero
+	// if there is no scheduled change.
+	Time time.Time
+
+	// Slot holds the slot that's active from Time,
+	// or nil if there is none.
+	Slot *Slot
+}
+
+// NextTransitions returns the next scheduled transition
+// after t for each relay, indexed by relay number.
+// It takes no account of power usage or history.
+func (cfg *Config) NextTransitions(t time.Time) []Transition {
+	ts := make([]Transition, len(cfg.Relays))
+	for i := range cfg.Relays {
+		ts[i].Time, ts[i].Slot = cfg.Relays[i].NextTransition(t)
+	}
+	return ts
+}
+
 type RelayMode int
 
 const (
@@ -163,6 +297,16 @@ func (slot *Slot) ActiveAt(t time.Time) (start, end time.Time, ok bool) {
 // activeAt is like ActiveAt except that it only looks at the slot
 // at dayOffset days from the day of t.
 func (slot *Slot) activeAt(t time.Time, dayOffset int) (start, end time.Time, ok bool) {
+	start, end = slot.bounds(t, dayOffset)
+	if !t.Before(start) && t.Before(end) {
+		return start, end, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// bounds returns the start and end times of the slot
+// that starts dayOffset days from the day of t.
+func (slot *Slot) bounds(t time.Time, dayOffset int) (start, end time.Time) {
 	start = dayStartWithOffset(t, dayOffset, slot.Start)
 	if slot.End.After(slot.Start) {
 		end = dayStartWithOffset(t, dayOffset, slot.End)
@@ -171,10 +315,7 @@ func (slot *Slot) activeAt(t time.Time, dayOffset int) (start, end time.Time, ok
 		// following day.
 		end = dayStartWithOffset(t, dayOffset+1, slot.End)
 	}
-	if !t.Before(start) && t.Before(end) {
-		return start, end, true
-	}
-	return time.Time{}, time.Time{}, false
+	return start, end
 }
 
 // dayStartWithOffset returns the time of day at the fromMidnight from the start of
@@ -204,6 +345,14 @@ func (slot0 *Slot) Overlaps(slot1 *Slot) bool {
 	return slot0.Start.d < slot1.endOffset() && slot1.Start.d < slot0.endOffset()
 }
 
+// Length returns the notional length of the slot. Like Overlaps,
+// it doesn't take daylight savings time changes into account.
+// A slot that ends at the same time of day as it starts
+// lasts for 24 hours.
+func (slot *Slot) Length() time.Duration {
+	return slot.endOffset() - slot.Start.d
+}
+
 // endOffset returns the notional time offset of the end of the slot
 // from the start of the day containing the start of the slot.
 // It's only good for estimation and will change when time
@@ -302,6 +451,7 @@ func (a *assessor) canSetRelay(r *assessedRelay, on bool, now time.Time) bool {
 		return true
 	}
 	a.logf("too soon to set relay %v (latestState %v; delta %v)", r.relay, r.latestState, r.latestStateDuration)
+	a.block(r.relay, BlockTooSoon)
 	return false
 }
 
@@ -315,6 +465,17 @@ type assessor struct {
 	minimumChangeDuration time.Duration
 	cycleDuration         time.Duration
 	meterReactionDuration time.Duration
+
+	// The following fields are used by Explain.
+
+	// relays holds the assessment of each relay.
+	relays []assessedRelay
+	// canTurnOn holds whether it's long enough since
+	// any relay was turned on to turn on another one.
+	canTurnOn bool
+	// blockers holds the first recorded reason that
+	// each relay couldn't be put into its desired state.
+	blockers [MaxRelayCount]Blocker
 }
 
 func (a *assessor) logf(f string, args ...interface{}) {
@@ -332,6 +493,24 @@ type AssessParams struct {
 	PowerUseSample PowerUseSample
 	Logger         Logger
 	Now            time.Time
+
+	// MetersFailedSince holds the time from which it has
+	// not been possible to read the meters. It's zero
+	// if the meters are currently readable.
+	MetersFailedSince time.Time
+
+	// Forecast, if non-nil, holds a forecast of generated
+	// power that's used to decide whether a relay that must
+	// be on for some minimum time should wait for generated
+	// power to become available or be turned on now.
+	Forecast GenerationForecast
+}
+
+// GenerationForecast represents a forecast of generated power.
+type GenerationForecast interface {
+	// Generation returns the average power in watts that's
+	// expected to be generated between t0 and t1.
+	Generation(t0, t1 time.Time) float64
 }
 
 // PowerUseSample holds a power use calculation that uses
@@ -349,13 +528,40 @@ type PowerUseSample struct {
 // It ensures that no more than one relay is turned on within MinimumChangeDuration
 // to prevent power surges, and similarly that if a relay was turned on or off recently, we
 // don't change its state too soon.
+//
+// When turning relays off to regain power, relays that share a
+// ShedGroup are treated as one: they're all turned off together
+// when the lowest priority of them would be, and only if
+// all of them can be turned off.
+//
+// When choosing between relays that are otherwise equally
+// deserving of power, relays on the phase with the least load
+// are preferred, to help keep the supply balanced. The load on
+// a phase is taken to be the power used here on that phase
+// as measured by the meters, less the relay's own MaxPower if it's
+// on. When the meters don't report per-phase power, the load is
+// estimated as the total MaxPower of the other relays on that
+// phase that are currently on.
+//
+// If there's a generation forecast, a relay in an AtLeast or
+// Exactly slot that still needs more time is turned on
+// regardless of available power when the generation forecast for
+// the rest of the slot isn't enough to supply the relay's
+// MaxPower for that time, because waiting won't help.
 func Assess(p AssessParams) RelayState {
-	a := &assessor{
+	return newAssessor(p).assess()
+}
+
+func newAssessor(p AssessParams) *assessor {
+	return &assessor{
 		AssessParams:          p,
 		cycleDuration:         durationWithDefault(p.Config.CycleDuration, DefaultCycleDuration),
 		minimumChangeDuration: durationWithDefault(p.Config.MinimumChangeDuration, DefaultMinimumChangeDuration),
 		meterReactionDuration: durationWithDefault(p.Config.MeterReactionDuration, DefaultMeterReactionDuration),
 	}
+}
+
+func (a *assessor) assess() RelayState {
 	newState := a.CurrentState
 	// assessed will hold all the relays that want discretionary power.
 	assessed := make([]assessedRelay, 0, len(a.Config.Relays))
@@ -371,13 +577,19 @@ func Assess(p AssessParams) RelayState {
 	added := -1 // Number of first relay with absolute priority to be turned on.
 	for i, rc := range a.Config.Relays {
 		ar := a.assessRelay(i, &rc)
+		a.relays = append(a.relays, ar)
 		if ar.pri == priAbsolute {
 			a.logf("relay %d has absolute priority %v (current state %v)", i, ar.pri, a.CurrentState.IsSet(i))
 			if ar.desiredState {
-				if !a.CurrentState.IsSet(i) && added == -1 {
-					// The relay is not already on and we haven't found
-					// any other relay being turned on.
-					added = i
+				if !a.CurrentState.IsSet(i) {
+					if added == -1 {
+						// The relay is not already on and we haven't found
+						// any other relay being turned on.
+						added = i
+					} else {
+						// Only one relay is turned on at a time.
+						a.block(i, BlockTurnOnDelay)
+					}
 				}
 			} else if a.canSetRelay(&ar, false, a.Now) {
 				newState.Set(i, false)
@@ -397,13 +609,14 @@ func Assess(p AssessParams) RelayState {
 		assessed = append(assessed, ar)
 	}
 
-	latestChangeTime, latestOnTime := allRelaysLatestChange(a.History, len(a.Config.Relays))
+	latestChangeTime, latestOnTime, latestOnRelay := allRelaysLatestChange(a.History, len(a.Config.Relays))
 
 	// canTurnOn holds whether we're allowed to turn on any
 	// relay because the last time we turned on any relay
 	// was long enough ago. We always allow turning relays
 	// off, but we turn them on slowly.
-	canTurnOn := !a.Now.Before(latestOnTime.Add(a.minimumChangeDuration))
+	canTurnOn := !a.Now.Before(latestOnTime.Add(a.turnOnDelay(latestOnRelay)))
+	a.canTurnOn = canTurnOn
 
 	if added != -1 && canTurnOn {
 		// Absolute priority requirements have resulted in
@@ -417,42 +630,81 @@ func Assess(p AssessParams) RelayState {
 			if a.canSetRelay(&ar, false, a.Now) {
 				newState.Set(ar.relay, false)
 			}
+			a.block(ar.relay, BlockAbsolutePriority)
 		}
 		newState.Set(added, true)
 		return newState
 	}
 
+	phaseLoad := a.phaseLoad()
+	for i := range assessed {
+		ar := &assessed[i]
+		ar.onDuration = a.History.OnDuration(i, earliestStart, a.Now)
+		if ar.phase != 0 {
+			ar.phaseLoad = phaseLoad[ar.phase]
+			if a.CurrentState.IsSet(ar.relay) {
+				// Don't count the relay's own load.
+				ar.phaseLoad -= a.Config.Relays[ar.relay].MaxPower
+			}
+		}
+	}
+	sort.Sort(assessedByPriority(assessed))
+	for i, ar := range assessed {
+		a.logf("sort %d: relay %d; pri %v; on %v", i, ar.relay, ar.pri, ar.onDuration)
+	}
+	if max := a.Config.MaxConcurrentRelays; max > 0 && countOn(newState, assessed) > max {
+		// There are too many relays on (perhaps the configuration
+		// has changed), so turn off enough of the lowest priority
+		// ones to bring us within the limit. This doesn't depend
+		// on the meter readings, so do it regardless of them.
+		a.logf("more than %d discretionary relays on", max)
+		a.limitRelays(&newState, assessed, max, false)
+		a.blockAll(assessed, BlockMaxConcurrent)
+		return newState
+	}
+
 	// From here on, we'll be using the meter readings to determine
 	// our action. If the meter readings aren't up to date, then don't
 	// do anything more, because we don't want to make decisions
 	// based on data that doesn't correspond to the current relay state.
 	a.logf("meter readings at %v; latest change time %v", a.PowerUseSample.T0, latestChangeTime)
 
+	if d := a.Config.MeterFailSafeDuration; d > 0 && !a.MetersFailedSince.IsZero() && !a.Now.Before(a.MetersFailedSince.Add(d)) {
+		// We haven't been able to read the meters for a long time,
+		// so we've no idea whether we're importing. Err on the
+		// side of caution and turn off all discretionary power.
+		a.logf("no meter readings since %v; turning off discretionary power", a.MetersFailedSince)
+		for _, ar := range assessed {
+			if newState.IsSet(ar.relay) && a.canSetRelay(&ar, false, a.Now) {
+				newState.Set(ar.relay, false)
+			}
+		}
+		a.blockAll(assessed, BlockMetersFailed)
+		return newState
+	}
+
 	if a.PowerUseSample.T0.IsZero() {
 		a.logf("invalid meter time (zero time)")
+		a.blockAll(assessed, BlockMeterReadings)
 		return newState
 	}
 
 	if a.PowerUseSample.T0.Before(latestChangeTime) {
 		a.logf("meter readings out of date, leaving discretionary power unchanged; reading at %s, not after %s", a.PowerUseSample.T0, latestChangeTime)
+		a.blockAll(assessed, BlockMeterReadings)
 		return newState
 	}
 	settledTime := latestChangeTime.Add(a.meterReactionDuration)
 	if a.PowerUseSample.T0.Before(settledTime) {
 		a.logf("meter readings not settled yet (settled in %v, reading %v ago)", settledTime.Sub(a.Now), a.Now.Sub(a.PowerUseSample.T0))
+		a.blockAll(assessed, BlockMeterReadings)
 		return newState
 	}
-	for i := range assessed {
-		assessed[i].onDuration = a.History.OnDuration(i, earliestStart, a.Now)
-	}
-	sort.Sort(assessedByPriority(assessed))
-	for i, ar := range assessed {
-		a.logf("sort %d: relay %d; pri %v; on %v", i, ar.relay, ar.pri, ar.onDuration)
-	}
 	pc := ChargeablePower(a.PowerUseSample.PowerUse)
 	a.logf("meter import %v", pc.ImportHere)
-	if pc.ImportHere > 0 {
-		// We're importing electricity. This must stop forthwith.
+	if excess := pc.ImportHere - a.Config.ImportAllowance; excess > 0 {
+		// We're importing more electricity than we're allowed to.
+		// This must stop forthwith.
 		// How do we decide how many meters to turn off?
 		// If we turn off all discretionary relays then we can get
 		// into a nasty cycle:
@@ -472,10 +724,12 @@ func Assess(p AssessParams) RelayState {
 		// So we switch off just enough relays that we hope we'll stop importing.
 		// TODO better algorithm for deciding which order to choose relays
 		// to switch off.
-		a.regainPower(&newState, assessed, pc.ImportHere, false)
+		a.regainPower(&newState, assessed, excess, false)
+		a.blockAll(assessed, BlockPower)
 		return newState
 	}
 	if !canTurnOn {
+		a.blockAll(assessed, BlockTurnOnDelay)
 		return newState
 	}
 	a.logf("we may be able to turn on something")
@@ -489,23 +743,40 @@ func Assess(p AssessParams) RelayState {
 			alreadyOn = true
 			continue
 		}
-		if imp := a.possibleImport(ar.relay); imp > 0 {
-			if !alreadyOn && a.regainPower(&newState, assessed, imp, true) {
+		if max := a.Config.MaxConcurrentRelays; max > 0 && countOn(newState, assessed) >= max {
+			if !alreadyOn && a.limitRelays(&newState, assessed, max-1, true) {
+				// There's no higher priority relay that's already on,
+				// so we've turned off a lower priority relay to make
+				// room for this one the next time we assess the situation.
+				a.logf("made room to turn on %d", ar.relay)
+				a.block(ar.relay, BlockMaxConcurrent)
+				break
+			}
+			a.logf("would like to turn on %d but %d discretionary relays are already on", ar.relay, max)
+			a.block(ar.relay, BlockMaxConcurrent)
+			continue
+		}
+		if excess := a.possibleImport(ar.relay) - a.Config.ImportAllowance; excess > 0 {
+			if !alreadyOn && a.regainPower(&newState, assessed, excess, true) {
 				// There's no higher priority relay that's already on and
 				// we've turned off some relays, so hopefully we that will
 				// give us enough power back that the next time we
 				// assess the situation we'll be able to turn on the
 				// current relay.
 				a.logf("regained power in order to turn on %d", ar.relay)
+				a.block(ar.relay, BlockPower)
 				break
 			}
 			a.logf("would like to turn on %d but not enough available power", ar.relay)
+			a.block(ar.relay, BlockPower)
 			continue
 		}
 		if a.canSetRelay(ar, true, a.Now) {
 			// Turn on just the one relay.
 			a.logf("turning on %d", ar.relay)
 			newState.Set(ar.relay, true)
+			// Only one relay is turned on at a time.
+			a.blockAll(assessed[:i], BlockTurnOnDelay)
 			break
 		}
 		a.logf("would like to turn on %d but can't", ar.relay)
@@ -525,45 +796,127 @@ func (a *assessor) regainPower(state *RelayState, assessed []assessedRelay, rega
 		if regain <= 0 {
 			break
 		}
-		if !a.CurrentState.IsSet(ar.relay) {
+		if !newState.IsSet(ar.relay) {
 			// Relay is already off - we won't change anything if we switch it off.
 			continue
 		}
+		group := []assessedRelay{ar}
+		if ar.shedGroup != "" {
+			group = shedGroup(newState, assessed, ar.shedGroup)
+		}
+		canSet := true
+		for i := range group {
+			if !a.canSetRelay(&group[i], false, a.Now) {
+				canSet = false
+			}
+		}
+		if !canSet {
+			a.logf("would like to turn off %d but can't", ar.relay)
+			continue
+		}
+		for _, gr := range group {
+			a.logf("regaining by turning off %v", gr.relay)
+			newState.Set(gr.relay, false)
+			a.block(gr.relay, BlockPower)
+			regain -= float64(a.Config.Relays[gr.relay].MaxPower)
+		}
+	}
+	if regain <= 0 || !must {
+		*state = newState
+		return true
+	}
+	return false
+}
+
+// shedGroup returns all the assessed relays in the given
+// shed group that are on in the given state.
+func shedGroup(state RelayState, assessed []assessedRelay, group string) []assessedRelay {
+	var relays []assessedRelay
+	for _, ar := range assessed {
+		if ar.shedGroup == group && state.IsSet(ar.relay) {
+			relays = append(relays, ar)
+		}
+	}
+	return relays
+}
+
+// limitRelays tries to turn off enough of the assessed relays that
+// no more than max of them are on. If must is true, no change will be
+// made if it's not possible to turn off enough relays.
+// It reports whether the goal was achieved.
+func (a *assessor) limitRelays(state *RelayState, assessed []assessedRelay, max int, must bool) bool {
+	newState := *state
+	excess := countOn(newState, assessed) - max
+	// Note: we traverse from least priority to highest priority.
+	for _, ar := range assessed {
+		if excess <= 0 {
+			break
+		}
+		if !newState.IsSet(ar.relay) {
+			continue
+		}
 		if !a.canSetRelay(&ar, false, a.Now) {
 			a.logf("would like to turn off %d but can't", ar.relay)
 			continue
 		}
-		a.logf("regaining by turning off %v", ar.relay)
+		a.logf("limiting concurrent relays by turning off %v", ar.relay)
 		newState.Set(ar.relay, false)
-		regain -= float64(a.Config.Relays[ar.relay].MaxPower)
+		a.block(ar.relay, BlockMaxConcurrent)
+		excess--
 	}
-	if regain <= 0 || !must {
+	if excess <= 0 || !must {
 		*state = newState
 		return true
 	}
 	return false
 }
 
+// countOn returns the number of the assessed relays that
+// are on in the given state.
+func countOn(state RelayState, assessed []assessedRelay) int {
+	n := 0
+	for _, ar := range assessed {
+		if state.IsSet(ar.relay) {
+			n++
+		}
+	}
+	return n
+}
+
+// turnOnDelay returns the minimum length of time to wait after
+// turning on the given relay before turning on any other relay.
+// If relay is -1, no relay has been turned on.
+func (a *assessor) turnOnDelay(relay int) time.Duration {
+	d := a.minimumChangeDuration
+	if relay >= 0 && a.Config.ChangeDurationPerKW > 0 {
+		d += time.Duration(float64(a.Config.ChangeDurationPerKW) * float64(a.Config.Relays[relay].MaxPower) / 1000)
+	}
+	return d
+}
+
 // allRelaysLatestOnTime returns the latest time
 // that any of the relays in [0, n) was changed
-// and the latest time that any of them was switched on.
+// and the latest time that any of them was switched on,
+// and the relay that was switched on at that time.
 // If none of them have changed, anyTime will hold the
 // zero time; if none of them are on it onTime will hold
-// the zero time.
+// the zero time and onRelay will be -1.
 // TODO investigate the possibility that this could
 // be more efficiently implemented if defined on
 // History interface.
-func allRelaysLatestChange(h History, n int) (anyTime, onTime time.Time) {
+func allRelaysLatestChange(h History, n int) (anyTime, onTime time.Time, onRelay int) {
+	onRelay = -1
 	for i := 0; i < n; i++ {
 		on, t := h.LatestChange(i)
 		if on && t.After(onTime) {
 			onTime = t
+			onRelay = i
 		}
 		if t.After(anyTime) {
 			anyTime = t
 		}
 	}
-	return anyTime, onTime
+	return anyTime, onTime, onRelay
 }
 
 // assessedRelay holds information about a relay that's being assessed.
@@ -595,6 +948,17 @@ type assessedRelay struct {
 
 	// cycleDuration holds the cycle duration for this relay.
 	cycleDuration time.Duration
+
+	// shedGroup holds the relay's shed group (see RelayConfig.ShedGroup).
+	shedGroup string
+
+	// phase holds the relay's phase (see RelayConfig.Phase).
+	phase int
+
+	// phaseLoad holds the power used by the other relays
+	// that are currently on in the same phase. This field
+	// is not set by assessRelay.
+	phaseLoad int
 }
 
 // assessedByPriority defines an ordering for relays
@@ -629,6 +993,10 @@ func (ap assessedByPriority) Less(i, j int) bool {
 		// Less time on wins
 		return a0.onDuration > a1.onDuration
 	}
+	if a0.phase != 0 && a1.phase != 0 && a0.phaseLoad != a1.phaseLoad {
+		// Less loaded phase wins.
+		return a0.phaseLoad > a1.phaseLoad
+	}
 	// Break ties with relay number - lower relay numbers
 	// have higher priority.
 	return a0.relay > a1.relay
@@ -650,6 +1018,40 @@ func (a *assessor) possibleImport(relay int) float64 {
 	return ChargeablePower(pu).ImportHere
 }
 
+// forecastSufficient reports whether enough power is forecast
+// to be generated between now and the given end time to run
+// the relay with the given configuration for the given duration.
+// If there's no forecast, or the relay's maximum power is
+// unknown, it returns true.
+func (a *assessor) forecastSufficient(rc *RelayConfig, end time.Time, need time.Duration) bool {
+	if a.Forecast == nil || rc.MaxPower == 0 {
+		return true
+	}
+	available := a.Forecast.Generation(a.Now, end) * end.Sub(a.Now).Hours()
+	required := float64(rc.MaxPower) * need.Hours()
+	a.logf("forecast generation %.0fWh; required %.0fWh", available, required)
+	return available >= required
+}
+
+// phaseLoad returns the power used here on each phase, indexed by
+// phase. If the meters don't report per-phase power, it returns the
+// total maximum power of the relays that are currently on instead.
+func (a *assessor) phaseLoad() [MaxPhase + 1]int {
+	var load [MaxPhase + 1]int
+	if phases := a.PowerUseSample.Phases; phases != ([MaxPhase]PhasePowerUse{}) {
+		for i, pu := range phases {
+			load[i+1] = int(pu.Here)
+		}
+		return load
+	}
+	for i, rc := range a.Config.Relays {
+		if rc.Phase > 0 && rc.Phase <= MaxPhase && a.CurrentState.IsSet(i) {
+			load[rc.Phase] += rc.MaxPower
+		}
+	}
+	return load
+}
+
 // assessRelay assesses the desired status of the given relay with
 // respect to its configuration and history at the given time. It
 // returns a summary of the relay's assessed state.
@@ -664,6 +1066,10 @@ func (a *assessor) assessRelay(relay int, rc *RelayConfig) assessedRelay {
 		latestStateDuration: 24 * time.Hour,
 		// TODO allow relay-specific cycle durations?
 		cycleDuration: a.cycleDuration,
+		shedGroup:     rc.ShedGroup,
+	}
+	if rc.Phase > 0 && rc.Phase <= MaxPhase {
+		ar.phase = rc.Phase
 	}
 	if !latestChangeTime.IsZero() {
 		if d := a.Now.Sub(latestChangeTime); d < 24*time.Hour {
@@ -707,6 +1113,10 @@ func (a *assessor) assessRelay0(relay int, rc *RelayConfig) (on bool, pri priori
 		a.logf("already had the time")
 		// Already had the time we require.
 		return false, priAbsolute
+	case (slot.Kind == Exactly || slot.Kind == AtLeast) && !a.forecastSufficient(rc, end, slot.Duration-dur):
+		a.logf("not enough generation forecast before the slot ends")
+		// There's no point in waiting for power, so use the time now.
+		return true, priAbsolute
 	case slot.Kind == Exactly || slot.Kind == AtLeast:
 		a.logf("want more discretionary time")
 		return true, priHigh
@@ -1,12 +1,14 @@
 package hydroctl_test
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 
 	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/history/historytest"
 	"github.com/rogpeppe/hydro/hydroctl"
 )
 
@@ -76,6 +78,39 @@ var assessTests = []struct {
 		now:         T(1),
 		expectState: mkRelays(0, 5),
 	}},
+}, {
+	testName: "a-large-load-delays-the-next-turn-on-more-than-a-small-one",
+	cfg: hydroctl.Config{
+		ChangeDurationPerKW: 2 * time.Second,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 5000,
+			},
+			1: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 200,
+			},
+			2: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+	},
+	currentState: mkRelays(),
+	assessNowTests: []assessNowTest{{
+		now:         T(0),
+		expectState: mkRelays(0),
+	}, {
+		// The 5kW load needs an extra 10s to settle.
+		now:         T(0).Add(hydroctl.DefaultMinimumChangeDuration + 10*time.Second),
+		expectState: mkRelays(0, 1),
+		transition:  true,
+	}, {
+		// The 200W load only needs an extra 400ms.
+		now:         T(0).Add(2*hydroctl.DefaultMinimumChangeDuration + 10*time.Second + 400*time.Millisecond),
+		expectState: mkRelays(0, 1, 2),
+		transition:  true,
+	}},
 }, {
 	testName: "everything-on,-one-relay-that's-always-off",
 	cfg: hydroctl.Config{
@@ -934,6 +969,604 @@ var assessTests = []struct {
 		transition:  true,
 		expectState: mkRelays(),
 	}},
+}, {
+	testName: "With-a-limit-of-two-concurrent-relays,-a-third-eligible-relay-stays-off-until-one-cycles-off",
+	cfg: hydroctl.Config{
+		MaxConcurrentRelays: 2,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+		},
+	},
+	assessNowTests: []assessNowTest{{
+		now:         T(10),
+		expectState: mkRelays(0),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+			},
+		},
+		transition: true,
+	}, {
+		now:         T(10).Add(hydroctl.DefaultMeterReactionDuration),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      100,
+			},
+		},
+		transition: true,
+	}, {
+		// There's plenty of power available, but
+		// the third relay can't come on because two
+		// are already on.
+		now:         T(10).Add(2 * hydroctl.DefaultMeterReactionDuration),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      200,
+			},
+		},
+	}, {
+		// When both relays have been on for a whole cycle, the one
+		// that's been on longest is turned off to make room for the
+		// third one.
+		now:         T(10).Add(hydroctl.DefaultCycleDuration + hydroctl.DefaultMeterReactionDuration),
+		expectState: mkRelays(1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      200,
+			},
+		},
+		transition: true,
+	}, {
+		now:         T(10).Add(hydroctl.DefaultCycleDuration + 2*hydroctl.DefaultMeterReactionDuration),
+		expectState: mkRelays(1, 2),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      100,
+			},
+		},
+		transition: true,
+	}},
+}, {
+	testName: "With-a-limit-of-two-concurrent-relays,-the-lowest-priority-relay-is-shed-when-three-are-on",
+	cfg: hydroctl.Config{
+		MaxConcurrentRelays: 2,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 100,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("10:00"),
+					End:      TD("11:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 30 * time.Minute,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0, 1, 2),
+	assessNowTests: []assessNowTest{{
+		now:         T(10),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      300,
+			},
+		},
+	}},
+}, {
+	testName: "relays-in-a-shed-group-are-turned-off-together",
+	cfg: hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			1: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			3: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0, 1, 2, 3),
+	assessNowTests: []assessNowTest{{
+		// Relay 3 has the lowest priority, so its whole
+		// group is turned off even though turning off relay 3
+		// alone would regain enough power.
+		now:         T(10),
+		expectState: mkRelays(0),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 3500,
+				Here:      4000,
+			},
+		},
+	}},
+}, {
+	testName: "a-shed-group-is-not-turned-off-if-any-of-its-relays-changed-recently",
+	cfg: hydroctl.Config{
+		MinimumChangeDuration: time.Minute,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			1: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			3: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "three-phase",
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("12:00"),
+					Kind:     hydroctl.AtMost,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	previousUpdates: []stateUpdate{{
+		t:     T(9),
+		state: mkRelays(0, 1, 3),
+	}, {
+		t:     T(10).Add(-30 * time.Second),
+		state: mkRelays(0, 1, 2, 3),
+	}},
+	currentState: mkRelays(0, 1, 2, 3),
+	assessNowTests: []assessNowTest{{
+		now:         T(10),
+		expectState: mkRelays(1, 2, 3),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 3500,
+				Here:      4000,
+			},
+		},
+	}},
+}, {
+	testName: "relay-on-least-loaded-phase-is-turned-on-first",
+	cfg: hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 3000,
+				Phase:    1,
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    1,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    2,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0),
+	assessNowTests: []assessNowTest{{
+		// Relay 1 would normally win on relay number, but
+		// relay 0 is loading its phase, so relay 2 goes first.
+		now:         T(10),
+		expectState: mkRelays(0, 2),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      3000,
+			},
+		},
+	}},
+}, {
+	testName: "measured-phase-power-is-used-when-available",
+	cfg: hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 3000,
+				Phase:    1,
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    1,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    2,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0),
+	assessNowTests: []assessNowTest{{
+		// Relay 0 is drawing little power, but there's
+		// an unmanaged load on phase 2, so relay 1 goes first.
+		now:         T(10),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      4500,
+				Phases: [hydroctl.MaxPhase]hydroctl.PhasePowerUse{
+					{Here: 500},
+					{Here: 4000},
+				},
+			},
+		},
+	}},
+}, {
+	testName: "relays-on-equally-loaded-phases-are-chosen-by-relay-number",
+	cfg: hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 3000,
+				Phase:    3,
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    1,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    2,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0),
+	assessNowTests: []assessNowTest{{
+		// Relay 0 is loading a phase that neither candidate
+		// uses, so the lower relay number goes first.
+		now:         T(10),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      3000,
+			},
+		},
+	}},
+}, {
+	testName: "relays-with-unknown-phase-are-chosen-by-relay-number",
+	cfg: hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 3000,
+				Phase:    1,
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    0,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			2: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				Phase:    2,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0),
+	assessNowTests: []assessNowTest{{
+		// Relay 1's phase is unknown, so phase load
+		// isn't considered.
+		now:         T(10),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10000,
+				Here:      3000,
+			},
+		},
+	}},
+}, {
+	testName: "import-within-the-allowance-does-not-turn-relays-off",
+	cfg: hydroctl.Config{
+		ImportAllowance: 200,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0, 1),
+	assessNowTests: []assessNowTest{{
+		// We're importing 150W, which is within the allowance.
+		now:         T(10),
+		expectState: mkRelays(0, 1),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 1000,
+				Here:      1150,
+			},
+		},
+	}},
+}, {
+	testName: "import-beyond-the-allowance-turns-relays-off",
+	cfg: hydroctl.Config{
+		ImportAllowance: 200,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+			1: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(0, 1),
+	assessNowTests: []assessNowTest{{
+		// We're importing 300W, which is 100W more than the
+		// allowance, so the lowest priority relay is turned off.
+		now:         T(10),
+		expectState: mkRelays(0),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 1000,
+				Here:      1300,
+			},
+		},
+	}},
+}, {
+	testName: "relay-is-turned-on-if-import-would-stay-within-the-allowance",
+	cfg: hydroctl.Config{
+		ImportAllowance: 200,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(),
+	assessNowTests: []assessNowTest{{
+		// Turning on the relay would import 150W, which
+		// is within the allowance.
+		now:         T(10),
+		expectState: mkRelays(0),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 2000,
+				Here:      1150,
+			},
+		},
+	}},
+}, {
+	testName: "relay-is-not-turned-on-if-import-would-exceed-the-allowance",
+	cfg: hydroctl.Config{
+		ImportAllowance: 200,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse: []*hydroctl.Slot{{
+					Start:    TD("09:00"),
+					End:      TD("16:00"),
+					Kind:     hydroctl.AtLeast,
+					Duration: 2 * time.Hour,
+				}},
+			},
+		},
+	},
+	currentState: mkRelays(),
+	assessNowTests: []assessNowTest{{
+		// Turning on the relay would import 300W, which
+		// is more than the allowance.
+		now:         T(10),
+		expectState: mkRelays(),
+		powerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 2000,
+				Here:      1300,
+			},
+		},
+	}},
 }}
 
 func TestAssess(t *testing.T) {
@@ -993,6 +1626,141 @@ func TestAssess(t *testing.T) {
 	}
 }
 
+func TestAssessWithBuiltHistory(t *testing.T) {
+	c := qt.New(t)
+	slot := &hydroctl.Slot{
+		Start:    TD("09:00"),
+		End:      TD("12:00"),
+		Kind:     hydroctl.AtMost,
+		Duration: 2 * time.Hour,
+	}
+	cfg := hydroctl.Config{
+		MinimumChangeDuration: time.Minute,
+		Relays: []hydroctl.RelayConfig{
+			0: {
+				Mode:     hydroctl.InUse,
+				MaxPower: 1000,
+				InUse:    []*hydroctl.Slot{slot},
+			},
+			1: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "group",
+				InUse:     []*hydroctl.Slot{slot},
+			},
+			2: {
+				Mode:      hydroctl.InUse,
+				MaxPower:  1000,
+				ShedGroup: "group",
+				InUse:     []*hydroctl.Slot{slot},
+			},
+		},
+	}
+	// Relay 1 has the lowest priority, but relay 2 in the same
+	// shed group was turned on too recently to be turned off,
+	// so relay 0 is turned off instead.
+	b := historytest.New().
+		At(T(9)).On(0, 1).
+		At(T(10).Add(-30 * time.Second)).On(2)
+	state := hydroctl.Assess(hydroctl.AssessParams{
+		Config:       &cfg,
+		CurrentState: b.CurrentState(),
+		History:      b.DB(),
+		PowerUseSample: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 2500,
+				Here:      3000,
+			},
+			T0: T(10),
+			T1: T(10),
+		},
+		Logger: clogger{c},
+		Now:    T(10),
+	})
+	c.Assert(state, qt.Equals, mkRelays(1, 2))
+}
+
+var assessWithForecastTests = []struct {
+	testName    string
+	forecast    hydroctl.GenerationForecast
+	powerUse    hydroctl.PowerUse
+	expectState hydroctl.RelayState
+}{{
+	testName: "no-forecast",
+	powerUse: hydroctl.PowerUse{
+		Here: 500,
+	},
+	expectState: mkRelays(),
+}, {
+	// 3kW is forecast for the remaining 7 hours of the slot,
+	// which is plenty to run the relay for 2 hours, so
+	// it waits for the generated power.
+	testName: "high-forecast-defers",
+	forecast: constForecast(3000),
+	powerUse: hydroctl.PowerUse{
+		Here: 500,
+	},
+	expectState: mkRelays(),
+}, {
+	// Only 700Wh is forecast, which isn't enough to run the
+	// relay for 2 hours, so it's run now.
+	testName: "low-forecast-runs-now",
+	forecast: constForecast(100),
+	powerUse: hydroctl.PowerUse{
+		Here: 500,
+	},
+	expectState: mkRelays(0),
+}, {
+	testName: "high-forecast-with-available-power",
+	forecast: constForecast(3000),
+	powerUse: hydroctl.PowerUse{
+		Generated: 3000,
+		Here:      500,
+	},
+	expectState: mkRelays(0),
+}}
+
+func TestAssessWithForecast(t *testing.T) {
+	c := qt.New(t)
+	cfg := hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.InUse,
+			MaxPower: 1000,
+			InUse: []*hydroctl.Slot{{
+				Start:    TD("09:00"),
+				End:      TD("17:00"),
+				Kind:     hydroctl.AtLeast,
+				Duration: 2 * time.Hour,
+			}},
+		}},
+	}
+	for _, test := range assessWithForecastTests {
+		c.Run(test.testName, func(c *qt.C) {
+			state := hydroctl.Assess(hydroctl.AssessParams{
+				Config:  &cfg,
+				History: historytest.New().DB(),
+				PowerUseSample: hydroctl.PowerUseSample{
+					PowerUse: test.powerUse,
+					T0:       T(10),
+					T1:       T(10),
+				},
+				Logger:   clogger{c},
+				Now:      T(10),
+				Forecast: test.forecast,
+			})
+			c.Assert(state, qt.Equals, test.expectState)
+		})
+	}
+}
+
+// constForecast implements hydroctl.GenerationForecast
+// by forecasting constant generation.
+type constForecast float64
+
+func (f constForecast) Generation(t0, t1 time.Time) float64 {
+	return float64(f)
+}
+
 var slotOverlapTests = []struct {
 	testName     string
 	slot1, slot2 hydroctl.Slot
@@ -1059,6 +1827,196 @@ func TestSlotOverlap(t *testing.T) {
 	}
 }
 
+var slotLengthTests = []struct {
+	testName string
+	slot     hydroctl.Slot
+	expect   time.Duration
+}{{
+	testName: "within-a-day",
+	slot: hydroctl.Slot{
+		Start: TD("01:00"),
+		End:   TD("02:30"),
+	},
+	expect: 90 * time.Minute,
+}, {
+	testName: "over-midnight",
+	slot: hydroctl.Slot{
+		Start: TD("23:00"),
+		End:   TD("01:00"),
+	},
+	expect: 2 * time.Hour,
+}, {
+	testName: "all-day",
+	expect:   24 * time.Hour,
+}}
+
+func TestSlotLength(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range slotLengthTests {
+		c.Run(test.testName, func(c *qt.C) {
+			c.Assert(test.slot.Length(), qt.Equals, test.expect)
+		})
+	}
+}
+
+var nextTransitionTests = []struct {
+	testName   string
+	cfg        hydroctl.RelayConfig
+	t          time.Time
+	expectTime time.Time
+	// expectSlot holds the index of the expected slot
+	// in cfg.InUse, or -1 if no slot is expected.
+	expectSlot int
+}{{
+	testName: "before-an-in-use-slot",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.InUse,
+		InUse: []*hydroctl.Slot{{
+			Start:    TD("10:00"),
+			End:      TD("14:00"),
+			Kind:     hydroctl.AtLeast,
+			Duration: time.Hour,
+		}},
+	},
+	t:          T(8),
+	expectTime: T(10),
+	expectSlot: 0,
+}, {
+	testName: "within-an-in-use-slot",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.InUse,
+		InUse: []*hydroctl.Slot{{
+			Start:    TD("10:00"),
+			End:      TD("14:00"),
+			Kind:     hydroctl.AtLeast,
+			Duration: time.Hour,
+		}},
+	},
+	t:          T(10),
+	expectTime: T(14),
+	expectSlot: -1,
+}, {
+	testName: "after-an-in-use-slot",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.InUse,
+		InUse: []*hydroctl.Slot{{
+			Start:    TD("10:00"),
+			End:      TD("14:00"),
+			Kind:     hydroctl.AtLeast,
+			Duration: time.Hour,
+		}},
+	},
+	t:          T(15),
+	expectTime: T(24 + 10),
+	expectSlot: 0,
+}, {
+	testName: "within-a-slot-that-spans-midnight",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.InUse,
+		InUse: []*hydroctl.Slot{{
+			Start:    TD("22:00"),
+			End:      TD("03:00"),
+			Kind:     hydroctl.AtMost,
+			Duration: time.Hour,
+		}},
+	},
+	t:          T(1),
+	expectTime: T(3),
+	expectSlot: -1,
+}, {
+	testName: "adjacent-slots",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.InUse,
+		InUse: []*hydroctl.Slot{{
+			Start:    TD("10:00"),
+			End:      TD("14:00"),
+			Kind:     hydroctl.AtLeast,
+			Duration: time.Hour,
+		}, {
+			Start: TD("14:00"),
+			End:   TD("16:00"),
+			Kind:  hydroctl.Continuous,
+		}},
+	},
+	t:          T(12),
+	expectTime: T(14),
+	expectSlot: 1,
+}, {
+	testName: "always-on",
+	cfg: hydroctl.RelayConfig{
+		Mode: hydroctl.AlwaysOn,
+	},
+	t:          T(12),
+	expectSlot: -1,
+}}
+
+func TestNextTransition(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range nextTransitionTests {
+		c.Run(test.testName, func(c *qt.C) {
+			next, slot := test.cfg.NextTransition(test.t)
+			c.Assert(next.Equal(test.expectTime), qt.Equals, true, qt.Commentf("got %v", next))
+			if test.expectSlot == -1 {
+				c.Assert(slot, qt.IsNil)
+			} else {
+				c.Assert(slot, qt.Equals, test.cfg.InUse[test.expectSlot])
+			}
+		})
+	}
+}
+
+func TestTimeOfDayMarshalText(t *testing.T) {
+	c := qt.New(t)
+	data, err := json.Marshal(hydroctl.Slot{
+		Start: TD("09:30"),
+		End:   TD("17:00"),
+		Kind:  hydroctl.Continuous,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, `{"Start":"09:30","End":"17:00","Kind":4,"Duration":0}`)
+	var slot hydroctl.Slot
+	err = json.Unmarshal(data, &slot)
+	c.Assert(err, qt.IsNil)
+	c.Assert(slot.Start, qt.Equals, TD("09:30"))
+	c.Assert(slot.End, qt.Equals, TD("17:00"))
+
+	err = json.Unmarshal([]byte(`{"Start":"25:00"}`), &slot)
+	c.Assert(err, qt.ErrorMatches, `invalid time of day value "25:00". .*`)
+}
+
+var timeOfDayRoundTripTests = []struct {
+	testName string
+	t        hydroctl.TimeOfDay
+	expect   string
+}{{
+	testName: "minutes",
+	t:        TD("09:30"),
+	expect:   `"09:30"`,
+}, {
+	testName: "seconds",
+	t:        hydroctl.TimeOfDayFromTime(time.Date(2020, 1, 1, 9, 30, 15, 0, time.UTC)),
+	expect:   `"09:30:15"`,
+}, {
+	testName: "midnight",
+	t:        TD("00:00"),
+	expect:   `"00:00"`,
+}}
+
+func TestTimeOfDayMarshalTextRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range timeOfDayRoundTripTests {
+		c.Run(test.testName, func(c *qt.C) {
+			data, err := json.Marshal(test.t)
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(data), qt.Equals, test.expect)
+			var got hydroctl.TimeOfDay
+			err = json.Unmarshal(data, &got)
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.Equals, test.t)
+		})
+	}
+}
+
 type clogger struct {
 	c *qt.C
 }
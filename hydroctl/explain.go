@@ -0,0 +1,108 @@
+package hydroctl
+
+import (
+	"strings"
+)
+
+// Blocker describes why a relay couldn't be put into
+// the state that its configuration asks for.
+type Blocker string
+
+const (
+	// BlockNone means that the relay is in its desired state.
+	BlockNone Blocker = ""
+	// BlockTooSoon means that the relay changed state too
+	// recently to change it again (see Config.MinimumChangeDuration).
+	BlockTooSoon Blocker = "too-soon"
+	// BlockTurnOnDelay means that another relay was turned on
+	// recently and relays are only turned on one at a time.
+	BlockTurnOnDelay Blocker = "turn-on-delay"
+	// BlockAbsolutePriority means that discretionary power
+	// has been turned off because a relay with absolute
+	// priority is being turned on.
+	BlockAbsolutePriority Blocker = "absolute-priority"
+	// BlockPower means that there isn't enough available power.
+	BlockPower Blocker = "power"
+	// BlockMaxConcurrent means that the maximum number of
+	// discretionary relays are already on (see Config.MaxConcurrentRelays).
+	BlockMaxConcurrent Blocker = "max-concurrent"
+	// BlockMeterReadings means that the meter readings are
+	// missing or don't yet reflect the latest relay changes.
+	BlockMeterReadings Blocker = "meter-readings"
+	// BlockMetersFailed means that discretionary power has
+	// been turned off because the meters haven't been readable
+	// for too long (see Config.MeterFailSafeDuration).
+	BlockMetersFailed Blocker = "meters-failed"
+	// BlockPriority means that other relays are
+	// being given priority.
+	BlockPriority Blocker = "priority"
+)
+
+// RelayExplanation explains the assessed state of a relay.
+type RelayExplanation struct {
+	// Relay holds the relay number.
+	Relay int
+	// Want holds the state that the relay's configuration
+	// asks for at the assessment time.
+	Want bool
+	// Priority holds how important it is for the relay
+	// to be in that state: one of "low", "high" or "absolute".
+	Priority string
+	// State holds the assessed state of the relay.
+	State bool
+	// Blocker holds the reason the relay isn't in the
+	// state it wants to be in. It's BlockNone if it is.
+	Blocker Blocker
+}
+
+// Explain is like Assess except that it returns an explanation of
+// the assessed state of each relay in p.Config.Relays.
+func Explain(p AssessParams) []RelayExplanation {
+	_, explanations := AssessExplain(p)
+	return explanations
+}
+
+// AssessExplain is like Assess except that it also returns
+// the explanations that Explain would return.
+func AssessExplain(p AssessParams) (RelayState, []RelayExplanation) {
+	a := newAssessor(p)
+	state := a.assess()
+	explanations := make([]RelayExplanation, len(a.relays))
+	for i, ar := range a.relays {
+		e := RelayExplanation{
+			Relay:    ar.relay,
+			Want:     ar.desiredState,
+			Priority: strings.ToLower(strings.TrimPrefix(ar.pri.String(), "pri")),
+			State:    state.IsSet(ar.relay),
+		}
+		if e.State != e.Want {
+			e.Blocker = a.blockers[ar.relay]
+			if e.Blocker == BlockNone {
+				if a.canTurnOn {
+					e.Blocker = BlockPriority
+				} else {
+					e.Blocker = BlockTurnOnDelay
+				}
+			}
+		}
+		explanations[i] = e
+	}
+	return state, explanations
+}
+
+// block records that the given relay was blocked from
+// being put into its desired state for the given reason,
+// unless a reason has already been recorded.
+func (a *assessor) block(relay int, b Blocker) {
+	if a.blockers[relay] == BlockNone {
+		a.blockers[relay] = b
+	}
+}
+
+// blockAll is like block but records the reason
+// for all the given relays.
+func (a *assessor) blockAll(assessed []assessedRelay, b Blocker) {
+	for _, ar := range assessed {
+		a.block(ar.relay, b)
+	}
+}
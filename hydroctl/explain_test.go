@@ -0,0 +1,123 @@
+package hydroctl_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+var explainConfig = hydroctl.Config{
+	Relays: []hydroctl.RelayConfig{
+		0: {
+			Mode:     hydroctl.InUse,
+			MaxPower: 3000,
+			InUse: []*hydroctl.Slot{{
+				Start:    TD("10:00"),
+				End:      TD("14:00"),
+				Kind:     hydroctl.AtLeast,
+				Duration: time.Hour,
+			}},
+		},
+		1: {
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		},
+	},
+}
+
+var explainTests = []struct {
+	testName        string
+	previousUpdates []stateUpdate
+	currentState    hydroctl.RelayState
+	powerUse        hydroctl.PowerUse
+	expect          []hydroctl.RelayExplanation
+}{{
+	testName:     "not-enough-power",
+	currentState: mkRelays(1),
+	powerUse: hydroctl.PowerUse{
+		Generated: 1000,
+		Here:      100,
+	},
+	expect: []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Want:     true,
+		Priority: "high",
+		Blocker:  hydroctl.BlockPower,
+	}, {
+		Relay:    1,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}},
+}, {
+	testName:     "enough-power",
+	currentState: mkRelays(1),
+	powerUse: hydroctl.PowerUse{
+		Generated: 5000,
+		Here:      100,
+	},
+	expect: []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Want:     true,
+		Priority: "high",
+		State:    true,
+	}, {
+		Relay:    1,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}},
+}, {
+	testName: "meters-not-settled",
+	previousUpdates: []stateUpdate{{
+		t:     T(11).Add(-time.Second),
+		state: mkRelays(1),
+	}},
+	currentState: mkRelays(1),
+	powerUse: hydroctl.PowerUse{
+		Generated: 5000,
+		Here:      100,
+	},
+	expect: []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Want:     true,
+		Priority: "high",
+		Blocker:  hydroctl.BlockMeterReadings,
+	}, {
+		Relay:    1,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}},
+}}
+
+func TestExplain(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range explainTests {
+		c.Run(test.testName, func(c *qt.C) {
+			history, err := history.New(&history.MemStore{})
+			c.Assert(err, qt.IsNil)
+			for _, u := range test.previousUpdates {
+				history.RecordState(u.state, u.t)
+			}
+			now := T(11)
+			explanations := hydroctl.Explain(hydroctl.AssessParams{
+				Config:       &explainConfig,
+				CurrentState: test.currentState,
+				History:      history,
+				PowerUseSample: hydroctl.PowerUseSample{
+					PowerUse: test.powerUse,
+					T0:       now,
+					T1:       now,
+				},
+				Logger: clogger{c},
+				Now:    now,
+			})
+			c.Assert(explanations, qt.DeepEquals, test.expect)
+		})
+	}
+}
@@ -34,10 +34,39 @@ type PowerUse struct {
 	Neighbour float64 `json:"Neighbour"`
 	// Here holds the power being used here in watts.
 	Here float64 `json:"Here"`
+	// Phases holds the power for each supply phase, indexed
+	// by phase number minus one. It's zero when the meters
+	// don't report per-phase power. Assess uses it to
+	// prefer relays on less loaded phases.
+	Phases [MaxPhase]PhasePowerUse `json:"Phases"`
+}
+
+// PhasePowerUse holds how power is being used
+// and generated on a single supply phase.
+type PhasePowerUse struct {
+	// Generated holds the power being generated in watts.
+	Generated float64 `json:"Generated"`
+	// Neighbour holds the power being used by our neighbour in watts.
+	Neighbour float64 `json:"Neighbour"`
+	// Here holds the power being used here in watts.
+	Here float64 `json:"Here"`
 }
 
 // ChargeablePower calculates how power use will be charged.
+//
+// When the generator is idle, it can consume a small amount
+// of power itself, in which case pu.Generated will be negative.
+// Nothing is exported then, and the power consumed by the
+// generator is imported, shared equally between here
+// and our neighbour as the generated power would be.
 func ChargeablePower(pu PowerUse) PowerChargeable {
+	if pu.Generated < 0 {
+		genUse := -pu.Generated / 2
+		return PowerChargeable{
+			ImportNeighbour: pu.Neighbour + genUse,
+			ImportHere:      pu.Here + genUse,
+		}
+	}
 	halfPower := pu.Generated / 2
 	imported := (pu.Neighbour + pu.Here) - pu.Generated
 	switch {
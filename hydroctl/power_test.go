@@ -1,6 +1,7 @@
 package hydroctl_test
 
 import (
+	"math"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -71,6 +72,26 @@ var chargeablePowerTests = []struct {
 		ImportNeighbour: (60 + 55 - 50) * (55.0 / (55 + 60)),
 		ImportHere:      (60 + 55 - 50) * (60.0 / (55 + 60)),
 	},
+}, {
+	testName: "generator-consuming-power-with-no-other-use-is-imported-equally",
+	use: hydroctl.PowerUse{
+		Generated: -6,
+	},
+	expect: hydroctl.PowerChargeable{
+		ImportNeighbour: 3,
+		ImportHere:      3,
+	},
+}, {
+	testName: "generator-consuming-power-is-imported-along-with-everything-else",
+	use: hydroctl.PowerUse{
+		Generated: -6,
+		Neighbour: 40,
+		Here:      20,
+	},
+	expect: hydroctl.PowerChargeable{
+		ImportNeighbour: 43,
+		ImportHere:      23,
+	},
 }}
 
 func TestChargeablePower(t *testing.T) {
@@ -85,7 +106,7 @@ func TestChargeablePower(t *testing.T) {
 			assertEqual(c, "ImportHere", pc.ImportHere, test.expect.ImportHere)
 			// Check invariant: all the power used should be accounted for.
 			totalExported := pc.ExportGrid + pc.ExportNeighbour + pc.ExportHere
-			assertEqual(c, "total exported", totalExported, test.use.Generated)
+			assertEqual(c, "total exported", totalExported, math.Max(test.use.Generated, 0))
 			// Check invariant: when importing, the power imported should be what's used less what's generated.
 			if imported := test.use.Here + test.use.Neighbour - test.use.Generated; imported > 0 {
 				assertEqual(c, "total imported", pc.ImportNeighbour+pc.ImportHere, imported)
@@ -20,7 +20,7 @@ func (t TimeOfDay) Minute() int {
 	return int(t.d / time.Minute % 60)
 }
 
-// Second returns the second from 0-59 (currently this is always zero).
+// Second returns the second from 0-59.
 func (t TimeOfDay) Second() int {
 	return int(t.d / time.Second % 60)
 }
@@ -29,6 +29,27 @@ func (t TimeOfDay) String() string {
 	return fmt.Sprintf("%.2d:%.2d", t.d/time.Hour, (t.d/time.Minute)%60)
 }
 
+// MarshalText implements encoding.TextMarshaler by
+// formatting the time of day as 15:04, or as 15:04:05
+// if the seconds are non-zero.
+func (t TimeOfDay) MarshalText() ([]byte, error) {
+	if t.Second() != 0 {
+		return []byte(fmt.Sprintf("%s:%.2d", t, t.Second())), nil
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+// by parsing the time of day with ParseTimeOfDay.
+func (t *TimeOfDay) UnmarshalText(data []byte) error {
+	t1, err := ParseTimeOfDay(string(data))
+	if err != nil {
+		return err
+	}
+	*t = t1
+	return nil
+}
+
 func (t TimeOfDay) Before(t1 TimeOfDay) bool {
 	return t.d < t1.d
 }
@@ -43,11 +64,12 @@ func (t TimeOfDay) Equal(t1 TimeOfDay) bool {
 
 var timeFormats = []string{
 	"15:04",
+	"15:04:05",
 	"3pm",
 	"3:04pm",
 }
 
-// ParseTimeOfDay parses a time of day in on of the formats 15:05, 3pm or 3:04pm.
+// ParseTimeOfDay parses a time of day in one of the formats 15:04, 15:04:05, 3pm or 3:04pm.
 func ParseTimeOfDay(s string) (TimeOfDay, error) {
 	for _, f := range timeFormats {
 		if t, err := time.Parse(f, s); err == nil {
@@ -30,6 +30,9 @@ type AllReportsParams struct {
 	// The data for that meter is assumed to be in the directory $dir/$name
 	// in any file named *.sample.
 	//
+	// When there's more than one meter at a location, the usage
+	// for the location is the sum of the usage of all its meters.
+	//
 	// Invalid sample files will be ignored.
 	Meters map[MeterLocation][]string
 	// TZ holds the time zone to use for the generated reports
@@ -43,6 +46,10 @@ type AllReportsParams struct {
 // A report can only be generated for a given month if there's some sample data
 // within that month for all specified meters. If the entire month isn't
 // covered, the report will be labeled as "partial".
+//
+// If any of the meters has no samples yet (including when its
+// directory doesn't exist), no reports are possible, so
+// AllReports returns no reports and no error.
 func AllReports(p AllReportsParams) ([]*Report, error) {
 	if len(p.Meters) != 3 {
 		return nil, fmt.Errorf("missing meter names for some meter locations (got %v)", p.Meters)
@@ -59,6 +66,9 @@ func AllReports(p AllReportsParams) ([]*Report, error) {
 		for _, name := range names {
 			meterDir := filepath.Join(p.SampleDir, name)
 			sd, err := meterstat.ReadSampleDir(meterDir, "*.sample")
+			if err == meterstat.ErrNoSamples {
+				return nil, nil
+			}
 			if err != nil {
 				return nil, fmt.Errorf("cannot read sample dir %v: %v", meterDir, err)
 			}
@@ -68,9 +78,10 @@ func AllReports(p AllReportsParams) ([]*Report, error) {
 		locRange[location] = trange
 		totalRange = totalRange.Intersect(trange)
 	}
-	// Find out what reports are possible.
+	// Find out what reports are possible. Note that month boundaries
+	// are determined in the report's time zone, not UTC.
 	var reports []*Report
-	for year := totalRange.T0.Year(); year <= totalRange.T1.Year(); year++ {
+	for year := totalRange.T0.In(p.TZ).Year(); year <= totalRange.T1.In(p.TZ).Year(); year++ {
 		for month := time.January; month <= time.December; month++ {
 			// We can generate a report if we've got some samples
 			// within the month for all meters.
@@ -87,11 +98,17 @@ func AllReports(p AllReportsParams) ([]*Report, error) {
 			}
 			if trange.T1.After(trange.T0) {
 				// There's a non-empty range of values, so it's a valid report.
+				// The range can be derived from sample times, so make sure
+				// it's in the right time zone so that when formatted it shows
+				// the correct month.
 				reports = append(reports, &Report{
 					MeterDirs: meterDirs,
-					Range:     trange,
-					Partial:   !trange.Equal(monthRange),
-					tz:        p.TZ,
+					Range: meterstat.TimeRange{
+						T0: trange.T0.In(p.TZ),
+						T1: trange.T1.In(p.TZ),
+					},
+					Partial: !trange.Equal(monthRange),
+					tz:      p.TZ,
 				})
 			}
 		}
@@ -105,6 +122,7 @@ type Report struct {
 	// indexed by meter location.
 	MeterDirs map[MeterLocation][]*meterstat.MeterSampleDir
 	// Range holds the time range of the report.
+	// Both times are in the report's time zone.
 	Range meterstat.TimeRange
 	tz    *time.Location
 	// Partial is true when the report doesn't cover the entire
@@ -118,9 +136,12 @@ func (r Report) Params() Params {
 	for loc, sds := range r.MeterDirs {
 		usageReaders := make([]meterstat.UsageReader, 0, len(sds))
 		for _, sd := range sds {
-			usageReaders = append(usageReaders, meterstat.NewUsageReader(sd.OpenRange(r.Range), r.Range.T0, time.Minute))
+			usageReaders = append(usageReaders, &meterUsageReader{
+				UsageReader: meterstat.NewUsageReader(sd.OpenRange(r.Range), r.Range.T0, time.Minute),
+				dir:         sd.Dir,
+			})
 		}
-		locUsageReaders[loc] = meterstat.SumUsage(usageReaders...)
+		locUsageReaders[loc] = locationUsage(usageReaders)
 	}
 	return Params{
 		Generator: locUsageReaders[LocGenerator],
@@ -131,11 +152,99 @@ func (r Report) Params() Params {
 	}
 }
 
+// meterUsageReader wraps the UsageReader for a single meter
+// so that any errors it returns identify the meter's sample
+// directory, which is otherwise lost when the usage for
+// several meters is summed.
+type meterUsageReader struct {
+	meterstat.UsageReader
+	dir string
+}
+
+// ReadUsage implements meterstat.UsageReader.ReadUsage.
+func (r *meterUsageReader) ReadUsage() (meterstat.Usage, error) {
+	u, err := r.UsageReader.ReadUsage()
+	if err != nil && err != io.EOF {
+		return u, fmt.Errorf("meter samples in %q: %v", r.dir, err)
+	}
+	return u, err
+}
+
+// locationUsage returns a UsageReader that sums the usage of all the meters
+// at a location. Unlike meterstat.SumUsage, the sample count is the minimum
+// over all the meters rather than the total, so that a gap in the samples
+// of any one meter shows up as a gap in the location's usage.
+func locationUsage(rs []meterstat.UsageReader) meterstat.UsageReader {
+	return &locationUsageReader{
+		readers: rs,
+	}
+}
+
+type locationUsageReader struct {
+	readers []meterstat.UsageReader
+	err     error
+}
+
+// Time implements meterstat.UsageReader.Time.
+func (r *locationUsageReader) Time() time.Time {
+	return r.readers[0].Time()
+}
+
+// Quantum implements meterstat.UsageReader.Quantum.
+func (r *locationUsageReader) Quantum() time.Duration {
+	return r.readers[0].Quantum()
+}
+
+// ReadUsage implements meterstat.UsageReader.ReadUsage.
+func (r *locationUsageReader) ReadUsage() (meterstat.Usage, error) {
+	if r.err != nil {
+		return meterstat.Usage{}, r.err
+	}
+	var total meterstat.Usage
+	for i, ur := range r.readers {
+		u, err := ur.ReadUsage()
+		if err != nil {
+			r.err = err
+			return meterstat.Usage{}, err
+		}
+		total.Energy += u.Energy
+		if i == 0 || u.Samples < total.Samples {
+			total.Samples = u.Samples
+		}
+	}
+	return total, nil
+}
+
+// Gaps returns the time ranges within the report that
+// aren't backed by meter samples, as determined by
+// DefaultMaxSampleGap. It reads the whole report to do so.
+func (r *Report) Gaps() ([]meterstat.TimeRange, error) {
+	rr, err := open(r.Params())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, err := rr.ReadEntry(); err != nil {
+			if err == io.EOF {
+				return rr.gaps, nil
+			}
+			return nil, err
+		}
+	}
+}
+
 // Write writes the report as a CSV to w.
 func (r *Report) Write(w io.Writer) error {
-	rr, err := Open(r.Params())
+	return r.WriteFormat(w, CSVFormat{})
+}
+
+// WriteFormat writes the report as a CSV to w in the given format.
+func (r *Report) WriteFormat(w io.Writer, f CSVFormat) error {
+	p := r.Params()
+	p.Peak = f.Peak
+	rr, err := Open(p)
 	if err != nil {
 		return err
 	}
-	return Write(w, rr)
+	return WriteFormat(w, rr, f)
 }
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -75,6 +76,39 @@ func TestAllReports(t *testing.T) {
 	})
 }
 
+func TestReportErrorNamesCorruptFile(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	for path, samples := range sampleDirContents {
+		path = filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		var buf bytes.Buffer
+		_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader(samples))
+		c.Assert(err, qt.IsNil)
+		data := buf.String()
+		if path == filepath.Join(dir, "here-a/1.sample") {
+			// Corrupt the file after its first sample.
+			i := strings.Index(data, "\n")
+			data = data[:i+1] + "garbage\n" + data[i+1:]
+		}
+		err = ioutil.WriteFile(path, []byte(data), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	reports, err := AllReports(AllReportsParams{
+		SampleDir: dir,
+		Meters: map[MeterLocation][]string{
+			LocGenerator: {"generator-a"},
+			LocHere:      {"here-a"},
+			LocNeighbour: {"neighbour-a"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.Not(qt.HasLen), 0)
+	err = reports[0].Write(ioutil.Discard)
+	c.Assert(err, qt.ErrorMatches, `here usage samples stopped early \(at .*\): meter samples in ".*/here-a": cannot read sample from ".*/here-a/1\.sample": invalid sample line found: "garbage"`)
+}
+
 func assertUniformReport(c *qt.C, r *Report, t0, t1 time.Time, interval time.Duration, expect hydroctl.PowerChargeable) {
 	var buf bytes.Buffer
 	err := r.Write(&buf)
@@ -146,3 +180,227 @@ var sampleDirContents = map[string][]meterstat.Sample{
 }
 
 const month = 31 * 24 * time.Hour
+
+func TestAllReportsDSTMonth(t *testing.T) {
+	c := qt.New(t)
+	tz, err := time.LoadLocation("Europe/London")
+	c.Assert(err, qt.IsNil)
+	dir := c.Mkdir()
+	// All meters have samples from mid February to mid April 2020,
+	// spanning the change to daylight saving time on 29th March.
+	t0 := time.Date(2020, 2, 15, 0, 0, 0, 0, time.UTC)
+	t1 := time.Date(2020, 4, 15, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"generator", "here", "neighbour"} {
+		path := filepath.Join(dir, name, "1.sample")
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		var buf bytes.Buffer
+		_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader([]meterstat.Sample{{
+			Time:        t0,
+			TotalEnergy: 1000,
+		}, {
+			Time:        t1,
+			TotalEnergy: 1000 + float64(t1.Sub(t0)/time.Hour)*1000,
+		}}))
+		c.Assert(err, qt.IsNil)
+		err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	reports, err := AllReports(AllReportsParams{
+		SampleDir: dir,
+		Meters: map[MeterLocation][]string{
+			LocGenerator: {"generator"},
+			LocHere:      {"here"},
+			LocNeighbour: {"neighbour"},
+		},
+		TZ: tz,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.HasLen, 3)
+	r := reports[1]
+	c.Assert(r.Partial, qt.IsFalse)
+	// The month starts at midnight GMT and finishes at midnight BST,
+	// so it's an hour shorter than 31 days.
+	c.Assert(r.Range.T0.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)), qt.IsTrue, qt.Commentf("%v", r.Range.T0))
+	c.Assert(r.Range.T1.Equal(time.Date(2020, 3, 31, 23, 0, 0, 0, time.UTC)), qt.IsTrue, qt.Commentf("%v", r.Range.T1))
+	c.Assert(r.Range.T0.Location(), qt.Equals, tz)
+	c.Assert(r.Range.T1.Location(), qt.Equals, tz)
+	c.Assert(r.Range.T0.Format("2006-01"), qt.Equals, "2020-03")
+
+	// The partial April report starts exactly where
+	// the March report finishes.
+	c.Assert(reports[2].Partial, qt.IsTrue)
+	c.Assert(reports[2].Range.T0.Equal(r.Range.T1), qt.IsTrue)
+	c.Assert(reports[2].Range.T0.Format("2006-01"), qt.Equals, "2020-04")
+	c.Assert(reports[2].Range.T1.Equal(t1), qt.IsTrue)
+}
+
+func TestReportEntriesWithGap(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	// All meters have samples every 10 minutes throughout March 2020
+	// except for a two day gap in the middle of the month.
+	t0 := date(2020, 3, 1)
+	t1 := date(2020, 4, 1)
+	gap := meterstat.TimeRange{
+		T0: date(2020, 3, 10),
+		T1: date(2020, 3, 12),
+	}
+	var samples []meterstat.Sample
+	for t := t0; !t.After(t1); t = t.Add(10 * time.Minute) {
+		if t.After(gap.T0) && t.Before(gap.T1) {
+			continue
+		}
+		samples = append(samples, meterstat.Sample{
+			Time:        t,
+			TotalEnergy: float64(t.Sub(t0)/time.Minute) * 10,
+		})
+	}
+	for _, name := range []string{"generator", "here", "neighbour"} {
+		path := filepath.Join(dir, name, "1.sample")
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		var buf bytes.Buffer
+		_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader(samples))
+		c.Assert(err, qt.IsNil)
+		err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	reports, err := AllReports(AllReportsParams{
+		SampleDir: dir,
+		Meters: map[MeterLocation][]string{
+			LocGenerator: {"generator"},
+			LocHere:      {"here"},
+			LocNeighbour: {"neighbour"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.HasLen, 1)
+	r := reports[0]
+	// The report covers the whole month even though
+	// some of its entries don't.
+	c.Assert(r.Partial, qt.IsFalse)
+
+	rr, err := Open(r.Params())
+	c.Assert(err, qt.IsNil)
+	n := 0
+	for {
+		e, err := rr.ReadEntry()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		inGap := !e.Time.Before(gap.T0) && e.Time.Before(gap.T1)
+		c.Assert(e.Partial, qt.Equals, inGap, qt.Commentf("entry at %v", e.Time))
+		n++
+	}
+	c.Assert(n, qt.Equals, 31*24)
+
+	gaps, err := r.Gaps()
+	c.Assert(err, qt.IsNil)
+	c.Assert(gaps, qt.HasLen, 1)
+	c.Assert(gaps[0].T0.Equal(gap.T0), qt.IsTrue, qt.Commentf("%v", gaps[0].T0))
+	c.Assert(gaps[0].T1.Equal(gap.T1), qt.IsTrue, qt.Commentf("%v", gaps[0].T1))
+}
+
+func TestReportGapInOneMeter(t *testing.T) {
+	c := qt.New(t)
+	// Two meters at the same location: one has continuous
+	// samples and the other has a gap. The location's
+	// usage is only as well backed as its worst meter.
+	t0 := date(2020, 3, 1)
+	quantum := time.Minute
+	var continuous, gappy []meterstat.Sample
+	for t := t0; !t.After(t0.Add(4 * time.Hour)); t = t.Add(time.Minute) {
+		s := meterstat.Sample{
+			Time:        t,
+			TotalEnergy: float64(t.Sub(t0) / time.Minute),
+		}
+		continuous = append(continuous, s)
+		if !t.After(t0.Add(time.Hour)) || !t.Before(t0.Add(3*time.Hour)) {
+			gappy = append(gappy, s)
+		}
+	}
+	usage := func(samples []meterstat.Sample) meterstat.UsageReader {
+		return meterstat.NewUsageReader(meterstat.NewMemSampleReader(samples), t0, quantum)
+	}
+	rr, err := Open(Params{
+		Generator: usage(continuous),
+		Neighbour: usage(continuous),
+		Here:      locationUsage([]meterstat.UsageReader{usage(continuous), usage(gappy)}),
+		EndTime:   t0.Add(4 * time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	var partial []bool
+	for {
+		e, err := rr.ReadEntry()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		partial = append(partial, e.Partial)
+	}
+	c.Assert(partial, qt.DeepEquals, []bool{false, true, true, false})
+}
+
+func TestAllReportsSumsMetersAtLocation(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	t0 := date(2020, 3, 1)
+	t1 := date(2020, 4, 1)
+	// There are two meters at the "here" location using
+	// 1kW and 2kW respectively. Nothing is generated.
+	for name, power := range map[string]float64{
+		"generator": 0,
+		"here-a":    1000,
+		"here-b":    2000,
+		"neighbour": 0,
+	} {
+		path := filepath.Join(dir, name, "1.sample")
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		var buf bytes.Buffer
+		_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader([]meterstat.Sample{{
+			Time:        t0,
+			TotalEnergy: 5000,
+		}, {
+			Time:        t1,
+			TotalEnergy: 5000 + t1.Sub(t0).Hours()*power,
+		}}))
+		c.Assert(err, qt.IsNil)
+		err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	reports, err := AllReports(AllReportsParams{
+		SampleDir: dir,
+		Meters: map[MeterLocation][]string{
+			LocGenerator: {"generator"},
+			LocHere:      {"here-a", "here-b"},
+			LocNeighbour: {"neighbour"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.HasLen, 1)
+	assertUniformReport(c, reports[0], t0, t1, time.Hour, hydroctl.PowerChargeable{
+		ImportHere: 3000,
+	})
+}
+
+func TestAllReportsNoSamples(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	// The generator directory exists but is empty and
+	// there's no directory at all for the other meters.
+	err := os.Mkdir(filepath.Join(dir, "generator"), 0777)
+	c.Assert(err, qt.IsNil)
+	reports, err := AllReports(AllReportsParams{
+		SampleDir: dir,
+		Meters: map[MeterLocation][]string{
+			LocGenerator: {"generator"},
+			LocHere:      {"here"},
+			LocNeighbour: {"neighbour"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.HasLen, 0)
+}
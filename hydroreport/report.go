@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/rogpeppe/hydro/hydroctl"
 	"github.com/rogpeppe/hydro/meterstat"
@@ -14,9 +16,11 @@ import (
 type Params struct {
 	// The UsageReaders hold the usage readers
 	// for the meters that the report takes into account.
-	// They must all start at the same instance, have the same quantum
-	// and provide usage information at least until after the end time.
+	// They must all start at the same instance and have the same quantum.
 	// Additionally, the quantum must evenly divide an hour.
+	// If any of them runs out of samples before the end time,
+	// the remainder of the report is treated as a gap in the samples
+	// and the affected entries are marked as partial.
 	Generator meterstat.UsageReader
 	Neighbour meterstat.UsageReader
 	Here      meterstat.UsageReader
@@ -29,12 +33,63 @@ type Params struct {
 	// EntryDuration holds the duration of a report entry.
 	// If it's zero, it defaults to one hour.
 	EntryDuration time.Duration
+	// MaxSampleGap holds the longest interval between meter
+	// samples that's treated as continuous data. Usage over
+	// longer intervals is interpolated and entries that include
+	// it are marked as partial. If it's zero, DefaultMaxSampleGap
+	// is used.
+	MaxSampleGap time.Duration
+	// MinEntrySamples holds the minimum number of samples
+	// that an entry must be backed by for its figures to be
+	// considered meaningful. Entries backed by fewer samples
+	// are marked as sparse. If it's zero, no entries are
+	// marked as sparse.
+	MinEntrySamples float64
+	// OmitSparseEntries specifies that sparse entries
+	// are left out of the report altogether.
+	OmitSparseEntries bool
+	// Peak specifies that the peak import and export
+	// power should be calculated for each entry.
+	Peak bool
 }
 
+// DefaultMaxSampleGap holds the default value of Params.MaxSampleGap.
+const DefaultMaxSampleGap = time.Hour
+
 // Entry holds a entry line in a report, corresponding to 1 hour of readings.
+//
+// Entries are evenly spaced in absolute time rather than wall-clock time,
+// so when daylight saving time starts, there's no entry for the hour
+// that's skipped, and when it finishes, the repeated hour has two entries,
+// each covering a distinct hour and distinguished by their time zone
+// abbreviations.
 type Entry struct {
 	Time time.Time
 	hydroctl.PowerChargeable
+	// Partial holds whether any of the entry's time period
+	// wasn't backed by meter samples, in which case
+	// the usage in that period has been interpolated
+	// from the samples either side of it.
+	Partial bool
+	// Samples holds the number of meter samples that
+	// the entry is backed by. This is taken from the meter
+	// location with the fewest samples, and may be
+	// fractional when samples are further apart than the
+	// entry's duration.
+	Samples float64
+	// Sparse holds whether Samples is less than
+	// Params.MinEntrySamples.
+	Sparse bool
+	// PeakImport holds the highest power imported from
+	// the grid (W) within the entry, averaged over the
+	// usage reader quantum. It's only calculated when
+	// Params.Peak is true.
+	PeakImport float64
+	// PeakExport holds the highest power exported to
+	// the grid (W) within the entry, averaged over the
+	// usage reader quantum. It's only calculated when
+	// Params.Peak is true.
+	PeakExport float64
 }
 
 // Reader represents a reader of report entry lines.
@@ -44,12 +99,23 @@ type Reader interface {
 
 // Open returns a reader that reads entries from the report.
 func Open(p Params) (Reader, error) {
+	r, err := open(p)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func open(p Params) (*reportReader, error) {
 	if p.TZ == nil {
 		p.TZ = time.UTC
 	}
 	if p.EntryDuration == 0 {
 		p.EntryDuration = time.Hour
 	}
+	if p.MaxSampleGap == 0 {
+		p.MaxSampleGap = DefaultMaxSampleGap
+	}
 	p.EndTime = p.EndTime.In(p.TZ)
 	if err := checkUsageReaderConsistency(
 		p.Generator,
@@ -75,6 +141,7 @@ func Open(p Params) (Reader, error) {
 		currentTime:       t,
 		quantum:           quantum,
 		samplesPerQuantum: int(p.EntryDuration / quantum),
+		minSamples:        float64(quantum) / float64(p.MaxSampleGap),
 		p:                 p,
 	}, nil
 }
@@ -84,36 +151,74 @@ type reportReader struct {
 	samplesPerQuantum int
 	quantum           time.Duration
 	p                 Params
+
+	// minSamples holds the sample count below which
+	// a quantum's usage is considered to be part of a gap.
+	minSamples float64
+
+	// gaps holds the time ranges read so far that
+	// weren't backed by samples from all meters.
+	gaps []meterstat.TimeRange
 }
 
 // ReadEntry implements Reader.
 func (r *reportReader) ReadEntry() (Entry, error) {
+	for {
+		e, err := r.readEntry()
+		if err != nil || !e.Sparse || !r.p.OmitSparseEntries {
+			return e, err
+		}
+	}
+}
+
+func (r *reportReader) readEntry() (Entry, error) {
 	if !r.currentTime.Before(r.p.EndTime) {
 		return Entry{}, io.EOF
 	}
 	var total hydroctl.PowerChargeable
+	var peakImport, peakExport float64
 	entryStartTime := r.currentTime
+	partial := false
+	// samples holds the number of samples read
+	// for the entry from each meter location.
+	var samples [3]float64
 	for i := 0; i < r.samplesPerQuantum; i++ {
 		var pu hydroctl.PowerUse
+		gap := false
 
-		u, err := r.p.Generator.ReadUsage()
+		u, err := r.readUsage(r.p.Generator, "generator")
 		if err != nil {
-			return Entry{}, fmt.Errorf("generator usage samples stopped early (at %v): %v", r.p.Generator.Time(), err)
+			return Entry{}, err
 		}
 		pu.Generated = u.Energy
+		samples[0] += u.Samples
+		gap = gap || u.Samples < r.minSamples
 
-		u, err = r.p.Neighbour.ReadUsage()
+		u, err = r.readUsage(r.p.Neighbour, "neighbour")
 		if err != nil {
-			return Entry{}, fmt.Errorf("neighbour usage samples stopped early (at %v): %v", r.p.Neighbour.Time(), err)
+			return Entry{}, err
 		}
 		pu.Neighbour = u.Energy
+		samples[1] += u.Samples
+		gap = gap || u.Samples < r.minSamples
 
-		u, err = r.p.Here.ReadUsage()
+		u, err = r.readUsage(r.p.Here, "here")
 		if err != nil {
-			return Entry{}, fmt.Errorf("here usage samples stopped early (at %v): %v", r.p.Here.Time(), err)
+			return Entry{}, err
 		}
 		pu.Here = u.Energy
-		total = total.Add(hydroctl.ChargeablePower(pu))
+		samples[2] += u.Samples
+		gap = gap || u.Samples < r.minSamples
+		if gap {
+			r.addGap(r.currentTime)
+			partial = true
+		}
+		pc := hydroctl.ChargeablePower(pu)
+		total = total.Add(pc)
+		if r.p.Peak {
+			peakImport = math.Max(peakImport, pc.ImportNeighbour+pc.ImportHere)
+			peakExport = math.Max(peakExport, pc.ExportGrid)
+		}
 		r.currentTime = r.currentTime.Add(r.quantum)
 		//fmt.Printf("chargeable at %v: usage %+v; %+v\n", r.currentTime.Format("2006-01-02 15:04 MST"), pu, hydroctl.ChargeablePower(pu))
 	}
@@ -121,21 +226,120 @@ func (r *reportReader) ReadEntry() (Entry, error) {
 		PowerChargeable: total,
 		// Note: a report entry summarises the activity that happens from
 		// the start of an entry until the end.
-		Time: entryStartTime,
+		Time:    entryStartTime,
+		Partial: partial,
+		Samples: math.Min(samples[0], math.Min(samples[1], samples[2])),
+		// The usage is energy over a quantum (Wh),
+		// so convert it to average power (W).
+		PeakImport: peakImport * float64(time.Hour) / float64(r.quantum),
+		PeakExport: peakExport * float64(time.Hour) / float64(r.quantum),
 	}
+	rec.Sparse = rec.Samples < r.p.MinEntrySamples
 	return rec, nil
 }
 
+// readUsage reads the next quantum of usage from ur.
+// If ur has run out of samples before the end of the report,
+// it returns zero usage with no samples, so the rest of the
+// report is treated as a gap rather than an error.
+func (r *reportReader) readUsage(ur meterstat.UsageReader, what string) (meterstat.Usage, error) {
+	u, err := ur.ReadUsage()
+	if err == io.EOF {
+		return meterstat.Usage{}, nil
+	}
+	if err != nil {
+		return meterstat.Usage{}, fmt.Errorf("%s usage samples stopped early (at %v): %v", what, ur.Time(), err)
+	}
+	return u, nil
+}
+
+// addGap records that the quantum starting at t isn't
+// backed by samples, extending the most recent gap
+// if it's contiguous with it.
+func (r *reportReader) addGap(t time.Time) {
+	t1 := t.Add(r.quantum)
+	if n := len(r.gaps); n > 0 && r.gaps[n-1].T1.Equal(t) {
+		r.gaps[n-1].T1 = t1
+		return
+	}
+	r.gaps = append(r.gaps, meterstat.TimeRange{
+		T0: t,
+		T1: t1,
+	})
+}
+
+// CSVFormat holds options for the format of a CSV report.
+// The zero value produces comma-separated values
+// with "." as the decimal separator.
+type CSVFormat struct {
+	// Delimiter holds the character that separates fields.
+	// If it's zero, ',' is used.
+	Delimiter rune
+	// DecimalSeparator holds the character used to separate
+	// the integer and fractional parts of numbers.
+	// If it's zero, '.' is used.
+	DecimalSeparator rune
+	// Peak specifies that the peak import and export
+	// power columns are included. The entries should
+	// be read with Params.Peak set for these to be
+	// meaningful.
+	Peak bool
+}
+
+func (f CSVFormat) withDefaults() CSVFormat {
+	if f.Delimiter == 0 {
+		f.Delimiter = ','
+	}
+	if f.DecimalSeparator == 0 {
+		f.DecimalSeparator = '.'
+	}
+	return f
+}
+
+// Validate checks that the format can be used to write
+// an unambiguous report.
+func (f CSVFormat) Validate() error {
+	f = f.withDefaults()
+	if f.Delimiter == f.DecimalSeparator {
+		return fmt.Errorf("delimiter and decimal separator are both %q", f.Delimiter)
+	}
+	for _, r := range []rune{f.Delimiter, f.DecimalSeparator} {
+		if r == '"' || r == '\r' || r == '\n' || unicode.IsDigit(r) {
+			return fmt.Errorf("invalid CSV format character %q", r)
+		}
+	}
+	return nil
+}
+
 // Write writes a report with entries read from r.
 func Write(w io.Writer, r Reader) error {
-	fmt.Fprintln(w, "Time,"+
-		"Export to grid (kWH),"+
+	return WriteFormat(w, r, CSVFormat{})
+}
+
+// WriteFormat is like Write but writes the report
+// in the given format.
+func WriteFormat(w io.Writer, r Reader, f CSVFormat) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	f = f.withDefaults()
+	delim := string(f.Delimiter)
+	header := []string{
+		"Time",
+		"Export to grid (kWH)",
 		// TODO don't hard-code the names!
-		"Export power used by Aliday (kWH),"+
-		"Export power used by Drynoch (kWH),"+
-		"Import power used by Aliday (kWH),"+
+		"Export power used by Aliday (kWH)",
+		"Export power used by Drynoch (kWH)",
+		"Import power used by Aliday (kWH)",
 		"Import power used by Drynoch (kWH)",
-	)
+	}
+	if f.Peak {
+		header = append(header,
+			"Peak import (kW)",
+			"Peak export (kW)",
+		)
+	}
+	fmt.Fprintln(w, strings.Join(header, delim))
 	for {
 		rec, err := r.ReadEntry()
 		if err != nil {
@@ -144,15 +348,30 @@ func Write(w io.Writer, r Reader) error {
 			}
 			return err
 		}
-		fmt.Fprintf(w, "%v,%s,%s,%s,%s,%s\n",
+		fields := []string{
 			rec.Time.Format("2006-01-02 15:04 MST"),
-			powerStr(rec.ExportGrid),
-			powerStr(rec.ExportNeighbour),
-			powerStr(rec.ExportHere),
-			powerStr(rec.ImportNeighbour),
-			powerStr(rec.ImportHere),
-		)
+			f.powerStr(rec.ExportGrid),
+			f.powerStr(rec.ExportNeighbour),
+			f.powerStr(rec.ExportHere),
+			f.powerStr(rec.ImportNeighbour),
+			f.powerStr(rec.ImportHere),
+		}
+		if f.Peak {
+			fields = append(fields,
+				f.powerStr(rec.PeakImport),
+				f.powerStr(rec.PeakExport),
+			)
+		}
+		fmt.Fprintln(w, strings.Join(fields, delim))
+	}
+}
+
+func (f CSVFormat) powerStr(p float64) string {
+	s := powerStr(p)
+	if f.DecimalSeparator != '.' {
+		s = strings.Replace(s, ".", string(f.DecimalSeparator), 1)
 	}
+	return s
 }
 
 func powerStr(f float64) string {
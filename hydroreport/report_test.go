@@ -2,6 +2,8 @@ package hydroreport
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,3 +108,334 @@ Time,Export to grid (kWH),Export power used by Aliday (kWH),Export power used by
 2000-10-03 11:00 UTC,0.000,25.000,25.000,43.077,36.923
 `[1:])
 }
+
+var dstReportTests = []struct {
+	testName string
+	day      [3]int
+	expect   string
+}{{
+	testName: "start-of-summer-time",
+	day:      [3]int{2020, 3, 29},
+	expect: `
+2020-03-29 00:00 GMT,50.000,0.000,0.000,0.000,0.000
+2020-03-29 02:00 BST,50.000,0.000,0.000,0.000,0.000
+2020-03-29 03:00 BST,50.000,0.000,0.000,0.000,0.000
+`,
+}, {
+	testName: "end-of-summer-time",
+	day:      [3]int{2020, 10, 25},
+	expect: `
+2020-10-25 00:00 BST,50.000,0.000,0.000,0.000,0.000
+2020-10-25 01:00 BST,50.000,0.000,0.000,0.000,0.000
+2020-10-25 01:00 GMT,50.000,0.000,0.000,0.000,0.000
+2020-10-25 02:00 GMT,50.000,0.000,0.000,0.000,0.000
+`,
+}}
+
+func TestWriteReportDST(t *testing.T) {
+	c := qt.New(t)
+	tz, err := time.LoadLocation("Europe/London")
+	c.Assert(err, qt.IsNil)
+	for _, test := range dstReportTests {
+		c.Run(test.testName, func(c *qt.C) {
+			t0 := time.Date(test.day[0], time.Month(test.day[1]), test.day[2], 0, 0, 0, 0, tz)
+			t1 := t0.AddDate(0, 0, 1)
+			// The generator exports at a constant 50kW.
+			samples := func(power float64) meterstat.UsageReader {
+				return meterstat.NewUsageReader(meterstat.NewMemSampleReader([]meterstat.Sample{{
+					Time:        t0,
+					TotalEnergy: 0,
+				}, {
+					Time:        t1,
+					TotalEnergy: power * t1.Sub(t0).Hours(),
+				}}), t0, time.Minute)
+			}
+			rr, err := Open(Params{
+				Generator: samples(50000),
+				Here:      samples(0),
+				Neighbour: samples(0),
+				EndTime:   t1,
+				TZ:        tz,
+			})
+			c.Assert(err, qt.IsNil)
+			var buf bytes.Buffer
+			err = Write(&buf, rr)
+			c.Assert(err, qt.IsNil)
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[1:]
+			// Each hour that actually occurred is reported exactly once.
+			c.Assert(lines, qt.HasLen, int(t1.Sub(t0)/time.Hour))
+			expect := strings.Split(strings.TrimPrefix(test.expect, "\n"), "\n")
+			expect = expect[:len(expect)-1]
+			c.Assert(lines[:len(expect)], qt.DeepEquals, expect)
+			c.Assert(lines[len(lines)-1], qt.Equals, t1.Add(-time.Hour).Format("2006-01-02 15:04 MST")+",50.000,0.000,0.000,0.000,0.000")
+		})
+	}
+}
+
+var writeFormatTests = []struct {
+	testName    string
+	format      CSVFormat
+	expect      string
+	expectError string
+}{{
+	testName: "default",
+	expect: `
+Time,Export to grid (kWH),Export power used by Aliday (kWH),Export power used by Drynoch (kWH),Import power used by Aliday (kWH),Import power used by Drynoch (kWH)
+2000-10-02 12:00 UTC,12.500,0.000,0.250,0.000,0.000
+2000-10-02 13:00 UTC,12.500,0.000,0.250,0.000,0.000
+`,
+}, {
+	testName: "semicolon-comma",
+	format: CSVFormat{
+		Delimiter:        ';',
+		DecimalSeparator: ',',
+	},
+	expect: `
+Time;Export to grid (kWH);Export power used by Aliday (kWH);Export power used by Drynoch (kWH);Import power used by Aliday (kWH);Import power used by Drynoch (kWH)
+2000-10-02 12:00 UTC;12,500;0,000;0,250;0,000;0,000
+2000-10-02 13:00 UTC;12,500;0,000;0,250;0,000;0,000
+`,
+}, {
+	testName: "tab",
+	format: CSVFormat{
+		Delimiter: '\t',
+	},
+	expect: `
+Time	Export to grid (kWH)	Export power used by Aliday (kWH)	Export power used by Drynoch (kWH)	Import power used by Aliday (kWH)	Import power used by Drynoch (kWH)
+2000-10-02 12:00 UTC	12.500	0.000	0.250	0.000	0.000
+2000-10-02 13:00 UTC	12.500	0.000	0.250	0.000	0.000
+`,
+}, {
+	testName: "peak",
+	format: CSVFormat{
+		Peak: true,
+	},
+	expect: `
+Time,Export to grid (kWH),Export power used by Aliday (kWH),Export power used by Drynoch (kWH),Import power used by Aliday (kWH),Import power used by Drynoch (kWH),Peak import (kW),Peak export (kW)
+2000-10-02 12:00 UTC,12.500,0.000,0.250,0.000,0.000,0.000,12.500
+2000-10-02 13:00 UTC,12.500,0.000,0.250,0.000,0.000,0.000,12.500
+`,
+}, {
+	testName: "comma-decimal-with-default-delimiter",
+	format: CSVFormat{
+		DecimalSeparator: ',',
+	},
+	expectError: `delimiter and decimal separator are both ','`,
+}, {
+	testName: "digit-delimiter",
+	format: CSVFormat{
+		Delimiter: '0',
+	},
+	expectError: `invalid CSV format character '0'`,
+}}
+
+func TestWriteFormat(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range writeFormatTests {
+		c.Run(test.testName, func(c *qt.C) {
+			samples := func(power float64) meterstat.UsageReader {
+				return meterstat.NewUsageReader(meterstat.NewMemSampleReader([]meterstat.Sample{{
+					Time:        epoch,
+					TotalEnergy: 0,
+				}, {
+					Time:        epoch.Add(2 * time.Hour),
+					TotalEnergy: power * 2,
+				}}), epoch, time.Minute)
+			}
+			rr, err := Open(Params{
+				Generator: samples(12750),
+				Here:      samples(250),
+				Neighbour: samples(0),
+				EndTime:   epoch.Add(2 * time.Hour),
+				Peak:      test.format.Peak,
+			})
+			c.Assert(err, qt.IsNil)
+			var buf bytes.Buffer
+			err = WriteFormat(&buf, rr, test.format)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(buf.String(), qt.Equals, "")
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(buf.String(), qt.Equals, test.expect[1:])
+		})
+	}
+}
+
+func TestReportReaderEndsEarly(t *testing.T) {
+	c := qt.New(t)
+	samples := func(power float64, end time.Duration) meterstat.UsageReader {
+		var samples []meterstat.Sample
+		for t := time.Duration(0); t <= end; t += 10 * time.Minute {
+			samples = append(samples, meterstat.Sample{
+				Time:        epoch.Add(t),
+				TotalEnergy: power * t.Hours(),
+			})
+		}
+		return meterstat.NewUsageReader(meterstat.NewMemSampleReader(samples), epoch, time.Minute)
+	}
+	// The here meter's samples finish two hours
+	// into the four hour report.
+	rr, err := Open(Params{
+		Generator: samples(50000, 4*time.Hour),
+		Here:      samples(10000, 2*time.Hour),
+		Neighbour: samples(0, 4*time.Hour),
+		EndTime:   epoch.Add(4 * time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	var entries []Entry
+	for {
+		e, err := rr.ReadEntry()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		entries = append(entries, e)
+	}
+	c.Assert(entries, qt.HasLen, 4)
+	for i, e := range entries {
+		c.Assert(e.Time.Equal(epoch.Add(time.Duration(i)*time.Hour)), qt.IsTrue)
+		c.Assert(e.Partial, qt.Equals, i >= 2, qt.Commentf("entry %d", i))
+	}
+	c.Assert(entries[0].ExportHere, approxDeepEquals, 10000.0)
+	c.Assert(entries[2].ExportHere, approxDeepEquals, 0.0)
+	c.Assert(rr.(*reportReader).gaps, qt.DeepEquals, []meterstat.TimeRange{{
+		T0: epoch.Add(2 * time.Hour),
+		T1: epoch.Add(4 * time.Hour),
+	}})
+}
+
+func TestReportSparseEntries(t *testing.T) {
+	c := qt.New(t)
+	// sampleTimes holds the offsets from epoch of the samples:
+	// every 10 minutes for the first hour, then every half hour
+	// for an hour, then only once more in the next two hours,
+	// so each of the last two entries is backed by half a sample.
+	sampleTimes := []time.Duration{
+		0, 10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 40 * time.Minute, 50 * time.Minute,
+		time.Hour, 90 * time.Minute,
+		2 * time.Hour,
+		4 * time.Hour,
+	}
+	usage := func(power float64) meterstat.UsageReader {
+		var samples []meterstat.Sample
+		for _, t := range sampleTimes {
+			samples = append(samples, meterstat.Sample{
+				Time:        epoch.Add(t),
+				TotalEnergy: power * t.Hours(),
+			})
+		}
+		return meterstat.NewUsageReader(meterstat.NewMemSampleReader(samples), epoch, time.Minute)
+	}
+	params := func() Params {
+		return Params{
+			Generator: usage(5000),
+			Here:      usage(1000),
+			Neighbour: usage(0),
+			EndTime:   epoch.Add(4 * time.Hour),
+			// Allow the long gap at the end without
+			// marking the entries as partial.
+			MaxSampleGap:    3 * time.Hour,
+			MinEntrySamples: 2,
+		}
+	}
+	readEntries := func(p Params) []Entry {
+		rr, err := Open(p)
+		c.Assert(err, qt.IsNil)
+		var entries []Entry
+		for {
+			e, err := rr.ReadEntry()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, qt.IsNil)
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	entries := readEntries(params())
+	c.Assert(entries, qt.HasLen, 4)
+	var samples []float64
+	var sparse []bool
+	for _, e := range entries {
+		samples = append(samples, e.Samples)
+		sparse = append(sparse, e.Sparse)
+		c.Assert(e.Partial, qt.IsFalse)
+		// The figures are still present for sparse entries.
+		c.Assert(e.ExportHere, approxDeepEquals, 1000.0)
+	}
+	c.Assert(samples, approxDeepEquals, []float64{6, 2, 0.5, 0.5})
+	c.Assert(sparse, qt.DeepEquals, []bool{false, false, true, true})
+
+	// Sparse entries can be omitted entirely.
+	p := params()
+	p.OmitSparseEntries = true
+	entries = readEntries(p)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(entries[0].Time.Equal(epoch), qt.IsTrue)
+	c.Assert(entries[1].Time.Equal(epoch.Add(time.Hour)), qt.IsTrue)
+
+	// With no minimum, no entries are sparse.
+	p = params()
+	p.MinEntrySamples = 0
+	for _, e := range readEntries(p) {
+		c.Assert(e.Sparse, qt.IsFalse)
+	}
+}
+
+func TestReportPeak(t *testing.T) {
+	c := qt.New(t)
+	// The generator produces a steady 5kW and here uses
+	// 1kW, except for a 20kW spike for two minutes
+	// half an hour into the first entry.
+	spikeStart := 30 * time.Minute
+	spikeEnd := 32 * time.Minute
+	var hereSamples, generatorSamples []meterstat.Sample
+	energy := 0.0
+	for t := time.Duration(0); t <= 2*time.Hour; t += time.Minute {
+		hereSamples = append(hereSamples, meterstat.Sample{
+			Time:        epoch.Add(t),
+			TotalEnergy: energy,
+		})
+		generatorSamples = append(generatorSamples, meterstat.Sample{
+			Time:        epoch.Add(t),
+			TotalEnergy: 5000 * t.Hours(),
+		})
+		power := 1000.0
+		if t >= spikeStart && t < spikeEnd {
+			power = 20000
+		}
+		energy += power / 60
+	}
+	params := Params{
+		Generator: meterstat.NewUsageReader(meterstat.NewMemSampleReader(generatorSamples), epoch, time.Minute),
+		Here:      meterstat.NewUsageReader(meterstat.NewMemSampleReader(hereSamples), epoch, time.Minute),
+		Neighbour: meterstat.NewUsageReader(meterstat.NewMemSampleReader([]meterstat.Sample{{
+			Time: epoch,
+		}, {
+			Time: epoch.Add(2 * time.Hour),
+		}}), epoch, time.Minute),
+		EndTime: epoch.Add(2 * time.Hour),
+		Peak:    true,
+	}
+	rr, err := Open(params)
+	c.Assert(err, qt.IsNil)
+	var entries []Entry
+	for {
+		e, err := rr.ReadEntry()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		entries = append(entries, e)
+	}
+	c.Assert(entries, qt.HasLen, 2)
+	// During the spike, 15kW is imported; otherwise
+	// 4kW is exported.
+	c.Assert(entries[0].PeakImport, approxDeepEquals, 15000.0)
+	c.Assert(entries[0].PeakExport, approxDeepEquals, 4000.0)
+	c.Assert(entries[1].PeakImport, approxDeepEquals, 0.0)
+	c.Assert(entries[1].PeakExport, approxDeepEquals, 4000.0)
+}
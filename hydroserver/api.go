@@ -2,12 +2,22 @@ package hydroserver
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 
+	"github.com/rogpeppe/hydro/eth8020"
+	"github.com/rogpeppe/hydro/hydroconfig"
 	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroworker"
+	"github.com/rogpeppe/hydro/meterworker"
+	"github.com/rogpeppe/hydro/ndmeter"
 )
 
 var reqServer httprequest.Server
@@ -26,6 +36,16 @@ type apiHandler struct {
 	h *Handler
 }
 
+// checkController returns an unauthorized error if the client
+// making the request doesn't provide the control password.
+func (h *apiHandler) checkController(p httprequest.Params) error {
+	if h.h.isController(p.Request) {
+		return nil
+	}
+	p.Response.Header().Set("WWW-Authenticate", `Basic realm="hydro"`)
+	return httprequest.Errorf(httprequest.CodeUnauthorized, "authorization required")
+}
+
 type configGetRequest struct {
 	httprequest.Route `httprequest:"GET /api/config"`
 }
@@ -39,3 +59,682 @@ func (h *apiHandler) GetConfig(*configGetRequest) (*configGetResponse, error) {
 		Config: h.h.store.CtlConfig(),
 	}, nil
 }
+
+type versionGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/version"`
+}
+
+// GetVersion returns information about the build
+// of the running server.
+func (h *apiHandler) GetVersion(*versionGetRequest) (*VersionInfo, error) {
+	v := BuildVersion()
+	return &v, nil
+}
+
+type effectiveConfigGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/effective-config"`
+}
+
+// GetEffectiveConfig returns the relay configuration as used
+// by the control system, with cohorts expanded into
+// per-relay settings, indexed by relay number.
+func (h *apiHandler) GetEffectiveConfig(*effectiveConfigGetRequest) (*hydroctl.Config, error) {
+	return h.h.store.CtlConfig(), nil
+}
+
+type configPreviewRequest struct {
+	httprequest.Route `httprequest:"POST /api/config/preview"`
+	Body              struct {
+		// Config holds the configuration text to preview.
+		Config string
+	} `httprequest:",body"`
+}
+
+type configPreviewResponse struct {
+	// On holds the numbers of the relays that would
+	// be on with the previewed configuration.
+	On []int
+	// Relays holds an explanation of the assessed
+	// state of each relay that's assigned to a cohort
+	// in the previewed configuration.
+	Relays []hydroctl.RelayExplanation
+	// Warnings holds any warnings about the
+	// previewed configuration. A configuration
+	// with warnings can't be saved.
+	Warnings []string `json:",omitempty"`
+}
+
+// PreviewConfig assesses the relays with the posted configuration
+// and the current meter readings and history, and returns what the
+// relay state would be. The current configuration and the relays
+// aren't changed.
+func (h *apiHandler) PreviewConfig(p httprequest.Params, req *configPreviewRequest) (*configPreviewResponse, error) {
+	cfg, err := hydroconfig.Parse(req.Body.Config)
+	if err != nil {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "invalid configuration: %v", err)
+	}
+	ctlConfig := cfg.CtlConfig()
+	explanations, err := h.h.worker.ExplainConfig(p.Context, ctlConfig)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot assess relays")
+	}
+	resp := &configPreviewResponse{
+		On:     []int{},
+		Relays: []hydroctl.RelayExplanation{},
+	}
+	for _, w := range cfg.Warnings {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("warning at %q: %s", req.Body.Config[w.P0:w.P1], w.Message))
+	}
+	for _, e := range explanations {
+		if e.State {
+			resp.On = append(resp.On, e.Relay)
+		}
+		if ctlConfig.Relays[e.Relay].Cohort != "" {
+			resp.Relays = append(resp.Relays, e)
+		}
+	}
+	return resp, nil
+}
+
+type scheduleGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/schedule"`
+}
+
+type scheduleGetResponse struct {
+	// Relays holds an entry for each relay that
+	// has a scheduled change.
+	Relays []scheduledRelayChange
+}
+
+type scheduledRelayChange struct {
+	Relay int
+	// Time holds when the relay's slot next changes.
+	Time time.Time
+	// Slot holds the slot that becomes active at Time.
+	// It's empty if no slot becomes active.
+	Slot string `json:",omitempty"`
+}
+
+// GetSchedule returns the next scheduled slot change for each relay,
+// without taking into account power availability.
+func (h *apiHandler) GetSchedule(*scheduleGetRequest) (*scheduleGetResponse, error) {
+	cfg := h.h.store.CtlConfig()
+	resp := &scheduleGetResponse{
+		Relays: []scheduledRelayChange{},
+	}
+	if cfg == nil {
+		return resp, nil
+	}
+	for i, t := range cfg.NextTransitions(time.Now().In(h.h.p.TZ)) {
+		if t.Time.IsZero() {
+			continue
+		}
+		c := scheduledRelayChange{
+			Relay: i,
+			Time:  t.Time,
+		}
+		if t.Slot != nil {
+			c.Slot = t.Slot.String()
+		}
+		resp.Relays = append(resp.Relays, c)
+	}
+	return resp, nil
+}
+
+type schedulePreviewRequest struct {
+	httprequest.Route `httprequest:"GET /api/schedule/preview"`
+	// Date holds the day to preview, in 2006-01-02 format.
+	Date string `httprequest:"date,form"`
+}
+
+type schedulePreviewResponse struct {
+	Relays []schedulePreviewRelay
+}
+
+type schedulePreviewRelay struct {
+	Relay   int
+	Windows []scheduleWindow
+}
+
+// GetSchedulePreview returns the periods during which each relay would be
+// on during the requested day if there was always enough power available.
+func (h *apiHandler) GetSchedulePreview(req *schedulePreviewRequest) (*schedulePreviewResponse, error) {
+	day, err := time.ParseInLocation("2006-01-02", req.Date, h.h.p.TZ)
+	if err != nil {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "invalid date %q", req.Date)
+	}
+	cfg := h.h.store.CtlConfig()
+	resp := &schedulePreviewResponse{
+		Relays: []schedulePreviewRelay{},
+	}
+	if cfg == nil {
+		return resp, nil
+	}
+	for i, windows := range previewSchedule(cfg, day) {
+		if len(windows) == 0 {
+			continue
+		}
+		resp.Relays = append(resp.Relays, schedulePreviewRelay{
+			Relay:   i,
+			Windows: windows,
+		})
+	}
+	return resp, nil
+}
+
+// meterTestTimeout holds the maximum length of time
+// that a meter test will wait for the meter to respond.
+const meterTestTimeout = 5 * time.Second
+
+type meterTestRequest struct {
+	httprequest.Route `httprequest:"POST /api/meters/test"`
+	Body              struct {
+		// Addr holds the address of the meter to read.
+		Addr string
+	} `httprequest:",body"`
+}
+
+type meterTestResponse struct {
+	// Reading holds the meter reading if it succeeded.
+	Reading *ndmeter.Reading `json:",omitempty"`
+	// Error holds the reason for failure if it didn't.
+	Error string `json:",omitempty"`
+}
+
+// TestMeter reads the meter at the given address, so that
+// it's possible to check that the address works before
+// adding it to the meter configuration.
+func (h *apiHandler) TestMeter(p httprequest.Params, req *meterTestRequest) (*meterTestResponse, error) {
+	if err := h.checkController(p); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Body.Addr == "" {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "no meter address provided")
+	}
+	ctx, cancel := context.WithTimeout(p.Context, meterTestTimeout)
+	defer cancel()
+	reading, err := ndmeter.Get(ctx, req.Body.Addr)
+	if err != nil {
+		return &meterTestResponse{
+			Error: err.Error(),
+		}, nil
+	}
+	return &meterTestResponse{
+		Reading: &reading,
+	}, nil
+}
+
+type recentMetersGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/meters/recent"`
+}
+
+type recentMetersGetResponse struct {
+	// States holds the recent power usage, oldest first.
+	States []recentMeterState
+}
+
+type recentMeterState struct {
+	Time       time.Time
+	Chargeable hydroctl.PowerChargeable
+	Use        hydroctl.PowerUse
+}
+
+// GetRecentMeters returns recently acquired meter readings, so that
+// the front end can show short-term power trends.
+func (h *apiHandler) GetRecentMeters(*recentMetersGetRequest) (*recentMetersGetResponse, error) {
+	states := h.h.meterWorker.RecentMeterStates()
+	resp := &recentMetersGetResponse{
+		States: make([]recentMeterState, len(states)),
+	}
+	for i, s := range states {
+		resp.States[i] = recentMeterState{
+			Time:       s.Time,
+			Chargeable: s.Chargeable,
+			Use:        s.Use,
+		}
+	}
+	return resp, nil
+}
+
+type metersGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/meters"`
+}
+
+type metersGetResponse struct {
+	Meters []meterStatus
+}
+
+type meterStatus struct {
+	Meter meterworker.Meter
+	// LastSampleTime holds the time of the most recent
+	// sample from the meter. It's zero if there's none.
+	LastSampleTime time.Time
+	// Lag holds the age of the most recent sample when
+	// the meters were last read.
+	Lag time.Duration
+	// RoundTrip holds the usual time taken by requests
+	// to the meter, or zero if it's not known.
+	RoundTrip time.Duration
+	// Reachable holds whether the most recent sample
+	// is recent enough that the meter is considered to
+	// be responding.
+	Reachable bool
+}
+
+// GetMeters returns the configured meters along with
+// whether each one is currently reachable.
+func (h *apiHandler) GetMeters(*metersGetRequest) (*metersGetResponse, error) {
+	resp := &metersGetResponse{
+		Meters: []meterStatus{},
+	}
+	ms := h.h.store.meterState()
+	if ms == nil {
+		return resp, nil
+	}
+	roundTrip := roundTripAllowance(ms, h.h.p.ExpectedMaxRoundTrip)
+	for _, m := range ms.Meters {
+		st := meterStatus{
+			Meter: m,
+		}
+		if s := ms.Samples[m.Addr]; s != nil {
+			st.LastSampleTime = s.Time
+			st.Lag = ms.Time.Sub(s.Time)
+			st.RoundTrip = s.RoundTrip
+			st.Reachable = st.Lag <= sampleAllowedLag(s, roundTrip)
+		}
+		resp.Meters = append(resp.Meters, st)
+	}
+	return resp, nil
+}
+
+type logGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/log"`
+}
+
+type logGetResponse struct {
+	// Entries holds the most recent relay assessment
+	// log entries, oldest first.
+	Entries []hydroworker.LogEntry
+}
+
+// GetLog returns the recent log messages from the relay
+// assessments so that the decisions can be seen in the UI.
+func (h *apiHandler) GetLog(*logGetRequest) (*logGetResponse, error) {
+	entries := h.h.worker.RecentLog()
+	if entries == nil {
+		entries = []hydroworker.LogEntry{}
+	}
+	return &logGetResponse{
+		Entries: entries,
+	}, nil
+}
+
+type relayDiagnoseRequest struct {
+	httprequest.Route `httprequest:"GET /api/relays/:relay/diagnose"`
+	Relay             int `httprequest:"relay,path"`
+}
+
+// DiagnoseRelay assesses the relays with the current inputs and
+// returns an explanation of why the given relay is in the state
+// it would be put in; for example, that it's not on because
+// there isn't enough available power.
+func (h *apiHandler) DiagnoseRelay(p httprequest.Params, req *relayDiagnoseRequest) (*hydroctl.RelayExplanation, error) {
+	if req.Relay < 0 || req.Relay >= hydroctl.MaxRelayCount {
+		return nil, httprequest.Errorf(httprequest.CodeNotFound, "relay %d not found", req.Relay)
+	}
+	explanations, err := h.h.worker.Explain(p.Context)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot assess relays")
+	}
+	if req.Relay >= len(explanations) {
+		return nil, httprequest.Errorf(httprequest.CodeNotFound, "relay %d is not configured", req.Relay)
+	}
+	return &explanations[req.Relay], nil
+}
+
+type relaysGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/relays"`
+	// Board and Terminal, if non-empty, restrict the
+	// result to relays at the given physical position.
+	Board    string `httprequest:"board,form"`
+	Terminal string `httprequest:"terminal,form"`
+}
+
+type relaysGetResponse struct {
+	Relays []relayStatus
+}
+
+type relayStatus struct {
+	Relay  int
+	Cohort string
+	On     bool
+	// Position holds the physical position of the
+	// relay, or nil if it's not configured.
+	Position *hydroctl.RelayPosition
+}
+
+// GetRelays returns the current state of all the relays that
+// are configured or on, along with their physical positions.
+func (h *apiHandler) GetRelays(req *relaysGetRequest) (*relaysGetResponse, error) {
+	board, err := parsePositionNumber(req.Board)
+	if err != nil {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "invalid board number %q", req.Board)
+	}
+	terminal, err := parsePositionNumber(req.Terminal)
+	if err != nil {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "invalid terminal number %q", req.Terminal)
+	}
+	var cfg hydroctl.Config
+	if c := h.h.store.CtlConfig(); c != nil {
+		cfg = *c
+	}
+	ws := h.h.store.WorkerState()
+	resp := &relaysGetResponse{
+		Relays: []relayStatus{},
+	}
+	for i := 0; i < hydroctl.MaxRelayCount; i++ {
+		st := relayStatus{
+			Relay: i,
+		}
+		if i < len(cfg.Relays) {
+			st.Cohort = cfg.Relays[i].Cohort
+			st.Position = cfg.Relays[i].Position
+		}
+		if ws != nil {
+			st.On = ws.Relays[i].On
+		}
+		if st.Cohort == "" && st.Position == nil && !st.On {
+			continue
+		}
+		if board >= 0 && (st.Position == nil || st.Position.Board != board) {
+			continue
+		}
+		if terminal >= 0 && (st.Position == nil || st.Position.Terminal != terminal) {
+			continue
+		}
+		resp.Relays = append(resp.Relays, st)
+	}
+	return resp, nil
+}
+
+// parsePositionNumber parses a board or terminal number
+// as used in a relay position. It returns -1 if s is empty.
+func parsePositionNumber(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errgo.Newf("invalid position number")
+	}
+	return n, nil
+}
+
+type assessNowRequest struct {
+	httprequest.Route `httprequest:"POST /api/assess-now"`
+}
+
+type assessNowResponse struct {
+	// On holds the numbers of the relays that
+	// are on after the assessment.
+	On []int
+}
+
+// AssessNow reads the meters and assesses the relays immediately
+// rather than waiting for the next scheduled assessment, and
+// returns the resulting relay state.
+func (h *apiHandler) AssessNow(p httprequest.Params, req *assessNowRequest) (*assessNowResponse, error) {
+	if err := h.checkController(p); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	state, err := h.h.worker.AssessNow(p.Context)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot assess relays")
+	}
+	resp := &assessNowResponse{
+		On: []int{},
+	}
+	for i := 0; i < hydroctl.MaxRelayCount; i++ {
+		if state.IsSet(i) {
+			resp.On = append(resp.On, i)
+		}
+	}
+	return resp, nil
+}
+
+type pausedPutRequest struct {
+	httprequest.Route `httprequest:"PUT /api/paused"`
+	Body              struct {
+		// Paused holds whether relay control should be paused.
+		Paused bool
+	} `httprequest:",body"`
+}
+
+// SetPaused pauses or resumes relay control. While it's paused,
+// the relays are left as they are.
+func (h *apiHandler) SetPaused(p httprequest.Params, req *pausedPutRequest) error {
+	if err := h.checkController(p); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	h.h.worker.SetPaused(req.Body.Paused)
+	return nil
+}
+
+type relayOverridePutRequest struct {
+	httprequest.Route `httprequest:"PUT /api/relays/:relay/override"`
+	Relay             int `httprequest:"relay,path"`
+	Body              struct {
+		// On holds whether the relay is forced on or off.
+		On bool
+		// Duration holds how long the override lasts for.
+		Duration string
+	} `httprequest:",body"`
+}
+
+// SetRelayOverride forces a relay on or off for a while,
+// regardless of its configuration, from the next assessment.
+// See hydroworker.Worker.SetOverride.
+func (h *apiHandler) SetRelayOverride(p httprequest.Params, req *relayOverridePutRequest) error {
+	if err := h.checkController(p); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Relay < 0 || req.Relay >= hydroctl.MaxRelayCount {
+		return httprequest.Errorf(httprequest.CodeNotFound, "relay %d not found", req.Relay)
+	}
+	d, err := time.ParseDuration(req.Body.Duration)
+	if err != nil || d <= 0 {
+		return httprequest.Errorf(httprequest.CodeBadRequest, "invalid override duration %q", req.Body.Duration)
+	}
+	if err := h.h.worker.SetOverride(req.Relay, hydroworker.Override{
+		On:    req.Body.On,
+		Until: time.Now().Add(d),
+	}); err != nil {
+		return errgo.Mask(err)
+	}
+	log.Printf("relay %d overridden (on %v) for %v", req.Relay, req.Body.On, d)
+	return nil
+}
+
+type relayOverrideDeleteRequest struct {
+	httprequest.Route `httprequest:"DELETE /api/relays/:relay/override"`
+	Relay             int `httprequest:"relay,path"`
+}
+
+// ClearRelayOverride removes any override for a relay,
+// so that it follows its configuration again.
+func (h *apiHandler) ClearRelayOverride(p httprequest.Params, req *relayOverrideDeleteRequest) error {
+	if err := h.checkController(p); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Relay < 0 || req.Relay >= hydroctl.MaxRelayCount {
+		return httprequest.Errorf(httprequest.CodeNotFound, "relay %d not found", req.Relay)
+	}
+	h.h.worker.ClearOverride(req.Relay)
+	return nil
+}
+
+type cohortDisabledPutRequest struct {
+	httprequest.Route `httprequest:"PUT /api/cohorts/:cohort/disabled"`
+	Cohort            string `httprequest:"cohort,path"`
+	Body              struct {
+		// Disabled holds whether the cohort should be disabled.
+		Disabled bool
+	} `httprequest:",body"`
+}
+
+// SetCohortDisabled disables or enables a cohort. The relays
+// in a disabled cohort are always off, whatever their
+// configured slots. The setting is kept separately from
+// the configuration text, so it's retained when the
+// configuration changes.
+func (h *apiHandler) SetCohortDisabled(p httprequest.Params, req *cohortDisabledPutRequest) error {
+	if err := h.checkController(p); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.h.store.setCohortDisabled(req.Cohort, req.Body.Disabled); err != nil {
+		if errgo.Cause(err) == errUnknownCohort {
+			return httprequest.Errorf(httprequest.CodeBadRequest, "%v", err)
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+type commissionRequest struct {
+	httprequest.Route `httprequest:"POST /api/commission"`
+	Body              struct {
+		// Duration holds how long each relay is turned on for.
+		// If it's empty, DefaultCommissionPulse is used.
+		Duration string
+		// Force specifies that the relays should be pulsed even
+		// when relay control is active, in which case it's paused
+		// until all the relays have been pulsed.
+		Force bool
+	} `httprequest:",body"`
+}
+
+type commissionResponse struct {
+	// Relays holds the relays that were pulsed, in order.
+	Relays []int
+}
+
+// DefaultCommissionPulse holds the default length of
+// time for which each relay is turned on when commissioning.
+const DefaultCommissionPulse = time.Second
+
+// maxCommissionPulse holds the longest pulse that
+// the relay controller supports.
+const maxCommissionPulse = 25 * time.Second
+
+// Commission turns each configured relay on in turn for a short time
+// so that the wiring can be checked by watching the contactors.
+// Relay control must be paused first unless Force is specified.
+// It returns when all the relays have been pulsed.
+func (h *apiHandler) Commission(p httprequest.Params, req *commissionRequest) (*commissionResponse, error) {
+	if err := h.checkController(p); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	duration := DefaultCommissionPulse
+	if req.Body.Duration != "" {
+		d, err := time.ParseDuration(req.Body.Duration)
+		if err != nil || d <= 0 {
+			return nil, httprequest.Errorf(httprequest.CodeBadRequest, "invalid pulse duration %q", req.Body.Duration)
+		}
+		if d > maxCommissionPulse {
+			return nil, httprequest.Errorf(httprequest.CodeBadRequest, "pulse duration %v is too long (maximum %v)", d, maxCommissionPulse)
+		}
+		duration = d
+	}
+	h.h.commissionMu.Lock()
+	defer h.h.commissionMu.Unlock()
+	if !h.h.worker.Paused() {
+		if !req.Body.Force {
+			return nil, httprequest.Errorf(httprequest.CodeBadRequest, "relay control is active; pause it or force commissioning")
+		}
+		h.h.worker.SetPaused(true)
+		defer h.h.worker.SetPaused(false)
+	}
+	var relays []int
+	if cfg := h.h.store.CtlConfig(); cfg != nil {
+		for i, r := range cfg.Relays {
+			if i < eth8020.NumRelays && (r.Cohort != "" || r.Position != nil) {
+				relays = append(relays, i)
+			}
+		}
+	}
+	if len(relays) == 0 {
+		return nil, httprequest.Errorf(httprequest.CodeBadRequest, "no relays configured")
+	}
+	for _, relay := range relays {
+		log.Printf("commissioning: pulsing relay %d for %v", relay, duration)
+		if err := h.h.controller.PulseRelay(relay, duration); err != nil {
+			return nil, errgo.Notef(err, "cannot pulse relay %d", relay)
+		}
+		// Wait for the pulse to finish, and then as long again
+		// so that it's clear which contactor is which.
+		select {
+		case <-time.After(2 * duration):
+		case <-p.Context.Done():
+			return nil, errgo.Notef(p.Context.Err(), "commissioning stopped after relay %d", relay)
+		}
+	}
+	log.Printf("commissioning: pulsed relays %v", relays)
+	return &commissionResponse{
+		Relays: relays,
+	}, nil
+}
+
+type backupGetRequest struct {
+	httprequest.Route `httprequest:"GET /api/backup"`
+}
+
+// GetBackup streams a tar archive holding the configuration,
+// relay history and meter samples, suitable for restoring
+// the server's state from scratch. It's only available to
+// clients that provide the control password, if there is one,
+// because it includes the relay controller address.
+func (h *apiHandler) GetBackup(p httprequest.Params, req *backupGetRequest) {
+	if !h.h.checkController(p.Response, p.Request) {
+		return
+	}
+	p.Response.Header().Set("Content-Type", "application/x-tar")
+	p.Response.Header().Set("Content-Disposition", `attachment; filename="hydro-backup-`+time.Now().In(h.h.p.TZ).Format("2006-01-02")+`.tar"`)
+	if err := writeBackup(p.Response, h.h.p); err != nil {
+		// We've already started writing the response,
+		// so all we can do is log the error.
+		log.Printf("cannot write backup: %v", err)
+	}
+}
+
+type restoreRequest struct {
+	httprequest.Route `httprequest:"POST /api/restore"`
+	// Force specifies that the backup should be restored
+	// even if it would overwrite existing state.
+	Force bool `httprequest:"force,form"`
+}
+
+type restoreResponse struct {
+	// RestartRequired holds whether the server needs
+	// to be restarted before the restored relay history
+	// takes effect.
+	RestartRequired bool
+}
+
+// Restore restores the server state from a backup archive
+// as produced by GetBackup, held in the request body.
+// Like GetBackup, it's only available to controllers.
+func (h *apiHandler) Restore(p httprequest.Params, req *restoreRequest) (*restoreResponse, error) {
+	if err := h.checkController(p); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if !req.Force && h.h.hasState() {
+		return nil, httprequest.Errorf(httprequest.CodeForbidden, "server already has state; use force=true to overwrite it")
+	}
+	restartRequired, err := h.h.restoreBackup(p.Request.Body)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &restoreResponse{
+		RestartRequired: restartRequired,
+	}, nil
+}
@@ -0,0 +1,746 @@
+package hydroserver
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/eth8020"
+	"github.com/rogpeppe/hydro/eth8020test"
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/hydroworker"
+	"github.com/rogpeppe/hydro/meterworker"
+	"github.com/rogpeppe/hydro/ndmeter"
+	"github.com/rogpeppe/hydro/ndmetertest"
+)
+
+func TestGetEffectiveConfig(t *testing.T) {
+	c := qt.New(t)
+	configPath := filepath.Join(c.Mkdir(), "config")
+	err := ioutil.WriteFile(configPath, []byte(`
+relay 6 is dining room
+relays 0, 4 are bedrooms
+relay 4 has max power 300w
+
+dining room on from 14:30 to 20:45 for at least 20m
+bedrooms on from 17:00 to 20:00
+`), 0666)
+	c.Assert(err, qt.IsNil)
+	store, err := newStore(configPath, DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	h := newAPIHandler(&Handler{
+		store: store,
+	})
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/effective-config", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+
+	var cfg struct {
+		Relays []json.RawMessage
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Relays, qt.HasLen, 32)
+	c.Assert(string(cfg.Relays[0]), qt.JSONEquals, map[string]interface{}{
+		"Mode":     2,
+		"MaxPower": 0,
+		"InUse": []interface{}{map[string]interface{}{
+			"Start":    "17:00",
+			"End":      "20:00",
+			"Kind":     4,
+			"Duration": 0,
+		}},
+		"NotInUse":  nil,
+		"Cohort":    "bedrooms",
+		"ShedGroup": "",
+		"Phase":     0,
+	})
+	c.Assert(string(cfg.Relays[4]), qt.JSONEquals, map[string]interface{}{
+		"Mode":     2,
+		"MaxPower": 300,
+		"InUse": []interface{}{map[string]interface{}{
+			"Start":    "17:00",
+			"End":      "20:00",
+			"Kind":     4,
+			"Duration": 0,
+		}},
+		"NotInUse":  nil,
+		"Cohort":    "bedrooms",
+		"ShedGroup": "",
+		"Phase":     0,
+	})
+	c.Assert(string(cfg.Relays[6]), qt.JSONEquals, map[string]interface{}{
+		"Mode":     2,
+		"MaxPower": 0,
+		"InUse": []interface{}{map[string]interface{}{
+			"Start":    "14:30",
+			"End":      "20:45",
+			"Kind":     1,
+			"Duration": 20 * 60 * 1e9,
+		}},
+		"NotInUse":  nil,
+		"Cohort":    "dining room",
+		"ShedGroup": "",
+		"Phase":     0,
+	})
+}
+
+func TestMeterTest(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	srv.SetPower(1500)
+	srv.SetEnergy(25000)
+
+	resp := testMeter(c, srv.Addr)
+	c.Assert(resp, qt.DeepEquals, meterTestResponse{
+		Reading: &ndmeter.Reading{
+			Model:       "350",
+			ActivePower: 1500,
+			TotalEnergy: 25000,
+		},
+	})
+}
+
+func TestMeterTestConnectionRefused(t *testing.T) {
+	c := qt.New(t)
+	// Find an address that nothing is listening on.
+	lis, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, qt.IsNil)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	resp := testMeter(c, addr)
+	c.Assert(resp.Reading, qt.IsNil)
+	c.Assert(resp.Error, qt.Matches, `cannot fetch live values: .*connection refused`)
+}
+
+func TestGetBackup(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	files := map[string]string{
+		"relayaddr":       "relays:80",
+		"relayconfig":     "relay 0 is heater",
+		"meterconfig":     `{"Meters":[]}`,
+		"disabledcohorts": `{"Disabled":["heater"]}`,
+		// Note: no history file, so it's omitted from the archive.
+		"samples/generator-meter1·80/log-2020-01-02.sample": "1577923200000,1000\n",
+		"samples/generator-meter1·80/manual.sample":         "1577836800000,500\n",
+		"samples/here-meter2·80/log-2020-01-02.sample":      "1577923200000,2000\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+	h := newAPIHandler(&Handler{
+		p: Params{
+			RelayAddrPath:       filepath.Join(dir, "relayaddr"),
+			ConfigPath:          filepath.Join(dir, "relayconfig"),
+			MeterConfigPath:     filepath.Join(dir, "meterconfig"),
+			DisabledCohortsPath: filepath.Join(dir, "disabledcohorts"),
+			HistoryPath:         filepath.Join(dir, "history"),
+			SampleDirPath:       filepath.Join(dir, "samples"),
+			TZ:                  time.UTC,
+		},
+	})
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/backup", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/x-tar")
+
+	got := make(map[string]string)
+	tr := tar.NewReader(rec.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.IsNil)
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, qt.IsNil)
+		got[hdr.Name] = string(data)
+	}
+	c.Assert(got, qt.DeepEquals, files)
+}
+
+// testMeter makes a meter test API request for the given
+// address and returns the response.
+func testMeter(c *qt.C, addr string) meterTestResponse {
+	h := newAPIHandler(&Handler{})
+	body, err := json.Marshal(map[string]string{
+		"Addr": addr,
+	})
+	c.Assert(err, qt.IsNil)
+	req, err := http.NewRequest("POST", "/api/meters/test", strings.NewReader(string(body)))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp meterTestResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	return resp
+}
+
+func TestDiagnoseRelayNotFound(t *testing.T) {
+	c := qt.New(t)
+	h := newAPIHandler(&Handler{})
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/relays/32/diagnose", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusNotFound, qt.Commentf("body: %s", rec.Body))
+}
+
+func TestGetLog(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+	h := newTestServer(c, c.Mkdir(), Params{
+		Heartbeat: 10 * time.Millisecond,
+	})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err = h.controller.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	// Wait for the worker to make an assessment.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/log", nil)
+		c.Assert(err, qt.IsNil)
+		h.ServeHTTP(rec, req)
+		c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+		var resp logGetResponse
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		c.Assert(err, qt.IsNil)
+		for _, e := range resp.Entries {
+			if strings.HasPrefix(e.Message, "meter readings at ") {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("no assessment found in log; got %#v", resp.Entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAssessNow(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+	// Write the configuration before starting the server
+	// so that the worker starts with it, and use a long
+	// heartbeat so that there are no further scheduled
+	// assessments after the first one.
+	dir := c.Mkdir()
+	err = ioutil.WriteFile(filepath.Join(dir, "relayconfig"), []byte("relay 0 is heater\nheater on\n"), 0666)
+	c.Assert(err, qt.IsNil)
+	h := newTestServer(c, dir, Params{
+		Heartbeat: time.Hour,
+	})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err = h.controller.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/assess-now", http.NoBody)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp assessNowResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, assessNowResponse{
+		On: []int{0},
+	})
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(1))
+}
+
+func TestPreviewConfig(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+	dir := c.Mkdir()
+	h := newTestServer(c, dir, Params{
+		Heartbeat: time.Hour,
+	})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err = h.controller.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	preview := func(config string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]string{
+			"Config": config,
+		})
+		c.Assert(err, qt.IsNil)
+		req, err := http.NewRequest("POST", "/api/config/preview", strings.NewReader(string(body)))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := preview("relay 1 is pump\npump on\n")
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp configPreviewResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, configPreviewResponse{
+		On: []int{1},
+		Relays: []hydroctl.RelayExplanation{{
+			Relay:    1,
+			Want:     true,
+			Priority: "absolute",
+			State:    true,
+		}},
+	})
+
+	// The running configuration and the relays are unchanged.
+	c.Assert(h.store.ConfigText(), qt.Equals, "")
+	_, err = os.Stat(filepath.Join(dir, "relayconfig"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(0))
+
+	rec = preview("relay 1 is\n")
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, "invalid configuration: ")
+
+	// Warnings are reported along with the preview.
+	rec = preview("relay 1 is pump\npump on from 01:00 to 02:00 for at least 3h\n")
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	resp = configPreviewResponse{}
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Warnings, qt.DeepEquals, []string{
+		`warning at "3h": duration 3h0m0s is longer than the slot (1h0m0s)`,
+	})
+}
+
+func TestGetMeters(t *testing.T) {
+	c := qt.New(t)
+	meterSrv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer meterSrv.Close()
+	// Find an address that nothing is listening on.
+	lis, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, qt.IsNil)
+	deadAddr := lis.Addr().String()
+	lis.Close()
+
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	meters := []meterworker.Meter{{
+		Name:     "generator",
+		Addr:     meterSrv.Addr,
+		Location: hydroreport.LocGenerator,
+	}, {
+		Name:     "here",
+		Addr:     deadAddr,
+		Location: hydroreport.LocHere,
+	}}
+	err = h.meterWorker.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = h.meterWorker.ReadMeters(ctx)
+	c.Assert(err, qt.ErrorMatches, `failed to get meter readings from \[`+deadAddr+`\]`)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/meters", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp metersGetResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Meters, qt.HasLen, 2)
+
+	c.Assert(resp.Meters[0].Meter, qt.DeepEquals, meters[0])
+	c.Assert(resp.Meters[0].Reachable, qt.IsTrue)
+	c.Assert(resp.Meters[0].LastSampleTime.IsZero(), qt.IsFalse)
+
+	c.Assert(resp.Meters[1].Meter, qt.DeepEquals, meters[1])
+	c.Assert(resp.Meters[1].Reachable, qt.IsFalse)
+	c.Assert(resp.Meters[1].LastSampleTime.IsZero(), qt.IsTrue)
+}
+
+func TestGetMetersStaleSample(t *testing.T) {
+	c := qt.New(t)
+	store, err := newStore(filepath.Join(c.Mkdir(), "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := meterworker.Meter{
+		Name:       "here",
+		Addr:       "localhost:1234",
+		Location:   hydroreport.LocHere,
+		AllowedLag: time.Second,
+	}
+	// The meter was last read successfully a minute ago.
+	store.UpdateMeterState(&meterworker.MeterState{
+		Time:   now,
+		Meters: []meterworker.Meter{m},
+		Samples: map[string]*meterworker.MeterSample{
+			m.Addr: {
+				Sample: &ndmeter.Sample{
+					Time: now.Add(-time.Minute),
+				},
+				AllowedLag: time.Second,
+			},
+		},
+	})
+	h := newAPIHandler(&Handler{
+		store: store,
+	})
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/meters", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp metersGetResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Meters, qt.HasLen, 1)
+	c.Assert(resp.Meters[0].Reachable, qt.IsFalse)
+	c.Assert(resp.Meters[0].Lag, qt.Equals, time.Minute)
+	c.Assert(resp.Meters[0].LastSampleTime.Equal(now.Add(-time.Minute)), qt.IsTrue)
+}
+
+func TestGetRelays(t *testing.T) {
+	c := qt.New(t)
+	configPath := filepath.Join(c.Mkdir(), "config")
+	store, err := newStore(configPath, DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	err = store.setConfigText(`
+relays 0, 4 are bedrooms
+relay 6 is dining room
+relay 0 has position board 1 terminal 3
+relay 4 has position board 1 terminal 5
+relay 9 has position board 2 terminal 3
+`)
+	c.Assert(err, qt.IsNil)
+
+	// The positions are persisted with the configuration.
+	store, err = newStore(configPath, DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	ws := &hydroworker.Update{
+		State: 1<<4 | 1<<6,
+	}
+	ws.Relays[4].On = true
+	ws.Relays[6].On = true
+	store.UpdateWorkerState(ws)
+	h := newAPIHandler(&Handler{
+		store: store,
+	})
+	getRelays := func(query string) []relayStatus {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/relays"+query, nil)
+		c.Assert(err, qt.IsNil)
+		h.ServeHTTP(rec, req)
+		c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+		var resp relaysGetResponse
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		c.Assert(err, qt.IsNil)
+		return resp.Relays
+	}
+	c.Assert(getRelays(""), qt.DeepEquals, []relayStatus{{
+		Relay:    0,
+		Cohort:   "bedrooms",
+		Position: &hydroctl.RelayPosition{Board: 1, Terminal: 3},
+	}, {
+		Relay:    4,
+		Cohort:   "bedrooms",
+		On:       true,
+		Position: &hydroctl.RelayPosition{Board: 1, Terminal: 5},
+	}, {
+		Relay:  6,
+		Cohort: "dining room",
+		On:     true,
+	}, {
+		Relay:    9,
+		Position: &hydroctl.RelayPosition{Board: 2, Terminal: 3},
+	}})
+	c.Assert(getRelays("?board=1&terminal=5"), qt.DeepEquals, []relayStatus{{
+		Relay:    4,
+		Cohort:   "bedrooms",
+		On:       true,
+		Position: &hydroctl.RelayPosition{Board: 1, Terminal: 5},
+	}})
+	c.Assert(getRelays("?terminal=3"), qt.HasLen, 2)
+	c.Assert(getRelays("?board=3"), qt.HasLen, 0)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/relays?board=x", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+}
+
+func TestCommission(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+	dir := c.Mkdir()
+	err = ioutil.WriteFile(filepath.Join(dir, "relayconfig"), []byte(`
+relays 0, 5 are heaters
+relay 3 has position board 1 terminal 2
+relay 5 has inverted output
+`), 0666)
+	c.Assert(err, qt.IsNil)
+	h := newTestServer(c, dir, Params{
+		Heartbeat: time.Hour,
+	})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err = h.controller.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	commission := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/api/commission", strings.NewReader(body))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// Commissioning is refused while relay control is active.
+	rec := commission(`{"Duration": "100ms"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, "relay control is active")
+	c.Assert(relaySrv.Pulses(), qt.HasLen, 0)
+
+	rec = commission(`{"Duration": "100ms", "Force": true}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp commissionResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Relays, qt.DeepEquals, []int{0, 3, 5})
+	c.Assert(relaySrv.Pulses(), qt.DeepEquals, []eth8020test.Pulse{{
+		Relay:    0,
+		On:       true,
+		Duration: 100 * time.Millisecond,
+	}, {
+		Relay:    3,
+		On:       true,
+		Duration: 100 * time.Millisecond,
+	}, {
+		Relay: 5,
+		// The relay is inverted, so its output is
+		// turned off to turn it on.
+		On:       false,
+		Duration: 100 * time.Millisecond,
+	}})
+	// Relay control resumes afterwards.
+	c.Assert(h.worker.Paused(), qt.IsFalse)
+
+	// When relay control is paused, no force is needed,
+	// and it stays paused afterwards.
+	rec = httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/api/paused", strings.NewReader(`{"Paused": true}`))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	rec = commission(`{"Duration": "100ms"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(relaySrv.Pulses(), qt.HasLen, 6)
+	c.Assert(h.worker.Paused(), qt.IsTrue)
+
+	rec = commission(`{"Duration": "1h"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+}
+
+func TestGetVersion(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&debugReadBuildInfo, func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{
+			GoVersion: "go1.99",
+			Main: debug.Module{
+				Path:    "github.com/rogpeppe/hydro",
+				Version: "v1.2.3",
+			},
+			Settings: []debug.BuildSetting{{
+				Key:   "vcs.revision",
+				Value: "0123456789abcdef0123456789abcdef01234567",
+			}, {
+				Key:   "vcs.time",
+				Value: "2020-01-02T03:04:05Z",
+			}, {
+				Key:   "vcs.modified",
+				Value: "true",
+			}},
+		}, true
+	})
+	h := newAPIHandler(&Handler{})
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/version", nil)
+	c.Assert(err, qt.IsNil)
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var resp VersionInfo
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, VersionInfo{
+		Version:    "v1.2.3",
+		Commit:     "0123456789abcdef0123456789abcdef01234567",
+		CommitTime: "2020-01-02T03:04:05Z",
+		Modified:   true,
+		GoVersion:  "go1.99",
+	})
+	c.Assert(resp.String(), qt.Equals, "v1.2.3 (commit 0123456789ab, modified, go1.99)")
+
+	// When there's no build information, the version is unknown.
+	c.Patch(&debugReadBuildInfo, func() (*debug.BuildInfo, bool) {
+		return nil, false
+	})
+	v := BuildVersion()
+	c.Assert(v.Version, qt.Equals, "unknown")
+	c.Assert(v.GoVersion, qt.Equals, runtime.Version())
+}
+
+func TestSetCohortDisabled(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	h := newTestServer(c, dir, Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err := h.store.setConfigText(`
+relays 0, 1 are heating
+relay 2 is lights
+heating on from 00:00 to 12:00
+heating on from 12:00 to 00:00 for at least 1h
+lights on
+`)
+	c.Assert(err, qt.IsNil)
+	setDisabled := func(cohort, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/api/cohorts/"+cohort+"/disabled", strings.NewReader(body))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// assess returns the relay state assessed for the current
+	// configuration at the given time, when all the relays
+	// are on and there's plenty of power available.
+	assess := func(now time.Time) hydroctl.RelayState {
+		hdb, err := history.New(&history.MemStore{})
+		c.Assert(err, qt.IsNil)
+		return hydroctl.Assess(hydroctl.AssessParams{
+			Config:       h.store.CtlConfig(),
+			CurrentState: 1<<0 | 1<<1 | 1<<2,
+			History:      hdb,
+			PowerUseSample: hydroctl.PowerUseSample{
+				T0: now,
+				T1: now,
+				PowerUse: hydroctl.PowerUse{
+					Generated: 100000,
+				},
+			},
+			Now: now,
+		})
+	}
+	morning := time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC)
+	evening := time.Date(2020, 1, 2, 23, 30, 0, 0, time.UTC)
+	c.Assert(assess(morning), qt.Equals, hydroctl.RelayState(1<<0|1<<1|1<<2))
+	c.Assert(assess(evening), qt.Equals, hydroctl.RelayState(1<<0|1<<1|1<<2))
+
+	rec := setDisabled("Heating", `{"Disabled": true}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(h.store.DisabledCohorts(), qt.DeepEquals, []string{"heating"})
+
+	// The disabled cohort's relays stay off whatever their slots.
+	cfg := h.store.CtlConfig()
+	for _, r := range []int{0, 1} {
+		c.Assert(cfg.Relays[r].Mode, qt.Equals, hydroctl.AlwaysOff)
+	}
+	c.Assert(cfg.Relays[2].Mode, qt.Equals, hydroctl.AlwaysOn)
+	c.Assert(assess(morning), qt.Equals, hydroctl.RelayState(1<<2))
+	c.Assert(assess(evening), qt.Equals, hydroctl.RelayState(1<<2))
+
+	// The setting is persisted separately from the configuration text.
+	store, err := newStore(filepath.Join(dir, "relayconfig"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	err = store.loadDisabledCohorts(filepath.Join(dir, "disabledcohorts"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.DisabledCohorts(), qt.DeepEquals, []string{"heating"})
+	c.Assert(store.CtlConfig().Relays[0].Mode, qt.Equals, hydroctl.AlwaysOff)
+
+	rec = setDisabled("nothing", `{"Disabled": true}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, `unknown cohort \"nothing\"`)
+
+	// When it's enabled again, the relays follow their slots again.
+	rec = setDisabled("heating", `{"Disabled": false}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(h.store.DisabledCohorts(), qt.HasLen, 0)
+	c.Assert(assess(morning), qt.Equals, hydroctl.RelayState(1<<0|1<<1|1<<2))
+}
+
+func TestRelayOverride(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	before := time.Now()
+	rec := do("PUT", "/api/relays/3/override", `{"On": true, "Duration": "1h"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	overrides := h.worker.Overrides()
+	c.Assert(overrides, qt.HasLen, 1)
+	c.Assert(overrides[3].On, qt.IsTrue)
+	c.Assert(overrides[3].Until.Before(before.Add(time.Hour)), qt.IsFalse)
+
+	rec = do("PUT", "/api/relays/3/override", `{"On": true, "Duration": "never"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, `invalid override duration \"never\"`)
+
+	rec = do("PUT", "/api/relays/32/override", `{"On": true, "Duration": "1h"}`)
+	c.Assert(rec.Code, qt.Equals, http.StatusNotFound, qt.Commentf("body: %s", rec.Body))
+
+	rec = do("DELETE", "/api/relays/3/override", "")
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(h.worker.Overrides(), qt.HasLen, 0)
+}
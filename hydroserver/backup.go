@@ -0,0 +1,267 @@
+package hydroserver
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/rogpeppe/hydro/hydroconfig"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+// backupFiles holds the names of the files other than
+// samples that are held in a backup archive.
+var backupFiles = map[string]bool{
+	"relayaddr":       true,
+	"relayconfig":     true,
+	"meterconfig":     true,
+	"disabledcohorts": true,
+	"history":         true,
+}
+
+// writeBackup writes a tar archive to w holding all the state
+// needed to recover the server: the configuration files, the
+// relay history and all the meter samples. Files that don't
+// exist are omitted.
+func writeBackup(w io.Writer, p Params) error {
+	tw := tar.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		path string
+	}{
+		{"relayaddr", p.RelayAddrPath},
+		{"relayconfig", p.ConfigPath},
+		{"meterconfig", p.MeterConfigPath},
+		{"disabledcohorts", p.DisabledCohortsPath},
+		{"history", p.HistoryPath},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if err := addBackupFile(tw, f.name, f.path); err != nil && !os.IsNotExist(errgo.Cause(err)) {
+			return errgo.Mask(err)
+		}
+	}
+	if p.SampleDirPath != "" {
+		err := filepath.Walk(p.SampleDirPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(p.SampleDirPath, path)
+			if err != nil {
+				return err
+			}
+			return addBackupFile(tw, "samples/"+filepath.ToSlash(rel), path)
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(tw.Close())
+}
+
+// addBackupFile adds the file at the given path to tw with the given name.
+// Sample and history files can be appended to while we're reading them,
+// so only the data that was there when the file was opened is included.
+func addBackupFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errgo.Mask(err, os.IsNotExist)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := io.CopyN(tw, f, info.Size()); err != nil {
+		return errgo.Notef(err, "cannot copy %q", path)
+	}
+	return nil
+}
+
+// hasState reports whether the server has any meters,
+// relay configuration or samples, and so would lose
+// information if a backup was restored.
+func (h *Handler) hasState() bool {
+	if ms := h.store.meterState(); ms != nil && len(ms.Meters) > 0 {
+		return true
+	}
+	if strings.TrimSpace(h.store.ConfigText()) != "" {
+		return true
+	}
+	if h.p.SampleDirPath != "" {
+		infos, _ := ioutil.ReadDir(h.p.SampleDirPath)
+		if len(infos) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreBackup restores the server state from the backup archive
+// read from r, as written by writeBackup. The relay history can't be
+// changed while the server is running, so the history file is replaced
+// but the new history won't be used until the server is restarted;
+// restoreBackup reports whether that's the case.
+func (h *Handler) restoreBackup(r io.Reader) (restartRequired bool, _ error) {
+	if h.p.SampleDirPath == "" {
+		return false, errgo.Newf("cannot restore without a sample directory")
+	}
+	// Extract the archive next to the sample directory so that
+	// we can move the samples into place atomically.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(h.p.SampleDirPath), ".restore")
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := extractBackup(r, tmpDir, h.p.FileMode, h.p.DirMode); err != nil {
+		return false, httprequest.Errorf(httprequest.CodeBadRequest, "invalid backup archive: %v", err)
+	}
+	// Check everything before changing anything.
+	var mcfg struct {
+		Meters []meterworker.Meter
+	}
+	if err := readJSONFile(filepath.Join(tmpDir, "meterconfig"), &mcfg); err != nil && !os.IsNotExist(err) {
+		return false, httprequest.Errorf(httprequest.CodeBadRequest, "invalid meter configuration in backup: %v", err)
+	}
+	var relayCfg relayCtlConfig
+	if err := readJSONFile(filepath.Join(tmpDir, "relayaddr"), &relayCfg); err != nil && !os.IsNotExist(err) {
+		return false, httprequest.Errorf(httprequest.CodeBadRequest, "invalid relay address in backup: %v", err)
+	}
+	configText, err := ioutil.ReadFile(filepath.Join(tmpDir, "relayconfig"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, errgo.Mask(err)
+	}
+	if _, err := hydroconfig.Parse(string(configText)); err != nil {
+		return false, httprequest.Errorf(httprequest.CodeBadRequest, "invalid relay configuration in backup: %v", err)
+	}
+	var disabledCohorts disabledCohortsFile
+	if err := readJSONFile(filepath.Join(tmpDir, "disabledcohorts"), &disabledCohorts); err != nil && !os.IsNotExist(err) {
+		return false, httprequest.Errorf(httprequest.CodeBadRequest, "invalid disabled cohorts in backup: %v", err)
+	}
+
+	// Stop all the sample workers so that nothing is writing
+	// to the sample directory while we replace it.
+	if err := h.meterWorker.SetMeters(nil); err != nil {
+		return false, errgo.Notef(err, "cannot stop meters")
+	}
+	if err := os.RemoveAll(h.p.SampleDirPath); err != nil {
+		return false, errgo.Mask(err)
+	}
+	if err := os.Rename(filepath.Join(tmpDir, "samples"), h.p.SampleDirPath); err != nil {
+		if !os.IsNotExist(err) {
+			return false, errgo.Mask(err)
+		}
+		if err := os.MkdirAll(h.p.SampleDirPath, h.p.DirMode); err != nil {
+			return false, errgo.Mask(err)
+		}
+	}
+	// Restart the sample workers with the restored meters.
+	if err := h.meterWorker.SetMeters(mcfg.Meters); err != nil {
+		return false, errgo.Notef(err, "cannot set meters")
+	}
+	if err := h.store.setConfigText(string(configText)); err != nil {
+		return false, errgo.Notef(err, "cannot set relay configuration")
+	}
+	if h.p.DisabledCohortsPath != "" {
+		// A backup without any disabled cohorts
+		// has no disabled cohorts file.
+		if err := os.Rename(filepath.Join(tmpDir, "disabledcohorts"), h.p.DisabledCohortsPath); err != nil {
+			if !os.IsNotExist(err) {
+				return false, errgo.Mask(err)
+			}
+			if err := os.Remove(h.p.DisabledCohortsPath); err != nil && !os.IsNotExist(err) {
+				return false, errgo.Mask(err)
+			}
+		}
+		if err := h.store.loadDisabledCohorts(h.p.DisabledCohortsPath); err != nil {
+			return false, errgo.Mask(err)
+		}
+	}
+	if relayCfg.Addr != "" {
+		if err := h.controller.SetRelayAddr(relayCfg.Addr); err != nil {
+			return false, errgo.Mask(err)
+		}
+	}
+	if err := os.Rename(filepath.Join(tmpDir, "history"), h.p.HistoryPath); err != nil {
+		if !os.IsNotExist(err) {
+			return false, errgo.Mask(err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// extractBackup extracts the files from the backup archive
+// read from r into dir, checking that all the entries are
+// ones that writeBackup could have produced. Files and directories
+// are created with the given permissions.
+func extractBackup(r io.Reader, dir string, fileMode, dirMode os.FileMode) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected non-regular file %q", hdr.Name)
+		}
+		name := path.Clean(hdr.Name)
+		if name != hdr.Name || (!backupFiles[name] && !isBackupSampleFile(name)) {
+			return fmt.Errorf("unexpected file %q", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), dirMode); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isBackupSampleFile reports whether name is a valid
+// name for a sample file in a backup archive.
+func isBackupSampleFile(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != "samples" {
+		return false
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return false
+		}
+	}
+	return true
+}
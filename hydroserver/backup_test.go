@@ -0,0 +1,160 @@
+package hydroserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+func TestBackupRestore(t *testing.T) {
+	c := qt.New(t)
+	h0 := newTestServer(c, c.Mkdir(), Params{})
+	defer h0.meterWorker.Close()
+	meters := []meterworker.Meter{{
+		Name:     "generator",
+		Location: hydroreport.LocGenerator,
+		Addr:     "localhost:1",
+	}, {
+		Name:     "here",
+		Location: hydroreport.LocHere,
+		Addr:     "localhost:2",
+	}}
+	err := h0.meterWorker.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	err = h0.store.setConfigText("relay 0 is heater\nrelay 1 is lights\nheater on from 10:00 to 12:00\nlights on\n")
+	c.Assert(err, qt.IsNil)
+	err = h0.store.setCohortDisabled("lights", true)
+	c.Assert(err, qt.IsNil)
+	samples := []meterstat.Sample{{
+		Time:        time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		TotalEnergy: 1000,
+	}, {
+		Time:        time.Date(2020, 1, 2, 1, 0, 0, 0, time.UTC),
+		TotalEnergy: 2000,
+	}}
+	for _, m := range meters {
+		err := os.MkdirAll(filepath.Join(h0.p.SampleDirPath, m.SampleDir()), 0777)
+		c.Assert(err, qt.IsNil)
+		writeSampleFile(c, filepath.Join(h0.p.SampleDirPath, m.SampleDir(), "manual.sample"), samples)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/backup", nil)
+	c.Assert(err, qt.IsNil)
+	h0.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	backup := rec.Body.Bytes()
+
+	// The original server already has state, so the backup
+	// isn't restored unless it's forced.
+	rec = restore(c, h0, backup, "")
+	c.Assert(rec.Code, qt.Equals, http.StatusForbidden, qt.Commentf("body: %s", rec.Body))
+	rec = restore(c, h0, backup, "?force=true")
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+
+	// Restore onto a new server.
+	h1 := newTestServer(c, c.Mkdir(), Params{})
+	defer h1.meterWorker.Close()
+	rec = restore(c, h1, backup, "")
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+
+	c.Assert(h1.store.ConfigText(), qt.Equals, h0.store.ConfigText())
+	c.Assert(h1.store.DisabledCohorts(), qt.DeepEquals, []string{"lights"})
+	err = h1.store.loadDisabledCohorts(h1.p.DisabledCohortsPath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(h1.store.DisabledCohorts(), qt.DeepEquals, []string{"lights"})
+	var mcfg struct {
+		Meters []meterworker.Meter
+	}
+	err = readJSONFile(h1.p.MeterConfigPath, &mcfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(mcfg.Meters, qt.DeepEquals, meters)
+	for _, m := range meters {
+		sd, err := meterstat.ReadSampleDir(filepath.Join(h1.p.SampleDirPath, m.SampleDir()), "*.sample")
+		c.Assert(err, qt.IsNil)
+		r := sd.Open()
+		got, err := meterstat.ReadAllSamples(r)
+		r.Close()
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.DeepEquals, samples)
+	}
+}
+
+func TestRestoreRequiresControlPassword(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{
+		ControlPassword: "secret",
+	})
+	defer h.meterWorker.Close()
+	var buf bytes.Buffer
+	writeTarFile(c, &buf, "relayconfig", "relay 0 is heater\n")
+	rec := restore(c, h, buf.Bytes(), "?force=true")
+	c.Assert(rec.Code, qt.Equals, http.StatusUnauthorized, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("WWW-Authenticate"), qt.Equals, `Basic realm="hydro"`)
+	c.Assert(h.store.ConfigText(), qt.Equals, "")
+	c.Assert(h.hasState(), qt.IsFalse)
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	var buf bytes.Buffer
+	writeTarFile(c, &buf, "../evil", "x")
+	rec := restore(c, h, buf.Bytes(), "")
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, `unexpected file \"../evil\"`)
+}
+
+// newTestServer returns a new server with its state held
+// in the given directory. Any paths in p are ignored.
+// The caller is responsible for closing its meter worker.
+func newTestServer(c *qt.C, dir string, p Params) *Handler {
+	p.RelayAddrPath = filepath.Join(dir, "relayaddr")
+	p.ConfigPath = filepath.Join(dir, "relayconfig")
+	p.MeterConfigPath = filepath.Join(dir, "meterconfig")
+	p.HistoryPath = filepath.Join(dir, "history")
+	p.DisabledCohortsPath = filepath.Join(dir, "disabledcohorts")
+	p.SampleDirPath = filepath.Join(dir, "samples")
+	p.TZ = time.UTC
+	p.PollMeters = true
+	h, err := New(p)
+	c.Assert(err, qt.IsNil)
+	return h
+}
+
+// restore makes a restore API request to h with the given
+// backup archive and query.
+func restore(c *qt.C, h *Handler, backup []byte, query string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/api/restore"+query, bytes.NewReader(backup))
+	c.Assert(err, qt.IsNil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func writeTarFile(c *qt.C, buf *bytes.Buffer, name, content string) {
+	tw := tar.NewWriter(buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0666,
+		Size:     int64(len(content)),
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = tw.Write([]byte(content))
+	c.Assert(err, qt.IsNil)
+	err = tw.Close()
+	c.Assert(err, qt.IsNil)
+}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/rogpeppe/hydro/hydroconfig"
 	"github.com/rogpeppe/hydro/hydroreport"
 	"github.com/rogpeppe/hydro/meterworker"
 	"gopkg.in/errgo.v1"
@@ -30,21 +33,24 @@ var configTempl = newTemplate(`
 Relay controller address <input name="relayAddr" type="text" value="{{.Controller.RelayAddr}}">
 <br>
 <table>
-<tr><th>Meter</th><th>Addresses (space separated)</th><th>Max lag</th></tr>
+<tr><th>Meter</th><th>Addresses (space separated)</th><th>Max lag</th><th>Disabled</th></tr>
 <tr>
 	<td>Generator</td>
 	<td><input name="genMeterAddr" type="text" value="{{.GeneratorMeterAddrs | joinSp}}"></td>
 	<td><input name="genMeterLag" type="text" value="{{.GeneratorAllowedLag}}"></td>
+	<td><input name="genMeterDisabled" type="checkbox"{{if .GeneratorDisabled}} checked{{end}}></td>
 </tr>
 <tr>
 	<td>Aliday</td>
 	<td><input name="neighbourMeterAddr" type="text" value="{{.NeighbourMeterAddrs | joinSp}}"></td>
 	<td><input name="neighbourMeterLag" type="text" value="{{.NeighbourAllowedLag}}"></td>
+	<td><input name="neighbourMeterDisabled" type="checkbox"{{if .NeighbourDisabled}} checked{{end}}></td>
 </tr>
 <tr>
 	<td>Drynoch</td>
 	<td><input name="hereMeterAddr" type="text" value="{{.HereMeterAddrs | joinSp}}"></td>
 	<td><input name="hereMeterLag" type="text" value="{{.HereAllowedLag}}"></td>
+	<td><input name="hereMeterDisabled" type="checkbox"{{if .HereDisabled}} checked{{end}}></td>
 </tr>
 </table>
 <br>
@@ -116,6 +122,33 @@ between turning on any relay. It will never turn on more than one relay
 at a time.
 </li>
 <p>
+Meters may be declared with lines starting with the word "meter",
+giving the meter's address and its location, which must be
+one of "generator", "here" or "neighbour":
+<br>
+<tt>meter <i>host:port</i> is <i>location</i></tt>
+<br>
+<tt>meters <i>host:port</i>, <i>host:port...</i> are <i>location</i></tt>
+<br>
+The maximum lag of a meter's readings may be set like this:
+<br>
+<tt>meter <i>host:port</i> has max lag <i>duration</i></tt>
+<br>
+If a meter's clock isn't set to the same time zone as this
+server, its time zone may be set like this (for example "Europe/Paris"):
+<br>
+<tt>meter <i>host:port</i> has time zone <i>name</i></tt>
+<br>
+When any meters are declared in the configuration, the meter
+fields above are ignored.
+</p>
+<p>
+Lines starting with "#" are comments, except that a note on a relay,
+shown alongside the relay on the main page, can be added like this:
+<br>
+<tt># note relay <i>number</i>: <i>text</i></tt>
+</p>
+<p>
 For example:
 <p>
 <tt>
@@ -135,6 +168,9 @@ config cycle 10m
 
 func (h *Handler) serveConfig(w http.ResponseWriter, req *http.Request) {
 	log.Printf("serve %s %q", req.Method, req.URL)
+	if !h.checkController(w, req) {
+		return
+	}
 	switch req.Method {
 	case "GET":
 		h.serveConfigGet(w, req)
@@ -145,18 +181,45 @@ func (h *Handler) serveConfig(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// checkConfigWarnings returns an error holding any warnings
+// about the given configuration text. Warnings don't stop
+// a configuration from being loaded, but a new configuration
+// with warnings isn't saved, so the problems can be fixed.
+// The current configuration is allowed through unchanged,
+// so that the meters can still be changed.
+func checkConfigWarnings(text, current string) error {
+	if text == current {
+		return nil
+	}
+	cfg, err := hydroconfig.Parse(text)
+	if err != nil {
+		// setConfigText will report the error.
+		return nil
+	}
+	if len(cfg.Warnings) > 0 {
+		return &hydroconfig.ConfigParseError{
+			Config: text,
+			Errors: cfg.Warnings,
+		}
+	}
+	return nil
+}
+
 type configTemplateParams struct {
 	Store      *store
 	Controller *relayCtl
 
 	GeneratorMeterAddrs []string
 	GeneratorAllowedLag time.Duration
+	GeneratorDisabled   bool
 
 	NeighbourMeterAddrs []string
 	NeighbourAllowedLag time.Duration
+	NeighbourDisabled   bool
 
 	HereMeterAddrs []string
 	HereAllowedLag time.Duration
+	HereDisabled   bool
 }
 
 func (h *Handler) serveConfigGet(w http.ResponseWriter, req *http.Request) {
@@ -169,12 +232,15 @@ func (h *Handler) serveConfigGet(w http.ResponseWriter, req *http.Request) {
 		case hydroreport.LocGenerator:
 			p.GeneratorMeterAddrs = append(p.GeneratorMeterAddrs, m.Addr)
 			p.GeneratorAllowedLag = m.AllowedLag
+			p.GeneratorDisabled = p.GeneratorDisabled || m.Disabled
 		case hydroreport.LocNeighbour:
 			p.NeighbourMeterAddrs = append(p.NeighbourMeterAddrs, m.Addr)
 			p.NeighbourAllowedLag = m.AllowedLag
+			p.NeighbourDisabled = p.NeighbourDisabled || m.Disabled
 		case hydroreport.LocHere:
 			p.HereMeterAddrs = append(p.HereMeterAddrs, m.Addr)
 			p.HereAllowedLag = m.AllowedLag
+			p.HereDisabled = p.HereDisabled || m.Disabled
 		}
 	}
 
@@ -188,8 +254,20 @@ func (h *Handler) serveConfigGet(w http.ResponseWriter, req *http.Request) {
 }
 
 func (h *Handler) serveConfigPost(w http.ResponseWriter, req *http.Request) {
+	if wait, ok := h.startConfigSave(); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		wait = wait.Round(time.Millisecond)
+		log.Printf("rejecting config save; try again in %v", wait)
+		http.Error(w, fmt.Sprintf("configuration saved too recently; try again in %v", wait), http.StatusTooManyRequests)
+		return
+	}
+	defer h.endConfigSave()
 	req.ParseForm()
 	configText := req.Form.Get("config")
+	if err := checkConfigWarnings(configText, h.store.ConfigText()); err != nil {
+		serveConfigError(w, req, err)
+		return
+	}
 	if err := h.store.setConfigText(configText); err != nil {
 		serveConfigError(w, req, err)
 		return
@@ -198,21 +276,51 @@ func (h *Handler) serveConfigPost(w http.ResponseWriter, req *http.Request) {
 	// TODO check that we can connect to the relay address?
 	h.controller.SetRelayAddr(relayAddr)
 
+	// Meters declared in the configuration text take
+	// precedence over those in the form fields.
+	meters := configMeters(h.store.Config())
+	if meters == nil {
+		var err error
+		meters, err = formMeters(req)
+		if err != nil {
+			badRequest(w, req, err)
+			return
+		}
+	}
+	if err := h.meterWorker.SetMeters(meters); err != nil {
+		serveConfigError(w, req, err)
+		return
+	}
+
+	http.Redirect(w, req, "/index.html", http.StatusMovedPermanently)
+}
+
+// formMeters returns the meters specified by the meter
+// fields in the configuration form. The meters are always
+// returned in the same order so that saving an unchanged
+// form doesn't change the meters.
+func formMeters(req *http.Request) ([]meterworker.Meter, error) {
+	fields := make([]string, 0, len(meterInfo))
+	for p := range meterInfo {
+		fields = append(fields, p)
+	}
+	sort.Strings(fields)
 	var meters []meterworker.Meter
-	for p, info := range meterInfo {
+	for _, p := range fields {
+		info := meterInfo[p]
 		addrField := p + "Addr"
 		lagField := p + "Lag"
+		// Unchecked checkboxes aren't included in the form.
+		disabled := req.Form.Get(p+"Disabled") != ""
 		lagStr := req.Form.Get(lagField)
 		allowedLag, err := time.ParseDuration(lagStr)
 		if err != nil {
-			badRequest(w, req, errgo.Notef(err, "invalid allowed lag duration %q (field %q; form %q)", lagStr, lagField, req.Form))
-			return
+			return nil, errgo.Notef(err, "invalid allowed lag duration %q (field %q; form %q)", lagStr, lagField, req.Form)
 		}
 		addrs := strings.Fields(req.Form.Get(addrField))
 		for i, addr := range addrs {
 			if _, _, err := net.SplitHostPort(addr); err != nil {
-				badRequest(w, req, errgo.Newf("invalid meter address %q (must be of the form host:port)", addr))
-				return
+				return nil, errgo.Newf("invalid meter address %q (must be of the form host:port)", addr)
 			}
 			name := info.name
 			if len(addrs) > 1 {
@@ -223,15 +331,78 @@ func (h *Handler) serveConfigPost(w http.ResponseWriter, req *http.Request) {
 				Location:   info.location,
 				Addr:       addr,
 				AllowedLag: allowedLag,
+				Disabled:   disabled,
 			})
 		}
 	}
-	if err := h.meterWorker.SetMeters(meters); err != nil {
-		serveConfigError(w, req, err)
-		return
+	return meters, nil
+}
+
+// configMeters returns the meters declared in the given
+// configuration, or nil if there are none.
+func configMeters(cfg *hydroconfig.Config) []meterworker.Meter {
+	if len(cfg.Meters) == 0 {
+		return nil
 	}
+	count := make(map[hydroreport.MeterLocation]int)
+	for _, m := range cfg.Meters {
+		count[m.Location]++
+	}
+	n := make(map[hydroreport.MeterLocation]int)
+	meters := make([]meterworker.Meter, len(cfg.Meters))
+	for i, m := range cfg.Meters {
+		name := meterLocationName(m.Location)
+		if count[m.Location] > 1 {
+			n[m.Location]++
+			name = fmt.Sprintf("%s #%d", name, n[m.Location])
+		}
+		meters[i] = meterworker.Meter{
+			Name:       name,
+			Location:   m.Location,
+			Addr:       m.Addr,
+			AllowedLag: m.AllowedLag,
+			TZ:         m.TZ,
+		}
+	}
+	return meters
+}
 
-	http.Redirect(w, req, "/index.html", http.StatusMovedPermanently)
+// meterLocationName returns the display name for
+// meters at the given location.
+func meterLocationName(loc hydroreport.MeterLocation) string {
+	for _, info := range meterInfo {
+		if info.location == loc {
+			return info.name
+		}
+	}
+	return loc.String()
+}
+
+// startConfigSave reports whether a configuration save may start now.
+// Saves are made one at a time and no more often than
+// Params.ConfigSaveInterval, because they can restart workers.
+// If a save may not start, it returns how long to wait before trying
+// again; otherwise endConfigSave must be called when the save is done.
+func (h *Handler) startConfigSave() (time.Duration, bool) {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	if h.configSaving {
+		return h.p.ConfigSaveInterval, false
+	}
+	if wait := time.Until(h.lastConfigSave.Add(h.p.ConfigSaveInterval)); wait > 0 {
+		return wait, false
+	}
+	h.configSaving = true
+	return 0, true
+}
+
+// endConfigSave marks the end of a configuration save
+// started with startConfigSave.
+func (h *Handler) endConfigSave() {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	h.configSaving = false
+	h.lastConfigSave = time.Now()
 }
 
 // TODO use this as a source of the meter names in configTempl
@@ -0,0 +1,405 @@
+package hydroserver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+func TestConfigPostDisabledMeters(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	form := url.Values{
+		"genMeterAddr":       {"localhost:1"},
+		"genMeterLag":        {"1s"},
+		"hereMeterAddr":      {"localhost:2 localhost:3"},
+		"hereMeterLag":       {"2s"},
+		"hereMeterDisabled":  {"on"},
+		"neighbourMeterAddr": {""},
+		"neighbourMeterLag":  {"0s"},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusMovedPermanently, qt.Commentf("body: %s", rec.Body))
+	syncMeterWorker(h)
+
+	disabled := make(map[string]bool)
+	for _, m := range h.store.meterState().Meters {
+		disabled[m.Addr] = m.Disabled
+	}
+	c.Assert(disabled, qt.DeepEquals, map[string]bool{
+		"localhost:1": false,
+		"localhost:2": true,
+		"localhost:3": true,
+	})
+
+	// The checkbox is shown checked only for the disabled location.
+	req = httptest.NewRequest("GET", "/config", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+	body := rec.Body.String()
+	c.Assert(body, qt.Contains, `<input name="hereMeterDisabled" type="checkbox" checked>`)
+	c.Assert(body, qt.Contains, `<input name="genMeterDisabled" type="checkbox">`)
+}
+
+func TestConfigGetDisabledMeter(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	err := h.meterWorker.SetMeters([]meterworker.Meter{{
+		Name:     "generator",
+		Location: hydroreport.LocGenerator,
+		Addr:     "localhost:1",
+		Disabled: true,
+	}})
+	c.Assert(err, qt.IsNil)
+	syncMeterWorker(h)
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), qt.Contains, `<input name="genMeterDisabled" type="checkbox" checked>`)
+}
+
+func TestConfigPostRateLimited(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	post := func(i int) *httptest.ResponseRecorder {
+		form := url.Values{
+			"config":            {fmt.Sprintf("relay %d is r", i)},
+			"genMeterAddr":      {fmt.Sprintf("localhost:%d", i+1)},
+			"genMeterLag":       {"1s"},
+			"hereMeterLag":      {"1s"},
+			"neighbourMeterLag": {"1s"},
+		}
+		req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// Only the first of several rapid saves is applied.
+	for i := 0; i < 5; i++ {
+		rec := post(i)
+		if i == 0 {
+			c.Assert(rec.Code, qt.Equals, http.StatusMovedPermanently, qt.Commentf("body: %s", rec.Body))
+			continue
+		}
+		c.Assert(rec.Code, qt.Equals, http.StatusTooManyRequests)
+		c.Assert(rec.Header().Get("Retry-After"), qt.Equals, "1")
+		c.Assert(rec.Body.String(), qt.Matches, `configuration saved too recently; try again in .*\n`)
+	}
+	syncMeterWorker(h)
+	c.Assert(h.store.ConfigText(), qt.Equals, "relay 0 is r")
+	meters := h.store.meterState().Meters
+	c.Assert(meters, qt.HasLen, 1)
+	c.Assert(meters[0].Addr, qt.Equals, "localhost:1")
+
+	// Once the interval has passed, saving works again.
+	h.configMu.Lock()
+	h.lastConfigSave = h.lastConfigSave.Add(-DefaultConfigSaveInterval)
+	h.configMu.Unlock()
+	rec := post(5)
+	c.Assert(rec.Code, qt.Equals, http.StatusMovedPermanently, qt.Commentf("body: %s", rec.Body))
+	c.Assert(h.store.ConfigText(), qt.Equals, "relay 5 is r")
+}
+
+// syncMeterWorker waits until the store reflects any meter
+// changes made before it was called. The meter worker updates
+// the store after replying to each request, so a subsequent
+// request can't complete until the update has been made.
+func syncMeterWorker(h *Handler) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.meterWorker.ReadMeters(ctx)
+}
+
+func TestConfigPostMeterDeclarations(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	// The meter fields in the form are ignored because
+	// the configuration declares meters.
+	form := url.Values{
+		"config": {`
+meter localhost:1 is generator
+meters localhost:2, localhost:3 are here
+meter localhost:2 has max lag 3s
+meter localhost:3 has time zone Europe/Paris
+`},
+		"genMeterAddr": {"localhost:99"},
+		"genMeterLag":  {"bad"},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusMovedPermanently, qt.Commentf("body: %s", rec.Body))
+	syncMeterWorker(h)
+
+	c.Assert(h.store.meterState().Meters, qt.DeepEquals, []meterworker.Meter{{
+		Name:     "Generator",
+		Location: hydroreport.LocGenerator,
+		Addr:     "localhost:1",
+	}, {
+		Name:       "Drynoch #1",
+		Location:   hydroreport.LocHere,
+		Addr:       "localhost:2",
+		AllowedLag: 3 * time.Second,
+	}, {
+		Name:     "Drynoch #2",
+		Location: hydroreport.LocHere,
+		Addr:     "localhost:3",
+		TZ:       "Europe/Paris",
+	}})
+}
+
+// unsatisfiableConfig holds a configuration with a slot
+// duration that can never be satisfied.
+const unsatisfiableConfig = "relay 1 is heater\nheater on from 01:00 to 02:00 for at least 3h\n"
+
+func TestSavedConfigWithWarningsLoads(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	err := ioutil.WriteFile(filepath.Join(dir, "relayconfig"), []byte(unsatisfiableConfig), 0666)
+	c.Assert(err, qt.IsNil)
+	h := newTestServer(c, dir, Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	c.Assert(h.store.ConfigText(), qt.Equals, unsatisfiableConfig)
+	c.Assert(h.store.Config().Warnings, qt.HasLen, 1)
+
+	// The configuration can be saved again unchanged.
+	form := url.Values{
+		"config":            {unsatisfiableConfig},
+		"genMeterLag":       {"0s"},
+		"hereMeterLag":      {"0s"},
+		"neighbourMeterLag": {"0s"},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusMovedPermanently, qt.Commentf("body: %s", rec.Body))
+}
+
+func TestConfigPostWithWarnings(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	form := url.Values{
+		"config": {unsatisfiableConfig},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, "Duration 3h0m0s is longer than the slot (1h0m0s)")
+	c.Assert(h.store.ConfigText(), qt.Equals, "")
+}
+
+func TestConfigPostDuplicateMeterAddress(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	form := url.Values{
+		"genMeterAddr":       {"localhost:1"},
+		"genMeterLag":        {"1s"},
+		"hereMeterAddr":      {"localhost:2 localhost:1"},
+		"hereMeterLag":       {"1s"},
+		"neighbourMeterAddr": {""},
+		"neighbourMeterLag":  {"1s"},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest)
+	c.Assert(rec.Body.String(), qt.Matches, `(?s).*meter address "localhost:1" is used by both "(Generator|Drynoch #2)" and "(Generator|Drynoch #2)".*`)
+	syncMeterWorker(h)
+	// No meters have been set.
+	if ms := h.store.meterState(); ms != nil {
+		c.Assert(ms.Meters, qt.HasLen, 0)
+	}
+}
+
+func TestFormMetersOrder(t *testing.T) {
+	c := qt.New(t)
+	form := url.Values{
+		"genMeterAddr":       {"localhost:1"},
+		"genMeterLag":        {"1s"},
+		"hereMeterAddr":      {"localhost:2 localhost:3"},
+		"hereMeterLag":       {"2s"},
+		"neighbourMeterAddr": {"localhost:4"},
+		"neighbourMeterLag":  {"0s"},
+	}
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	meters0, err := formMeters(req)
+	c.Assert(err, qt.IsNil)
+	c.Assert(meters0, qt.HasLen, 4)
+	// The meters are returned in the same order every time
+	// so that the meter worker doesn't see a change.
+	for i := 0; i < 20; i++ {
+		meters, err := formMeters(req)
+		c.Assert(err, qt.IsNil)
+		c.Assert(meters, qt.DeepEquals, meters0)
+	}
+}
+
+var controlPasswordTests = []struct {
+	testName     string
+	method       string
+	path         string
+	body         string
+	password     string
+	expectStatus int
+}{{
+	testName:     "config-viewer",
+	path:         "/config",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "config-wrong-password",
+	path:         "/config",
+	password:     "other",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "config-controller",
+	path:         "/config",
+	password:     "secret",
+	expectStatus: http.StatusOK,
+}, {
+	testName:     "backup-viewer",
+	path:         "/api/backup",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "backup-controller",
+	path:         "/api/backup",
+	password:     "secret",
+	expectStatus: http.StatusOK,
+}, {
+	testName:     "meter-test-viewer",
+	method:       "POST",
+	path:         "/api/meters/test",
+	body:         `{"Addr": "localhost:1"}`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "assess-now-viewer",
+	method:       "POST",
+	path:         "/api/assess-now",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "paused-viewer",
+	method:       "PUT",
+	path:         "/api/paused",
+	body:         `{"Paused": true}`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "override-viewer",
+	method:       "PUT",
+	path:         "/api/relays/0/override",
+	body:         `{"On": true, "Duration": "1h"}`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "override-delete-viewer",
+	method:       "DELETE",
+	path:         "/api/relays/0/override",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "cohort-disabled-viewer",
+	method:       "PUT",
+	path:         "/api/cohorts/heater/disabled",
+	body:         `{"Disabled": true}`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "commission-viewer",
+	method:       "POST",
+	path:         "/api/commission",
+	body:         `{"Force": true}`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "restore-viewer",
+	method:       "POST",
+	path:         "/api/restore",
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName:     "paused-wrong-password",
+	method:       "PUT",
+	path:         "/api/paused",
+	body:         `{"Paused": true}`,
+	password:     "other",
+	expectStatus: http.StatusUnauthorized,
+}}
+
+func TestControlPassword(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{
+		ControlPassword: "secret",
+	})
+	defer h.meterWorker.Close()
+	defer h.Close()
+	err := h.controller.SetRelayAddr("localhost:1234")
+	c.Assert(err, qt.IsNil)
+	err = h.meterWorker.SetMeters([]meterworker.Meter{{
+		Name:     "generator",
+		Location: hydroreport.LocGenerator,
+		Addr:     "localhost:1",
+	}})
+	c.Assert(err, qt.IsNil)
+	syncMeterWorker(h)
+	for _, test := range controlPasswordTests {
+		c.Run(test.testName, func(c *qt.C) {
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, test.path, strings.NewReader(test.body))
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if test.password != "" {
+				req.SetBasicAuth("user", test.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			c.Assert(rec.Code, qt.Equals, test.expectStatus, qt.Commentf("body: %s", rec.Body))
+			if test.expectStatus == http.StatusUnauthorized {
+				c.Assert(rec.Header().Get("WWW-Authenticate"), qt.Equals, `Basic realm="hydro"`)
+				c.Assert(rec.Body.String(), qt.Not(qt.Contains), "localhost:1234")
+			}
+		})
+	}
+	// None of the rejected requests should have had any effect.
+	c.Assert(h.worker.Paused(), qt.IsFalse)
+}
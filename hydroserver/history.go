@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/rogpeppe/hydro/googlecharts"
+	"github.com/rogpeppe/hydro/history"
 	"github.com/rogpeppe/hydro/hydroctl"
 )
 
@@ -16,58 +18,100 @@ type historyRecord struct {
 	End   time.Time
 }
 
+// historyDuration holds how far back the history
+// served by serveHistoryJSON goes.
+const historyDuration = 7 * 24 * time.Hour
+
 func (h *Handler) serveHistoryJSON(w http.ResponseWriter, req *http.Request) {
 	ws := h.store.WorkerState()
 	if ws == nil {
 		http.Error(w, "no current relay information available", http.StatusInternalServerError)
 		return
 	}
-	cfg := h.store.CtlConfig()
 	now := time.Now()
+	records := relayPeriods(h.history.ReverseIter(), h.store.CtlConfig(), ws.State, now.Add(-historyDuration), now)
+	data, err := json.Marshal(googlecharts.NewDataTable(records))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot marshal data table: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// relayPeriods returns a record for each period within [t0, t1)
+// during which a relay was on, ordered by start time, using the relay
+// events from iter, which should iterate backwards in time, and
+// current, which holds the state of the relays after the most recent
+// event. Periods that extend outside the time range are truncated to it.
+func relayPeriods(iter history.Iterator, cfg *hydroctl.Config, current hydroctl.RelayState, t0, t1 time.Time) []historyRecord {
+	defer iter.Close()
+	// offTimes holds the time that each relay that's on at
+	// the current point in the iteration was turned off,
+	// or t1 if it hasn't been turned off since.
 	offTimes := make([]time.Time, hydroctl.MaxRelayCount)
+	// onCount holds the number of non-zero elements in offTimes.
+	onCount := 0
 	for i := range offTimes {
-		if ws.State.IsSet(i) {
-			offTimes[i] = now
+		if current.IsSet(i) {
+			offTimes[i] = t1
+			onCount++
 		}
 	}
-	limit := now.Add(-7 * 24 * time.Hour)
 	var records []historyRecord
-	iter := h.history.ReverseIter()
+	addRecord := func(relay int, start, end time.Time) {
+		if start.Before(t0) {
+			start = t0
+		}
+		if end.After(t1) {
+			end = t1
+		}
+		if !start.Before(end) {
+			return
+		}
+		records = append(records, historyRecord{
+			// TODO use relay number only when needed for disambiguation.
+			Name:  fmt.Sprintf("%d: %s", relay, cfg.Relays[relay].Cohort),
+			Start: start,
+			End:   end,
+		})
+	}
 	for iter.Next() {
 		e := iter.Item()
-		if e.Time.Before(limit) {
+		if e.Relay < 0 || e.Relay >= hydroctl.MaxRelayCount {
+			continue
+		}
+		if onCount == 0 && e.Time.Before(t0) {
+			// All the relays were off at t0, so
+			// there are no more periods to find.
 			break
 		}
 		if e.On {
 			if offt := offTimes[e.Relay]; !offt.IsZero() {
-				records = append(records, historyRecord{
-					// TODO use relay number only when needed for disambiguation.
-					Name:  fmt.Sprintf("%d: %s", e.Relay, cfg.Relays[e.Relay].Cohort),
-					Start: e.Time,
-					End:   offt,
-				})
+				addRecord(e.Relay, e.Time, offt)
 				offTimes[e.Relay] = time.Time{}
+				onCount--
 			}
 		} else {
+			if offTimes[e.Relay].IsZero() {
+				onCount++
+			}
 			offTimes[e.Relay] = e.Time
 		}
 	}
-	// Give starting times to all the periods that start before the limit.
+	// Any relays that still have an off time were on
+	// before the first event in the history.
 	for i, offt := range offTimes {
 		if !offt.IsZero() {
-			records = append(records, historyRecord{
-				// TODO use relay number only when needed for disambiguation.
-				Name:  fmt.Sprintf("%d: %s", i, cfg.Relays[i].Cohort),
-				Start: limit,
-				End:   offt,
-			})
+			addRecord(i, t0, offt)
 		}
 	}
-	data, err := json.Marshal(googlecharts.NewDataTable(records))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cannot marshal data table: %v", err), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	sort.Slice(records, func(i, j int) bool {
+		r0, r1 := &records[i], &records[j]
+		if !r0.Start.Equal(r1.Start) {
+			return r0.Start.Before(r1.Start)
+		}
+		return r0.Name < r1.Name
+	})
+	return records
 }
@@ -97,6 +97,21 @@ func (h *Handler) serveSamples(w http.ResponseWriter, req *http.Request) {
 		// TODO could serve summary of meters.
 		http.NotFound(w, req)
 	}
+	if p := strings.TrimSuffix(path, "/range"); p != path {
+		// GET /samples/:meter/range is the same as GET /samples/:meter
+		// but makes it clear that only a time window is wanted.
+		m, ok := h.meterFromPath(p)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != "GET" {
+			http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveSamplesGet(w, req, m)
+		return
+	}
 	m, ok := h.meterFromPath(path)
 	if !ok {
 		http.NotFound(w, req)
@@ -112,19 +127,41 @@ func (h *Handler) serveSamples(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// serveSamplesGet serves GET /samples/:meter by returning all the samples available for this meter.
+// serveSamplesGet serves GET /samples/:meter by returning the samples available for this meter.
+// If the from or to query parameters are specified (in RFC3339 format), only
+// samples within that time range are returned.
 func (h *Handler) serveSamplesGet(w http.ResponseWriter, req *http.Request, m meterworker.Meter) {
+	var t meterstat.TimeRange
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &t.T0}, {"to", &t.T1}} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		pt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %q parameter: %v", p.name, err), http.StatusBadRequest)
+			return
+		}
+		*p.t = pt
+	}
+	if !t.T0.IsZero() && !t.T1.IsZero() && t.T1.Before(t.T0) {
+		http.Error(w, "\"to\" time is before \"from\" time", http.StatusBadRequest)
+		return
+	}
 	if h.p.SampleDirPath == "" {
 		return
 	}
-	sdir, err := meterstat.ReadSampleDir(filepath.Join(h.p.SampleDirPath, m.SampleDir()), "*.sample")
+	sdir, err := meterstat.ReadSampleDirRange(filepath.Join(h.p.SampleDirPath, m.SampleDir()), "*.sample", t)
 	if err != nil {
 		return
 	}
 	w.Header().Set("Content-Type", "text/csv")
-	f := sdir.Open()
+	f := sdir.OpenRange(t)
 	defer f.Close()
-	meterstat.WriteSamples(w, sdir.Open())
+	meterstat.WriteSamples(w, meterstat.RangeSampleReader(f, t))
 }
 
 // serveSamplesPost serves POST /samples/:meter by updating the manually added samples.
@@ -149,11 +186,11 @@ func (h *Handler) serveSamplesPost(w http.ResponseWriter, req *http.Request, m m
 		http.Redirect(w, req, "/index.html", http.StatusMovedPermanently)
 		return
 	}
-	if err := os.MkdirAll(sampleDir, 0777); err != nil {
+	if err := os.MkdirAll(sampleDir, h.p.DirMode); err != nil {
 		http.Error(w, fmt.Sprintf("cannot make sample directory: %v", err), http.StatusInternalServerError)
 		return
 	}
-	f, err := os.Create(sampleFilePath)
+	f, err := os.OpenFile(sampleFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, h.p.FileMode)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("cannot create sample file: %v", err), http.StatusInternalServerError)
 		return
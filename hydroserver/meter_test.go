@@ -0,0 +1,122 @@
+package hydroserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+var sampleRangeTests = []struct {
+	testName   string
+	path       string
+	query      string
+	expectCode int
+	expect     []int
+}{{
+	testName:   "no-range",
+	path:       "/samples/meter1:80",
+	expectCode: http.StatusOK,
+	expect:     []int{0, 1, 2, 3, 4, 5},
+}, {
+	testName:   "from-and-to",
+	path:       "/samples/meter1:80/range",
+	query:      "from=2020-01-02T01:00:00Z&to=2020-01-02T03:00:00Z",
+	expectCode: http.StatusOK,
+	expect:     []int{1, 2, 3},
+}, {
+	testName:   "only-from",
+	path:       "/samples/meter1:80/range",
+	query:      "from=2020-01-02T03:30:00Z",
+	expectCode: http.StatusOK,
+	expect:     []int{4, 5},
+}, {
+	testName:   "only-to-in-main-endpoint",
+	path:       "/samples/meter1:80",
+	query:      "to=2020-01-02T00:00:00Z",
+	expectCode: http.StatusOK,
+	expect:     []int{0},
+}, {
+	testName:   "invalid-time",
+	path:       "/samples/meter1:80/range",
+	query:      "from=yesterday",
+	expectCode: http.StatusBadRequest,
+}, {
+	testName:   "unknown-meter",
+	path:       "/samples/other:80/range",
+	expectCode: http.StatusNotFound,
+}}
+
+func TestServeSamplesRange(t *testing.T) {
+	c := qt.New(t)
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	var samples []meterstat.Sample
+	for i := 0; i < 6; i++ {
+		samples = append(samples, meterstat.Sample{
+			Time:        day.Add(time.Duration(i) * time.Hour),
+			TotalEnergy: float64(1000 * (i + 1)),
+		})
+	}
+	m := meterworker.Meter{
+		Name:     "meter1",
+		Location: hydroreport.LocGenerator,
+		Addr:     "meter1:80",
+	}
+	sampleDir := c.Mkdir()
+	dir := filepath.Join(sampleDir, m.SampleDir())
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, qt.IsNil)
+	// The samples are split between a manual sample file and a log file.
+	writeSampleFile(c, filepath.Join(dir, "manual.sample"), samples[0:2])
+	writeSampleFile(c, filepath.Join(dir, "log.sample"), samples[2:])
+
+	configPath := filepath.Join(c.Mkdir(), "config")
+	store, err := newStore(configPath, DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	store.UpdateMeterState(&meterworker.MeterState{
+		Meters: []meterworker.Meter{m},
+	})
+	h := &Handler{
+		store: store,
+		p: Params{
+			SampleDirPath: sampleDir,
+		},
+	}
+	for _, test := range sampleRangeTests {
+		c.Run(test.testName, func(c *qt.C) {
+			req, err := http.NewRequest("GET", test.path+"?"+test.query, nil)
+			c.Assert(err, qt.IsNil)
+			rec := httptest.NewRecorder()
+			h.serveSamples(rec, req)
+			c.Assert(rec.Code, qt.Equals, test.expectCode, qt.Commentf("body: %s", rec.Body))
+			if test.expectCode != http.StatusOK {
+				return
+			}
+			got, err := meterstat.ReadAllSamples(meterstat.NewSampleReader(rec.Body))
+			c.Assert(err, qt.IsNil)
+			var expect []meterstat.Sample
+			for _, i := range test.expect {
+				expect = append(expect, samples[i])
+			}
+			c.Assert(got, qt.DeepEquals, expect)
+		})
+	}
+}
+
+func writeSampleFile(c *qt.C, path string, samples []meterstat.Sample) {
+	var buf strings.Builder
+	_, err := meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader(samples))
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(path, []byte(buf.String()), 0666)
+	c.Assert(err, qt.IsNil)
+}
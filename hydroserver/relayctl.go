@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -17,18 +18,67 @@ import (
 )
 
 type relayCtl struct {
-	cfgStore *relayCtlConfigStore
+	p relayCtlParams
+	// now is used to find out the current time.
+	// It's a variable so that tests can change it.
+	now func() time.Time
 
-	mu               sync.Mutex
-	conn             *eth8020.Conn
-	currentStateTime time.Time
-	currentState     hydroctl.RelayState
+	mu   sync.Mutex
+	conn *eth8020.Conn
+	// currentOutputs holds the most recently obtained outputs
+	// of the relay controller, which are believed until
+	// currentStateExpiry. Note that these are the physical outputs,
+	// which differ from the relay state for inverted relays.
+	currentOutputs     eth8020.State
+	currentStateExpiry time.Time
+	// lastSetTime holds when the relays were last set.
+	lastSetTime time.Time
+
+	// kick is sent a value (without blocking) when the
+	// worker shows signs of life, to reset the watchdog.
+	kick chan struct{}
+	// closed is closed when the controller is closed.
+	closed chan struct{}
+}
+
+type relayCtlParams struct {
+	// CfgStore holds the relay controller address.
+	CfgStore *relayCtlConfigStore
+	// Updater is notified when the relay controller address changes.
+	Updater relayAddrUpdater
+	// Config, if non-nil, is called to obtain the current
+	// relay configuration, which determines which relays
+	// have inverted outputs.
+	Config func() *hydroctl.Config
+	// Verify holds whether to read back the relay
+	// state after setting it.
+	Verify bool
+	// RefreshInterval holds the amount of time for which
+	// we will believe the most recently obtained relay settings.
+	// If it's zero, DefaultRelayRefreshInterval is used.
+	RefreshInterval time.Duration
+	// RefreshJitter holds the maximum random amount of time
+	// added to RefreshInterval so that relay reads from
+	// different places don't all happen together.
+	RefreshJitter time.Duration
+	// ActiveRefreshInterval, if non-zero, holds a shorter
+	// refresh interval that's used while the relays are being
+	// actively controlled (that is, within RefreshInterval
+	// of the relays last being set), so that external changes
+	// to the relays are noticed sooner.
+	ActiveRefreshInterval time.Duration
+	// WatchdogTimeout, if non-zero, holds the length of time
+	// after which, if there have been no calls to SetRelays or
+	// Heartbeat, the relays are set to WatchdogState on the
+	// assumption that the worker has stopped.
+	WatchdogTimeout time.Duration
+	// WatchdogState holds the relay state set by the watchdog.
+	WatchdogState hydroctl.RelayState
 }
 
-// refreshDuration holds the maximum amount of time
-// for which we will believe the most recently
-// obtained relay settings.
-const refreshDuration = 30 * time.Second
+// DefaultRelayRefreshInterval holds the default value of
+// Params.RelayRefreshInterval.
+const DefaultRelayRefreshInterval = 30 * time.Second
 
 // TODO make the relay controller provide a notification when
 // the relay state changes, so we can send the new relay
@@ -40,22 +90,83 @@ const refreshDuration = 30 * time.Second
 //
 // Probably a single websocket with several different types of delta.
 
-func newRelayController(cfgStore *relayCtlConfigStore) *relayCtl {
-	return &relayCtl{
-		cfgStore: cfgStore,
+// relayAddrUpdater is used by relayCtl to notify
+// when the relay controller address changes.
+type relayAddrUpdater interface {
+	UpdateRelayAddr(addr string)
+}
+
+func newRelayController(p relayCtlParams) *relayCtl {
+	if p.RefreshInterval == 0 {
+		p.RefreshInterval = DefaultRelayRefreshInterval
+	}
+	ctl := &relayCtl{
+		p:      p,
+		now:    time.Now,
+		kick:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	if p.WatchdogTimeout > 0 {
+		go ctl.runWatchdog()
+	}
+	return ctl
+}
+
+// Close stops the watchdog, if any.
+func (ctl *relayCtl) Close() {
+	close(ctl.closed)
+}
+
+// Heartbeat implements hydroworker.HeartbeatReceiver
+// by resetting the watchdog.
+func (ctl *relayCtl) Heartbeat() {
+	select {
+	case ctl.kick <- struct{}{}:
+	default:
+	}
+}
+
+// runWatchdog sets the relays to the watchdog state
+// when the worker has been silent for longer than
+// the watchdog timeout. Note that the change isn't
+// recorded in the relay history.
+func (ctl *relayCtl) runWatchdog() {
+	for {
+		select {
+		case <-ctl.kick:
+			continue
+		case <-ctl.closed:
+			return
+		case <-time.After(ctl.p.WatchdogTimeout):
+		}
+		log.Printf("relay controller: no word from worker for %v; setting relays to %v", ctl.p.WatchdogTimeout, ctl.p.WatchdogState)
+		ctl.mu.Lock()
+		err := ctl.setRelays(ctl.p.WatchdogState)
+		ctl.mu.Unlock()
+		if err != nil && errgo.Cause(err) != hydroworker.ErrNoRelayController {
+			log.Printf("relay controller: watchdog cannot set relays: %v", err)
+		}
+		// Wait for the worker to come back to life
+		// before starting the watchdog again.
+		select {
+		case <-ctl.kick:
+		case <-ctl.closed:
+			return
+		}
 	}
 }
 
 func (ctl *relayCtl) SetRelayAddr(addr string) error {
 	// TODO provide a way to change the password too.
-	changed, err := ctl.cfgStore.SetRelayAddr(addr)
+	changed, err := ctl.p.CfgStore.SetRelayAddr(addr)
 	if changed {
 		ctl.mu.Lock()
-		defer ctl.mu.Unlock()
 		if ctl.conn != nil {
 			ctl.conn.Close()
 			ctl.conn = nil
 		}
+		ctl.mu.Unlock()
+		ctl.p.Updater.UpdateRelayAddr(addr)
 	}
 	if err != nil {
 		return errgo.Notef(err, "cannot set relay controller address")
@@ -64,7 +175,7 @@ func (ctl *relayCtl) SetRelayAddr(addr string) error {
 }
 
 func (ctl *relayCtl) RelayAddr() (string, error) {
-	addr, err := ctl.cfgStore.RelayAddr()
+	addr, err := ctl.p.CfgStore.RelayAddr()
 	if err == nil || errgo.Cause(err) == hydroworker.ErrNoRelayController {
 		return addr, nil
 	}
@@ -74,37 +185,143 @@ func (ctl *relayCtl) RelayAddr() (string, error) {
 func (ctl *relayCtl) Relays() (hydroctl.RelayState, error) {
 	ctl.mu.Lock()
 	defer ctl.mu.Unlock()
-	if !ctl.currentStateTime.IsZero() && time.Since(ctl.currentStateTime) < refreshDuration {
-		return ctl.currentState, nil
+	if ctl.now().Before(ctl.currentStateExpiry) {
+		return ctl.relayState(ctl.currentOutputs), nil
 	}
-	var state eth8020.State
+	var outputs eth8020.State
 	err := ctl.retry(func() error {
 		var err error
-		state, err = ctl.conn.GetOutputs()
+		outputs, err = ctl.conn.GetOutputs()
 		return err
 	})
 	if err != nil {
 		return 0, errgo.NoteMask(err, "cannot get current state", errgo.Is(hydroworker.ErrNoRelayController))
 	}
-	ctl.currentState = hydroctl.RelayState(state)
-	ctl.currentStateTime = time.Now()
-	return ctl.currentState, nil
+	ctl.setCurrentOutputs(outputs)
+	return ctl.relayState(outputs), nil
+}
+
+// NumRelays implements hydroworker.RelayCounter.NumRelays.
+// The worker never asks for relays beyond the range of the
+// relay controller, so they're recorded as off.
+func (ctl *relayCtl) NumRelays() int {
+	return eth8020.NumRelays
 }
 
 // SetRelays implements hydroworker.RelayController.SetRelays.
+//
+// If the controller was created with verification enabled,
+// the state is read back after setting it and an error is
+// returned if it doesn't match.
 func (ctl *relayCtl) SetRelays(state hydroctl.RelayState) error {
+	ctl.Heartbeat()
 	ctl.mu.Lock()
 	defer ctl.mu.Unlock()
+	return ctl.setRelays(state)
+}
+
+// setRelays is the internal version of SetRelays.
+// It's called with ctl.mu held.
+func (ctl *relayCtl) setRelays(state hydroctl.RelayState) error {
+	if extra := state &^ hydroctl.RelayState(eth8020.AllOn); extra != 0 {
+		return errgo.Newf("cannot set relay state %v: relays %v are out of range (the relay controller has %d relays)", state, extra, eth8020.NumRelays)
+	}
+	outputs := ctl.outputs(state)
 	if err := ctl.retry(func() error {
-		return ctl.conn.SetOutputs(eth8020.State(state))
+		return ctl.conn.SetOutputs(outputs)
 	}); err != nil {
-		return errgo.Notef(err, "cannot set relay state")
+		return errgo.NoteMask(err, "cannot set relay state", errgo.Is(hydroworker.ErrNoRelayController))
+	}
+	ctl.lastSetTime = ctl.now()
+	ctl.setCurrentOutputs(outputs)
+	if !ctl.p.Verify {
+		return nil
 	}
-	ctl.currentState = state
-	ctl.currentStateTime = time.Now()
+	actual, err := ctl.conn.GetOutputs()
+	if err != nil {
+		// Don't retry because the state was set on the
+		// current connection and we want to know whether
+		// it was applied, but don't believe the cached state
+		// any longer either.
+		ctl.currentStateExpiry = time.Time{}
+		return errgo.Notef(err, "cannot read back relay state")
+	}
+	ctl.setCurrentOutputs(actual)
+	if actual != outputs {
+		got := ctl.relayState(actual)
+		err := errgo.Newf("relay controller did not apply relay state (relays %v differ; wanted %v, got %v)", state^got, state, got)
+		log.Printf("%v", err)
+		return err
+	}
+	return nil
+}
+
+// PulseRelay turns the given relay on for the given duration,
+// after which the relay controller turns it off again.
+// See eth8020.Conn.Pulse for restrictions on the duration.
+func (ctl *relayCtl) PulseRelay(relay int, duration time.Duration) error {
+	if relay < 0 || relay >= eth8020.NumRelays {
+		return errgo.Newf("relay %d is out of range (the relay controller has %d relays)", relay, eth8020.NumRelays)
+	}
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	on := !ctl.inverted().IsSet(relay)
+	if err := ctl.retry(func() error {
+		return ctl.conn.Pulse(relay, on, duration)
+	}); err != nil {
+		return errgo.NoteMask(err, "cannot pulse relay", errgo.Is(hydroworker.ErrNoRelayController))
+	}
+	// The outputs are changing under our feet,
+	// so don't believe the cached state.
+	ctl.currentStateExpiry = time.Time{}
 	return nil
 }
 
+// setCurrentOutputs records the given relay controller outputs
+// as current, to be believed for the current refresh interval.
+func (ctl *relayCtl) setCurrentOutputs(outputs eth8020.State) {
+	ctl.currentOutputs = outputs
+	ctl.currentStateExpiry = ctl.now().Add(ctl.refreshInterval())
+}
+
+// outputs returns the relay controller outputs
+// that correspond to the given relay state.
+func (ctl *relayCtl) outputs(state hydroctl.RelayState) eth8020.State {
+	return eth8020.State(state ^ ctl.inverted())
+}
+
+// relayState returns the relay state that
+// corresponds to the given relay controller outputs.
+func (ctl *relayCtl) relayState(outputs eth8020.State) hydroctl.RelayState {
+	return hydroctl.RelayState(outputs) ^ ctl.inverted()
+}
+
+// inverted returns the set of relays with inverted outputs.
+func (ctl *relayCtl) inverted() hydroctl.RelayState {
+	if ctl.p.Config == nil {
+		return 0
+	}
+	// Relays beyond the range of the relay controller
+	// can't be set, so there's nothing to invert.
+	return ctl.p.Config().InvertedRelays() & hydroctl.RelayState(eth8020.AllOn)
+}
+
+// refreshInterval returns the length of time for which
+// newly obtained relay settings will be believed.
+func (ctl *relayCtl) refreshInterval() time.Duration {
+	interval := ctl.p.RefreshInterval
+	if ctl.p.RefreshJitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(ctl.p.RefreshJitter)))
+	}
+	if ctl.p.ActiveRefreshInterval > 0 &&
+		ctl.p.ActiveRefreshInterval < interval &&
+		!ctl.lastSetTime.IsZero() &&
+		ctl.now().Sub(ctl.lastSetTime) < ctl.p.RefreshInterval {
+		interval = ctl.p.ActiveRefreshInterval
+	}
+	return interval
+}
+
 // retry retries the given function (once) when the connection
 // goes down. The function should not have any side effects
 // on ctl, as at some point we'll add a timeout and side effects
@@ -132,7 +349,7 @@ func (ctl *relayCtl) retry(f func() error) error {
 }
 
 func (ctl *relayCtl) connect() error {
-	addr, err := ctl.cfgStore.RelayAddr()
+	addr, err := ctl.p.CfgStore.RelayAddr()
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(hydroworker.ErrNoRelayController))
 	}
@@ -150,8 +367,7 @@ func (ctl *relayCtl) connect() error {
 		return errgo.Notef(err, "cannot get current state (initially)")
 	}
 	ctl.conn = econn
-	ctl.currentState = hydroctl.RelayState(state)
-	ctl.currentStateTime = time.Now()
+	ctl.setCurrentOutputs(state)
 	return nil
 }
 
@@ -160,6 +376,8 @@ func (ctl *relayCtl) connect() error {
 type relayCtlConfigStore struct {
 	// path holds the filename that stores the address.
 	path string
+	// mode holds the permissions used when writing the file.
+	mode os.FileMode
 
 	mu  sync.Mutex
 	cfg relayCtlConfig
@@ -183,7 +401,7 @@ func (s *relayCtlConfigStore) SetRelayAddr(addr string) (bool, error) {
 	if err != nil {
 		return true, errgo.Mask(err)
 	}
-	if err := ioutil.WriteFile(s.path, data, 0666); err != nil {
+	if err := ioutil.WriteFile(s.path, data, s.mode); err != nil {
 		return true, errgo.Mask(err)
 	}
 	return true, nil
@@ -209,10 +427,10 @@ func readJSONFile(path string, x interface{}) error {
 	return json.Unmarshal(data, x)
 }
 
-func writeJSONFile(path string, x interface{}) error {
+func writeJSONFile(path string, x interface{}, mode os.FileMode) error {
 	data, err := json.Marshal(x)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, data, 0666)
+	return ioutil.WriteFile(path, data, mode)
 }
@@ -0,0 +1,371 @@
+package hydroserver
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/eth8020"
+	"github.com/rogpeppe/hydro/eth8020test"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+func TestSetRelayAddrNotifiesWatchers(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	ctl := newRelayController(relayCtlParams{
+		CfgStore: &relayCtlConfigStore{
+			path: filepath.Join(dir, "relayaddr"),
+			mode: DefaultFileMode,
+		},
+		Updater: store,
+	})
+	w := store.anyNotifier.Watch()
+	defer w.Close()
+	changed := make(chan bool)
+	go func() {
+		for w.Next() {
+			changed <- true
+		}
+		close(changed)
+	}()
+
+	err = ctl.SetRelayAddr("localhost:1234")
+	c.Assert(err, qt.IsNil)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for notification")
+	}
+	addr, err := ctl.RelayAddr()
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, "localhost:1234")
+
+	// Setting the same address again doesn't notify.
+	err = ctl.SetRelayAddr("localhost:1234")
+	c.Assert(err, qt.IsNil)
+	select {
+	case <-changed:
+		c.Fatalf("unexpected notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+var setRelaysVerifyTests = []struct {
+	testName    string
+	verify      bool
+	stuck       eth8020.State
+	expectError string
+	expectState hydroctl.RelayState
+}{{
+	testName:    "no-verify",
+	stuck:       1 << 2,
+	expectState: 1<<1 | 1<<2,
+}, {
+	testName:    "verify-ok",
+	verify:      true,
+	expectState: 1<<1 | 1<<2,
+}, {
+	testName:    "verify-mismatch",
+	verify:      true,
+	stuck:       1 << 2,
+	expectError: `relay controller did not apply relay state \(relays \[2\] differ; wanted \[1 2\], got \[1\]\)`,
+	expectState: 1 << 1,
+}}
+
+func TestSetRelaysVerify(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range setRelaysVerifyTests {
+		c.Run(test.testName, func(c *qt.C) {
+			relaySrv, err := eth8020test.NewServer("localhost:0")
+			c.Assert(err, qt.IsNil)
+			defer relaySrv.Close()
+			relaySrv.SetStuck(test.stuck)
+
+			dir := c.Mkdir()
+			store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+			c.Assert(err, qt.IsNil)
+			ctl := newRelayController(relayCtlParams{
+				CfgStore: &relayCtlConfigStore{
+					path: filepath.Join(dir, "relayaddr"),
+					mode: DefaultFileMode,
+				},
+				Updater: store,
+				Verify:  test.verify,
+			})
+			err = ctl.SetRelayAddr(relaySrv.Addr)
+			c.Assert(err, qt.IsNil)
+
+			err = ctl.SetRelays(1<<1 | 1<<2)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+			// The cached state reflects what the controller
+			// reported when verifying.
+			state, err := ctl.Relays()
+			c.Assert(err, qt.IsNil)
+			c.Assert(state, qt.Equals, test.expectState)
+		})
+	}
+}
+
+var relaysRefreshTests = []struct {
+	testName string
+	p        relayCtlParams
+	// setRelays holds whether the relays are set (making
+	// the control active) before the external change.
+	setRelays bool
+	// cachedUntil holds the latest time after the state was
+	// obtained when the cached value must still be returned.
+	cachedUntil time.Duration
+	// refreshedBy holds the earliest time after the state was
+	// obtained when the state must have been read again.
+	refreshedBy time.Duration
+}{{
+	testName:    "default",
+	cachedUntil: DefaultRelayRefreshInterval - time.Millisecond,
+	refreshedBy: DefaultRelayRefreshInterval,
+}, {
+	testName: "configured-interval",
+	p: relayCtlParams{
+		RefreshInterval: 5 * time.Second,
+	},
+	cachedUntil: 5*time.Second - time.Millisecond,
+	refreshedBy: 5 * time.Second,
+}, {
+	testName: "jitter",
+	p: relayCtlParams{
+		RefreshInterval: 5 * time.Second,
+		RefreshJitter:   2 * time.Second,
+	},
+	cachedUntil: 5*time.Second - time.Millisecond,
+	refreshedBy: 7 * time.Second,
+}, {
+	testName: "active-not-in-use",
+	p: relayCtlParams{
+		RefreshInterval:       5 * time.Second,
+		ActiveRefreshInterval: time.Second,
+	},
+	cachedUntil: 5*time.Second - time.Millisecond,
+	refreshedBy: 5 * time.Second,
+}, {
+	testName: "active",
+	p: relayCtlParams{
+		RefreshInterval:       5 * time.Second,
+		ActiveRefreshInterval: time.Second,
+	},
+	setRelays:   true,
+	cachedUntil: time.Second - time.Millisecond,
+	refreshedBy: time.Second,
+}}
+
+func TestRelaysRefresh(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range relaysRefreshTests {
+		c.Run(test.testName, func(c *qt.C) {
+			relaySrv, err := eth8020test.NewServer("localhost:0")
+			c.Assert(err, qt.IsNil)
+			defer relaySrv.Close()
+
+			dir := c.Mkdir()
+			store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+			c.Assert(err, qt.IsNil)
+			p := test.p
+			p.CfgStore = &relayCtlConfigStore{
+				path: filepath.Join(dir, "relayaddr"),
+				mode: DefaultFileMode,
+			}
+			p.Updater = store
+			ctl := newRelayController(p)
+			now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+			ctl.now = func() time.Time {
+				return now
+			}
+			err = ctl.SetRelayAddr(relaySrv.Addr)
+			c.Assert(err, qt.IsNil)
+			if test.setRelays {
+				err = ctl.SetRelays(1 << 1)
+			} else {
+				_, err = ctl.Relays()
+			}
+			c.Assert(err, qt.IsNil)
+			t0 := now
+
+			// Change the relays behind the controller's back,
+			// as if someone had switched them manually.
+			conn, err := net.Dial("tcp", relaySrv.Addr)
+			c.Assert(err, qt.IsNil)
+			econn := eth8020.NewConn(conn)
+			defer econn.Close()
+			err = econn.SetOutputs(1 << 4)
+			c.Assert(err, qt.IsNil)
+
+			now = t0.Add(test.cachedUntil)
+			state, err := ctl.Relays()
+			c.Assert(err, qt.IsNil)
+			c.Assert(state, qt.Not(qt.Equals), hydroctl.RelayState(1<<4))
+
+			now = t0.Add(test.refreshedBy)
+			state, err = ctl.Relays()
+			c.Assert(err, qt.IsNil)
+			c.Assert(state, qt.Equals, hydroctl.RelayState(1<<4))
+		})
+	}
+}
+
+func TestSetRelaysInverted(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+
+	dir := c.Mkdir()
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	cfg := &hydroctl.Config{
+		Relays: make([]hydroctl.RelayConfig, hydroctl.MaxRelayCount),
+	}
+	cfg.Relays[2].Invert = true
+	cfg.Relays[3].Invert = true
+	ctl := newRelayController(relayCtlParams{
+		CfgStore: &relayCtlConfigStore{
+			path: filepath.Join(dir, "relayaddr"),
+			mode: DefaultFileMode,
+		},
+		Updater: store,
+		Config: func() *hydroctl.Config {
+			return cfg
+		},
+		Verify: true,
+	})
+	err = ctl.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	for _, state := range []hydroctl.RelayState{
+		0,
+		1 << 1,
+		1<<1 | 1<<2,
+		1<<2 | 1<<3,
+	} {
+		err = ctl.SetRelays(state)
+		c.Assert(err, qt.IsNil)
+		// The board outputs for the inverted relays are
+		// the complement of their logical state.
+		c.Assert(relaySrv.State(), qt.Equals, eth8020.State(state^(1<<2|1<<3)), qt.Commentf("state %v", state))
+		got, err := ctl.Relays()
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, state)
+	}
+
+	// When the state is read from the board, it's
+	// inverted too.
+	ctl.currentStateExpiry = time.Time{}
+	got, err := ctl.Relays()
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Equals, hydroctl.RelayState(1<<2|1<<3))
+}
+
+func TestSetRelaysOutOfRange(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+
+	dir := c.Mkdir()
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	cfg := &hydroctl.Config{
+		Relays: make([]hydroctl.RelayConfig, hydroctl.MaxRelayCount),
+	}
+	// An inverted relay beyond the board's range is ignored.
+	cfg.Relays[eth8020.NumRelays+2].Invert = true
+	ctl := newRelayController(relayCtlParams{
+		CfgStore: &relayCtlConfigStore{
+			path: filepath.Join(dir, "relayaddr"),
+			mode: DefaultFileMode,
+		},
+		Updater: store,
+		Config: func() *hydroctl.Config {
+			return cfg
+		},
+	})
+	err = ctl.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+
+	err = ctl.SetRelays(1<<0 | 1<<(eth8020.NumRelays-1))
+	c.Assert(err, qt.IsNil)
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(1<<0|1<<(eth8020.NumRelays-1)))
+
+	err = ctl.SetRelays(1<<1 | 1<<eth8020.NumRelays | 1<<25)
+	c.Assert(err, qt.ErrorMatches, `cannot set relay state \[1 20 25\]: relays \[20 25\] are out of range \(the relay controller has 20 relays\)`)
+	// The relay state is left unchanged.
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(1<<0|1<<(eth8020.NumRelays-1)))
+	got, err := ctl.Relays()
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Equals, hydroctl.RelayState(1<<0|1<<(eth8020.NumRelays-1)))
+	c.Assert(ctl.NumRelays(), qt.Equals, eth8020.NumRelays)
+}
+
+func TestRelayWatchdog(t *testing.T) {
+	c := qt.New(t)
+	relaySrv, err := eth8020test.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer relaySrv.Close()
+
+	dir := c.Mkdir()
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	const timeout = 100 * time.Millisecond
+	ctl := newRelayController(relayCtlParams{
+		CfgStore: &relayCtlConfigStore{
+			path: filepath.Join(dir, "relayaddr"),
+			mode: DefaultFileMode,
+		},
+		Updater:         store,
+		WatchdogTimeout: timeout,
+		WatchdogState:   1 << 3,
+	})
+	defer ctl.Close()
+	err = ctl.SetRelayAddr(relaySrv.Addr)
+	c.Assert(err, qt.IsNil)
+	err = ctl.SetRelays(1<<1 | 1<<2)
+	c.Assert(err, qt.IsNil)
+
+	// While the worker's sending heartbeats, the relays
+	// are left alone.
+	for i := 0; i < 6; i++ {
+		time.Sleep(timeout / 3)
+		ctl.Heartbeat()
+	}
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(1<<1|1<<2))
+
+	// When the worker goes silent, the relays are
+	// set to the watchdog state.
+	waitRelayState(c, relaySrv, 1<<3)
+
+	// When the worker comes back to life, it can set
+	// the relays again.
+	err = ctl.SetRelays(1 << 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(relaySrv.State(), qt.Equals, eth8020.State(1<<1))
+	waitRelayState(c, relaySrv, 1<<3)
+}
+
+// waitRelayState waits for the relay controller
+// to have the given state.
+func waitRelayState(c *qt.C, srv *eth8020test.Server, state eth8020.State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.State() != state {
+		if time.Now().After(deadline) {
+			c.Fatalf("relay state never became %v (currently %v)", state, srv.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rogpeppe/hydro/googlecharts"
 	"github.com/rogpeppe/hydro/hydroctl"
@@ -32,24 +33,38 @@ var reportTempl = newTemplate(`
 		<link rel="stylesheet" href="/common.css">
 		<script type="text/javascript" src="https://www.gstatic.com/charts/loader.js"></script>
 		<script type="text/javascript">
-			google.charts.load('current', {'packages':['corechart']});
+			google.charts.load('current', {'packages':['corechart', 'timeline']});
 			google.charts.setOnLoadCallback(getData);
 			function getData() {
 				var request = new XMLHttpRequest();
-				request.open('GET', '{{.JSONLink}}', true);
+				request.open('GET', '{{.JSONLink}}?relays=1', true);
 				request.onload = function() {
 					if (this.status != 200) {
 						console.log("got error status", this.status, this.response);
 						return
 					}
 					var data = JSON.parse(this.response);
-					drawChart(document, data)
+					drawChart(document, data.Energy)
+					drawRelays(data.Relays)
 				};
 				request.onerror = function() {
 					console.log("connection error getting history.json")
 				};
 				request.send();
 			}
+			function drawRelays(data) {
+				var dataTable = new google.visualization.DataTable(data);
+				if(dataTable.getNumberOfRows() === 0) {
+					return
+				}
+				var container = document.getElementById('relayTimeline');
+				var chart = new google.visualization.Timeline(container);
+				chart.draw(dataTable, {
+					timeline: {
+						groupByRowLabel: true
+					}
+				});
+			}
 			function drawChart(doc, data) {
 				var container = document.getElementById('reportGraph');
 				var chart = new google.visualization.AreaChart(container);
@@ -126,18 +141,57 @@ are only available from {{.Report.Range.T0.Format "2006-01-02"}} to {{.Report.Ra
 </table>
 <p/>
 <div id="reportGraph" style="height: 600px; width: 800px"></div>
+<div id="relayTimeline" style="width: 800px"></div>
+`)
+
+var reportIndexTempl = newTemplate(`
+<html>
+	<head>
+		<title>Energy usage reports</title>
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<link rel="stylesheet" href="/common.css">
+	</head>
+<h2>Energy usage reports</h2>
+{{with .Reports}}
+<ul>
+{{range .}}	<li><a href="{{.Link}}">{{.Name}}</a>{{if .Partial}} (partial){{end}}</li>
+{{end}}</ul>
+{{else}}
+<p>{{.Message}}</p>
+{{end}}
 `)
 
 const (
 	reportCSVLinkFormat  = "hydro-report-2006-01.csv"
 	reportJSONLinkFormat = "2006-01.json"
+
+	// reportIndexJSON holds the name of the JSON
+	// index of the available reports.
+	reportIndexJSON = "index.json"
 )
 
+// noReportsMessage is shown when there are no reports,
+// which is usual for a newly configured system.
+const noReportsMessage = "No reports are available yet. Reports become available when there are samples from all the meters covering at least an hour."
+
+// reportIndex holds information on the available reports
+// as served by /reports/ and /reports/index.json.
+type reportIndex struct {
+	Reports []clientReport
+	// Message holds a message explaining why there
+	// are no reports, if there are none.
+	Message string `json:",omitempty"`
+}
+
 func (h *Handler) serveReports(w http.ResponseWriter, req *http.Request) {
 	reports := h.store.AvailableReports()
 	reportName := strings.TrimPrefix(req.URL.Path, "/reports/")
-	if reportName == "" {
-		fmt.Fprintf(w, "%d reports available (TODO more info about available reports!)", len(reports))
+	if reportName == "" || reportName == reportIndexJSON {
+		h.serveReportIndex(w, reportName == reportIndexJSON, reports)
+		return
+	}
+	if len(reports) == 0 {
+		http.Error(w, noReportsMessage, http.StatusNotFound)
 		return
 	}
 	handler := h.serveReport
@@ -156,7 +210,7 @@ func (h *Handler) serveReports(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	for _, report := range reports {
-		rt := report.Range.T0
+		rt := report.Range.T0.In(h.p.TZ)
 		if rt.Year() == t.Year() && rt.Month() == t.Month() {
 			handler(w, req, report)
 			return
@@ -165,17 +219,78 @@ func (h *Handler) serveReports(w http.ResponseWriter, req *http.Request) {
 	http.NotFound(w, req)
 }
 
+// serveReportIndex serves the list of available reports, as
+// HTML or as JSON.
+func (h *Handler) serveReportIndex(w http.ResponseWriter, asJSON bool, reports []*hydroreport.Report) {
+	index := reportIndex{
+		Reports: clientReports(reports),
+	}
+	if len(reports) == 0 {
+		index.Message = noReportsMessage
+	}
+	if asJSON {
+		data, err := json.Marshal(index)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot marshal report index: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	var b bytes.Buffer
+	if err := reportIndexTempl.Execute(&b, index); err != nil {
+		log.Printf("report index template execution failed: %v", err)
+		http.Error(w, fmt.Sprintf("template execution failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b.Bytes())
+}
+
+// clientReports returns the client's view of the given reports.
+// It never returns nil.
+func clientReports(reports []*hydroreport.Report) []clientReport {
+	crs := make([]clientReport, len(reports))
+	for i, r := range reports {
+		crs[i] = clientReport{
+			Name:    r.Range.T0.Format("Jan 2006"),
+			Link:    "/reports/" + r.Range.T0.Format("2006-01"),
+			Partial: r.Partial,
+		}
+	}
+	return crs
+}
+
 var reportGraphLabels = map[string]string{
 	"ExportGrid":      "Exported to grid",
 	"ExportNeighbour": "Aliday export",
 	"ExportHere":      "Drynoch export",
 	"ImportNeighbour": "Aliday import",
 	"ImportHere":      "Drynoch import",
+	"PeakImport":      "Peak import",
+	"PeakExport":      "Peak export",
 }
 
+// reportWithRelays holds the form of the report JSON when
+// the relays query parameter is set.
+type reportWithRelays struct {
+	// Energy holds the energy usage data table, as served
+	// when the relays parameter isn't set.
+	Energy *googlecharts.DataTable
+	// Relays holds a data table with a row for each period
+	// within the report's time range when a relay was on,
+	// suitable for drawing as a timeline.
+	Relays *googlecharts.DataTable
+}
+
+// serveReportJSON serves the report data as a Google Charts data
+// table. If the relays query parameter is set, the periods
+// when relays were on (taken from the relay history) are
+// included too as a separate table; see reportWithRelays.
 func (h *Handler) serveReportJSON(w http.ResponseWriter, req *http.Request, report *hydroreport.Report) {
 	var entries []hydroreport.Entry
 	p := report.Params()
+	p.Peak = true
 	//p.EntryDuration = time.Minute
 	r, err := hydroreport.Open(p)
 	if err != nil {
@@ -189,7 +304,7 @@ func (h *Handler) serveReportJSON(w http.ResponseWriter, req *http.Request, repo
 			break
 		}
 		if err != nil {
-			log.Printf("report template execution failed: %v", err)
+			log.Printf("cannot read report entries: %v", err)
 			http.Error(w, fmt.Sprintf("cannot get report data points: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -199,24 +314,100 @@ func (h *Handler) serveReportJSON(w http.ResponseWriter, req *http.Request, repo
 	for id, label := range reportGraphLabels {
 		table.Column(id).Label = label
 	}
-	w.Header().Set("Content-Type", "application/json")
-	data, _ := json.Marshal(table)
+	var v interface{} = table
+	if req.FormValue("relays") != "" {
+		var records []historyRecord
+		// Without the current relay state, we can't tell
+		// which relays are still on, so leave the periods out.
+		if ws := h.store.WorkerState(); h.history != nil && ws != nil {
+			records = relayPeriods(h.history.ReverseIter(), h.store.CtlConfig(), ws.State, report.Range.T0, report.Range.T1)
+		}
+		v = reportWithRelays{
+			Energy: table,
+			Relays: googlecharts.NewDataTable(records),
+		}
+	}
+	data, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("cannot marshal data table: %v", err), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
 
+// serveReportCSV serves the report as CSV. The delimiter and decimal
+// query parameters can be used to choose the field delimiter and the
+// decimal separator (for example delimiter=;&decimal=, for locales
+// that use a comma as a decimal point). If the peak query parameter
+// is set, peak import and export power columns are included.
 func (h *Handler) serveReportCSV(w http.ResponseWriter, req *http.Request, report *hydroreport.Report) {
+	var f hydroreport.CSVFormat
+	for _, p := range []struct {
+		name string
+		r    *rune
+	}{{"delimiter", &f.Delimiter}, {"decimal", &f.DecimalSeparator}} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		if utf8.RuneCountInString(v) != 1 {
+			http.Error(w, fmt.Sprintf("invalid %q parameter: must be a single character", p.name), http.StatusBadRequest)
+			return
+		}
+		*p.r, _ = utf8.DecodeRuneInString(v)
+	}
+	if err := f.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid CSV format: %v", err), http.StatusBadRequest)
+		return
+	}
+	f.Peak = req.FormValue("peak") != ""
 	w.Header().Set("Content-Type", "text/csv")
-	if err := report.Write(w); err != nil {
+	w.Header().Set("Content-Disposition", `attachment; filename="`+report.Range.T0.Format(reportCSVLinkFormat)+`"`)
+	if err := report.WriteFormat(newFlushWriter(w, reportFlushInterval), f); err != nil {
 		if err != nil {
 			log.Printf("error writing report: %v", err)
 		}
 	}
 }
 
+// reportFlushInterval holds the maximum interval between
+// flushes of a report that's being written to a client.
+const reportFlushInterval = time.Second
+
+// flushWriter is an io.Writer that writes to an http.ResponseWriter,
+// flushing it after the first write and then at most once every interval
+// so that large responses start arriving at the client immediately
+// without incurring the cost of a flush for every write.
+type flushWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func newFlushWriter(w http.ResponseWriter, interval time.Duration) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushWriter{
+		w:        w,
+		flusher:  flusher,
+		interval: interval,
+	}
+}
+
+// Write implements io.Writer.
+func (w *flushWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	if now := time.Now(); now.Sub(w.lastFlush) >= w.interval {
+		w.flusher.Flush()
+		w.lastFlush = now
+	}
+	return n, err
+}
+
 func columnIndex(cols []googlecharts.Column, id string) int {
 	for i := range cols {
 		if cols[i].ID == id {
@@ -264,7 +455,7 @@ func (h *Handler) serveReport(w http.ResponseWriter, req *http.Request, report *
 			break
 		}
 		if err != nil {
-			log.Printf("report template execution failed: %v", err)
+			log.Printf("cannot read report entries: %v", err)
 			http.Error(w, fmt.Sprintf("cannot summarise report: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,331 @@
+package hydroserver
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/googlecharts"
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/hydroworker"
+	"github.com/rogpeppe/hydro/meterstat"
+)
+
+var reportCSVFormatTests = []struct {
+	testName     string
+	query        string
+	expectStatus int
+	expectLine   string
+}{{
+	testName:     "default",
+	expectStatus: http.StatusOK,
+	expectLine:   "2020-03-01 00:00 UTC,0.000,0.500,0.500,0.500,0.500",
+}, {
+	testName:     "semicolon-comma",
+	query:        "?delimiter=%3B&decimal=%2C",
+	expectStatus: http.StatusOK,
+	expectLine:   "2020-03-01 00:00 UTC;0,000;0,500;0,500;0,500;0,500",
+}, {
+	testName:     "ambiguous",
+	query:        "?decimal=%2C",
+	expectStatus: http.StatusBadRequest,
+	expectLine:   `invalid CSV format: delimiter and decimal separator are both ','`,
+}, {
+	testName:     "too-long",
+	query:        "?delimiter=ab",
+	expectStatus: http.StatusBadRequest,
+	expectLine:   `invalid "delimiter" parameter: must be a single character`,
+}}
+
+func TestReportCSVFormat(t *testing.T) {
+	c := qt.New(t)
+	h := newReportTestHandler(c)
+	for _, test := range reportCSVFormatTests {
+		c.Run(test.testName, func(c *qt.C) {
+			req := httptest.NewRequest("GET", "/reports/hydro-report-2020-03.csv"+test.query, nil)
+			rec := httptest.NewRecorder()
+			h.serveReports(rec, req)
+			c.Assert(rec.Code, qt.Equals, test.expectStatus, qt.Commentf("body: %s", rec.Body))
+			lines := strings.Split(rec.Body.String(), "\n")
+			if test.expectStatus != http.StatusOK {
+				c.Assert(lines[0], qt.Equals, test.expectLine)
+				return
+			}
+			c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "text/csv")
+			c.Assert(lines[1], qt.Equals, test.expectLine)
+		})
+	}
+}
+
+func TestReportCSVContentDisposition(t *testing.T) {
+	c := qt.New(t)
+	h := newReportTestHandler(c)
+	req := httptest.NewRequest("GET", "/reports/hydro-report-2020-03.csv", nil)
+	rec := httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Disposition"), qt.Equals, `attachment; filename="hydro-report-2020-03.csv"`)
+	_, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(params["filename"], qt.Equals, "hydro-report-2020-03.csv")
+	// The response is flushed so that the download starts
+	// before the whole report has been generated.
+	c.Assert(rec.Flushed, qt.IsTrue)
+}
+
+func TestReportIndexNoSamples(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	meters := map[hydroreport.MeterLocation][]string{
+		hydroreport.LocGenerator: {"generator"},
+		hydroreport.LocHere:      {"here"},
+		hydroreport.LocNeighbour: {"neighbour"},
+	}
+	for _, names := range meters {
+		err := os.Mkdir(filepath.Join(dir, names[0]), 0777)
+		c.Assert(err, qt.IsNil)
+	}
+	reports, err := hydroreport.AllReports(hydroreport.AllReportsParams{
+		SampleDir: dir,
+		Meters:    meters,
+	})
+	c.Assert(err, qt.IsNil)
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	store.UpdateAvailableReports(reports)
+	h := &Handler{
+		store: store,
+		p: Params{
+			TZ: time.UTC,
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/reports/index.json", nil)
+	rec := httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/json")
+	c.Assert(rec.Body.String(), qt.JSONEquals, reportIndex{
+		Reports: []clientReport{},
+		Message: noReportsMessage,
+	})
+
+	req = httptest.NewRequest("GET", "/reports/", nil)
+	rec = httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, noReportsMessage)
+
+	// Asking for a particular report explains why it's not there.
+	req = httptest.NewRequest("GET", "/reports/2020-03", nil)
+	rec = httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusNotFound, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Equals, noReportsMessage+"\n")
+}
+
+func TestReportIndex(t *testing.T) {
+	c := qt.New(t)
+	h := newReportTestHandler(c)
+	req := httptest.NewRequest("GET", "/reports/index.json", nil)
+	rec := httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.JSONEquals, reportIndex{
+		Reports: []clientReport{{
+			Name: "Mar 2020",
+			Link: "/reports/2020-03",
+		}},
+	})
+
+	req = httptest.NewRequest("GET", "/reports/", nil)
+	rec = httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), qt.Contains, `<a href="/reports/2020-03">Mar 2020</a>`)
+}
+
+func TestReportJSONRelays(t *testing.T) {
+	c := qt.New(t)
+	h := newReportTestHandler(c)
+	hstore, err := history.NewDiskStore(filepath.Join(c.Mkdir(), "history"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	defer hstore.Close()
+	h.history = hstore
+	t0 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	events := []history.Event{
+		// Relay 1 is already on at the start of the report.
+		{Relay: 1, On: true, Time: t0.Add(-48 * time.Hour)},
+		{Relay: 1, On: false, Time: t0.Add(24 * time.Hour)},
+		// Relay 2 is on twice, once entirely within the report.
+		{Relay: 2, On: true, Time: t0.Add(-10 * time.Hour)},
+		{Relay: 2, On: false, Time: t0.Add(-5 * time.Hour)},
+		{Relay: 2, On: true, Time: t0.Add(10 * 24 * time.Hour)},
+		{Relay: 2, On: false, Time: t0.Add(11 * 24 * time.Hour)},
+		// Relay 3 is on throughout.
+		{Relay: 3, On: true, Time: t0.Add(-24 * time.Hour)},
+		// Relay 4 is turned on after the end of the report.
+		{Relay: 4, On: true, Time: t0.AddDate(0, 1, 1)},
+		// Relay 5 is turned on near the end of the report and
+		// remains on.
+		{Relay: 5, On: true, Time: t0.AddDate(0, 1, 0).Add(-time.Hour)},
+	}
+	// The history is stored in time order.
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	for _, e := range events {
+		hstore.Append(e)
+	}
+	c.Assert(hstore.Commit(), qt.IsNil)
+	h.store.UpdateWorkerState(&hydroworker.Update{
+		State: 1<<3 | 1<<4 | 1<<5,
+	})
+
+	// Without the relays parameter, only the energy data is returned.
+	req := httptest.NewRequest("GET", "/reports/2020-03.json", nil)
+	rec := httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	var table googlecharts.DataTable
+	err = json.Unmarshal(rec.Body.Bytes(), &table)
+	c.Assert(err, qt.IsNil)
+	c.Assert(table.Column("ExportGrid"), qt.Not(qt.IsNil))
+
+	req = httptest.NewRequest("GET", "/reports/2020-03.json?relays=1", nil)
+	rec = httptest.NewRecorder()
+	h.serveReports(rec, req)
+	c.Assert(rec.Code, qt.Equals, http.StatusOK, qt.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/json")
+	var resp struct {
+		Energy googlecharts.DataTable
+		Relays json.RawMessage
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Energy.Cols, qt.DeepEquals, table.Cols)
+	c.Assert(resp.Energy.Rows, qt.HasLen, len(table.Rows))
+	t1 := t0.AddDate(0, 1, 0)
+	c.Assert(string(resp.Relays), qt.JSONEquals, googlecharts.NewDataTable([]historyRecord{{
+		Name:  "1: ",
+		Start: t0,
+		End:   t0.Add(24 * time.Hour),
+	}, {
+		Name:  "3: ",
+		Start: t0,
+		End:   t1,
+	}, {
+		Name:  "2: ",
+		Start: t0.Add(10 * 24 * time.Hour),
+		End:   t0.Add(11 * 24 * time.Hour),
+	}, {
+		Name:  "5: ",
+		Start: t1.Add(-time.Hour),
+		End:   t1,
+	}}))
+}
+
+func TestRelayPeriodsStopsEarly(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(24 * time.Hour)
+	store := &history.MemStore{}
+	for _, e := range []history.Event{
+		{Relay: 0, On: true, Time: t0.Add(-72 * time.Hour)},
+		{Relay: 0, On: false, Time: t0.Add(-71 * time.Hour)},
+		// Relay 1 is on at t0, so its on event must be found.
+		{Relay: 1, On: true, Time: t0.Add(-48 * time.Hour)},
+		{Relay: 0, On: true, Time: t0.Add(-24 * time.Hour)},
+		{Relay: 0, On: false, Time: t0.Add(-12 * time.Hour)},
+		{Relay: 1, On: false, Time: t0.Add(time.Hour)},
+		{Relay: 0, On: true, Time: t0.Add(2 * time.Hour)},
+	} {
+		store.Append(e)
+	}
+	c.Assert(store.Commit(), qt.IsNil)
+	iter := &countingIter{Iterator: store.ReverseIter()}
+	cfg := &hydroctl.Config{
+		Relays: make([]hydroctl.RelayConfig, 2),
+	}
+	records := relayPeriods(iter, cfg, 1<<0, t0, t1)
+	c.Assert(records, qt.DeepEquals, []historyRecord{{
+		Name:  "1: ",
+		Start: t0,
+		End:   t0.Add(time.Hour),
+	}, {
+		Name:  "0: ",
+		Start: t0.Add(2 * time.Hour),
+		End:   t1,
+	}})
+	// Once relay 1's on event has been found, the iteration
+	// stops at the next event, without reading the earliest one.
+	c.Assert(iter.n, qt.Equals, 6)
+}
+
+// countingIter counts the number of items read
+// from an iterator.
+type countingIter struct {
+	history.Iterator
+	n int
+}
+
+func (iter *countingIter) Next() bool {
+	if !iter.Iterator.Next() {
+		return false
+	}
+	iter.n++
+	return true
+}
+
+// newReportTestHandler returns a Handler with a single available report
+// for March 2020 in which each meter uses a constant 1kW.
+func newReportTestHandler(c *qt.C) *Handler {
+	dir := c.Mkdir()
+	t0 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.AddDate(0, 1, 0)
+	for _, name := range []string{"generator", "here", "neighbour"} {
+		path := filepath.Join(dir, name, "1.sample")
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		f, err := os.Create(path)
+		c.Assert(err, qt.IsNil)
+		_, err = meterstat.WriteSamples(f, meterstat.NewMemSampleReader([]meterstat.Sample{{
+			Time: t0,
+		}, {
+			Time:        t1,
+			TotalEnergy: t1.Sub(t0).Hours() * 1000,
+		}}))
+		c.Assert(err, qt.IsNil)
+		c.Assert(f.Close(), qt.IsNil)
+	}
+	reports, err := hydroreport.AllReports(hydroreport.AllReportsParams{
+		SampleDir: dir,
+		Meters: map[hydroreport.MeterLocation][]string{
+			hydroreport.LocGenerator: {"generator"},
+			hydroreport.LocHere:      {"here"},
+			hydroreport.LocNeighbour: {"neighbour"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(reports, qt.HasLen, 1)
+	store, err := newStore(filepath.Join(dir, "config"), DefaultFileMode)
+	c.Assert(err, qt.IsNil)
+	store.UpdateAvailableReports(reports)
+	return &Handler{
+		store: store,
+		p: Params{
+			TZ: time.UTC,
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package hydroserver
+
+import (
+	"time"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+// previewResolution holds the interval between
+// simulated assessments when previewing a schedule.
+const previewResolution = time.Minute
+
+// idealPower holds the power generation (W) assumed when
+// previewing a schedule. It's large enough that no relay
+// will ever be denied power.
+const idealPower = 1e9
+
+// scheduleWindow holds a period of time during which
+// a relay is on.
+type scheduleWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// previewSchedule returns, for each relay in cfg, the windows of time
+// within the day starting at dayStart during which the relay would be on
+// if there was always enough power available. All relays are assumed
+// to be off at the start of the day.
+func previewSchedule(cfg *hydroctl.Config, dayStart time.Time) [][]scheduleWindow {
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	var store history.MemStore
+	hdb, err := history.New(&store)
+	if err != nil {
+		// A new memory store can't fail.
+		panic(err)
+	}
+	windows := make([][]scheduleWindow, len(cfg.Relays))
+	var state hydroctl.RelayState
+	for now := dayStart; now.Before(dayEnd); now = now.Add(previewResolution) {
+		newState := hydroctl.Assess(hydroctl.AssessParams{
+			Config:       cfg,
+			CurrentState: state,
+			History:      hdb,
+			PowerUseSample: hydroctl.PowerUseSample{
+				PowerUse: hydroctl.PowerUse{
+					Generated: idealPower,
+				},
+				T0: now,
+				T1: now,
+			},
+			Now: now,
+		})
+		if newState == state {
+			continue
+		}
+		hdb.RecordState(newState, now)
+		store.Commit()
+		for i := range cfg.Relays {
+			switch on := newState.IsSet(i); {
+			case on && !state.IsSet(i):
+				windows[i] = append(windows[i], scheduleWindow{
+					Start: now,
+				})
+			case !on && state.IsSet(i):
+				windows[i][len(windows[i])-1].End = now
+			}
+		}
+		state = newState
+	}
+	// Close any windows that are still open at the end of the day.
+	for i := range cfg.Relays {
+		if state.IsSet(i) {
+			windows[i][len(windows[i])-1].End = dayEnd
+		}
+	}
+	return windows
+}
@@ -0,0 +1,74 @@
+package hydroserver
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroctl"
+)
+
+func TestPreviewSchedule(t *testing.T) {
+	c := qt.New(t)
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+	cfg := &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode: hydroctl.InUse,
+			InUse: []*hydroctl.Slot{{
+				Start:    mustParseTimeOfDay("10:00"),
+				End:      mustParseTimeOfDay("14:00"),
+				Kind:     hydroctl.Exactly,
+				Duration: 2 * time.Hour,
+			}},
+		}, {
+			Mode: hydroctl.InUse,
+			InUse: []*hydroctl.Slot{{
+				Start:    mustParseTimeOfDay("16:00"),
+				End:      mustParseTimeOfDay("18:00"),
+				Kind:     hydroctl.AtLeast,
+				Duration: time.Hour,
+			}},
+		}, {
+			Mode: hydroctl.AlwaysOff,
+		}, {
+			Mode: hydroctl.InUse,
+			InUse: []*hydroctl.Slot{{
+				Start: mustParseTimeOfDay("23:00"),
+				End:   mustParseTimeOfDay("01:00"),
+				Kind:  hydroctl.Continuous,
+			}},
+		}},
+	}
+	windows := previewSchedule(cfg, day)
+	c.Assert(windows, qt.DeepEquals, [][]scheduleWindow{{{
+		// An Exactly slot uses only the time it needs.
+		Start: at(10, 0),
+		End:   at(12, 0),
+	}}, {{
+		// An AtLeast slot uses all of its time when
+		// power is freely available.
+		Start: at(16, 0),
+		End:   at(18, 0),
+	}}, nil, {{
+		// The slot that started the previous day.
+		Start: at(0, 0),
+		End:   at(1, 0),
+	}, {
+		// The slot that finishes the next day is
+		// cut off at the end of the day.
+		Start: at(23, 0),
+		End:   at(24, 0),
+	}}})
+}
+
+func mustParseTimeOfDay(s string) hydroctl.TimeOfDay {
+	td, err := hydroctl.ParseTimeOfDay(s)
+	if err != nil {
+		panic(err)
+	}
+	return td
+}
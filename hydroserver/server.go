@@ -1,10 +1,13 @@
 package hydroserver
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -12,11 +15,14 @@ import (
 	"github.com/rakyll/statik/fs"
 	"gopkg.in/errgo.v1"
 
+	"github.com/rogpeppe/hydro/decisionlog"
 	"github.com/rogpeppe/hydro/history"
 	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
 	"github.com/rogpeppe/hydro/hydroworker"
 	"github.com/rogpeppe/hydro/logworker"
 	"github.com/rogpeppe/hydro/meterworker"
+	"github.com/rogpeppe/hydro/sampleworker"
 	_ "github.com/rogpeppe/hydro/statik"
 )
 
@@ -24,15 +30,36 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// updateDebounce holds how long to wait after a change before
+// sending an update to websocket clients, so that rapid
+// successive changes result in a single update.
+const updateDebounce = 100 * time.Millisecond
+
 type Handler struct {
 	store *store
 	// TODO rename this to relayworker.
 	worker      *hydroworker.Worker
 	meterWorker *meterworker.Worker
 	controller  *relayCtl
+	decisions   *decisionlog.Writer
 	mux         *http.ServeMux
 	history     *history.DiskStore
 	p           Params
+
+	// configMu guards the fields below.
+	configMu sync.Mutex
+	// configSaving holds whether a configuration save is in progress.
+	configSaving bool
+	// lastConfigSave holds when the configuration was last saved.
+	lastConfigSave time.Time
+
+	// commissionMu is held while relays are being
+	// pulsed for commissioning.
+	commissionMu sync.Mutex
+
+	// version holds the version of the running server
+	// as shown to clients.
+	version string
 }
 
 type Params struct {
@@ -44,8 +71,112 @@ type Params struct {
 	ReportPollInterval time.Duration
 	// TZ holds the time zone to use for meter assessments.
 	TZ *time.Location
+	// PollMeters specifies that meter samples should be gathered
+	// by regularly polling the meters' live values rather than
+	// by reading their energy logs.
+	PollMeters bool
+	// HistoryWindow holds how far back in time relay history
+	// events are loaded when the server starts. If it's zero,
+	// DefaultHistoryWindow is used.
+	HistoryWindow time.Duration
+	// MACSampleDirs specifies that meter sample directories
+	// should be named after the meters' MAC addresses
+	// rather than their network addresses.
+	MACSampleDirs bool
+	// PowerSmoothing holds the factor used to smooth meter
+	// power readings before they're used for relay decisions.
+	// See meterworker.Params.PowerSmoothing.
+	PowerSmoothing float64
+	// PowerBounds holds the range of plausible power readings
+	// for meters at each location.
+	// See meterworker.Params.PowerBounds.
+	PowerBounds map[hydroreport.MeterLocation]meterworker.PowerBounds
+	// Heartbeat holds the interval at which relay changes
+	// are assessed. If it's zero, hydroworker.DefaultHeartbeat
+	// is used.
+	Heartbeat time.Duration
+	// ControlPassword, if non-empty, holds the password that
+	// clients must provide (with HTTP basic auth) to see sensitive
+	// information such as the relay controller address.
+	// Clients of the updates websocket without it are treated
+	// as read-only viewers; the config page and the backup
+	// endpoint are refused to them.
+	ControlPassword string
+	// RequireAuth specifies that clients of the updates websocket
+	// must provide ControlPassword; viewers are not allowed.
+	RequireAuth bool
+	// ConfigSaveInterval holds the minimum interval between
+	// saves of the configuration from the config page, which can
+	// restart workers. Saves made sooner than that are rejected.
+	// If it's zero, DefaultConfigSaveInterval is used.
+	ConfigSaveInterval time.Duration
+	// VerifyRelays specifies that the relay state should be read
+	// back from the relay controller after setting it, so that
+	// a controller that fails to apply some of the changes is
+	// noticed immediately rather than when the state is next read.
+	VerifyRelays bool
+	// RelayRefreshInterval holds how long the relay state
+	// read from the relay controller is believed before it's
+	// read again. If it's zero, DefaultRelayRefreshInterval is used.
+	RelayRefreshInterval time.Duration
+	// RelayRefreshJitter holds the maximum random amount
+	// of time added to RelayRefreshInterval.
+	RelayRefreshJitter time.Duration
+	// RelayActiveRefreshInterval, if non-zero, holds a shorter
+	// refresh interval that's used while the relays are being
+	// changed, so that manual changes to the relays are
+	// noticed sooner.
+	RelayActiveRefreshInterval time.Duration
+	// ShutdownRelayState, if non-nil, holds the relay state
+	// that's set when the Handler is closed.
+	// See hydroworker.Params.ShutdownState.
+	ShutdownRelayState *hydroctl.RelayState
+	// RelayWatchdogTimeout, if non-zero, holds the length of time
+	// for which the worker may stop running before the relays
+	// are set to a safe state: ShutdownRelayState if it's set,
+	// or all off otherwise.
+	RelayWatchdogTimeout time.Duration
+	// DecisionLogDir, if non-empty, holds the directory in which
+	// a durable record of relay decisions is kept.
+	// See the decisionlog package for details.
+	DecisionLogDir string
+	// ExpectedMaxRoundTrip holds the longest time that a meter
+	// request might normally be expected to take. It's used
+	// when deciding whether a sample's lag is worth showing
+	// until the meters' actual round trip times are known.
+	// If it's zero, DefaultExpectedMaxRoundTrip is used.
+	ExpectedMaxRoundTrip time.Duration
+	// DisabledCohortsPath, if non-empty, holds the path of the
+	// file where the names of disabled cohorts are stored.
+	// The relays in a disabled cohort are always off.
+	DisabledCohortsPath string
+	// FileMode holds the permissions used when creating
+	// configuration, history, sample and decision log files.
+	// If it's zero, DefaultFileMode is used.
+	FileMode os.FileMode
+	// DirMode holds the permissions used when creating
+	// sample and decision log directories.
+	// If it's zero, DefaultDirMode is used.
+	DirMode os.FileMode
 }
 
+// DefaultHistoryWindow holds the default value of Params.HistoryWindow.
+const DefaultHistoryWindow = 7 * 24 * time.Hour
+
+// DefaultConfigSaveInterval holds the default value of Params.ConfigSaveInterval.
+const DefaultConfigSaveInterval = time.Second
+
+// DefaultExpectedMaxRoundTrip holds the default value of Params.ExpectedMaxRoundTrip.
+const DefaultExpectedMaxRoundTrip = time.Second
+
+// DefaultFileMode holds the default value of Params.FileMode.
+// The state files can hold sensitive information such as
+// the relay controller's address, so they're private by default.
+const DefaultFileMode os.FileMode = 0600
+
+// DefaultDirMode holds the default value of Params.DirMode.
+const DefaultDirMode os.FileMode = 0700
+
 // TODO make it so it's possible to change this via the UI.
 var timezone, _ = time.LoadLocation("Europe/London")
 
@@ -54,54 +185,104 @@ func New(p Params) (_ *Handler, err error) {
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot get static data")
 	}
-	store, err := newStore(p.ConfigPath)
+	if p.FileMode == 0 {
+		p.FileMode = DefaultFileMode
+	}
+	if p.DirMode == 0 {
+		p.DirMode = DefaultDirMode
+	}
+	store, err := newStore(p.ConfigPath, p.FileMode)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot make store")
 	}
-	historyStore, err := history.NewDiskStore(p.HistoryPath, time.Now().Add(-7*24*time.Hour))
+	if p.DisabledCohortsPath != "" {
+		if err := store.loadDisabledCohorts(p.DisabledCohortsPath); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if p.HistoryWindow == 0 {
+		p.HistoryWindow = DefaultHistoryWindow
+	}
+	if p.ConfigSaveInterval == 0 {
+		p.ConfigSaveInterval = DefaultConfigSaveInterval
+	}
+	if p.ExpectedMaxRoundTrip == 0 {
+		p.ExpectedMaxRoundTrip = DefaultExpectedMaxRoundTrip
+	}
+	historyStore, err := history.NewDiskStoreWithMode(p.HistoryPath, time.Now().Add(-p.HistoryWindow), p.FileMode)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot open history file")
 	}
 	relayCtlConfigStore := &relayCtlConfigStore{
 		path: p.RelayAddrPath,
+		mode: p.FileMode,
+	}
+	var watchdogState hydroctl.RelayState
+	if p.ShutdownRelayState != nil {
+		watchdogState = *p.ShutdownRelayState
 	}
-	controller := newRelayController(relayCtlConfigStore)
+	controller := newRelayController(relayCtlParams{
+		CfgStore:              relayCtlConfigStore,
+		Updater:               store,
+		Config:                store.CtlConfig,
+		Verify:                p.VerifyRelays,
+		RefreshInterval:       p.RelayRefreshInterval,
+		RefreshJitter:         p.RelayRefreshJitter,
+		ActiveRefreshInterval: p.RelayActiveRefreshInterval,
+		WatchdogTimeout:       p.RelayWatchdogTimeout,
+		WatchdogState:         watchdogState,
+	})
 
+	// Use logworker to gather samples unless we've been asked to poll.
+	// We could also use a sampleworker proxy via a raspberry pi adjacent to the meter.
+	newSampleWorker := newLogSampleWorker
+	if p.PollMeters {
+		newSampleWorker = newPollSampleWorker
+	}
 	meterWorker, err := meterworker.New(meterworker.Params{
-		Updater:         store,
-		SampleDirPath:   p.SampleDirPath,
-		MeterConfigPath: p.MeterConfigPath,
-		TZ:              p.TZ,
-		// Use logworker to gather samples. We could also use sampleworker here,
-		// or a sampleworker proxy via a raspberry pi adjacent to the meter.
-		NewSampleWorker: func(p meterworker.SampleWorkerParams) (meterworker.SampleWorker, error) {
-			w, err := logworker.New(logworker.Params{
-				SampleDir:      p.SampleDir,
-				MeterAddr:      p.MeterAddr,
-				TZ:             p.TZ,
-				Prefix:         "log-",
-				SamplesChanged: p.SamplesChanged,
-			})
-			if err != nil {
-				return nil, err
-			}
-			return w, nil
-		},
+		Updater:            store,
+		SampleDirPath:      p.SampleDirPath,
+		MeterConfigPath:    p.MeterConfigPath,
+		TZ:                 p.TZ,
+		NewSampleWorker:    newSampleWorker,
 		ReportPollInterval: p.ReportPollInterval,
+		UseMACSampleDirs:   p.MACSampleDirs,
+		PowerSmoothing:     p.PowerSmoothing,
+		PowerBounds:        p.PowerBounds,
+		FileMode:           p.FileMode,
+		DirMode:            p.DirMode,
 	})
 	if err != nil {
+		controller.Close()
 		return nil, errgo.Notef(err, "cannot start meter worker")
 	}
 
-	w, err := hydroworker.New(hydroworker.Params{
-		Config:     store.CtlConfig(),
-		Store:      historyStore,
-		Updater:    store,
-		Controller: controller,
-		Meters:     meterWorker,
-		TZ:         p.TZ,
-	})
+	var decisions *decisionlog.Writer
+	if p.DecisionLogDir != "" {
+		decisions, err = decisionlog.NewWriterWithMode(p.DecisionLogDir, p.TZ, p.FileMode, p.DirMode)
+		if err != nil {
+			controller.Close()
+			return nil, errgo.Notef(err, "cannot open decision log")
+		}
+	}
+	workerParams := hydroworker.Params{
+		Config:        store.CtlConfig(),
+		Store:         historyStore,
+		Updater:       store,
+		Controller:    controller,
+		Meters:        meterWorker,
+		TZ:            p.TZ,
+		Heartbeat:     p.Heartbeat,
+		ShutdownState: p.ShutdownRelayState,
+	}
+	if decisions != nil {
+		// Note: don't assign a nil *decisionlog.Writer
+		// to the interface field.
+		workerParams.Decisions = decisions
+	}
+	w, err := hydroworker.New(workerParams)
 	if err != nil {
+		controller.Close()
 		return nil, errgo.Notef(err, "cannot start worker")
 	}
 	h := &Handler{
@@ -110,8 +291,10 @@ func New(p Params) (_ *Handler, err error) {
 		worker:      w,
 		meterWorker: meterWorker,
 		controller:  controller,
+		decisions:   decisions,
 		history:     historyStore,
 		p:           p,
+		version:     BuildVersion().String(),
 	}
 	go h.configUpdater()
 	h.store.anyNotifier.Changed()
@@ -132,6 +315,43 @@ func New(p Params) (_ *Handler, err error) {
 	return h, nil
 }
 
+// newLogSampleWorker returns a sample worker that
+// gathers samples from the meter's energy log.
+func newLogSampleWorker(p meterworker.SampleWorkerParams) (meterworker.SampleWorker, error) {
+	w, err := logworker.New(logworker.Params{
+		SampleDir:      p.SampleDir,
+		MeterAddr:      p.MeterAddr,
+		TZ:             p.TZ,
+		MeterTZ:        p.MeterTZ,
+		Prefix:         "log-",
+		SamplesChanged: p.SamplesChanged,
+		FileMode:       p.FileMode,
+		DirMode:        p.DirMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newPollSampleWorker returns a sample worker that
+// gathers samples by polling the meter's live values.
+func newPollSampleWorker(p meterworker.SampleWorkerParams) (meterworker.SampleWorker, error) {
+	w, err := sampleworker.New(sampleworker.Params{
+		SampleDir:      p.SampleDir,
+		MeterAddr:      p.MeterAddr,
+		TZ:             p.TZ,
+		Prefix:         "live-",
+		SamplesChanged: p.SamplesChanged,
+		FileMode:       p.FileMode,
+		DirMode:        p.DirMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
 func (h *Handler) configUpdater() {
 	for {
 		for w := h.store.configNotifier.Watch(); w.Next(); {
@@ -149,6 +369,12 @@ func (h *Handler) Close() {
 	h.store.anyNotifier.Close()
 	h.store.configNotifier.Close()
 	h.worker.Close()
+	h.controller.Close()
+	if h.decisions != nil {
+		if err := h.decisions.Close(); err != nil {
+			log.Printf("cannot close decision log: %v", err)
+		}
+	}
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -157,14 +383,42 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (h *Handler) serveUpdates(w http.ResponseWriter, req *http.Request) {
+	viewer := !h.isController(req)
+	if viewer && h.p.RequireAuth {
+		unauthorized(w)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		log.Printf("connection upgrade failed: %v", err)
 		return
 	}
-	log.Printf("websocket connection made")
-	for w := h.store.anyNotifier.Watch(); w.Next(); {
-		if err := conn.WriteJSON(h.makeUpdate()); err != nil {
+	log.Printf("websocket connection made (viewer %v)", viewer)
+	watcher := h.store.anyNotifier.Watch()
+	defer watcher.Close()
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		for watcher.Next() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	for range changes {
+		time.Sleep(updateDebounce)
+		// Any changes made while we were sleeping
+		// will be included in this update.
+		select {
+		case <-changes:
+		default:
+		}
+		u := h.makeUpdate()
+		if viewer {
+			u = u.viewerUpdate()
+		}
+		if err := conn.WriteJSON(u); err != nil {
 			log.Printf("cannot write JSON to websocket: %v", err)
 			return
 		}
@@ -175,19 +429,99 @@ func (h *Handler) serveUpdates(w http.ResponseWriter, req *http.Request) {
 // down the websocket connection to the client.
 type clientUpdate struct {
 	Relays  []clientRelayInfo
+	Cohorts []clientCohortInfo
 	Meters  *clientMeterInfo
 	Reports []clientReport
+	// Log holds the most recent relay assessment
+	// log entries, oldest first.
+	Log []hydroworker.LogEntry
+	// RelayAddr holds the address of the relay controller.
+	// It's omitted for read-only viewers.
+	RelayAddr string `json:",omitempty"`
+	// Version holds the version of the running server.
+	Version string
+}
+
+// viewerUpdate returns a copy of u with sensitive
+// information removed, suitable for sending to
+// read-only viewers.
+func (u clientUpdate) viewerUpdate() clientUpdate {
+	u.RelayAddr = ""
+	return u
+}
+
+// isController reports whether the client making the request
+// may see sensitive information; that is, either no control password
+// is configured or the request holds the correct password.
+func (h *Handler) isController(req *http.Request) bool {
+	if h.p.ControlPassword == "" {
+		return true
+	}
+	_, password, ok := req.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(h.p.ControlPassword)) == 1
+}
+
+// checkController reports whether the client making the request
+// may see sensitive information. If it may not, it writes
+// an unauthorized response.
+func (h *Handler) checkController(w http.ResponseWriter, req *http.Request) bool {
+	if h.isController(req) {
+		return true
+	}
+	unauthorized(w)
+	return false
+}
+
+// unauthorized writes a response asking the
+// client to provide the control password.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="hydro"`)
+	http.Error(w, "authorization required", http.StatusUnauthorized)
 }
 
+// clientLogCount holds the maximum number of log entries
+// sent in each client update. All the retained entries
+// can be retrieved with the /api/log endpoint.
+const clientLogCount = 50
+
 type clientRelayInfo struct {
 	Cohort string
 	Relay  int
 	On     bool
 	Since  string
+	// Note holds any notes on the relay from
+	// the configuration.
+	Note string `json:",omitempty"`
+	// Position holds the physical position of the relay
+	// from the configuration, if known.
+	Position string `json:",omitempty"`
+	// OnToday holds the length of time that the
+	// relay has been on since midnight.
+	OnToday string
+	// EnergyToday holds an estimate of the energy used
+	// by the relay since midnight in kWh, assuming it
+	// always draws its maximum power.
+	EnergyToday float64
+}
+
+// clientCohortInfo holds a summary of the state of
+// all the relays in a cohort.
+type clientCohortInfo struct {
+	Name string
+	// Relays holds the number of relays in the cohort.
+	Relays int
+	// On holds the number of relays in the cohort that are on.
+	On int
+	// OnToday holds the total time that relays in the cohort
+	// have been on since midnight.
+	OnToday string
+	// Disabled holds whether the cohort has been disabled.
+	Disabled bool
 }
 
 type clientSample struct {
 	TimeLag     string
+	RoundTrip   string
 	Power       float64
 	TotalEnergy float64
 }
@@ -205,31 +539,33 @@ type clientReport struct {
 	Partial bool
 }
 
-// expectedMaxRoundTrip holds the maximum duration we might normally expect
-// a meter request to take. If we've got a sample that's older than the allowed lag
-// plus the round trip time, we consider that it's useful to display the lag to the user
-// as a hint that all is not well.
-const expectedMaxRoundTrip = time.Second
+// roundTripMargin holds the factor by which the slowest meter's
+// usual round trip time is multiplied to allow for requests that
+// take longer than usual.
+const roundTripMargin = 2
 
 func (h *Handler) makeUpdate() clientUpdate {
 	ws := h.store.WorkerState()
 	cfg := h.store.CtlConfig()
 	meters := h.store.meterState()
 	reports := h.store.AvailableReports()
+	if meters == nil {
+		// The meter worker hasn't reported its state yet.
+		meters = &meterworker.MeterState{}
+	}
 	var u clientUpdate
+	u.RelayAddr, _ = h.controller.RelayAddr()
+	u.Version = h.version
+	u.Log = h.worker.RecentLog()
+	if n := len(u.Log); n > clientLogCount {
+		u.Log = u.Log[n-clientLogCount:]
+	}
 	samples := make(map[string]clientSample)
+	roundTrip := roundTripAllowance(meters, h.p.ExpectedMaxRoundTrip)
 	for addr, s := range meters.Samples {
-		// Allow 50% extra time for a round trip when the allowed lag is long,
-		// or a fairly arbitrary constant when it's short. We should probably
-		// do a bit better than this and estimate the usual round trip time so
-		// that we send a request sufficiently in advance of the allowed-lag
-		// deadline that it's rare to overrun it.
-		allowedLag := s.AllowedLag * 3 / 2
-		if allowedLag < expectedMaxRoundTrip {
-			allowedLag = expectedMaxRoundTrip
-		}
 		samples[addr] = clientSample{
-			TimeLag:     lag(s.Time, allowedLag, meters.Time),
+			TimeLag:     lag(s.Time, sampleAllowedLag(s, roundTrip), meters.Time),
+			RoundTrip:   s.RoundTrip.Round(time.Millisecond).String(),
 			Power:       s.ActivePower,
 			TotalEnergy: s.TotalEnergy,
 		}
@@ -242,62 +578,192 @@ func (h *Handler) makeUpdate() clientUpdate {
 	}
 	if ws == nil || len(ws.Relays) == 0 {
 		u.Relays = []clientRelayInfo{} // be nice to JS and don't give it null.
+		u.Cohorts = []clientCohortInfo{}
 		return u
 	}
+	now := time.Now().In(h.p.TZ)
+	onToday := onDurations(h.history, ws.State, dayStart(now), now)
+	u.Cohorts = cohortInfo(cfg, ws.State, onToday)
+	for _, name := range h.store.DisabledCohorts() {
+		for i := range u.Cohorts {
+			if u.Cohorts[i].Name == name {
+				u.Cohorts[i].Disabled = true
+			}
+		}
+	}
+	u.Relays = relayInfo(cfg, ws, onToday, now)
+	if len(reports) != 0 {
+		u.Reports = clientReports(reports)
+	}
+	return u
+}
+
+// relayInfo returns information on all the relays that have been
+// used, given the current worker state and the length of time each
+// relay has been on today.
+func relayInfo(cfg *hydroctl.Config, ws *hydroworker.Update, onToday []time.Duration, now time.Time) []clientRelayInfo {
+	relays := []clientRelayInfo{}
 	for i, r := range ws.Relays {
 		if r.Since.IsZero() && !r.On {
 			continue
 		}
-		cohort := ""
+		info := clientRelayInfo{
+			Relay:   i,
+			On:      r.On,
+			OnToday: onToday[i].Round(time.Second).String(),
+		}
 		if cfg != nil && len(cfg.Relays) > i {
-			cohort = cfg.Relays[i].Cohort
+			info.Cohort = cfg.Relays[i].Cohort
+			info.Note = cfg.Relays[i].Note
+			if pos := cfg.Relays[i].Position; pos != nil {
+				info.Position = pos.String()
+			}
+			info.EnergyToday = onToday[i].Hours() * float64(cfg.Relays[i].MaxPower) / 1000
 		}
-		var since string
-		now := time.Now()
 		switch howlong := now.Sub(r.Since); {
 		case howlong > 6*24*time.Hour:
-			since = r.Since.Format("2006-01-02 15:04")
+			info.Since = r.Since.Format("2006-01-02 15:04")
 		case r.Since.Day() != now.Day():
-			since = r.Since.Format("Mon 15:04")
+			info.Since = r.Since.Format("Mon 15:04")
 		default:
-			since = r.Since.Format("15:04:05")
+			info.Since = r.Since.Format("15:04:05")
 		}
+		relays = append(relays, info)
+	}
+	return relays
+}
 
-		u.Relays = append(u.Relays, clientRelayInfo{
-			Cohort: cohort,
-			Relay:  i,
-			On:     r.On,
-			Since:  since,
-		})
+// cohortInfo returns a summary of each cohort in cfg, in the order that
+// they're first mentioned, given the current relay state and the
+// length of time each relay has been on today.
+func cohortInfo(cfg *hydroctl.Config, state hydroctl.RelayState, onToday []time.Duration) []clientCohortInfo {
+	cohorts := []clientCohortInfo{}
+	if cfg == nil {
+		return cohorts
 	}
-	if len(reports) != 0 {
-		u.Reports = make([]clientReport, len(reports))
-		for i, r := range reports {
-			cr := &u.Reports[i]
-			cr.Name = r.Range.T0.Format("Jan 2006")
-			cr.Link = "/reports/" + r.Range.T0.Format("2006-01")
-			cr.Partial = r.Partial
+	index := make(map[string]int)
+	for i, rc := range cfg.Relays {
+		if rc.Cohort == "" {
+			continue
+		}
+		ci, ok := index[rc.Cohort]
+		if !ok {
+			ci = len(cohorts)
+			index[rc.Cohort] = ci
+			cohorts = append(cohorts, clientCohortInfo{
+				Name: rc.Cohort,
+			})
+		}
+		cohorts[ci].Relays++
+		if state.IsSet(i) {
+			cohorts[ci].On++
 		}
 	}
-	return u
+	totals := make([]time.Duration, len(cohorts))
+	for i, rc := range cfg.Relays {
+		if rc.Cohort != "" {
+			totals[index[rc.Cohort]] += onToday[i]
+		}
+	}
+	for i := range cohorts {
+		cohorts[i].OnToday = totals[i].Round(time.Second).String()
+	}
+	return cohorts
+}
+
+// onDurations returns the length of time that each relay has been on
+// between t0 and now, given the relay history and the current state.
+func onDurations(store history.Store, state hydroctl.RelayState, t0, now time.Time) []time.Duration {
+	durations := make([]time.Duration, hydroctl.MaxRelayCount)
+	// offTimes holds the time that each relay was next switched
+	// off, or the zero time if it was off.
+	offTimes := make([]time.Time, hydroctl.MaxRelayCount)
+	for i := range offTimes {
+		if state.IsSet(i) {
+			offTimes[i] = now
+		}
+	}
+	iter := store.ReverseIter()
+	defer iter.Close()
+	for iter.Next() {
+		e := iter.Item()
+		if e.Time.Before(t0) {
+			break
+		}
+		if e.On {
+			if offt := offTimes[e.Relay]; !offt.IsZero() {
+				durations[e.Relay] += offt.Sub(e.Time)
+				offTimes[e.Relay] = time.Time{}
+			}
+		} else {
+			offTimes[e.Relay] = e.Time
+		}
+	}
+	// Any relay that's still got an off time was on at t0.
+	for i, offt := range offTimes {
+		if !offt.IsZero() {
+			durations[i] += offt.Sub(t0)
+		}
+	}
+	return durations
+}
+
+// dayStart returns the start of the day containing t.
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// roundTripAllowance returns the time to allow for a round
+// trip to the meters when deciding whether the lag of a sample
+// in the given meter state is worth showing to the user.
+//
+// All the meters are read together, so the age of each sample
+// includes the time spent waiting for the slowest meter.
+// The allowance is therefore based on the largest of the
+// meters' usual round trip times, or on maxRoundTrip if
+// none of them are known yet.
+func roundTripAllowance(ms *meterworker.MeterState, maxRoundTrip time.Duration) time.Duration {
+	var roundTrip time.Duration
+	for _, s := range ms.Samples {
+		if s.RoundTrip > roundTrip {
+			roundTrip = s.RoundTrip
+		}
+	}
+	if roundTrip == 0 {
+		return maxRoundTrip
+	}
+	return roundTrip * roundTripMargin
+}
+
+// sampleAllowedLag returns how old the given sample may be
+// before its lag is considered worth showing to the user,
+// given the round trip allowance returned by roundTripAllowance.
+// If we've got a sample that's older than that, it's a hint
+// that all is not well.
+func sampleAllowedLag(s *meterworker.MeterSample, roundTrip time.Duration) time.Duration {
+	return s.AllowedLag + roundTrip
 }
 
 // lag returns a human-readable representation of the lag for
 // a meter reading that was acquired at time t0 with the given
 // allowed lag, when the result was returned at time t1.
+// It returns the empty string if the lag is within the allowed lag.
+//
+// Lags under a minute are shown to the nearest millisecond;
+// longer lags are shown to the nearest second. The decision is
+// made on the rounded value so that, for example, a lag that
+// rounds up to a minute is shown as "1m0s" in whole seconds,
+// and a lag that only rounds to more than the allowed lag
+// is not shown at all.
 func lag(t0 time.Time, allowedLag time.Duration, t1 time.Time) string {
-	d := t1.Sub(t0)
+	d := t1.Sub(t0).Round(time.Millisecond)
+	if d >= time.Minute {
+		d = t1.Sub(t0).Round(time.Second)
+	}
 	if d <= allowedLag {
 		return ""
 	}
-	var q time.Duration
-	switch {
-	case d < time.Minute:
-		q = time.Millisecond
-	default:
-		q = time.Second
-	}
-	return d.Round(q).String()
+	return d.String()
 }
 
 func badRequest(w http.ResponseWriter, req *http.Request, err error) {
@@ -0,0 +1,446 @@
+package hydroserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/hydroworker"
+	"github.com/rogpeppe/hydro/meterworker"
+	"github.com/rogpeppe/hydro/ndmeter"
+)
+
+func TestCohortInfo(t *testing.T) {
+	c := qt.New(t)
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return day.Add(time.Duration(hour) * time.Hour)
+	}
+	cfg := &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Cohort: "bedrooms",
+		}, {
+			Cohort: "water",
+		}, {
+			Cohort: "bedrooms",
+		}, {
+			// Relays without a cohort aren't included.
+		}, {
+			Cohort: "bedrooms",
+		}},
+	}
+	store := &history.MemStore{
+		Events: []history.Event{{
+			// Relay 0 was on before the start of the day
+			// and turned off in the morning.
+			Relay: 0,
+			On:    true,
+			Time:  at(-2),
+		}, {
+			Relay: 0,
+			On:    false,
+			Time:  at(1),
+		}, {
+			Relay: 1,
+			On:    true,
+			Time:  at(2),
+		}, {
+			Relay: 1,
+			On:    false,
+			Time:  at(4),
+		}, {
+			Relay: 2,
+			On:    true,
+			Time:  at(8),
+		}, {
+			Relay: 3,
+			On:    true,
+			Time:  at(9),
+		}, {
+			Relay: 4,
+			On:    true,
+			Time:  at(9),
+		}},
+	}
+	state := mkRelays(2, 3, 4)
+	onToday := onDurations(store, state, day, at(10))
+	cohorts := cohortInfo(cfg, state, onToday)
+	c.Assert(cohorts, qt.DeepEquals, []clientCohortInfo{{
+		Name:    "bedrooms",
+		Relays:  3,
+		On:      2,
+		OnToday: "4h0m0s",
+	}, {
+		Name:    "water",
+		Relays:  1,
+		On:      0,
+		OnToday: "2h0m0s",
+	}})
+}
+
+func TestRelayInfo(t *testing.T) {
+	c := qt.New(t)
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return day.Add(time.Duration(hour) * time.Hour)
+	}
+	cfg := &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Cohort:   "bedrooms",
+			MaxPower: 2000,
+		}, {
+			Cohort:   "water",
+			MaxPower: 3000,
+			Note:     "east immersion",
+			Position: &hydroctl.RelayPosition{Board: 1, Terminal: 7},
+		}},
+	}
+	store := &history.MemStore{
+		Events: []history.Event{{
+			Relay: 0,
+			On:    true,
+			Time:  at(-1),
+		}, {
+			Relay: 0,
+			On:    false,
+			Time:  at(2),
+		}, {
+			Relay: 1,
+			On:    true,
+			Time:  at(3),
+		}, {
+			Relay: 1,
+			On:    false,
+			Time:  at(4),
+		}, {
+			Relay: 1,
+			On:    true,
+			Time:  at(9),
+		}},
+	}
+	ws := &hydroworker.Update{
+		State: mkRelays(1),
+	}
+	ws.Relays[0] = hydroworker.RelayUpdate{
+		On:    false,
+		Since: at(2),
+	}
+	ws.Relays[1] = hydroworker.RelayUpdate{
+		On:    true,
+		Since: at(9),
+	}
+	now := at(9).Add(30 * time.Minute)
+	onToday := onDurations(store, ws.State, day, now)
+	c.Assert(relayInfo(cfg, ws, onToday, now), qt.DeepEquals, []clientRelayInfo{{
+		Cohort:      "bedrooms",
+		Relay:       0,
+		On:          false,
+		Since:       "02:00:00",
+		OnToday:     "2h0m0s",
+		EnergyToday: 4,
+	}, {
+		Cohort:      "water",
+		Relay:       1,
+		On:          true,
+		Since:       "09:00:00",
+		OnToday:     "1h30m0s",
+		EnergyToday: 4.5,
+		Note:        "east immersion",
+		Position:    "board 1 terminal 7",
+	}})
+}
+
+var historyWindowTests = []struct {
+	testName string
+	window   time.Duration
+	expect   []int
+}{{
+	testName: "default",
+	// The most recent event before the window is
+	// always retained.
+	expect: []int{9, 1},
+}, {
+	testName: "larger",
+	window:   30 * 24 * time.Hour,
+	expect:   []int{20, 19, 10, 9, 1},
+}}
+
+func TestHistoryWindow(t *testing.T) {
+	c := qt.New(t)
+	now := time.Now().UTC()
+	daysAgo := func(days int) time.Time {
+		return now.AddDate(0, 0, -days)
+	}
+	events := []history.Event{{
+		Relay: 0,
+		On:    true,
+		Time:  daysAgo(20),
+	}, {
+		Relay: 0,
+		On:    false,
+		Time:  daysAgo(19),
+	}, {
+		Relay: 0,
+		On:    true,
+		Time:  daysAgo(10),
+	}, {
+		Relay: 0,
+		On:    false,
+		Time:  daysAgo(9),
+	}, {
+		Relay: 0,
+		On:    true,
+		Time:  daysAgo(1),
+	}}
+	for _, test := range historyWindowTests {
+		c.Run(test.testName, func(c *qt.C) {
+			dir := c.Mkdir()
+			hstore, err := history.NewDiskStore(filepath.Join(dir, "history"), time.Time{})
+			c.Assert(err, qt.IsNil)
+			for _, e := range events {
+				hstore.Append(e)
+			}
+			err = hstore.Commit()
+			c.Assert(err, qt.IsNil)
+			hstore.Close()
+
+			h := newTestServer(c, dir, Params{
+				HistoryWindow: test.window,
+			})
+			defer h.meterWorker.Close()
+			var got []int
+			for iter := h.history.ReverseIter(); iter.Next(); {
+				got = append([]int{int(now.Sub(iter.Item().Time).Hours() / 24)}, got...)
+			}
+			c.Assert(got, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func mkRelays(relays ...int) hydroctl.RelayState {
+	var state hydroctl.RelayState
+	for _, r := range relays {
+		state.Set(r, true)
+	}
+	return state
+}
+
+var lagTests = []struct {
+	testName   string
+	allowedLag time.Duration
+	lag        time.Duration
+	expect     string
+}{{
+	testName:   "no-lag",
+	allowedLag: time.Second,
+	expect:     "",
+}, {
+	testName:   "within-allowed-lag",
+	allowedLag: 3 * time.Second,
+	lag:        3 * time.Second,
+	expect:     "",
+}, {
+	testName:   "just-over-allowed-lag",
+	allowedLag: 3 * time.Second,
+	lag:        3*time.Second + time.Millisecond,
+	expect:     "3.001s",
+}, {
+	testName:   "rounds-to-allowed-lag",
+	allowedLag: 3 * time.Second,
+	lag:        3*time.Second + 400*time.Microsecond,
+	expect:     "",
+}, {
+	testName:   "negative-lag",
+	allowedLag: time.Second,
+	lag:        -time.Hour,
+	expect:     "",
+}, {
+	testName:   "zero-allowed-lag",
+	allowedLag: 0,
+	lag:        1500 * time.Microsecond,
+	expect:     "2ms",
+}, {
+	testName:   "rounded-to-millisecond",
+	allowedLag: time.Second,
+	lag:        12*time.Second + 345678*time.Microsecond,
+	expect:     "12.346s",
+}, {
+	testName:   "rounded-to-second",
+	allowedLag: time.Second,
+	lag:        3*time.Minute + 4600*time.Millisecond,
+	expect:     "3m5s",
+}, {
+	testName:   "just-under-a-minute",
+	allowedLag: time.Second,
+	lag:        59*time.Second + 600*time.Millisecond,
+	expect:     "59.6s",
+}, {
+	testName:   "rounds-up-to-a-minute",
+	allowedLag: time.Second,
+	lag:        time.Minute - 400*time.Microsecond,
+	expect:     "1m0s",
+}, {
+	testName:   "exactly-a-minute",
+	allowedLag: time.Second,
+	lag:        time.Minute,
+	expect:     "1m0s",
+}, {
+	testName:   "just-over-a-minute",
+	allowedLag: time.Second,
+	lag:        time.Minute + 400*time.Millisecond,
+	expect:     "1m0s",
+}, {
+	testName:   "rounds-up-to-next-second-over-a-minute",
+	allowedLag: time.Second,
+	lag:        time.Minute + 500*time.Millisecond,
+	expect:     "1m1s",
+}, {
+	testName:   "hours",
+	allowedLag: time.Minute,
+	lag:        2*time.Hour + 3*time.Second + 999*time.Millisecond,
+	expect:     "2h0m4s",
+}}
+
+func TestLag(t *testing.T) {
+	c := qt.New(t)
+	t0 := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range lagTests {
+		c.Run(test.testName, func(c *qt.C) {
+			c.Assert(lag(t0, test.allowedLag, t0.Add(test.lag)), qt.Equals, test.expect)
+		})
+	}
+}
+
+var roundTripAllowanceTests = []struct {
+	testName   string
+	roundTrips []time.Duration
+	expect     time.Duration
+}{{
+	testName: "no-samples",
+	expect:   DefaultExpectedMaxRoundTrip,
+}, {
+	testName:   "round-trips-unknown",
+	roundTrips: []time.Duration{0, 0},
+	expect:     DefaultExpectedMaxRoundTrip,
+}, {
+	testName:   "fast-meters",
+	roundTrips: []time.Duration{20 * time.Millisecond, 50 * time.Millisecond},
+	expect:     100 * time.Millisecond,
+}, {
+	testName:   "slow-meter",
+	roundTrips: []time.Duration{20 * time.Millisecond, 3 * time.Second, 0},
+	expect:     6 * time.Second,
+}}
+
+func TestRoundTripAllowance(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range roundTripAllowanceTests {
+		c.Run(test.testName, func(c *qt.C) {
+			ms := &meterworker.MeterState{
+				Samples: make(map[string]*meterworker.MeterSample),
+			}
+			for i, rt := range test.roundTrips {
+				ms.Samples[fmt.Sprint("meter", i)] = &meterworker.MeterSample{
+					RoundTrip: rt,
+				}
+			}
+			c.Assert(roundTripAllowance(ms, DefaultExpectedMaxRoundTrip), qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestSampleLagDisplay(t *testing.T) {
+	c := qt.New(t)
+	t1 := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := &meterworker.MeterSample{
+		Sample: &ndmeter.Sample{
+			Time: t1.Add(-1400 * time.Millisecond),
+		},
+		AllowedLag: time.Second,
+		RoundTrip:  200 * time.Millisecond,
+	}
+	ms := &meterworker.MeterState{
+		Time: t1,
+		Samples: map[string]*meterworker.MeterSample{
+			"meter0": s,
+		},
+	}
+	// The lag is within the allowed lag plus the round trip allowance.
+	allowedLag := sampleAllowedLag(s, roundTripAllowance(ms, DefaultExpectedMaxRoundTrip))
+	c.Assert(allowedLag, qt.Equals, 1400*time.Millisecond)
+	c.Assert(lag(s.Time, allowedLag, ms.Time), qt.Equals, "")
+
+	// When the meters get slower, the lag is still not shown.
+	s.Time = t1.Add(-2 * time.Second)
+	s.RoundTrip = 500 * time.Millisecond
+	allowedLag = sampleAllowedLag(s, roundTripAllowance(ms, DefaultExpectedMaxRoundTrip))
+	c.Assert(lag(s.Time, allowedLag, ms.Time), qt.Equals, "")
+
+	// When they get faster again, it is.
+	s.RoundTrip = 100 * time.Millisecond
+	allowedLag = sampleAllowedLag(s, roundTripAllowance(ms, DefaultExpectedMaxRoundTrip))
+	c.Assert(lag(s.Time, allowedLag, ms.Time), qt.Equals, "2s")
+}
+
+var fileModeTests = []struct {
+	testName   string
+	p          Params
+	expectFile os.FileMode
+	expectDir  os.FileMode
+}{{
+	testName:   "default",
+	expectFile: DefaultFileMode,
+	expectDir:  DefaultDirMode,
+}, {
+	testName: "configured",
+	p: Params{
+		FileMode: 0640,
+		DirMode:  0750,
+	},
+	expectFile: 0640,
+	expectDir:  0750,
+}}
+
+func TestFileModes(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range fileModeTests {
+		c.Run(test.testName, func(c *qt.C) {
+			dir := c.Mkdir()
+			p := test.p
+			p.DecisionLogDir = filepath.Join(dir, "decisions")
+			h := newTestServer(c, dir, p)
+			defer h.meterWorker.Close()
+			defer h.worker.Close()
+
+			meters := []meterworker.Meter{{
+				Name:     "meter0",
+				Location: hydroreport.LocGenerator,
+				Addr:     "localhost:1",
+			}}
+			err := h.meterWorker.SetMeters(meters)
+			c.Assert(err, qt.IsNil)
+			err = h.store.setConfigText("relay 0 is heater\n")
+			c.Assert(err, qt.IsNil)
+			err = h.controller.SetRelayAddr("localhost:1234")
+			c.Assert(err, qt.IsNil)
+
+			assertMode := func(path string, mode os.FileMode) {
+				info, err := os.Stat(path)
+				c.Assert(err, qt.IsNil)
+				c.Check(info.Mode().Perm(), qt.Equals, mode, qt.Commentf("%s", path))
+			}
+			for _, name := range []string{"relayconfig", "relayaddr", "meterconfig", "history"} {
+				assertMode(filepath.Join(dir, name), test.expectFile)
+			}
+			assertMode(filepath.Join(dir, "decisions"), test.expectDir)
+			assertMode(filepath.Join(dir, "samples", meters[0].SampleDir()), test.expectDir)
+		})
+	}
+}
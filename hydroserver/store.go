@@ -2,7 +2,10 @@ package hydroserver
 
 import (
 	"io/ioutil"
+	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 
 	"gopkg.in/errgo.v1"
@@ -19,6 +22,9 @@ type store struct {
 	// configPath holds the file name where the configuration is stored.
 	configPath string
 
+	// fileMode holds the permissions used when writing the configuration file.
+	fileMode os.FileMode
+
 	// configNotifier is updated when the configuration changes.
 	configNotifier notifier.Notifier
 
@@ -37,6 +43,17 @@ type store struct {
 	// from configText.
 	config *hydroconfig.Config
 
+	// disabledCohorts holds the names of the cohorts that
+	// have been disabled. It's kept separately from the
+	// configuration text so that cohorts can be disabled
+	// without changing it.
+	disabledCohorts map[string]bool
+
+	// disabledCohortsPath holds the file name where
+	// disabledCohorts is stored. If it's empty, it's
+	// not stored.
+	disabledCohortsPath string
+
 	// workerState holds the latest known worker state.
 	workerState *hydroworker.Update
 
@@ -48,7 +65,7 @@ type store struct {
 	reports []*hydroreport.Report
 }
 
-func newStore(configPath string) (*store, error) {
+func newStore(configPath string, fileMode os.FileMode) (*store, error) {
 	data, err := ioutil.ReadFile(configPath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, errgo.Mask(err)
@@ -57,9 +74,12 @@ func newStore(configPath string) (*store, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-
+	for _, w := range cfg.Warnings {
+		log.Printf("warning: relay configuration at %q: %v", string(data)[w.P0:w.P1], w.Message)
+	}
 	return &store{
 		configPath: configPath,
+		fileMode:   fileMode,
 		config:     cfg,
 		configText: string(data),
 	}, nil
@@ -74,12 +94,109 @@ func (s *store) ConfigText() string {
 
 // CtlConfig returns the current *hydroctl.Config value;
 // the caller should not mutate the returned value.
+// Relays in disabled cohorts are always off.
 func (s *store) CtlConfig() *hydroctl.Config {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.config.CtlConfig()
+	cfg := s.config.CtlConfig()
+	for i := range cfg.Relays {
+		rc := &cfg.Relays[i]
+		if rc.Cohort != "" && s.disabledCohorts[rc.Cohort] {
+			rc.Mode = hydroctl.AlwaysOff
+			rc.InUse = nil
+			rc.NotInUse = nil
+		}
+	}
+	return cfg
 }
 
+// disabledCohortsFile holds the format of the file that
+// holds the disabled cohorts.
+type disabledCohortsFile struct {
+	Disabled []string
+}
+
+// loadDisabledCohorts reads the disabled cohorts from the file
+// with the given path, which is used to store them from then on.
+// It's OK if the file doesn't exist.
+func (s *store) loadDisabledCohorts(path string) error {
+	var f disabledCohortsFile
+	if err := readJSONFile(path, &f); err != nil && !os.IsNotExist(err) {
+		return errgo.Notef(err, "cannot read disabled cohorts")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabledCohortsPath = path
+	s.disabledCohorts = make(map[string]bool)
+	for _, name := range f.Disabled {
+		s.disabledCohorts[name] = true
+	}
+	s.configNotifier.Changed()
+	s.anyNotifier.Changed()
+	return nil
+}
+
+// DisabledCohorts returns the names of all the disabled
+// cohorts, in alphabetical order.
+func (s *store) DisabledCohorts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.disabledCohorts))
+	for name := range s.disabledCohorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setCohortDisabled sets whether the cohort with the given
+// name is disabled. The name is matched case-insensitively
+// against the cohorts in the current configuration.
+func (s *store) setCohortDisabled(name string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for _, c := range s.config.Cohorts {
+		if strings.EqualFold(c.Name, name) {
+			name, found = c.Name, true
+			break
+		}
+	}
+	if !found {
+		return errgo.WithCausef(nil, errUnknownCohort, "unknown cohort %q", name)
+	}
+	if s.disabledCohorts[name] == disabled {
+		return nil
+	}
+	// Make a new set so that nothing changes if
+	// the file can't be written.
+	disabledCohorts := make(map[string]bool)
+	for n := range s.disabledCohorts {
+		disabledCohorts[n] = true
+	}
+	if disabled {
+		disabledCohorts[name] = true
+	} else {
+		delete(disabledCohorts, name)
+	}
+	var f disabledCohortsFile
+	for n := range disabledCohorts {
+		f.Disabled = append(f.Disabled, n)
+	}
+	sort.Strings(f.Disabled)
+	if s.disabledCohortsPath != "" {
+		if err := writeJSONFile(s.disabledCohortsPath, f, s.fileMode); err != nil {
+			return errgo.Notef(err, "cannot write disabled cohorts file")
+		}
+	}
+	s.disabledCohorts = disabledCohorts
+	s.configNotifier.Changed()
+	s.anyNotifier.Changed()
+	return nil
+}
+
+var errUnknownCohort = errgo.New("unknown cohort")
+
 // Config returns the current relay configuration. The returned value
 // must not be mutated.
 func (s *store) Config() *hydroconfig.Config {
@@ -101,7 +218,7 @@ func (s *store) setConfigText(text string) error {
 	}
 	// TODO write config atomically.
 	// TODO should the store type be writing config files?
-	if err := ioutil.WriteFile(s.configPath, []byte(text), 0666); err != nil {
+	if err := ioutil.WriteFile(s.configPath, []byte(text), s.fileMode); err != nil {
 		return errgo.Notef(err, "cannot write relay config file")
 	}
 	s.config = cfg
@@ -120,6 +237,12 @@ func (s *store) UpdateMeterState(ms *meterworker.MeterState) {
 	s.anyNotifier.Changed()
 }
 
+// UpdateRelayAddr notifies watchers that the relay
+// controller address has changed.
+func (s *store) UpdateRelayAddr(addr string) {
+	s.anyNotifier.Changed()
+}
+
 // UpdateWorkerState sets the current worker state.
 // It implements hydroworker.Updater.UpdaterWorkerState.
 func (s *store) UpdateWorkerState(u *hydroworker.Update) {
@@ -0,0 +1,103 @@
+package hydroserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/hydroworker"
+	"github.com/rogpeppe/hydro/meterworker"
+)
+
+// TestStoreConcurrentAccess checks that the store can be updated
+// concurrently with HTTP handlers reading from it. It's most
+// useful when run with the race detector enabled.
+func TestStoreConcurrentAccess(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+
+	// Start with some worker state, as there would be soon after
+	// startup, so that all the handlers have something to read.
+	h.store.UpdateWorkerState(&hydroworker.Update{})
+
+	const n = 50
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f(i)
+			}
+		}()
+	}
+	// Worker updates.
+	run(func(i int) {
+		h.store.UpdateMeterState(&meterworker.MeterState{
+			Time: time.Now(),
+			Meters: []meterworker.Meter{{
+				Name:     "meter",
+				Addr:     fmt.Sprintf("localhost:%d", 1000+i),
+				Location: hydroreport.LocHere,
+			}},
+			Samples: map[string]*meterworker.MeterSample{},
+		})
+	})
+	run(func(i int) {
+		u := &hydroworker.Update{}
+		u.Relays[i%4] = hydroworker.RelayUpdate{
+			On:    true,
+			Since: time.Now(),
+		}
+		u.State.Set(i%4, true)
+		h.store.UpdateWorkerState(u)
+	})
+	run(func(i int) {
+		h.store.UpdateAvailableReports([]*hydroreport.Report{})
+	})
+	// Configuration updates.
+	run(func(i int) {
+		err := h.store.setConfigText(fmt.Sprintf("relay %d is x\nx from 10:00 to 11:00\n", i%4))
+		c.Check(err, qt.IsNil)
+	})
+	// HTTP reads.
+	for _, path := range []string{
+		"/api/config",
+		"/api/effective-config",
+		"/api/schedule",
+		"/config",
+		"/history.json",
+		"/reports/",
+	} {
+		path := path
+		run(func(i int) {
+			req := httptest.NewRequest("GET", path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			c.Check(rec.Code, qt.Not(qt.Equals), http.StatusInternalServerError, qt.Commentf("path %s", path))
+		})
+	}
+	run(func(i int) {
+		h.makeUpdate()
+	})
+	wg.Wait()
+}
+
+func TestMakeUpdateWithNoMeterState(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.worker.Close()
+	h.store.UpdateMeterState(nil)
+	u := h.makeUpdate()
+	c.Assert(u.Meters, qt.Not(qt.IsNil))
+	c.Assert(u.Meters.Meters, qt.HasLen, 0)
+}
@@ -0,0 +1,131 @@
+package hydroserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+)
+
+var updatesAuthTests = []struct {
+	testName        string
+	params          Params
+	password        string
+	expectStatus    int
+	expectRelayAddr string
+}{{
+	testName:        "no-control-password",
+	expectRelayAddr: "localhost:1234",
+}, {
+	testName: "viewer",
+	params: Params{
+		ControlPassword: "secret",
+	},
+}, {
+	testName: "viewer-wrong-password",
+	params: Params{
+		ControlPassword: "secret",
+	},
+	password: "other",
+}, {
+	testName: "controller",
+	params: Params{
+		ControlPassword: "secret",
+	},
+	password:        "secret",
+	expectRelayAddr: "localhost:1234",
+}, {
+	testName: "viewer-auth-required",
+	params: Params{
+		ControlPassword: "secret",
+		RequireAuth:     true,
+	},
+	expectStatus: http.StatusUnauthorized,
+}, {
+	testName: "controller-auth-required",
+	params: Params{
+		ControlPassword: "secret",
+		RequireAuth:     true,
+	},
+	password:        "secret",
+	expectRelayAddr: "localhost:1234",
+}}
+
+func TestUpdatesAuth(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range updatesAuthTests {
+		c.Run(test.testName, func(c *qt.C) {
+			h := newTestServer(c, c.Mkdir(), test.params)
+			defer h.meterWorker.Close()
+			defer h.Close()
+			err := h.controller.SetRelayAddr("localhost:1234")
+			c.Assert(err, qt.IsNil)
+
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			hdr := make(http.Header)
+			if test.password != "" {
+				hdr.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:"+test.password)))
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/updates", hdr)
+			if test.expectStatus != 0 {
+				c.Assert(err, qt.Equals, websocket.ErrBadHandshake)
+				c.Assert(resp.StatusCode, qt.Equals, test.expectStatus)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			defer conn.Close()
+			var u map[string]json.RawMessage
+			err = conn.ReadJSON(&u)
+			c.Assert(err, qt.IsNil)
+			if test.expectRelayAddr == "" {
+				_, ok := u["RelayAddr"]
+				c.Assert(ok, qt.IsFalse)
+				return
+			}
+			var addr string
+			err = json.Unmarshal(u["RelayAddr"], &addr)
+			c.Assert(err, qt.IsNil)
+			c.Assert(addr, qt.Equals, test.expectRelayAddr)
+		})
+	}
+}
+
+func TestUpdatesCoalesced(t *testing.T) {
+	c := qt.New(t)
+	h := newTestServer(c, c.Mkdir(), Params{})
+	defer h.meterWorker.Close()
+	defer h.Close()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/updates", nil)
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	var u clientUpdate
+	err = conn.ReadJSON(&u)
+	c.Assert(err, qt.IsNil)
+
+	for i := 0; i < 5; i++ {
+		h.store.anyNotifier.Changed()
+	}
+	err = conn.ReadJSON(&u)
+	c.Assert(err, qt.IsNil)
+
+	// No further updates should arrive.
+	conn.SetReadDeadline(time.Now().Add(3 * updateDebounce))
+	err = conn.ReadJSON(&u)
+	c.Assert(err, qt.Not(qt.IsNil))
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, qt.IsTrue, qt.Commentf("error %#v", err))
+	c.Assert(netErr.Timeout(), qt.IsTrue)
+}
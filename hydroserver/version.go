@@ -0,0 +1,79 @@
+package hydroserver
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// VersionInfo holds information about the build
+// of the running binary.
+type VersionInfo struct {
+	// Version holds the module version of the binary,
+	// which is "(devel)" when it's built from a source tree.
+	Version string
+	// Commit holds the VCS revision that the binary
+	// was built from, if known.
+	Commit string `json:",omitempty"`
+	// CommitTime holds the time of the commit, if known.
+	CommitTime string `json:",omitempty"`
+	// Modified holds whether the source tree had
+	// uncommitted changes when the binary was built.
+	Modified bool `json:",omitempty"`
+	// GoVersion holds the version of Go that the
+	// binary was built with.
+	GoVersion string
+}
+
+// String returns the version information in a form
+// suitable for showing to people.
+func (v VersionInfo) String() string {
+	var extra []string
+	if v.Commit != "" {
+		commit := v.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		extra = append(extra, "commit "+commit)
+	}
+	if v.Modified {
+		extra = append(extra, "modified")
+	}
+	extra = append(extra, v.GoVersion)
+	return fmt.Sprintf("%s (%s)", v.Version, strings.Join(extra, ", "))
+}
+
+// debugReadBuildInfo is defined as a variable so
+// that it can be patched in tests.
+var debugReadBuildInfo = debug.ReadBuildInfo
+
+// BuildVersion returns version information
+// for the running binary.
+func BuildVersion() VersionInfo {
+	v := VersionInfo{
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+	}
+	info, ok := debugReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if info.Main.Version != "" {
+		v.Version = info.Main.Version
+	}
+	if info.GoVersion != "" {
+		v.GoVersion = info.GoVersion
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Commit = s.Value
+		case "vcs.time":
+			v.CommitTime = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+package hydroworker
+
+import (
+	"sync"
+	"time"
+)
+
+// LogEntry holds a message logged by the worker when
+// assessing the relay state.
+type LogEntry struct {
+	Time    time.Time
+	Message string
+}
+
+// logRing holds a bounded number of the most
+// recently logged entries.
+type logRing struct {
+	mu sync.Mutex
+	// entries holds the recorded entries. When it's full,
+	// the oldest entry is at entries[next].
+	entries []LogEntry
+	// next holds the index of the next entry to be overwritten.
+	next int
+	// full holds whether the entries slice has been completely filled.
+	full bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		entries: make([]LogEntry, size),
+	}
+}
+
+// add adds an entry to the ring, discarding the oldest
+// entry if the ring is full.
+func (r *logRing) add(e LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// all returns all the entries in the ring, oldest first.
+func (r *logRing) all() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]LogEntry(nil), r.entries[:r.next]...)
+	}
+	entries := make([]LogEntry, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	return append(entries, r.entries[:r.next]...)
+}
@@ -8,16 +8,16 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"gopkg.in/errgo.v1"
 
+	"github.com/rogpeppe/hydro/decisionlog"
 	"github.com/rogpeppe/hydro/history"
 	"github.com/rogpeppe/hydro/hydroctl"
 )
 
-// TODO provide feedback of log messages to the front end
-
 // Params holds parameters for creating a new Worker.
 type Params struct {
 	// Config holds the initial relay configuration.
@@ -33,6 +33,57 @@ type Params struct {
 	Updater Updater
 	// TZ holds the time zone to use for time assessments.
 	TZ *time.Location
+	// Clock is used to find out the current time and to wait
+	// between assessments. If it's nil, the system clock is used.
+	Clock Clock
+	// Heartbeat holds the interval at which the worker assesses
+	// for possible relay changes. If it's zero, DefaultHeartbeat
+	// is used.
+	Heartbeat time.Duration
+	// RecentLogCount holds the number of assessment log entries
+	// that will be returned by RecentLog. If it's zero,
+	// DefaultRecentLogCount is used.
+	RecentLogCount int
+	// Forecast holds a forecast of generated power used
+	// to help schedule relays (see hydroctl.AssessParams.Forecast).
+	// It may be nil.
+	Forecast hydroctl.GenerationForecast
+	// ShutdownState, if non-nil, holds the relay state that's
+	// set when the worker is closed, so that loads that would
+	// be unsafe to leave on unattended can be turned off.
+	// If it's nil, the relays are left as they are.
+	ShutdownState *hydroctl.RelayState
+	// Decisions, if non-nil, is used to record relay decisions
+	// durably. A decision is recorded whenever the inputs to
+	// the assessment (other than the time), the assessed relay
+	// state or the reasons for it change.
+	Decisions DecisionLog
+}
+
+// DecisionLog represents a durable record of relay decisions.
+// It's implemented by *decisionlog.Writer.
+type DecisionLog interface {
+	Write(d decisionlog.Decision) error
+}
+
+// Clock represents a source of time. It's an interface
+// so that tests can control the passing of time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that receives the current
+	// time after the given duration has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
 }
 
 // CommitStore adds a Commit method to the history.Store
@@ -48,17 +99,63 @@ type CommitStore interface {
 // Worker represents the worker goroutines.
 type Worker struct {
 	cancelContext func()
+	// done is closed when the worker has stopped.
+	done          chan struct{}
+	shutdownState *hydroctl.RelayState
+	decisions     DecisionLog
 	controller    RelayController
 	meters        MeterReader
 	// history holds the history storage layer. It
 	// uses Worker.store for its persistent state.
-	history *history.DB
-	tz      *time.Location
+	history   *history.DB
+	tz        *time.Location
+	clock     Clock
+	heartbeat time.Duration
+	forecast  hydroctl.GenerationForecast
 
 	store CommitStore
 
-	updater Updater
-	cfgChan chan *hydroctl.Config
+	updater     Updater
+	cfgChan     chan *hydroctl.Config
+	explainChan chan explainRequest
+	assessChan  chan chan assessResult
+
+	// recentLog holds the most recently logged assessment messages.
+	recentLog *logRing
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// paused holds whether relay control is paused.
+	paused bool
+	// overrides holds the current relay overrides,
+	// indexed by relay number.
+	overrides map[int]Override
+}
+
+// Override holds a manual override of a relay's state.
+type Override struct {
+	// On holds whether the relay is forced on or off.
+	On bool
+	// Until holds when the override expires.
+	Until time.Time
+}
+
+type explainRequest struct {
+	// cfg holds the configuration to use for the
+	// assessment. If it's nil, the current
+	// configuration is used.
+	cfg   *hydroctl.Config
+	reply chan explainResult
+}
+
+type explainResult struct {
+	explanations []hydroctl.RelayExplanation
+	err          error
+}
+
+type assessResult struct {
+	state hydroctl.RelayState
+	err   error
 }
 
 // Updater is called when the current state changes.
@@ -82,18 +179,48 @@ type RelayController interface {
 
 var ErrNoRelayController = errgo.New("no relay controller configured")
 
+// ErrPaused is returned by Worker.AssessNow when
+// relay control has been paused.
+var ErrPaused = errgo.New("relay control is paused")
+
+// HeartbeatReceiver may optionally be implemented by a
+// RelayController. If it is, Heartbeat is called at each
+// worker heartbeat so that the controller can tell that
+// the worker is still running even when the relays aren't
+// changing.
+type HeartbeatReceiver interface {
+	Heartbeat()
+}
+
+// RelayCounter may optionally be implemented by a
+// RelayController that can only control a limited number
+// of relays. If it is, relays numbered NumRelays or above
+// are always left off, so the relay history holds only
+// relays that were actually switched on.
+type RelayCounter interface {
+	NumRelays() int
+}
+
 // MeterReader represents a meter reader.
 type MeterReader interface {
 	// ReadMeters returns the most recent state of the meters.
-	// If there's no available meter information, it returns ErrNoMeters.
+	// If there's no available meter information, it returns ErrNoMeters,
+	// in which case the worker assumes that all active relays are
+	// using their maximum power.
 	ReadMeters(ctx context.Context) (hydroctl.PowerUseSample, error)
 }
 
 var ErrNoMeters = fmt.Errorf("no meter information available")
 
-// Heartbeat is the interval at which the worker assesses for
-// possible relay changes.
-const Heartbeat = 1000 * time.Millisecond
+// DefaultHeartbeat holds the default value of Params.Heartbeat.
+const DefaultHeartbeat = 1000 * time.Millisecond
+
+// DefaultRecentLogCount holds the default value of Params.RecentLogCount.
+const DefaultRecentLogCount = 500
+
+// unchangedLogInterval holds the minimum interval between
+// log messages when the relay state isn't changing.
+const unchangedLogInterval = time.Minute
 
 // New returns a new worker that keeps the relay state up to date
 // with respect to configuration and meter changes.
@@ -102,21 +229,39 @@ func New(p Params) (*Worker, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if p.RecentLogCount == 0 {
+		p.RecentLogCount = DefaultRecentLogCount
+	}
 	ctx := context.TODO()
 	ctx, cancel := context.WithCancel(ctx)
 	w := &Worker{
 		cancelContext: cancel,
+		done:          make(chan struct{}),
+		shutdownState: p.ShutdownState,
+		decisions:     p.Decisions,
 		store:         p.Store,
 		controller:    p.Controller,
 		meters:        p.Meters,
 		tz:            p.TZ,
+		clock:         p.Clock,
+		heartbeat:     p.Heartbeat,
+		forecast:      p.Forecast,
 		history:       hdb,
 		updater:       p.Updater,
 		cfgChan:       make(chan *hydroctl.Config),
+		explainChan:   make(chan explainRequest),
+		assessChan:    make(chan chan assessResult),
+		recentLog:     newLogRing(p.RecentLogCount),
 	}
 	if w.updater == nil {
 		w.updater = nopUpdater{}
 	}
+	if w.clock == nil {
+		w.clock = systemClock{}
+	}
+	if w.heartbeat == 0 {
+		w.heartbeat = DefaultHeartbeat
+	}
 	go w.run(ctx, p.Config)
 	return w, nil
 }
@@ -132,105 +277,401 @@ func (w *Worker) SetConfig(cfg *hydroctl.Config) {
 	w.cfgChan <- cfg
 }
 
-// Close shuts down the worker.
+// Explain assesses the relays with the current configuration,
+// relay state and meter readings and returns an explanation of
+// the assessed state of each relay. It doesn't change any relays.
+func (w *Worker) Explain(ctx context.Context) ([]hydroctl.RelayExplanation, error) {
+	return w.explainWith(ctx, nil)
+}
+
+// ExplainConfig is like Explain except that it assesses the relays
+// with the given configuration instead of the current one. The
+// current configuration isn't changed. The caller must not mutate
+// cfg after calling this function.
+func (w *Worker) ExplainConfig(ctx context.Context, cfg *hydroctl.Config) ([]hydroctl.RelayExplanation, error) {
+	return w.explainWith(ctx, cfg)
+}
+
+func (w *Worker) explainWith(ctx context.Context, cfg *hydroctl.Config) ([]hydroctl.RelayExplanation, error) {
+	reply := make(chan explainResult, 1)
+	select {
+	case w.explainChan <- explainRequest{cfg, reply}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case r := <-reply:
+		return r.explanations, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AssessNow reads the meters and assesses the relays immediately
+// rather than waiting for the next heartbeat, changing any relays
+// as needed, and returns the resulting relay state.
+// If relay control is paused, it returns ErrPaused.
+func (w *Worker) AssessNow(ctx context.Context) (hydroctl.RelayState, error) {
+	reply := make(chan assessResult, 1)
+	select {
+	case w.assessChan <- reply:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case r := <-reply:
+		return r.state, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// SetPaused sets whether relay control is paused. While it's
+// paused, the worker doesn't assess or change the relays,
+// although heartbeats are still sent to the relay controller.
+func (w *Worker) SetPaused(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+}
+
+// Paused reports whether relay control is paused.
+func (w *Worker) Paused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// SetOverride forces the given relay into the state specified
+// by o until o.Until, regardless of its configuration.
+// The forced state is recorded in the history like
+// any other, so time that a relay is forced on counts
+// towards its slot durations, but changes caused by
+// the override are marked as such.
+func (w *Worker) SetOverride(relay int, o Override) error {
+	if relay < 0 || relay >= hydroctl.MaxRelayCount {
+		return errgo.Newf("relay %d out of range", relay)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.overrides == nil {
+		w.overrides = make(map[int]Override)
+	}
+	w.overrides[relay] = o
+	return nil
+}
+
+// ClearOverride removes any override for the given relay.
+func (w *Worker) ClearOverride(relay int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.overrides, relay)
+}
+
+// Overrides returns the current relay overrides, indexed by relay
+// number. Overrides are removed when they've expired, so the
+// result might include some that have expired but haven't
+// been removed yet.
+func (w *Worker) Overrides() map[int]Override {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	overrides := make(map[int]Override)
+	for relay, o := range w.overrides {
+		overrides[relay] = o
+	}
+	return overrides
+}
+
+// applyOverrides applies any current overrides to the given
+// relay state, removing any that have expired by now.
+// It returns the resulting state and the set of overridden relays.
+func (w *Worker) applyOverrides(state hydroctl.RelayState, now time.Time) (_ hydroctl.RelayState, overridden hydroctl.RelayState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for relay, o := range w.overrides {
+		if !now.Before(o.Until) {
+			delete(w.overrides, relay)
+			continue
+		}
+		state.Set(relay, o.On)
+		overridden.Set(relay, true)
+	}
+	return state, overridden
+}
+
+// availableRelays returns the set of all the relays
+// that the relay controller can control.
+func (w *Worker) availableRelays() hydroctl.RelayState {
+	rc, ok := w.controller.(RelayCounter)
+	if !ok || rc.NumRelays() >= hydroctl.MaxRelayCount {
+		return ^hydroctl.RelayState(0)
+	}
+	return 1<<uint(rc.NumRelays()) - 1
+}
+
+// RecentLog returns the most recently logged assessment
+// messages, oldest first. Messages are only logged when
+// the relay state changes or, when it's not changing,
+// occasionally to show that the worker is still alive.
+func (w *Worker) RecentLog() []LogEntry {
+	return w.recentLog.all()
+}
+
+// Close shuts down the worker. If Params.ShutdownState
+// was specified, the relays will have been set to that
+// state by the time it returns.
 func (w *Worker) Close() {
 	w.cancelContext()
+	<-w.done
 }
 
 func (w *Worker) run(ctx context.Context, currentConfig *hydroctl.Config) {
+	defer close(w.done)
 	log.Printf("hydroworker starting")
-	timer := time.NewTimer(0)
-	defer timer.Stop()
+	heartbeat := w.clock.After(0)
 	firstTime := true
 	var currentState Update
-	var logger logger
-	alreadyUnchanged := false
+	logger := logger{
+		recent: w.recentLog,
+	}
+	var lastUnchangedLog time.Time
+	// metersFailedSince holds the time of the first
+	// of the current run of failed meter reads.
+	var metersFailedSince time.Time
+	// lastDecision holds the most recently recorded decision.
+	var lastDecision *decisionlog.Decision
+	// lastOverridden holds the relays that were overridden
+	// when the state was last updated.
+	var lastOverridden hydroctl.RelayState
 	for {
+		// assessReply, if non-nil, is sent the
+		// result of the assessment.
+		var assessReply chan assessResult
 		select {
 		case <-ctx.Done():
+			w.shutdown()
 			return
 		case cfg := <-w.cfgChan:
 			currentConfig = cfg
-		case <-timer.C:
-			timer.Reset(Heartbeat)
+		case req := <-w.explainChan:
+			cfg := req.cfg
+			if cfg == nil {
+				cfg = currentConfig
+			}
+			explanations, err := w.explain(ctx, cfg, metersFailedSince)
+			req.reply <- explainResult{explanations, err}
+			continue
+		case assessReply = <-w.assessChan:
+		case <-heartbeat:
+			heartbeat = w.clock.After(w.heartbeat)
+			if hr, ok := w.controller.(HeartbeatReceiver); ok {
+				hr.Heartbeat()
+			}
+		}
+		if w.Paused() {
+			sendAssessResult(assessReply, 0, ErrPaused)
+			continue
 		}
 		haveRelays := true
-		currentRelays, err := w.controller.Relays()
-		if err != nil {
-			if errgo.Cause(err) != ErrNoRelayController {
-				log.Printf("cannot get current relay state: %v (%#v)", err, err)
+		currentRelays, relaysErr := w.controller.Relays()
+		if relaysErr != nil {
+			if errgo.Cause(relaysErr) != ErrNoRelayController {
+				log.Printf("cannot get current relay state: %v (%#v)", relaysErr, relaysErr)
 			}
 			haveRelays = false
 		}
 		// By deriving the context from our parent context,
 		// this will automatically stop when the worker is closed.
-		ctx1, cancel := context.WithTimeout(ctx, Heartbeat)
+		ctx1, cancel := context.WithTimeout(ctx, w.heartbeat)
 		currentPowerUse, err := w.meters.ReadMeters(ctx1)
 		cancel()
-		if err != nil && errgo.Cause(err) != ErrNoMeters {
+		metersFailed := err != nil && errgo.Cause(err) != ErrNoMeters
+		if metersFailed {
 			log.Printf("warning: cannot get current meter reading: %v", err)
 		}
 		if !haveRelays {
 			log.Printf("can't talk to relay server")
+			sendAssessResult(assessReply, 0, errgo.NoteMask(relaysErr, "cannot get current relay state", errgo.Is(ErrNoRelayController)))
 			// No point in continuing if we can't talk to the relay server.
 			continue
 		}
-		if err == ErrNoMeters {
-			currentPowerUse = w.allMaxPower(currentConfig, currentRelays)
+		now := w.clock.Now().In(w.tz)
+		if errgo.Cause(err) == ErrNoMeters {
+			currentPowerUse = w.allMaxPower(currentConfig, currentRelays, now)
+		}
+		switch {
+		case !metersFailed:
+			metersFailedSince = time.Time{}
+		case metersFailedSince.IsZero():
+			metersFailedSince = now
 		}
-		now := time.Now().In(w.tz)
 		logger.msgs = logger.msgs[:0]
-		newRelays := hydroctl.Assess(hydroctl.AssessParams{
-			Config:         currentConfig,
-			CurrentState:   currentRelays,
-			History:        w.history,
-			PowerUseSample: currentPowerUse,
-			Logger:         &logger,
-			Now:            now,
-		})
+		assessParams := hydroctl.AssessParams{
+			Config:            currentConfig,
+			CurrentState:      currentRelays,
+			History:           w.history,
+			PowerUseSample:    currentPowerUse,
+			Logger:            &logger,
+			Now:               now,
+			MetersFailedSince: metersFailedSince,
+			Forecast:          w.forecast,
+		}
+		var newRelays hydroctl.RelayState
+		var explanations []hydroctl.RelayExplanation
+		if w.decisions != nil {
+			newRelays, explanations = hydroctl.AssessExplain(assessParams)
+		} else {
+			newRelays = hydroctl.Assess(assessParams)
+		}
+		newRelays, overridden := w.applyOverrides(newRelays, now)
+		if overridden != 0 {
+			logger.Log(fmt.Sprintf("relays %v overridden", overridden))
+		}
+		if extra := newRelays &^ w.availableRelays(); extra != 0 {
+			logger.Log(fmt.Sprintf("relays %v left off because the relay controller cannot control them", extra))
+			newRelays &^= extra
+		}
+		if w.decisions != nil {
+			lastDecision = w.recordDecision(lastDecision, decisionlog.Decision{
+				Time:              now,
+				PowerUse:          currentPowerUse,
+				MetersFailedSince: metersFailedSince,
+				Previous:          currentRelays,
+				Relays:            newRelays,
+				Overridden:        overridden,
+				Blocked:           decisionlog.Blocked(explanations),
+			})
+		}
 		changed := newRelays != currentRelays
-		if changed {
-			for _, msg := range logger.msgs {
-				log.Printf("%s", msg)
+		if !changed && overridden == lastOverridden && !firstTime {
+			// Nothing to do, but let the logs show that
+			// we're still alive every so often.
+			if now.Sub(lastUnchangedLog) >= unchangedLogInterval {
+				logger.print(now)
+				logger.printf(now, "relay state unchanged")
+				lastUnchangedLog = now
 			}
-			log.Printf("relay state changed to %v", newRelays)
+			sendAssessResult(assessReply, newRelays, nil)
+			continue
+		}
+		logger.print(now)
+		if changed {
+			logger.printf(now, "relay state changed to %v", newRelays)
 			if err := w.controller.SetRelays(newRelays); err != nil {
 				log.Printf("cannot set relay state: %v", err)
+				sendAssessResult(assessReply, 0, errgo.Notef(err, "cannot set relay state"))
 				continue
 			}
-			alreadyUnchanged = false
-		} else {
-			if !alreadyUnchanged {
-				for _, msg := range logger.msgs {
-					log.Printf("%s", msg)
-				}
-				log.Printf("relay state unchanged")
-				alreadyUnchanged = true
-			}
 		}
-		if firstTime || changed {
-			// The first time through the loop, even if the relay state might not
-			// have changed from the actual state, the history might not
-			// reflect the current state, so record it anyway.
-			w.history.RecordState(newRelays, now)
-			if err := w.store.Commit(); err != nil {
-				log.Printf("cannot record state: %v", err)
-			}
-			w.updateState(&currentState, newRelays, firstTime)
-			w.updater.UpdateWorkerState(currentState.Clone())
-			firstTime = false
+		lastUnchangedLog = now
+		// The first time through the loop, even if the relay state might not
+		// have changed from the actual state, the history might not
+		// reflect the current state, so record it anyway.
+		w.history.RecordOverriddenState(newRelays, overridden, now)
+		if err := w.store.Commit(); err != nil {
+			log.Printf("cannot record state: %v", err)
+		}
+		w.updateState(&currentState, newRelays, overridden, firstTime)
+		lastOverridden = overridden
+		w.updater.UpdateWorkerState(currentState.Clone())
+		firstTime = false
+		sendAssessResult(assessReply, newRelays, nil)
+	}
+}
+
+// recordDecision records d in the decision log unless it
+// doesn't change the relays and has the same inputs (other than
+// the time) and outcome as the last recorded decision, and
+// returns the most recently recorded decision.
+func (w *Worker) recordDecision(last *decisionlog.Decision, d decisionlog.Decision) *decisionlog.Decision {
+	if last != nil &&
+		d.Previous == d.Relays &&
+		d.PowerUse.PowerUse == last.PowerUse.PowerUse &&
+		d.MetersFailedSince.Equal(last.MetersFailedSince) &&
+		last.SameOutcome(d) {
+		return last
+	}
+	if err := w.decisions.Write(d); err != nil {
+		log.Printf("cannot record decision: %v", err)
+	}
+	return &d
+}
+
+// shutdown sets the relays to the shutdown state,
+// if there is one.
+func (w *Worker) shutdown() {
+	if w.shutdownState == nil {
+		return
+	}
+	state := *w.shutdownState
+	log.Printf("hydroworker shutting down; setting relay state to %v", state)
+	if err := w.controller.SetRelays(state); err != nil {
+		if errgo.Cause(err) != ErrNoRelayController {
+			log.Printf("cannot set relay state on shutdown: %v", err)
 		}
+		return
+	}
+	w.history.RecordState(state, w.clock.Now().In(w.tz))
+	if err := w.store.Commit(); err != nil {
+		log.Printf("cannot record state: %v", err)
 	}
 }
 
-func (w *Worker) allMaxPower(config *hydroctl.Config, relayState hydroctl.RelayState) hydroctl.PowerUseSample {
+// sendAssessResult sends the result of an assessment
+// to the given reply channel, if it's not nil.
+func sendAssessResult(reply chan assessResult, state hydroctl.RelayState, err error) {
+	if reply != nil {
+		reply <- assessResult{state, err}
+	}
+}
+
+// explain returns an explanation of the relay states as
+// they would be assessed given the current relay state
+// and meter readings.
+func (w *Worker) explain(ctx context.Context, cfg *hydroctl.Config, metersFailedSince time.Time) ([]hydroctl.RelayExplanation, error) {
+	currentRelays, err := w.controller.Relays()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get current relay state")
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.heartbeat)
+	currentPowerUse, err := w.meters.ReadMeters(ctx)
+	cancel()
+	now := w.clock.Now().In(w.tz)
+	switch {
+	case errgo.Cause(err) == ErrNoMeters:
+		currentPowerUse = w.allMaxPower(cfg, currentRelays, now)
+	case err != nil && metersFailedSince.IsZero():
+		metersFailedSince = now
+	}
+	return hydroctl.Explain(hydroctl.AssessParams{
+		Config:            cfg,
+		CurrentState:      currentRelays,
+		History:           w.history,
+		PowerUseSample:    currentPowerUse,
+		Now:               now,
+		MetersFailedSince: metersFailedSince,
+		Forecast:          w.forecast,
+	}), nil
+}
+
+// allMaxPower returns a power use sample to use when there
+// are no meters. It assumes that all currently active relays
+// are using their maximum power and that nothing is being
+// generated, so discretionary relays will only be turned on
+// within the configured import allowance.
+//
+// The sample is taken to be current so that relays can still
+// be scheduled.
+func (w *Worker) allMaxPower(config *hydroctl.Config, relayState hydroctl.RelayState, now time.Time) hydroctl.PowerUseSample {
 	total := 0
-	for i := 0; i < hydroctl.MaxRelayCount; i++ {
+	for i := range config.Relays {
 		if relayState.IsSet(i) {
 			total += config.Relays[i].MaxPower
 		}
 	}
 	return hydroctl.PowerUseSample{
+		T0: now,
+		T1: now,
 		PowerUse: hydroctl.PowerUse{
 			Here: float64(total),
 		},
@@ -238,19 +679,39 @@ func (w *Worker) allMaxPower(config *hydroctl.Config, relayState hydroctl.RelayS
 }
 
 type logger struct {
-	msgs []string
+	msgs   []string
+	recent *logRing
 }
 
 func (l *logger) Log(s string) {
 	l.msgs = append(l.msgs, s)
 }
 
+// print logs all the messages in l, recording them
+// as logged at the given time.
+func (l *logger) print(now time.Time) {
+	for _, msg := range l.msgs {
+		l.printf(now, "%s", msg)
+	}
+}
+
+// printf logs a message and records it in l.recent.
+func (l *logger) printf(now time.Time, f string, args ...interface{}) {
+	msg := fmt.Sprintf(f, args...)
+	log.Printf("%s", msg)
+	l.recent.add(LogEntry{
+		Time:    now,
+		Message: msg,
+	})
+}
+
 // updateState updates u to reflect the latest state stored in w.history,
 // updating only those entries that have changed value,
 // unless all is true, in which case all entries are updated.
-func (w *Worker) updateState(u *Update, newState hydroctl.RelayState, all bool) {
+// The overridden relays are marked as such.
+func (w *Worker) updateState(u *Update, newState, overridden hydroctl.RelayState, all bool) {
 	for i := range u.Relays {
-		if !all && newState.IsSet(i) == u.State.IsSet(i) {
+		if !all && newState.IsSet(i) == u.State.IsSet(i) && overridden.IsSet(i) == u.Relays[i].Override {
 			continue
 		}
 		on, t := w.history.LatestChange(i)
@@ -258,8 +719,9 @@ func (w *Worker) updateState(u *Update, newState hydroctl.RelayState, all bool)
 			panic(errgo.Newf("unexpected result from history; relay %d expected %v got %v %v", i, newState.IsSet(i), on, t))
 		}
 		u.Relays[i] = RelayUpdate{
-			On:    on,
-			Since: t,
+			On:       on,
+			Since:    t,
+			Override: overridden.IsSet(i),
 		}
 	}
 	u.State = newState
@@ -281,4 +743,7 @@ func (u *Update) Clone() *Update {
 type RelayUpdate struct {
 	On    bool
 	Since time.Time
+	// Override holds whether the relay's state
+	// is currently forced by an override.
+	Override bool
 }
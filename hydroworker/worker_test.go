@@ -0,0 +1,1155 @@
+package hydroworker_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/hydro/decisionlog"
+	"github.com/rogpeppe/hydro/history"
+	"github.com/rogpeppe/hydro/hydroctl"
+	"github.com/rogpeppe/hydro/hydroworker"
+)
+
+var epoch = time.Date(2000, 01, 01, 12, 0, 0, 0, time.UTC)
+
+func TestWorkerHeartbeats(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}, {
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	}, 0)
+	defer env.w.Close()
+
+	// The worker asks for an immediate first assessment.
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	// Only one relay is turned on at a time.
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+
+	// Not enough time has passed to turn on the next relay.
+	env.clock.advance(hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0 1]",
+		"commit",
+		"update [0 1]",
+	})
+
+	// Everything's on now, so nothing should change.
+	env.clock.advance(hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+}
+
+func TestWorkerSteadyStateCommitsOnce(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	}, 1)
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	// The relay state doesn't change, but the first
+	// state is recorded anyway.
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"commit",
+		"update [0]",
+	})
+	for i := 0; i < 200; i++ {
+		env.clock.advance(hydroworker.DefaultHeartbeat)
+		env.clock.fire()
+		c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+		c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+			"relays",
+			"read meters",
+		})
+	}
+}
+
+func TestWorkerShedsRelaysAfterMeterFailure(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}, {
+			Mode:     hydroctl.InUse,
+			MaxPower: 100,
+			InUse: []*hydroctl.Slot{{
+				Kind:     hydroctl.AtMost,
+				Duration: 24 * time.Hour,
+			}},
+		}},
+		MeterFailSafeDuration: time.Minute,
+	}, 3)
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"commit",
+		"update [0 1]",
+	})
+
+	env.meters.setFailing(true)
+	// The relays are left alone while the meters
+	// haven't been failing for long.
+	for d := time.Duration(0); d < time.Minute; d += 10 * time.Second {
+		env.clock.advance(10 * time.Second)
+		env.clock.fire()
+		c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+		c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+			"relays",
+			"read meters",
+		})
+	}
+	// The discretionary relay is turned off when the meters
+	// have been failing for long enough.
+	env.clock.advance(10 * time.Second)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+}
+
+// noMetersConfig returns a configuration with a relay that
+// must be on for the first half hour after epoch and a
+// discretionary relay that may be on for the following hour.
+func noMetersConfig(importAllowance float64) *hydroctl.Config {
+	return &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.InUse,
+			MaxPower: 100,
+			InUse: []*hydroctl.Slot{{
+				Start: hydroctl.TimeOfDayFromTime(epoch),
+				End:   hydroctl.TimeOfDayFromTime(epoch.Add(30 * time.Minute)),
+				Kind:  hydroctl.Continuous,
+			}},
+		}, {
+			Mode:     hydroctl.InUse,
+			MaxPower: 100,
+			InUse: []*hydroctl.Slot{{
+				Start:    hydroctl.TimeOfDayFromTime(epoch),
+				End:      hydroctl.TimeOfDayFromTime(epoch.Add(time.Hour)),
+				Kind:     hydroctl.AtMost,
+				Duration: time.Hour,
+			}},
+		}},
+		ImportAllowance: importAllowance,
+	}
+}
+
+func TestWorkerWithoutMeters(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, noMetersConfig(250), 0)
+	defer env.w.Close()
+	env.meters.setNoMeters(true)
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+
+	// Once the change has had time to settle, the discretionary
+	// relay is turned on because the maximum power of both relays
+	// is within the import allowance.
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0 1]",
+		"commit",
+		"update [0 1]",
+	})
+
+	// The first relay turns off at the end of its slot.
+	env.clock.advance(30*time.Minute - hydroctl.DefaultMeterReactionDuration)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [1]",
+		"commit",
+		"update [1]",
+	})
+
+	// The second relay turns off at the end of its slot.
+	env.clock.advance(30 * time.Minute)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays []",
+		"commit",
+		"update []",
+	})
+}
+
+func TestWorkerWithoutMetersNoImportAllowance(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, noMetersConfig(0), 0)
+	defer env.w.Close()
+	env.meters.setNoMeters(true)
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+
+	// With no meters and no import allowance, any power
+	// use is assumed to be imported, so the discretionary
+	// relay is never turned on.
+	for i := 0; i < 5; i++ {
+		env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+		env.clock.fire()
+		c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+		c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+			"relays",
+			"read meters",
+		})
+	}
+}
+
+func TestWorkerAssessNow(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	}, 0)
+	defer env.w.Close()
+
+	// The worker asks for an immediate first assessment,
+	// but we don't fire the timer, so nothing is assessed
+	// until we ask for it.
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state, err := env.w.AssessNow(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(state, qt.Equals, hydroctl.RelayState(1))
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+
+	// When nothing changes, the current state is returned.
+	state, err = env.w.AssessNow(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(state, qt.Equals, hydroctl.RelayState(1))
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+}
+
+func TestWorkerConfiguredHeartbeat(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorkerWithParams(c, 0, hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		Heartbeat: 5 * time.Second,
+	})
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, 5*time.Second)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+	for i := 0; i < 3; i++ {
+		env.clock.advance(5 * time.Second)
+		env.clock.fire()
+		c.Assert(env.clock.waitAfter(c), qt.Equals, 5*time.Second)
+		c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+			"relays",
+			"read meters",
+		})
+	}
+}
+
+func TestWorkerShutdownState(t *testing.T) {
+	c := qt.New(t)
+	shutdownState := hydroctl.RelayState(1 << 1)
+	env := newTestWorkerWithParams(c, 0, hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		ShutdownState: &shutdownState,
+	})
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+
+	// The shutdown state is set by the time Close returns.
+	env.clock.advance(time.Second)
+	env.w.Close()
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"set relays [1]",
+		"commit",
+	})
+}
+
+func TestWorkerShutdownWithoutShutdownState(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	}, 0)
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	readEvents(env.events)
+
+	// The relays are left alone.
+	env.w.Close()
+	c.Assert(readEvents(env.events), qt.HasLen, 0)
+}
+
+func TestWorkerHeartbeatReceiver(t *testing.T) {
+	c := qt.New(t)
+	events := make(chan string, 100)
+	clock := newTestClock(epoch)
+	w, err := hydroworker.New(hydroworker.Params{
+		Config: &hydroctl.Config{},
+		Store: &testStore{
+			events: events,
+		},
+		Controller: &heartbeatController{
+			testController: &testController{
+				events: events,
+			},
+		},
+		Meters: &testMeters{
+			events: events,
+			clock:  clock,
+		},
+		TZ:    time.UTC,
+		Clock: clock,
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	c.Assert(clock.waitAfter(c), qt.Equals, time.Duration(0))
+	clock.fire()
+	c.Assert(clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	clock.advance(hydroworker.DefaultHeartbeat)
+	clock.fire()
+	c.Assert(clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(events), qt.DeepEquals, []string{
+		"heartbeat",
+		"relays",
+		"read meters",
+		"commit",
+		"heartbeat",
+		"relays",
+		"read meters",
+	})
+}
+
+func TestWorkerRelayCounter(t *testing.T) {
+	c := qt.New(t)
+	events := make(chan string, 100)
+	clock := newTestClock(epoch)
+	store := &testStore{
+		events: events,
+	}
+	w, err := hydroworker.New(hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{}, {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		Store: store,
+		Controller: &countingController{
+			testController: &testController{
+				events: events,
+			},
+			numRelays: 1,
+		},
+		Meters: &testMeters{
+			events: events,
+			clock:  clock,
+		},
+		TZ:    time.UTC,
+		Clock: clock,
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	// Relay 1 is beyond the controller's range,
+	// so it's left off and not recorded as on.
+	c.Assert(clock.waitAfter(c), qt.Equals, time.Duration(0))
+	clock.fire()
+	c.Assert(clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"commit",
+	})
+
+	// The state now matches, so the relays
+	// aren't set again.
+	clock.advance(hydroworker.DefaultHeartbeat)
+	clock.fire()
+	c.Assert(clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+}
+
+// countingController is a testController that
+// implements hydroworker.RelayCounter.
+type countingController struct {
+	*testController
+	numRelays int
+}
+
+func (ctl *countingController) NumRelays() int {
+	return ctl.numRelays
+}
+
+func TestWorkerPaused(t *testing.T) {
+	c := qt.New(t)
+	events := make(chan string, 100)
+	clock := newTestClock(epoch)
+	w, err := hydroworker.New(hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		Store: &testStore{
+			events: events,
+		},
+		Controller: &heartbeatController{
+			testController: &testController{
+				events: events,
+			},
+		},
+		Meters: &testMeters{
+			events: events,
+			clock:  clock,
+		},
+		TZ:    time.UTC,
+		Clock: clock,
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	c.Assert(w.Paused(), qt.IsFalse)
+	w.SetPaused(true)
+	c.Assert(w.Paused(), qt.IsTrue)
+
+	// While paused, heartbeats are still sent but
+	// nothing is assessed.
+	c.Assert(clock.waitAfter(c), qt.Equals, time.Duration(0))
+	clock.fire()
+	c.Assert(clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(events), qt.DeepEquals, []string{
+		"heartbeat",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = w.AssessNow(ctx)
+	c.Assert(errgo.Cause(err), qt.Equals, hydroworker.ErrPaused)
+	c.Assert(readEvents(events), qt.HasLen, 0)
+
+	// When resumed, the relays are assessed again.
+	w.SetPaused(false)
+	state, err := w.AssessNow(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(state, qt.Equals, hydroctl.RelayState(1))
+	c.Assert(readEvents(events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+	})
+}
+
+var overrideTests = []struct {
+	testName string
+	override bool
+	// expectPriority holds the expected priority of the
+	// relay when the slot has an hour remaining.
+	expectPriority string
+	expectOnFor    time.Duration
+}{{
+	testName: "no-override",
+	// Without the override, the relay has had no time
+	// so far, so it must be on for the rest of the slot.
+	expectPriority: "absolute",
+}, {
+	testName: "override",
+	override: true,
+	// The time for which the override forced the relay
+	// on counts towards the slot, so the relay no longer
+	// needs to be on.
+	expectPriority: "high",
+	expectOnFor:    time.Hour,
+}}
+
+func TestWorkerOverrideCountsTowardsSlot(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range overrideTests {
+		c.Run(test.testName, func(c *qt.C) {
+			env := newTestWorker(c, &hydroctl.Config{
+				Relays: []hydroctl.RelayConfig{{
+					Mode: hydroctl.InUse,
+					InUse: []*hydroctl.Slot{{
+						Start:    hydroctl.TimeOfDayFromTime(epoch),
+						End:      hydroctl.TimeOfDayFromTime(epoch.Add(2 * time.Hour)),
+						Kind:     hydroctl.AtLeast,
+						Duration: time.Hour,
+					}},
+					// The test meters never report enough
+					// generated power for the relay to be
+					// turned on discretionarily.
+					MaxPower: 100000,
+				}},
+			}, 0)
+			defer env.w.Close()
+			if test.override {
+				err := env.w.SetOverride(0, hydroworker.Override{
+					On:    true,
+					Until: epoch.Add(time.Hour),
+				})
+				c.Assert(err, qt.IsNil)
+			}
+			c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+			env.clock.fire()
+			c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+			readEvents(env.events)
+
+			env.clock.advance(time.Hour)
+			explanations, err := env.w.Explain(context.Background())
+			c.Assert(err, qt.IsNil)
+			c.Assert(explanations, qt.HasLen, 1)
+			c.Assert(explanations[0].Priority, qt.Equals, test.expectPriority)
+
+			// The override is removed when it has expired.
+			env.clock.fire()
+			c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+			c.Assert(env.w.Overrides(), qt.HasLen, 0)
+
+			hdb, err := history.New(&env.store.MemStore)
+			c.Assert(err, qt.IsNil)
+			c.Assert(hdb.OnDuration(0, epoch, epoch.Add(time.Hour)), qt.Equals, test.expectOnFor)
+		})
+	}
+}
+
+func TestWorkerOverrideMarksDecisions(t *testing.T) {
+	c := qt.New(t)
+	decisions := &testDecisionLog{}
+	env := newTestWorkerWithParams(c, 0, hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOff,
+				MaxPower: 100,
+			}},
+		},
+		Decisions: decisions,
+	})
+	defer env.w.Close()
+	err := env.w.SetOverride(0, hydroworker.Override{
+		On:    true,
+		Until: epoch.Add(time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	err = env.w.SetOverride(hydroctl.MaxRelayCount, hydroworker.Override{})
+	c.Assert(err, qt.ErrorMatches, `relay 32 out of range`)
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays [0]",
+		"commit",
+		"update [0]",
+	})
+	d := decisions.get()
+	c.Assert(d, qt.HasLen, 1)
+	c.Assert(d[0].Relays, qt.Equals, hydroctl.RelayState(1<<0))
+	c.Assert(d[0].Overridden, qt.Equals, hydroctl.RelayState(1<<0))
+
+	// When the override is cleared, the relay
+	// reverts to its configured state.
+	env.w.ClearOverride(0)
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+		"set relays []",
+		"commit",
+		"update []",
+	})
+	d = decisions.get()
+	c.Assert(d, qt.HasLen, 2)
+	c.Assert(d[1].Overridden, qt.Equals, hydroctl.RelayState(0))
+}
+
+// heartbeatController is a testController that
+// implements hydroworker.HeartbeatReceiver.
+type heartbeatController struct {
+	*testController
+}
+
+func (ctl *heartbeatController) Heartbeat() {
+	ctl.events <- "heartbeat"
+}
+
+func TestWorkerRecordsDecisions(t *testing.T) {
+	c := qt.New(t)
+	decisions := &testDecisionLog{}
+	env := newTestWorkerWithParams(c, 0, hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}, {
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		Decisions: decisions,
+	})
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	// The test meters always report the same power use.
+	powerUse := hydroctl.PowerUse{
+		Generated: 10000,
+	}
+	t1 := epoch.Add(hydroworker.DefaultHeartbeat + hydroctl.DefaultMeterReactionDuration)
+	c.Assert(decisions.get(), qt.DeepEquals, []decisionlog.Decision{{
+		Time: epoch,
+		PowerUse: hydroctl.PowerUseSample{
+			PowerUse: powerUse,
+			T0:       epoch,
+			T1:       epoch,
+		},
+		Previous: 0,
+		Relays:   1 << 0,
+		Blocked: map[int]hydroctl.Blocker{
+			1: hydroctl.BlockTurnOnDelay,
+		},
+	}})
+
+	// Nothing has changed, so nothing more is recorded.
+	env.clock.advance(hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(decisions.get(), qt.HasLen, 1)
+
+	// The outcome is the same but the power use has changed,
+	// so the decision is recorded.
+	env.meters.setExtraGenerated(500)
+	env.clock.advance(hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	t2 := epoch.Add(2 * hydroworker.DefaultHeartbeat)
+	c.Assert(decisions.get()[1:], qt.DeepEquals, []decisionlog.Decision{{
+		Time: t2,
+		PowerUse: hydroctl.PowerUseSample{
+			PowerUse: hydroctl.PowerUse{
+				Generated: 10500,
+			},
+			T0: t2,
+			T1: t2,
+		},
+		Previous: 1 << 0,
+		Relays:   1 << 0,
+		Blocked: map[int]hydroctl.Blocker{
+			1: hydroctl.BlockTurnOnDelay,
+		},
+	}})
+	env.meters.setExtraGenerated(0)
+
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration - hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(decisions.get()[2:], qt.DeepEquals, []decisionlog.Decision{{
+		Time: t1,
+		PowerUse: hydroctl.PowerUseSample{
+			PowerUse: powerUse,
+			T0:       t1,
+			T1:       t1,
+		},
+		Previous: 1 << 0,
+		Relays:   1<<0 | 1<<1,
+	}})
+
+	env.clock.advance(hydroworker.DefaultHeartbeat)
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	c.Assert(decisions.get(), qt.HasLen, 3)
+}
+
+type testDecisionLog struct {
+	mu        sync.Mutex
+	decisions []decisionlog.Decision
+}
+
+func (l *testDecisionLog) Write(d decisionlog.Decision) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions = append(l.decisions, d)
+	return nil
+}
+
+func (l *testDecisionLog) get() []decisionlog.Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]decisionlog.Decision(nil), l.decisions...)
+}
+
+func TestWorkerExplain(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}, {
+			// The test meters only ever report 10kW of
+			// generated power, so there's never enough
+			// power for this relay.
+			Mode:     hydroctl.InUse,
+			MaxPower: 20000,
+			InUse: []*hydroctl.Slot{{
+				Kind:     hydroctl.AtMost,
+				Duration: 24 * time.Hour,
+			}},
+		}},
+	}, 1)
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	readEvents(env.events)
+
+	// Wait until the meter readings reflect the relay state.
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+	explanations, err := env.w.Explain(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(explanations, qt.DeepEquals, []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}, {
+		Relay:    1,
+		Want:     true,
+		Priority: "low",
+		Blocker:  hydroctl.BlockPower,
+	}})
+	// Explaining doesn't change anything.
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+}
+
+func TestWorkerExplainConfig(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorker(c, &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	}, 1)
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	readEvents(env.events)
+
+	env.clock.advance(hydroctl.DefaultMeterReactionDuration)
+	// With the new configuration, relay 0 is always off
+	// and relay 1 is always on.
+	explanations, err := env.w.ExplainConfig(context.Background(), &hydroctl.Config{
+		Relays: []hydroctl.RelayConfig{{
+			Mode: hydroctl.AlwaysOff,
+		}, {
+			Mode:     hydroctl.AlwaysOn,
+			MaxPower: 100,
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(explanations, qt.DeepEquals, []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Priority: "absolute",
+	}, {
+		Relay:    1,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}})
+	// Explaining doesn't change anything.
+	c.Assert(readEvents(env.events), qt.DeepEquals, []string{
+		"relays",
+		"read meters",
+	})
+
+	// The original configuration is still in use.
+	explanations, err = env.w.Explain(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(explanations, qt.DeepEquals, []hydroctl.RelayExplanation{{
+		Relay:    0,
+		Want:     true,
+		Priority: "absolute",
+		State:    true,
+	}})
+}
+
+func TestWorkerRecentLog(t *testing.T) {
+	c := qt.New(t)
+	env := newTestWorkerWithParams(c, 0, hydroworker.Params{
+		Config: &hydroctl.Config{
+			Relays: []hydroctl.RelayConfig{{
+				Mode:     hydroctl.AlwaysOn,
+				MaxPower: 100,
+			}},
+		},
+		RecentLogCount: 3,
+	})
+	defer env.w.Close()
+
+	c.Assert(env.clock.waitAfter(c), qt.Equals, time.Duration(0))
+	env.clock.fire()
+	c.Assert(env.clock.waitAfter(c), qt.Equals, hydroworker.DefaultHeartbeat)
+	// Only the most recent entries are retained.
+	c.Assert(env.w.RecentLog(), qt.DeepEquals, []hydroworker.LogEntry{{
+		Time:    epoch,
+		Message: "assessRelay 0 -> true priAbsolute",
+	}, {
+		Time:    epoch,
+		Message: "relay 0 has absolute priority priAbsolute (current state false)",
+	}, {
+		Time:    epoch,
+		Message: "relay state changed to [0]",
+	}})
+}
+
+type testEnv struct {
+	w      *hydroworker.Worker
+	clock  *testClock
+	meters *testMeters
+	store  *testStore
+	// events receives an event for each
+	// external call made by the worker.
+	events <-chan string
+}
+
+// newTestWorker returns a new worker using the given configuration
+// and initial relay state.
+func newTestWorker(c *qt.C, cfg *hydroctl.Config, initial hydroctl.RelayState) *testEnv {
+	return newTestWorkerWithParams(c, initial, hydroworker.Params{
+		Config: cfg,
+	})
+}
+
+// newTestWorkerWithParams is like newTestWorker except that the
+// configuration and any other worker parameters not relating
+// to the test environment are taken from p.
+func newTestWorkerWithParams(c *qt.C, initial hydroctl.RelayState, p hydroworker.Params) *testEnv {
+	events := make(chan string, 100)
+	clock := newTestClock(epoch)
+	meters := &testMeters{
+		events: events,
+		clock:  clock,
+	}
+	store := &testStore{
+		events: events,
+	}
+	p.Store = store
+	p.Controller = &testController{
+		events: events,
+		state:  initial,
+	}
+	p.Meters = meters
+	p.Updater = &testUpdater{
+		events: events,
+	}
+	p.TZ = time.UTC
+	p.Clock = clock
+	w, err := hydroworker.New(p)
+	c.Assert(err, qt.IsNil)
+	return &testEnv{
+		w:      w,
+		clock:  clock,
+		meters: meters,
+		store:  store,
+		events: events,
+	}
+}
+
+// readEvents returns all the events currently
+// buffered in the given channel.
+func readEvents(events <-chan string) []string {
+	var got []string
+	for {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		default:
+			return got
+		}
+	}
+}
+
+// testClock implements hydroworker.Clock. Each call
+// to After must be acknowledged by a call to waitAfter.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+
+	afterc chan afterReq
+	fired  chan time.Time
+}
+
+type afterReq struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{
+		now:    now,
+		afterc: make(chan afterReq),
+	}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.afterc <- afterReq{
+		d: d,
+		c: ch,
+	}
+	return ch
+}
+
+// waitAfter waits for the worker to call After
+// and returns the duration it was called with.
+func (c *testClock) waitAfter(qc *qt.C) time.Duration {
+	select {
+	case req := <-c.afterc:
+		c.fired = req.c
+		return req.d
+	case <-time.After(5 * time.Second):
+		qc.Fatalf("timed out waiting for After call")
+		panic("unreachable")
+	}
+}
+
+// advance moves the clock forward by the given duration.
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fire triggers the channel returned by the most
+// recent call to After.
+func (c *testClock) fire() {
+	c.fired <- c.Now()
+}
+
+type testController struct {
+	events chan<- string
+	mu     sync.Mutex
+	state  hydroctl.RelayState
+}
+
+func (ctl *testController) SetRelays(state hydroctl.RelayState) error {
+	ctl.events <- fmt.Sprintf("set relays %v", state)
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	ctl.state = state
+	return nil
+}
+
+func (ctl *testController) Relays() (hydroctl.RelayState, error) {
+	ctl.events <- "relays"
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	return ctl.state, nil
+}
+
+type testMeters struct {
+	events chan<- string
+	clock  *testClock
+
+	mu       sync.Mutex
+	failing  bool
+	noMeters bool
+	// extraGenerated holds power that's added to
+	// the generated power that's usually reported.
+	extraGenerated float64
+}
+
+// setExtraGenerated sets the power that's added to the
+// generated power returned by ReadMeters.
+func (m *testMeters) setExtraGenerated(power float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.extraGenerated = power
+}
+
+// setNoMeters sets whether ReadMeters will return ErrNoMeters.
+func (m *testMeters) setNoMeters(noMeters bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.noMeters = noMeters
+}
+
+// setFailing sets whether ReadMeters will return an error.
+func (m *testMeters) setFailing(failing bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failing = failing
+}
+
+func (m *testMeters) ReadMeters(ctx context.Context) (hydroctl.PowerUseSample, error) {
+	m.events <- "read meters"
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failing {
+		return hydroctl.PowerUseSample{}, fmt.Errorf("meter failure")
+	}
+	if m.noMeters {
+		return hydroctl.PowerUseSample{}, hydroworker.ErrNoMeters
+	}
+	now := m.clock.Now()
+	return hydroctl.PowerUseSample{
+		T0: now,
+		T1: now,
+		PowerUse: hydroctl.PowerUse{
+			Generated: 10000 + m.extraGenerated,
+		},
+	}, nil
+}
+
+type testStore struct {
+	history.MemStore
+	events chan<- string
+}
+
+func (s *testStore) Commit() error {
+	s.events <- "commit"
+	return s.MemStore.Commit()
+}
+
+type testUpdater struct {
+	events chan<- string
+}
+
+func (u *testUpdater) UpdateWorkerState(update *hydroworker.Update) {
+	u.events <- fmt.Sprintf("update %v", update.State)
+}
@@ -3,6 +3,7 @@ package logworker
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -14,8 +15,8 @@ import (
 	"github.com/rogpeppe/hydro/ndmeter"
 )
 
-var ndmeterOpenEnergyLog = func(ctx context.Context, host string, t0, t1 time.Time) (sampleReadCloser, error) {
-	r, err := ndmeter.OpenEnergyLog(ctx, host, t0, t1)
+var ndmeterOpenEnergyLog = func(ctx context.Context, host string, t0, t1 time.Time, loc *time.Location) (sampleReadCloser, error) {
+	r, err := ndmeter.OpenEnergyLogInLocation(ctx, host, t0, t1, loc)
 	if err != nil {
 		return nil, err
 	}
@@ -41,9 +42,19 @@ type Params struct {
 	// TZ holds the time zone to use when calculating day boundaries
 	// to use for the sample names.
 	TZ *time.Location
+	// MeterTZ holds the time zone that the meter's clock is
+	// set to, which is used to interpret the times in its
+	// energy log. If it's nil, TZ is used.
+	MeterTZ *time.Location
 	// SamplesChanged is called if non-nil to notify that some new samples
 	// have been added.
 	SamplesChanged func()
+	// FileMode holds the permissions of the sample files.
+	// If it's zero, 0600 is used.
+	FileMode os.FileMode
+	// DirMode holds the permissions used when creating SampleDir.
+	// If it's zero, 0777 is used.
+	DirMode os.FileMode
 }
 
 type Worker struct {
@@ -64,16 +75,25 @@ func New(p Params) (*Worker, error) {
 	if p.TZ == nil {
 		p.TZ = time.UTC
 	}
+	if p.MeterTZ == nil {
+		p.MeterTZ = p.TZ
+	}
 	if p.StorageDuration == 0 {
 		p.StorageDuration = 28 * 24 * time.Hour
 	}
+	if p.FileMode == 0 {
+		p.FileMode = 0600
+	}
+	if p.DirMode == 0 {
+		p.DirMode = 0777
+	}
 	if p.SampleDir == "" {
 		return nil, fmt.Errorf("empty sample directory name")
 	}
 	if p.MeterAddr == "" {
 		return nil, fmt.Errorf("empty meter address")
 	}
-	if err := os.MkdirAll(p.SampleDir, 0777); err != nil {
+	if err := os.MkdirAll(p.SampleDir, p.DirMode); err != nil {
 		return nil, fmt.Errorf("cannot create sample directory: %v", err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -144,7 +164,7 @@ func (w *Worker) poll() error {
 }
 
 func (w *Worker) downloadSamples(t time.Time) (n int, err error) {
-	r, err := ndmeterOpenEnergyLog(w.ctx, w.p.MeterAddr, t, t.AddDate(0, 0, 1))
+	r, err := ndmeterOpenEnergyLog(w.ctx, w.p.MeterAddr, t, t.AddDate(0, 0, 1), w.p.MeterTZ)
 	if err != nil {
 		return 0, err
 	}
@@ -160,15 +180,29 @@ func (w *Worker) downloadSamples(t time.Time) (n int, err error) {
 			os.Remove(f.Name())
 		}
 	}()
-	n, err = meterstat.WriteSamples(f, r)
+	// Start with any samples that we've already got for the day, so
+	// that we don't lose samples that the meter might since have
+	// discarded, and then add only the samples that come after them.
+	var last time.Time
+	if old, err := meterstat.OpenSampleFile(w.filename(t)); err == nil {
+		_, last, err = writeNewSamples(f, old, last)
+		old.Close()
+		if err != nil {
+			return 0, fmt.Errorf("cannot copy existing samples: %v", err)
+		}
+	}
+	n, _, err = writeNewSamples(f, r, last)
 	if err != nil {
 		return 0, fmt.Errorf("cannot write samples: %v", err)
 	}
+	if err := f.Chmod(w.p.FileMode); err != nil {
+		return 0, fmt.Errorf("cannot set output file permissions: %v", err)
+	}
 	if err := f.Close(); err != nil {
 		return 0, fmt.Errorf("cannot close output file: %v", err)
 	}
 	if n == 0 {
-		return 0, fmt.Errorf("no samples found at %v", t)
+		return 0, fmt.Errorf("no new samples found at %v", t)
 	}
 	if err := os.Rename(f.Name(), w.filename(t)); err != nil {
 		return 0, fmt.Errorf("cannot rename temp file: %v", err)
@@ -176,6 +210,32 @@ func (w *Worker) downloadSamples(t time.Time) (n int, err error) {
 	return n, nil
 }
 
+// writeNewSamples writes to w all the samples read from r that are after
+// the given time, discarding any others so that the written samples
+// are strictly ordered by time. It returns the number of samples
+// written and the time of the last sample written, or after if
+// none were written.
+func writeNewSamples(w io.Writer, r meterstat.SampleReader, after time.Time) (int, time.Time, error) {
+	n := 0
+	for {
+		s, err := r.ReadSample()
+		if err != nil {
+			if err == io.EOF {
+				return n, after, nil
+			}
+			return n, after, fmt.Errorf("error reading sample: %v", err)
+		}
+		if !s.Time.After(after) {
+			continue
+		}
+		if err := meterstat.WriteSample(w, s); err != nil {
+			return n, after, fmt.Errorf("error writing sample: %v", err)
+		}
+		after = s.Time
+		n++
+	}
+}
+
 const leeway = time.Hour
 
 func (w *Worker) need(t time.Time) bool {
@@ -0,0 +1,206 @@
+package logworker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/ndmetertest"
+)
+
+func TestRestartDoesNotDuplicateSamples(t *testing.T) {
+	c := qt.New(t)
+	// Use yesterday so that the worker will decide that
+	// it needs a complete set of samples for the day.
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return day.Add(time.Duration(hour) * time.Hour)
+	}
+	var logSamples []meterstat.Sample
+	for i := 9; i <= 24; i++ {
+		logSamples = append(logSamples, meterstat.Sample{
+			Time:        at(i),
+			TotalEnergy: float64(i * 100),
+		})
+	}
+	c.Patch(&ndmeterOpenEnergyLog, func(ctx context.Context, host string, t0, t1 time.Time, loc *time.Location) (sampleReadCloser, error) {
+		return nopCloser{meterstat.NewMemSampleReader(logSamples)}, nil
+	})
+
+	p := Params{
+		SampleDir:       c.Mkdir(),
+		MeterAddr:       "0.1.2.3:1234",
+		Prefix:          "log-",
+		StorageDuration: 48 * time.Hour,
+	}
+	// Write the samples from a previous run of the worker that
+	// finished part way through the day.
+	var oldSamples []meterstat.Sample
+	for i := 0; i <= 10; i++ {
+		oldSamples = append(oldSamples, meterstat.Sample{
+			Time:        at(i),
+			TotalEnergy: float64(i * 100),
+		})
+	}
+	path := (&Worker{p: p}).filename(day)
+	f, err := os.Create(path)
+	c.Assert(err, qt.IsNil)
+	_, err = meterstat.WriteSamples(f, meterstat.NewMemSampleReader(oldSamples))
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	changed := make(chan struct{}, 1)
+	p.SamplesChanged = func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	w, err := New(p)
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for samples")
+	}
+
+	r, err := meterstat.OpenSampleFile(path)
+	c.Assert(err, qt.IsNil)
+	defer r.Close()
+	samples, err := meterstat.ReadAllSamples(r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(samples, qt.HasLen, 25)
+	for i, s := range samples {
+		c.Assert(s.Time.Equal(at(i)), qt.Equals, true, qt.Commentf("sample %d: %v", i, s.Time))
+		c.Assert(s.TotalEnergy, qt.Equals, float64(i*100))
+	}
+	// Check that there are no other files left lying around.
+	infos, err := ioutil.ReadDir(p.SampleDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(infos, qt.HasLen, 1)
+}
+
+func TestMeterInDifferentTimeZone(t *testing.T) {
+	c := qt.New(t)
+	meterSrv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer meterSrv.Close()
+	meterTZ := time.FixedZone("X", 5*60*60)
+	meterSrv.SetTZ(meterTZ)
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return day.Add(time.Duration(hour) * time.Hour)
+	}
+	var samples []meterstat.Sample
+	for i := -6; i <= 30; i++ {
+		samples = append(samples, meterstat.Sample{
+			Time:        at(i),
+			TotalEnergy: float64((i + 6) * 100),
+		})
+	}
+	meterSrv.AddSamples(samples)
+
+	changed := make(chan struct{}, 1)
+	p := Params{
+		SampleDir:       c.Mkdir(),
+		MeterAddr:       meterSrv.Addr,
+		Prefix:          "log-",
+		StorageDuration: 48 * time.Hour,
+		TZ:              time.UTC,
+		MeterTZ:         meterTZ,
+		SamplesChanged: func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		},
+	}
+	w, err := New(p)
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for samples")
+	}
+
+	// The samples for the day are at the correct times
+	// even though the meter's clock is in a different
+	// time zone.
+	r, err := meterstat.OpenSampleFile(w.filename(day))
+	c.Assert(err, qt.IsNil)
+	defer r.Close()
+	got, err := meterstat.ReadAllSamples(r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.HasLen, 25)
+	for i, s := range got {
+		c.Assert(s.Time.Equal(at(i)), qt.IsTrue, qt.Commentf("sample %d: %v", i, s.Time))
+		c.Assert(s.TotalEnergy, qt.Equals, float64((i+6)*100))
+	}
+}
+
+type nopCloser struct {
+	meterstat.SampleReader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func TestFileModes(t *testing.T) {
+	c := qt.New(t)
+	meterSrv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer meterSrv.Close()
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+	meterSrv.AddSamples([]meterstat.Sample{{
+		Time:        day,
+		TotalEnergy: 100,
+	}, {
+		Time:        day.Add(time.Hour),
+		TotalEnergy: 200,
+	}})
+
+	changed := make(chan struct{}, 1)
+	sampleDir := filepath.Join(c.Mkdir(), "samples")
+	w, err := New(Params{
+		SampleDir:       sampleDir,
+		MeterAddr:       meterSrv.Addr,
+		Prefix:          "log-",
+		StorageDuration: 48 * time.Hour,
+		TZ:              time.UTC,
+		FileMode:        0640,
+		DirMode:         0750,
+		SamplesChanged: func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for samples")
+	}
+	info, err := os.Stat(sampleDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0750))
+	info, err = os.Stat(w.filename(day))
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0640))
+}
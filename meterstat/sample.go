@@ -60,7 +60,9 @@ func (r *memSampleReader) ReadSample() (Sample, error) {
 // increasing, discarding samples that don't.
 func MultiSampleReader(rs ...SampleReader) SampleReader {
 	return &multiReader{
-		readers: rs,
+		// Copy the readers because we remove them from
+		// the slice as they terminate.
+		readers: append([]SampleReader(nil), rs...),
 		samples: make([]Sample, len(rs)),
 	}
 }
@@ -137,6 +139,209 @@ func (r *multiReader) readSample() (Sample, error) {
 	return s, nil
 }
 
+// Regression describes a sample that went backwards in time or
+// energy with respect to the sample before it. This can happen, for
+// example, when a meter's clock is reset.
+type Regression struct {
+	// Prev holds the most recent valid sample.
+	Prev Sample
+	// Sample holds the sample that regressed.
+	Sample Sample
+}
+
+// TimeJump returns how far back in time the sample went.
+// It returns zero if the time didn't go backwards.
+func (r Regression) TimeJump() time.Duration {
+	if !r.Sample.Time.Before(r.Prev.Time) {
+		return 0
+	}
+	return r.Prev.Time.Sub(r.Sample.Time)
+}
+
+// EnergyJump returns how much the total energy (in WH) went backwards.
+// It returns zero if the energy didn't go backwards.
+func (r Regression) EnergyJump() float64 {
+	if r.Sample.TotalEnergy >= r.Prev.TotalEnergy {
+		return 0
+	}
+	return r.Prev.TotalEnergy - r.Sample.TotalEnergy
+}
+
+// ValidatingSampleReader returns a SampleReader that returns samples
+// from r, discarding any that aren't monotonically increasing
+// like MultiSampleReader does. Rather than discarding samples
+// silently, it calls report for each sample that goes
+// backwards in time or energy. Samples that duplicate the
+// time of the previous sample are discarded without being reported.
+func ValidatingSampleReader(r SampleReader, report func(Regression)) SampleReader {
+	return &validatingReader{
+		r:      r,
+		report: report,
+	}
+}
+
+type validatingReader struct {
+	r      SampleReader
+	report func(Regression)
+	prev   Sample
+}
+
+func (r *validatingReader) ReadSample() (Sample, error) {
+	for {
+		s, err := r.r.ReadSample()
+		if err != nil {
+			return Sample{}, err
+		}
+		if r.prev.Time.IsZero() {
+			r.prev = s
+			return s, nil
+		}
+		if s.Time.Before(r.prev.Time) || s.TotalEnergy < r.prev.TotalEnergy {
+			r.report(Regression{
+				Prev:   r.prev,
+				Sample: s,
+			})
+			continue
+		}
+		if !s.Time.After(r.prev.Time) {
+			continue
+		}
+		r.prev = s
+		return s, nil
+	}
+}
+
+// RangeSampleReader returns a SampleReader that returns only
+// the samples from r that lie within the given time range inclusive.
+// If t.T0 or t.T1 are zero, the range is unbounded at that end.
+// The samples read from r must be ordered by time.
+func RangeSampleReader(r SampleReader, t TimeRange) SampleReader {
+	return &rangeReader{
+		r: r,
+		t: t,
+	}
+}
+
+type rangeReader struct {
+	r SampleReader
+	t TimeRange
+}
+
+func (r *rangeReader) ReadSample() (Sample, error) {
+	for {
+		s, err := r.r.ReadSample()
+		if err != nil {
+			return Sample{}, err
+		}
+		if !r.t.T0.IsZero() && s.Time.Before(r.t.T0) {
+			continue
+		}
+		if !r.t.T1.IsZero() && s.Time.After(r.t.T1) {
+			// All subsequent samples will be out of range too.
+			return Sample{}, io.EOF
+		}
+		return s, nil
+	}
+}
+
+// RolloverSampleReader returns a SampleReader that returns samples
+// from r, compensating for a meter's energy counter wrapping back
+// to zero after reaching max. When the energy drops by more than
+// half of max from one sample to the next, it's treated as a rollover,
+// and max is added to that and all subsequent samples. Smaller drops
+// are assumed to be genuine resets, and those samples are returned
+// unchanged, so they'll be discarded by MultiSampleReader as usual.
+func RolloverSampleReader(r SampleReader, max float64) SampleReader {
+	return &rolloverReader{
+		r:   r,
+		max: max,
+	}
+}
+
+type rolloverReader struct {
+	r   SampleReader
+	max float64
+	// prev holds the energy reading from the previous sample
+	// as read from r.
+	prev float64
+	// offset holds the amount to add to the energy readings.
+	offset  float64
+	started bool
+}
+
+func (r *rolloverReader) ReadSample() (Sample, error) {
+	s, err := r.r.ReadSample()
+	if err != nil {
+		return Sample{}, err
+	}
+	if r.started && r.prev-s.TotalEnergy > r.max/2 {
+		r.offset += r.max
+	}
+	r.prev = s.TotalEnergy
+	r.started = true
+	s.TotalEnergy += r.offset
+	return s, nil
+}
+
+// NewRegularReader returns a SampleReader that returns a sample at
+// each multiple of the given interval (relative to the zero time) that lies
+// within the range of the samples read from r. The energy of each
+// sample is interpolated linearly from the samples either side of it;
+// when a sample from r falls exactly on an interval boundary,
+// its energy is used unchanged. No samples are returned
+// after the last sample read from r.
+//
+// The samples read from r must be ordered by time.
+func NewRegularReader(r SampleReader, interval time.Duration) SampleReader {
+	return &regularReader{
+		r:        r,
+		interval: interval,
+	}
+}
+
+type regularReader struct {
+	r        SampleReader
+	interval time.Duration
+	// s0 and s1 hold the samples either side of t.
+	s0, s1 Sample
+	// t holds the time of the next sample to return.
+	t       time.Time
+	started bool
+}
+
+func (r *regularReader) ReadSample() (Sample, error) {
+	if !r.started {
+		s, err := r.r.ReadSample()
+		if err != nil {
+			return Sample{}, err
+		}
+		r.s0, r.s1 = s, s
+		r.t = s.Time.Truncate(r.interval)
+		if r.t.Before(s.Time) {
+			r.t = r.t.Add(r.interval)
+		}
+		r.started = true
+	}
+	for r.s1.Time.Before(r.t) {
+		s, err := r.r.ReadSample()
+		if err != nil {
+			return Sample{}, err
+		}
+		r.s0, r.s1 = r.s1, s
+	}
+	energy := r.s1.TotalEnergy
+	if d := r.s1.Time.Sub(r.s0.Time); d > 0 {
+		frac := float64(r.t.Sub(r.s0.Time)) / float64(d)
+		energy = r.s0.TotalEnergy + frac*(r.s1.TotalEnergy-r.s0.TotalEnergy)
+	}
+	s := Sample{
+		Time:        r.t,
+		TotalEnergy: energy,
+	}
+	r.t = r.t.Add(r.interval)
+	return s, nil
+}
+
 // NewSampleReader returns a SampleReader that reads samples from
 // a textual sample file. Each line consists of three comma-separated fields:
 // 	timestamp of sample (in milliseconds since the unix epoch)
@@ -178,7 +383,16 @@ func (r *fileSampleReader) ReadSample() (Sample, error) {
 
 // WriteSamples reads all the samples from r and writes them to w
 // in the format understood by NewSampleReader.
+// Energy values are written without loss of precision.
 func WriteSamples(w io.Writer, r SampleReader) (int, error) {
+	return WriteSamplesWithPrecision(w, r, -1)
+}
+
+// WriteSamplesWithPrecision is like WriteSamples except that
+// energy values are written with the given number of digits
+// after the decimal point. A negative precision writes the
+// smallest number of digits needed to represent each value exactly.
+func WriteSamplesWithPrecision(w io.Writer, r SampleReader, prec int) (int, error) {
 	for n := 0; ; n++ {
 		s, err := r.ReadSample()
 		if err != nil {
@@ -187,15 +401,24 @@ func WriteSamples(w io.Writer, r SampleReader) (int, error) {
 			}
 			return n, fmt.Errorf("error reading sample: %v", err)
 		}
-		if err := WriteSample(w, s); err != nil {
+		if err := WriteSampleWithPrecision(w, s, prec); err != nil {
 			return n, fmt.Errorf("error writing sample: %v", err)
 		}
 	}
 }
 
 // WriteSample writes a single sample to w in the format understood by NewSampleReader.
+// The energy value is written without loss of precision.
 func WriteSample(w io.Writer, s Sample) error {
-	_, err := fmt.Fprintf(w, "%d,%.0f\n", s.Time.UnixNano()/1e6, s.TotalEnergy)
+	return WriteSampleWithPrecision(w, s, -1)
+}
+
+// WriteSampleWithPrecision is like WriteSample except that the energy
+// value is written with the given number of digits after the decimal point.
+// A negative precision writes the smallest number of digits needed
+// to represent the value exactly.
+func WriteSampleWithPrecision(w io.Writer, s Sample, prec int) error {
+	_, err := fmt.Fprintf(w, "%d,%s\n", s.Time.UnixNano()/1e6, strconv.FormatFloat(s.TotalEnergy, 'f', prec, 64))
 	return err
 }
 
@@ -2,6 +2,7 @@ package meterstat
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"path/filepath"
@@ -51,6 +52,35 @@ func TestWriteSamples(t *testing.T) {
 	c.Assert(n, qt.Equals, 3)
 }
 
+func TestWriteSamplesFractionalEnergy(t *testing.T) {
+	c := qt.New(t)
+	samples := []Sample{{
+		Time:        epoch,
+		TotalEnergy: 1000.25,
+	}, {
+		Time:        epoch.Add(time.Second),
+		TotalEnergy: 1000.7,
+	}, {
+		Time:        epoch.Add(2 * time.Second),
+		TotalEnergy: 1003,
+	}}
+	var buf bytes.Buffer
+	_, err := WriteSamples(&buf, NewMemSampleReader(samples))
+	c.Assert(err, qt.IsNil)
+	got, err := ReadAllSamples(NewSampleReader(&buf))
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, samples)
+
+	buf.Reset()
+	_, err = WriteSamplesWithPrecision(&buf, NewMemSampleReader(samples), 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `
+946814400000,1000.2
+946814401000,1000.7
+946814402000,1003.0
+`[1:])
+}
+
 func TestMultiReader(t *testing.T) {
 	c := qt.New(t)
 	r0 := NewSampleReader(strings.NewReader(`
@@ -102,6 +132,252 @@ func TestMultiReader(t *testing.T) {
 	}})
 }
 
+func TestValidatingSampleReader(t *testing.T) {
+	c := qt.New(t)
+	at := func(secs int, energy float64) Sample {
+		return Sample{
+			Time:        epoch.Add(time.Duration(secs) * time.Second),
+			TotalEnergy: energy,
+		}
+	}
+	r := NewMemSampleReader([]Sample{
+		at(0, 1000),
+		at(10, 1010),
+		// The meter's clock was reset backwards by an hour.
+		at(20-3600, 1020),
+		at(30-3600, 1030),
+		at(20, 1040),
+		// A duplicate sample is discarded silently.
+		at(20, 1040),
+		// The energy goes backwards.
+		at(30, 900),
+		at(40, 1050),
+	})
+	var regressions []Regression
+	samples, err := ReadAllSamples(ValidatingSampleReader(r, func(r Regression) {
+		regressions = append(regressions, r)
+	}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(samples, qt.DeepEquals, []Sample{
+		at(0, 1000),
+		at(10, 1010),
+		at(20, 1040),
+		at(40, 1050),
+	})
+	c.Assert(regressions, qt.DeepEquals, []Regression{{
+		Prev:   at(10, 1010),
+		Sample: at(20-3600, 1020),
+	}, {
+		Prev:   at(10, 1010),
+		Sample: at(30-3600, 1030),
+	}, {
+		Prev:   at(20, 1040),
+		Sample: at(30, 900),
+	}})
+	c.Assert(regressions[0].TimeJump(), qt.Equals, 3590*time.Second)
+	c.Assert(regressions[0].EnergyJump(), qt.Equals, 0.0)
+	c.Assert(regressions[2].TimeJump(), qt.Equals, time.Duration(0))
+	c.Assert(regressions[2].EnergyJump(), qt.Equals, 140.0)
+}
+
+var rangeSampleReaderTests = []struct {
+	testName string
+	t        TimeRange
+	expect   []int
+}{{
+	testName: "all",
+	expect:   []int{0, 10, 20, 30},
+}, {
+	testName: "inclusive",
+	t:        TimeRange{epoch.Add(10 * time.Second), epoch.Add(20 * time.Second)},
+	expect:   []int{10, 20},
+}, {
+	testName: "between-samples",
+	t:        TimeRange{epoch.Add(5 * time.Second), epoch.Add(25 * time.Second)},
+	expect:   []int{10, 20},
+}, {
+	testName: "open-start",
+	t:        TimeRange{T1: epoch.Add(15 * time.Second)},
+	expect:   []int{0, 10},
+}, {
+	testName: "open-end",
+	t:        TimeRange{T0: epoch.Add(15 * time.Second)},
+	expect:   []int{20, 30},
+}, {
+	testName: "empty",
+	t:        TimeRange{epoch.Add(1 * time.Second), epoch.Add(2 * time.Second)},
+}}
+
+func TestRangeSampleReader(t *testing.T) {
+	c := qt.New(t)
+	var all []Sample
+	for i := 0; i < 4; i++ {
+		all = append(all, Sample{
+			Time:        epoch.Add(time.Duration(i*10) * time.Second),
+			TotalEnergy: float64(1000 + i),
+		})
+	}
+	for _, test := range rangeSampleReaderTests {
+		c.Run(test.testName, func(c *qt.C) {
+			samples, err := ReadAllSamples(RangeSampleReader(NewMemSampleReader(all), test.t))
+			c.Assert(err, qt.IsNil)
+			var expect []Sample
+			for _, secs := range test.expect {
+				expect = append(expect, all[secs/10])
+			}
+			c.Assert(samples, qt.DeepEquals, expect)
+		})
+	}
+}
+
+var rolloverSampleReaderTests = []struct {
+	testName string
+	energies []float64
+	expect   []float64
+}{{
+	testName: "no-rollover",
+	energies: []float64{100, 200, 300},
+	expect:   []float64{100, 200, 300},
+}, {
+	testName: "rollover",
+	energies: []float64{9800, 9950, 50, 200},
+	expect:   []float64{9800, 9950, 10050, 10200},
+}, {
+	testName: "reset",
+	energies: []float64{3000, 3100, 0, 100},
+	expect:   []float64{3000, 3100, 0, 100},
+}, {
+	testName: "multiple-rollovers",
+	energies: []float64{9000, 1000, 9000, 500},
+	expect:   []float64{9000, 11000, 19000, 20500},
+}, {
+	testName: "reset-after-rollover",
+	energies: []float64{9900, 100, 300, 10},
+	expect:   []float64{9900, 10100, 10300, 10010},
+}}
+
+func TestRolloverSampleReader(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range rolloverSampleReaderTests {
+		c.Run(test.testName, func(c *qt.C) {
+			var samples []Sample
+			for i, e := range test.energies {
+				samples = append(samples, Sample{
+					Time:        epoch.Add(time.Duration(i) * time.Second),
+					TotalEnergy: e,
+				})
+			}
+			got, err := ReadAllSamples(RolloverSampleReader(NewMemSampleReader(samples), 10000))
+			c.Assert(err, qt.IsNil)
+			var energies []float64
+			for _, s := range got {
+				energies = append(energies, s.TotalEnergy)
+			}
+			c.Assert(energies, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+var regularReaderTests = []struct {
+	testName string
+	samples  []Sample
+	interval time.Duration
+	expect   []Sample
+}{{
+	testName: "empty",
+	interval: 10 * time.Second,
+}, {
+	testName: "single-sample-on-boundary",
+	samples: []Sample{{
+		Time:        epoch,
+		TotalEnergy: 1000,
+	}},
+	interval: 10 * time.Second,
+	expect: []Sample{{
+		Time:        epoch,
+		TotalEnergy: 1000,
+	}},
+}, {
+	testName: "single-sample-off-boundary",
+	samples: []Sample{{
+		Time:        epoch.Add(time.Second),
+		TotalEnergy: 1000,
+	}},
+	interval: 10 * time.Second,
+}, {
+	testName: "irregular",
+	samples: []Sample{{
+		Time:        epoch.Add(5 * time.Second),
+		TotalEnergy: 1000,
+	}, {
+		Time:        epoch.Add(15 * time.Second),
+		TotalEnergy: 1100,
+	}, {
+		Time:        epoch.Add(20 * time.Second),
+		TotalEnergy: 1200,
+	}, {
+		Time:        epoch.Add(21 * time.Second),
+		TotalEnergy: 1210,
+	}, {
+		Time:        epoch.Add(50 * time.Second),
+		TotalEnergy: 1500,
+	}, {
+		Time:        epoch.Add(55 * time.Second),
+		TotalEnergy: 1600,
+	}},
+	interval: 10 * time.Second,
+	expect: []Sample{{
+		Time:        epoch.Add(10 * time.Second),
+		TotalEnergy: 1050,
+	}, {
+		Time:        epoch.Add(20 * time.Second),
+		TotalEnergy: 1200,
+	}, {
+		Time:        epoch.Add(30 * time.Second),
+		TotalEnergy: 1300,
+	}, {
+		Time:        epoch.Add(40 * time.Second),
+		TotalEnergy: 1400,
+	}, {
+		Time:        epoch.Add(50 * time.Second),
+		TotalEnergy: 1500,
+	}},
+}, {
+	testName: "constant-energy",
+	samples: []Sample{{
+		Time:        epoch,
+		TotalEnergy: 1000,
+	}, {
+		Time:        epoch.Add(time.Minute),
+		TotalEnergy: 1000,
+	}},
+	interval: 20 * time.Second,
+	expect: []Sample{{
+		Time:        epoch,
+		TotalEnergy: 1000,
+	}, {
+		Time:        epoch.Add(20 * time.Second),
+		TotalEnergy: 1000,
+	}, {
+		Time:        epoch.Add(40 * time.Second),
+		TotalEnergy: 1000,
+	}, {
+		Time:        epoch.Add(60 * time.Second),
+		TotalEnergy: 1000,
+	}},
+}}
+
+func TestRegularReader(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range regularReaderTests {
+		c.Run(test.testName, func(c *qt.C) {
+			samples, err := ReadAllSamples(NewRegularReader(NewMemSampleReader(test.samples), test.interval))
+			c.Assert(err, qt.IsNil)
+			c.Assert(samples, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
 func TestSampleFile(t *testing.T) {
 	c := qt.New(t)
 
@@ -224,3 +500,123 @@ func TestSampleFileRangeIncompleteLastLine(t *testing.T) {
 	c.Assert(info.FirstSample().Time, qt.DeepEquals, epoch)
 	c.Assert(info.LastSample().Time, qt.DeepEquals, epoch.Add(10*time.Second))
 }
+
+var sampleFileRangeTrailingDataTests = []struct {
+	testName   string
+	data       string
+	expectLast time.Time
+}{{
+	testName: "partial-line-with-only-timestamp",
+	data: `
+946814400000,1000
+946814410000,12345
+946814420000`[1:],
+	expectLast: epoch.Add(10 * time.Second),
+}, {
+	testName: "complete-line-with-only-timestamp",
+	data: `
+946814400000,1000
+946814410000,12345
+946814420000
+`[1:],
+	expectLast: epoch.Add(10 * time.Second),
+}, {
+	testName: "trailing-newlines",
+	data: `
+946814400000,1000
+946814410000,12345
+
+
+`[1:],
+	expectLast: epoch.Add(10 * time.Second),
+}, {
+	testName:   "trailing-whitespace",
+	data:       "946814400000,1000\n946814410000,12345  \n \t\n",
+	expectLast: epoch.Add(10 * time.Second),
+}, {
+	testName: "trailing-garbage",
+	data: `
+946814400000,1000
+946814410000,12345
+xxx
+946814420000,
+`[1:],
+	expectLast: epoch.Add(10 * time.Second),
+}, {
+	testName:   "single-sample",
+	data:       "946814400000,1000\n946814410000",
+	expectLast: epoch,
+}, {
+	testName:   "trailing-data-longer-than-read-size",
+	data:       "946814400000,1000\n946814410000,12345\n" + strings.Repeat("\n", 2000),
+	expectLast: epoch.Add(10 * time.Second),
+}}
+
+func TestSampleFileRangeTrailingData(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range sampleFileRangeTrailingDataTests {
+		c.Run(test.testName, func(c *qt.C) {
+			path := filepath.Join(c.Mkdir(), "samples")
+			err := ioutil.WriteFile(path, []byte(test.data), 0666)
+			c.Assert(err, qt.IsNil)
+			info, err := SampleFileInfo(path)
+			c.Assert(err, qt.IsNil)
+			c.Assert(info.FirstSample().Time, qt.DeepEquals, epoch)
+			c.Assert(info.LastSample().Time, qt.DeepEquals, test.expectLast)
+		})
+	}
+}
+
+func TestSampleFileOpenAt(t *testing.T) {
+	c := qt.New(t)
+	// Make a file that's big enough that seeking is
+	// worthwhile, with irregular times and line lengths.
+	var samples []Sample
+	now := epoch
+	energy := 1.0
+	for i := 0; i < 5000; i++ {
+		samples = append(samples, Sample{
+			Time:        now,
+			TotalEnergy: energy,
+		})
+		now = now.Add(time.Duration(1+i%7) * time.Second)
+		energy += float64(i % 13)
+	}
+	var buf bytes.Buffer
+	_, err := WriteSamples(&buf, NewMemSampleReader(samples))
+	c.Assert(err, qt.IsNil)
+	path := filepath.Join(t.TempDir(), "samples")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+	c.Assert(err, qt.IsNil)
+	info, err := SampleFileInfo(path)
+	c.Assert(err, qt.IsNil)
+
+	last := samples[len(samples)-1].Time
+	times := []time.Time{
+		{},
+		epoch.Add(-time.Hour),
+		epoch,
+		epoch.Add(time.Millisecond),
+		last.Add(-time.Millisecond),
+		last,
+		last.Add(time.Hour),
+	}
+	for i := 0; i < len(samples); i += 499 {
+		times = append(times, samples[i].Time, samples[i].Time.Add(-time.Millisecond), samples[i].Time.Add(time.Millisecond))
+	}
+	for _, t := range times {
+		c.Run(fmt.Sprint(t), func(c *qt.C) {
+			// The naive approach: read all the samples
+			// and skip the ones we don't need.
+			expect := samples
+			for len(expect) > 1 && !expect[1].Time.After(t) {
+				expect = expect[1:]
+			}
+			r := info.OpenAt(t)
+			defer r.Close()
+			got, err := ReadAllSamples(r)
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, expect)
+		})
+	}
+}
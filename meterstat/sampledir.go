@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 )
 
@@ -17,6 +18,18 @@ var ErrNoSamples = fmt.Errorf("no samples found")
 // or the directory doesn't exist.
 // If pattern is empty, "*" is assumed.
 func ReadSampleDir(dir string, pattern string) (*MeterSampleDir, error) {
+	return ReadSampleDirRange(dir, pattern, TimeRange{})
+}
+
+// ReadSampleDirRange is like ReadSampleDir except that files with a date
+// in their name (in 2006-01-02 format, as created by the logworker package)
+// are skipped without being opened when they can't hold samples within
+// the given time range. A zero T0 or T1 in the range is taken to be
+// unbounded. Files without a date in their name are always read.
+//
+// The Range of the returned MeterSampleDir only covers
+// the files that were read.
+func ReadSampleDirRange(dir string, pattern string, t TimeRange) (*MeterSampleDir, error) {
 	if pattern == "" {
 		pattern = "*"
 	}
@@ -35,7 +48,7 @@ func ReadSampleDir(dir string, pattern string) (*MeterSampleDir, error) {
 			continue
 		}
 		match, _ := filepath.Match(pattern, info.Name())
-		if !match {
+		if !match || !nameMayOverlap(info.Name(), t) {
 			continue
 		}
 		path := filepath.Join(dir, info.Name())
@@ -57,21 +70,52 @@ func ReadSampleDir(dir string, pattern string) (*MeterSampleDir, error) {
 		return nil, ErrNoSamples
 	}
 	return &MeterSampleDir{
+		Dir:   dir,
 		Files: files,
 		Range: TimeRange{t0, t1},
 	}, nil
 }
 
+// fileDatePat matches the date in a sample file name.
+var fileDatePat = regexp.MustCompile(`[0-9]{4}-[0-9]{2}-[0-9]{2}`)
+
+// nameMayOverlap reports whether a sample file with the given
+// name might hold samples within t, judging by the date in its name.
+func nameMayOverlap(name string, t TimeRange) bool {
+	d, err := time.Parse("2006-01-02", fileDatePat.FindString(name))
+	if err != nil {
+		// No valid date in the name.
+		return true
+	}
+	// We don't know the time zone that the date is in, and the
+	// file might hold some samples from either side of it, so
+	// allow a day's leeway in each direction.
+	fileRange := TimeRange{
+		T0: d.Add(-24 * time.Hour),
+		T1: d.Add(2 * 24 * time.Hour),
+	}
+	if !t.T0.IsZero() && fileRange.T1.Before(t.T0) {
+		return false
+	}
+	if !t.T1.IsZero() && fileRange.T0.After(t.T1) {
+		return false
+	}
+	return true
+}
+
 // MeterSampleDir represents a set of sample files in a directory.
 type MeterSampleDir struct {
+	// Dir holds the directory that the sample files were read from.
+	Dir string
 	// Files holds an entry for each sample file in the directory.
 	Files []*FileInfo
 	// Range holds the time range of samples found in the directory.
 	Range TimeRange
 }
 
-// OpenRange is like Open but includes only samples from files that are needed
+// OpenRange is like Open but includes only samples that are needed
 // to determine energy values within the specifid time range inclusive.
+// Samples well before t.T0 are skipped without being read (see FileInfo.OpenAt).
 // If t.T0 or t.T1 are zero, d.T0 and d.T1 are used respectively.
 func (d *MeterSampleDir) OpenRange(t TimeRange) SampleReadCloser {
 	if t.T0.IsZero() {
@@ -83,7 +127,7 @@ func (d *MeterSampleDir) OpenRange(t TimeRange) SampleReadCloser {
 	files := relevantFiles(d.Files, t)
 	rs := make([]SampleReader, len(files))
 	for i, f := range files {
-		rs[i] = f.Open()
+		rs[i] = f.OpenAt(t.T0)
 	}
 	return &sampleDirReader{
 		files: rs,
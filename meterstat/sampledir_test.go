@@ -0,0 +1,114 @@
+package meterstat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var readSampleDirRangeTests = []struct {
+	testName    string
+	t           TimeRange
+	expectFiles []string
+}{{
+	testName: "all",
+	expectFiles: []string{
+		"log-2000-01-01.sample",
+		"log-2000-01-02.sample",
+		"log-2000-01-03.sample",
+		"log-2000-01-04.sample",
+		"log-2000-01-05.sample",
+		"log-2000-01-06.sample",
+		"log-2000-01-07.sample",
+		"log-2000-01-08.sample",
+		"log-2000-01-09.sample",
+		"log-2000-01-10.sample",
+		"manual.sample",
+	},
+}, {
+	testName: "one-day",
+	t: TimeRange{
+		T0: time.Date(2000, 1, 5, 0, 0, 0, 0, time.UTC),
+		T1: time.Date(2000, 1, 6, 0, 0, 0, 0, time.UTC),
+	},
+	expectFiles: []string{
+		"log-2000-01-03.sample",
+		"log-2000-01-04.sample",
+		"log-2000-01-05.sample",
+		"log-2000-01-06.sample",
+		"log-2000-01-07.sample",
+		"manual.sample",
+	},
+}, {
+	testName: "from-only",
+	t: TimeRange{
+		T0: time.Date(2000, 1, 8, 0, 0, 0, 0, time.UTC),
+	},
+	expectFiles: []string{
+		"log-2000-01-06.sample",
+		"log-2000-01-07.sample",
+		"log-2000-01-08.sample",
+		"log-2000-01-09.sample",
+		"log-2000-01-10.sample",
+		"manual.sample",
+	},
+}, {
+	testName: "to-only",
+	t: TimeRange{
+		T1: time.Date(2000, 1, 2, 12, 0, 0, 0, time.UTC),
+	},
+	expectFiles: []string{
+		"log-2000-01-01.sample",
+		"log-2000-01-02.sample",
+		"log-2000-01-03.sample",
+		"manual.sample",
+	},
+}}
+
+func TestReadSampleDirRange(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	for day := 1; day <= 10; day++ {
+		t0 := time.Date(2000, 1, day, 12, 0, 0, 0, time.UTC)
+		name := fmt.Sprintf("log-%s.sample", t0.Format("2006-01-02"))
+		writeSamples(c, filepath.Join(dir, name), t0)
+	}
+	writeSamples(c, filepath.Join(dir, "manual.sample"), time.Date(2000, 1, 5, 12, 0, 0, 0, time.UTC))
+
+	for _, test := range readSampleDirRangeTests {
+		c.Run(test.testName, func(c *qt.C) {
+			sd, err := ReadSampleDirRange(dir, "*.sample", test.t)
+			c.Assert(err, qt.IsNil)
+			c.Assert(sd.Dir, qt.Equals, dir)
+			var names []string
+			for _, f := range sd.Files {
+				names = append(names, filepath.Base(f.Path()))
+			}
+			sort.Strings(names)
+			c.Assert(names, qt.DeepEquals, test.expectFiles)
+		})
+	}
+}
+
+func TestReadSampleDirRangeNoFiles(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	writeSamples(c, filepath.Join(dir, "log-2000-01-01.sample"), time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC))
+	_, err := ReadSampleDirRange(dir, "*.sample", TimeRange{
+		T0: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	c.Assert(err, qt.Equals, ErrNoSamples)
+}
+
+// writeSamples writes a sample file to the given path holding
+// two samples an hour apart starting at t0.
+func writeSamples(c *qt.C, path string, t0 time.Time) {
+	data := fmt.Sprintf("%d,1000\n%d,2000\n", t0.Unix()*1000, t0.Add(time.Hour).Unix()*1000)
+	err := ioutil.WriteFile(path, []byte(data), 0666)
+	c.Assert(err, qt.IsNil)
+}
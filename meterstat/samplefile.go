@@ -1,11 +1,13 @@
 package meterstat
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 // OpenSampleFile is a convenient shortcut for SampleFileInfo(path).Open.
@@ -39,11 +41,11 @@ func SampleFileInfo(path string) (*FileInfo, error) {
 	}
 	if err == nil && s0.Time.IsZero() {
 		// A valid sample should never have the zero time.
-		return nil, fmt.Errorf("sample has zero time")
+		return nil, fmt.Errorf("first sample in %q has zero time", path)
 	}
 	s1, err := readLastSample(f)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot read last sample from %q: %v", path, err)
 	}
 	return &FileInfo{
 		path:        path,
@@ -88,8 +90,21 @@ func (info *FileInfo) LastSample() Sample {
 // opened until ReadSample is called for the second time - the
 // sample already read is used to satisfy the first read.
 func (info *FileInfo) Open() SampleReadCloser {
+	return info.OpenAt(time.Time{})
+}
+
+// OpenAt is like Open except that the first sample returned
+// will be the last sample in the file that's not after t, or the first
+// sample in the file if there is no such sample.
+//
+// Rather than reading all the samples before t, it searches
+// through the file to find the starting point, so it's
+// considerably more efficient than Open when t is well
+// after the start of the file.
+func (info *FileInfo) OpenAt(t time.Time) SampleReadCloser {
 	return &sampleFile{
-		info: info,
+		info:  info,
+		start: t,
 	}
 }
 
@@ -98,6 +113,7 @@ type sampleFile struct {
 	doneFirst bool
 	closed    bool
 	info      *FileInfo
+	start     time.Time
 	r         SampleReader
 	f         *os.File
 }
@@ -112,6 +128,9 @@ func (sf *sampleFile) ReadSample() (Sample, error) {
 		if sf.info.firstSample.Time.IsZero() {
 			return Sample{}, io.EOF
 		}
+		if sf.start.After(sf.info.firstSample.Time) {
+			return sf.seek()
+		}
 		return sf.info.firstSample, nil
 	}
 	if sf.r == nil {
@@ -144,6 +163,132 @@ func (sf *sampleFile) ReadSample() (Sample, error) {
 	return Sample{}, fmt.Errorf("cannot read sample from %q: %v", sf.info.path, err)
 }
 
+// seek opens the sample file and returns the last sample
+// that's not after sf.start, leaving sf.r positioned to read
+// the samples after that.
+func (sf *sampleFile) seek() (Sample, error) {
+	f, err := os.Open(sf.info.path)
+	if err != nil {
+		return Sample{}, err
+	}
+	sf.f = f
+	off, err := seekSample(f, sf.start)
+	if err != nil {
+		return Sample{}, fmt.Errorf("cannot seek in %q: %v", sf.info.path, err)
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return Sample{}, fmt.Errorf("cannot seek in %q: %v", sf.info.path, err)
+	}
+	r := NewSampleReader(f)
+	s0, err := r.ReadSample()
+	if err != nil {
+		return Sample{}, fmt.Errorf("cannot read sample from %q: %v", sf.info.path, err)
+	}
+	// The search only gets us close to the start time,
+	// so read forward to find the exact sample.
+	for {
+		s1, err := r.ReadSample()
+		if err != nil {
+			if err != io.EOF {
+				return Sample{}, fmt.Errorf("cannot read sample from %q: %v", sf.info.path, err)
+			}
+			sf.r = r
+			return s0, nil
+		}
+		if s1.Time.After(sf.start) {
+			sf.r = &pushbackReader{
+				s: s1,
+				r: r,
+			}
+			return s0, nil
+		}
+		s0 = s1
+	}
+}
+
+// seekThreshold holds the size of file region below which
+// seekSample stops searching and leaves the rest to be
+// read sequentially.
+const seekThreshold = 4096
+
+// seekSample returns the offset of a line in f that holds a
+// sample not after t and is close to the last such line.
+// The first line in the file must hold a sample not after t.
+//
+// It uses a binary search on the file contents, relying on
+// the fact that samples are ordered by time.
+func seekSample(f *os.File, t time.Time) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Invariant: there's a line starting at lo that holds
+	// a sample not after t, and there are no such lines
+	// starting at or after hi.
+	lo, hi := int64(0), info.Size()
+	br := bufio.NewReader(f)
+	for hi-lo > seekThreshold {
+		mid := lo + (hi-lo)/2
+		p, s, ok, err := sampleAfter(f, br, mid)
+		if err != nil {
+			return 0, err
+		}
+		if !ok || p >= hi || s.Time.After(t) {
+			hi = mid
+		} else {
+			lo = p
+		}
+	}
+	return lo, nil
+}
+
+// sampleAfter reads the first complete line starting at or after
+// the given offset in f and returns its offset and the sample it holds.
+// It reports whether there was such a line.
+func sampleAfter(f *os.File, br *bufio.Reader, off int64) (int64, Sample, bool, error) {
+	if _, err := f.Seek(off-1, io.SeekStart); err != nil {
+		return 0, Sample{}, false, err
+	}
+	br.Reset(f)
+	// Skip the remains of the line that we've landed in the middle of.
+	skip, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return 0, Sample{}, false, nil
+		}
+		return 0, Sample{}, false, err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			// No complete line found.
+			return 0, Sample{}, false, nil
+		}
+		return 0, Sample{}, false, err
+	}
+	s, err := NewSampleReader(strings.NewReader(line)).ReadSample()
+	if err != nil {
+		return 0, Sample{}, false, err
+	}
+	return off - 1 + int64(len(skip)), s, true, nil
+}
+
+// pushbackReader returns s and then
+// all the samples read from r.
+type pushbackReader struct {
+	done bool
+	s    Sample
+	r    SampleReader
+}
+
+func (r *pushbackReader) ReadSample() (Sample, error) {
+	if !r.done {
+		r.done = true
+		return r.s, nil
+	}
+	return r.r.ReadSample()
+}
+
 // Close implements SampleReadCloser.Close.
 func (sf *sampleFile) Close() error {
 	var err error
@@ -156,45 +301,60 @@ func (sf *sampleFile) Close() error {
 	return err
 }
 
-// readLastSample returns the last sample in the file.
+// readLastSample returns the last valid sample in the file.
+// Any final line without a terminating newline is ignored because
+// it might have been only partially written, as are blank or
+// otherwise invalid lines.
 func readLastSample(f *os.File) (Sample, error) {
 	info, err := f.Stat()
 	if err != nil {
 		return Sample{}, fmt.Errorf("cannot get file info: %v", err)
 	}
-	// Read the last part of the file to find the final line.
-	const maxLineLen = 50 // overkill - it's just an int and a float.
-	if info.Size() > maxLineLen {
-		_, err := f.Seek(-maxLineLen, io.SeekEnd)
-		if err != nil {
-			return Sample{}, fmt.Errorf("cannot seek to end of file: %v", err)
+	// Read progressively larger parts from the end of the file
+	// until we find a valid line. Usually the first part
+	// will be more than enough.
+	for n := int64(512); ; n *= 2 {
+		off := info.Size() - n
+		if off < 0 {
+			off = 0
 		}
-	} else {
-		_, err := f.Seek(0, io.SeekStart)
-		if err != nil {
-			return Sample{}, fmt.Errorf("cannot seek to start of file: %v", err)
+		data := make([]byte, info.Size()-off)
+		if _, err := f.ReadAt(data, off); err != nil {
+			return Sample{}, fmt.Errorf("cannot read last part of sample file: %v", err)
+		}
+		if s, ok := lastValidSample(data, off == 0); ok {
+			return s, nil
+		}
+		if off == 0 {
+			return Sample{}, fmt.Errorf("cannot read final sample: no valid sample found")
 		}
 	}
-	data, err := ioutil.ReadAll(f)
-	if err != nil {
-		return Sample{}, fmt.Errorf("cannot read last part of sample file: %v", err)
-	}
-	i := bytes.LastIndexByte(data, '\n')
-	if i != -1 && i < len(data)-1 {
-		// The file doesn't end with a newline, so it probably ends with an invalid record,
-		// so ignore it.
-		data = data[0 : i+1]
-	}
-	i = bytes.LastIndexByte(data[0:len(data)-1], '\n')
-	if i >= 0 {
-		data = data[i+1:]
-	}
-	r := NewSampleReader(bytes.NewReader(data))
-	s, err := r.ReadSample()
-	if err != nil {
-		return Sample{}, fmt.Errorf("cannot read final sample: %v", err)
+}
+
+// lastValidSample returns the last valid sample in the complete
+// lines held in data and reports whether it found one.
+// If atStart is false, data might start part way through a line,
+// so the first line is ignored.
+func lastValidSample(data []byte, atStart bool) (Sample, bool) {
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	for len(data) > 0 {
+		// Strip the final newline.
+		data = data[:len(data)-1]
+		i := bytes.LastIndexByte(data, '\n')
+		if i == -1 && !atStart {
+			break
+		}
+		line := bytes.TrimSpace(data[i+1:])
+		data = data[:i+1]
+		if len(line) == 0 {
+			continue
+		}
+		s, err := NewSampleReader(bytes.NewReader(line)).ReadSample()
+		if err == nil {
+			return s, true
+		}
 	}
-	return s, nil
+	return Sample{}, false
 }
 
 type eofReader struct{}
@@ -0,0 +1,50 @@
+package meterworker
+
+import "sync"
+
+// stateRing holds a bounded number of the most
+// recently recorded meter states.
+type stateRing struct {
+	mu sync.Mutex
+	// states holds the recorded states. When it's full,
+	// the oldest state is at states[next].
+	states []*MeterState
+	// next holds the index of the next state to be overwritten.
+	next int
+	// full holds whether the states slice has been completely filled.
+	full bool
+}
+
+func newStateRing(size int) *stateRing {
+	return &stateRing{
+		states: make([]*MeterState, size),
+	}
+}
+
+// add adds a state to the ring, discarding the oldest
+// state if the ring is full.
+func (r *stateRing) add(s *MeterState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.states) == 0 {
+		return
+	}
+	r.states[r.next] = s
+	r.next++
+	if r.next == len(r.states) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// all returns all the states in the ring, oldest first.
+func (r *stateRing) all() []*MeterState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]*MeterState(nil), r.states[:r.next]...)
+	}
+	states := make([]*MeterState, 0, len(r.states))
+	states = append(states, r.states[r.next:]...)
+	return append(states, r.states[:r.next]...)
+}
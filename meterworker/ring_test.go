@@ -0,0 +1,65 @@
+package meterworker
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var stateRingTests = []struct {
+	testName string
+	size     int
+	add      int
+	expect   []int
+}{{
+	testName: "empty",
+	size:     3,
+	add:      0,
+	expect:   []int{},
+}, {
+	testName: "partially-full",
+	size:     3,
+	add:      2,
+	expect:   []int{0, 1},
+}, {
+	testName: "exactly-full",
+	size:     3,
+	add:      3,
+	expect:   []int{0, 1, 2},
+}, {
+	testName: "wrapped",
+	size:     3,
+	add:      5,
+	expect:   []int{2, 3, 4},
+}, {
+	testName: "wrapped-several-times",
+	size:     3,
+	add:      9,
+	expect:   []int{6, 7, 8},
+}, {
+	testName: "zero-size",
+	size:     0,
+	add:      4,
+	expect:   []int{},
+}}
+
+func TestStateRing(t *testing.T) {
+	c := qt.New(t)
+	epoch := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, test := range stateRingTests {
+		c.Run(test.testName, func(c *qt.C) {
+			r := newStateRing(test.size)
+			for i := 0; i < test.add; i++ {
+				r.add(&MeterState{
+					Time: epoch.Add(time.Duration(i) * time.Second),
+				})
+			}
+			got := []int{}
+			for _, s := range r.all() {
+				got = append(got, int(s.Time.Sub(epoch)/time.Second))
+			}
+			c.Assert(got, qt.DeepEquals, test.expect)
+		})
+	}
+}
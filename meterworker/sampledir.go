@@ -0,0 +1,165 @@
+package meterworker
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/hydro/ndmeter"
+)
+
+// macDiscoveryTimeout holds the maximum time we'll wait
+// for a meter to tell us its MAC address.
+const macDiscoveryTimeout = 5 * time.Second
+
+// ndmeterGetNetworkSettings is defined as a variable so that
+// it can be patched in tests.
+var ndmeterGetNetworkSettings = ndmeter.GetNetworkSettings
+
+// setMACs sets the MAC address of any meters that don't have one.
+// The MAC address is copied from the current meter with the same
+// address if there is one; otherwise, if Params.UseMACSampleDirs is
+// set, it's acquired from the meter itself.
+func (w *Worker) setMACs(meters []Meter) {
+	for i := range meters {
+		m := &meters[i]
+		if m.MAC != "" {
+			continue
+		}
+		for _, oldm := range w.meters {
+			if oldm.Addr == m.Addr {
+				m.MAC = oldm.MAC
+				break
+			}
+		}
+		if m.MAC == "" && w.p.UseMACSampleDirs && !m.Disabled {
+			w.discoverMAC(m)
+		}
+	}
+}
+
+// discoverMAC asks the meter for its MAC address and sets m.MAC
+// accordingly, moving any existing samples for the meter into
+// the new sample directory. If the MAC address can't be found,
+// m.MAC is left unchanged.
+func (w *Worker) discoverMAC(m *Meter) {
+	ctx, cancel := context.WithTimeout(w.ctx, macDiscoveryTimeout)
+	defer cancel()
+	ns, err := ndmeterGetNetworkSettings(ctx, m.Addr)
+	if err != nil {
+		log.Printf("cannot get MAC address of meter %q: %v", m.Addr, err)
+		return
+	}
+	if len(ns.MacAddress) == 0 {
+		log.Printf("meter %q did not report a MAC address", m.Addr)
+		return
+	}
+	m1 := *m
+	m1.MAC = ns.MacAddress.String()
+	if w.p.SampleDirPath != "" {
+		// Stop any sample worker that's writing to the old
+		// directory. It'll be restarted by ensureSampleWorkers.
+		if sw, ok := w.sampleWorkers[m.Addr]; ok {
+			sw.Close()
+			delete(w.sampleWorkers, m.Addr)
+		}
+		if err := migrateSampleDir(w.p.SampleDirPath, m.addrSampleDir(), m1.SampleDir()); err != nil {
+			log.Printf("cannot migrate samples for meter %q: %v", m.Addr, err)
+			return
+		}
+	}
+	*m = m1
+}
+
+// migrateMovedMeters moves the sample directory of any meter
+// in meters whose sample directory name differs from that of
+// the same meter in the current meters (for example because its
+// location has changed), so that its existing samples are kept.
+func (w *Worker) migrateMovedMeters(meters []Meter) {
+	if w.p.SampleDirPath == "" {
+		return
+	}
+	for _, m := range meters {
+		oldm, ok := w.currentMeter(m)
+		if !ok || oldm.SampleDir() == m.SampleDir() {
+			continue
+		}
+		// Stop the sample worker that's writing to the old
+		// directory. It'll be restarted by ensureSampleWorkers.
+		if sw, ok := w.sampleWorkers[oldm.Addr]; ok {
+			sw.Close()
+			delete(w.sampleWorkers, oldm.Addr)
+		}
+		if err := migrateSampleDir(w.p.SampleDirPath, oldm.SampleDir(), m.SampleDir()); err != nil {
+			log.Printf("cannot migrate samples for meter %q: %v", m.Addr, err)
+		}
+	}
+}
+
+// currentMeter returns the current meter that refers to the same
+// physical meter as m, matching by MAC address if known,
+// or by network address otherwise.
+func (w *Worker) currentMeter(m Meter) (Meter, bool) {
+	for _, oldm := range w.meters {
+		if m.MAC != "" && oldm.MAC != "" {
+			if m.MAC == oldm.MAC {
+				return oldm, true
+			}
+			continue
+		}
+		if m.Addr == oldm.Addr {
+			return oldm, true
+		}
+	}
+	return Meter{}, false
+}
+
+// migrateSampleDir moves all the sample files in the directory
+// named oldName within sampleDir to the directory named newName.
+// If the new directory already exists, the files are moved into
+// it, being renamed if necessary to avoid overwriting existing
+// files. It's not an error if the old directory doesn't exist.
+func migrateSampleDir(sampleDir, oldName, newName string) error {
+	oldDir := filepath.Join(sampleDir, oldName)
+	newDir := filepath.Join(sampleDir, newName)
+	if _, err := os.Stat(oldDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	if _, err := os.Stat(newDir); os.IsNotExist(err) {
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return errgo.Mask(err)
+		}
+		return nil
+	}
+	infos, err := ioutil.ReadDir(oldDir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, info := range infos {
+		name := info.Name()
+		newPath := filepath.Join(newDir, name)
+		if _, err := os.Stat(newPath); err == nil {
+			// Avoid overwriting the existing file. All sample files
+			// are read when gathering samples, so the name
+			// doesn't matter much.
+			ext := filepath.Ext(name)
+			newPath = filepath.Join(newDir, strings.TrimSuffix(name, ext)+"-"+oldName+ext)
+		}
+		if err := os.Rename(filepath.Join(oldDir, name), newPath); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := os.Remove(oldDir); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package meterworker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/ndmeter"
+)
+
+var sampleDirTests = []struct {
+	testName string
+	meter    Meter
+	expect   string
+}{{
+	testName: "addr",
+	meter: Meter{
+		Location: hydroreport.LocGenerator,
+		Addr:     "192.168.1.10:80",
+	},
+	expect: "generator-192.168.1.10·80",
+}, {
+	testName: "mac",
+	meter: Meter{
+		Location: hydroreport.LocNeighbour,
+		Addr:     "192.168.1.10:80",
+		MAC:      "00:1A:2b:3c:4d:5e",
+	},
+	expect: "neighbour-001a2b3c4d5e",
+}}
+
+func TestSampleDir(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range sampleDirTests {
+		c.Run(test.testName, func(c *qt.C) {
+			c.Assert(test.meter.SampleDir(), qt.Equals, test.expect)
+		})
+	}
+}
+
+var migrateSampleDirTests = []struct {
+	testName string
+	before   map[string]string
+	expect   map[string]string
+}{{
+	testName: "no-old-dir",
+	before: map[string]string{
+		"new/log.sample": "new log",
+	},
+	expect: map[string]string{
+		"new/log.sample": "new log",
+	},
+}, {
+	testName: "no-new-dir",
+	before: map[string]string{
+		"old/log.sample":    "old log",
+		"old/manual.sample": "old manual",
+	},
+	expect: map[string]string{
+		"new/log.sample":    "old log",
+		"new/manual.sample": "old manual",
+	},
+}, {
+	testName: "both-dirs",
+	before: map[string]string{
+		"old/log-1.sample":  "old log",
+		"old/manual.sample": "old manual",
+		"new/log-2.sample":  "new log",
+		"new/manual.sample": "new manual",
+	},
+	expect: map[string]string{
+		"new/log-1.sample":      "old log",
+		"new/log-2.sample":      "new log",
+		"new/manual.sample":     "new manual",
+		"new/manual-old.sample": "old manual",
+	},
+}}
+
+func TestMigrateSampleDir(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range migrateSampleDirTests {
+		c.Run(test.testName, func(c *qt.C) {
+			dir := c.Mkdir()
+			writeFiles(c, dir, test.before)
+			err := migrateSampleDir(dir, "old", "new")
+			c.Assert(err, qt.IsNil)
+			c.Assert(readFiles(c, dir), qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestSetMetersDiscoversMAC(t *testing.T) {
+	c := qt.New(t)
+	mac, err := net.ParseMAC("00:1a:2b:3c:4d:5e")
+	c.Assert(err, qt.IsNil)
+	c.Patch(&ndmeterGetNetworkSettings, func(ctx context.Context, host string) (ndmeter.NetworkSettings, error) {
+		return ndmeter.NetworkSettings{
+			MacAddress: mac,
+		}, nil
+	})
+	sampleDir := c.Mkdir()
+	// Samples have previously been stored under the meter's address.
+	writeFiles(c, sampleDir, map[string]string{
+		"generator-meter1·80/log.sample": "log",
+	})
+	sampleDirs := make(chan string, 10)
+	w, err := New(Params{
+		Updater:          funcUpdater{},
+		MeterConfigPath:  filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:    sampleDir,
+		UseMACSampleDirs: true,
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			sampleDirs <- p.SampleDir
+			return nopSampleWorker{}, nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	err = w.SetMeters([]Meter{{
+		Name:     "meter1",
+		Location: hydroreport.LocGenerator,
+		Addr:     "meter1:80",
+	}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(<-sampleDirs, qt.Equals, filepath.Join(sampleDir, "generator-001a2b3c4d5e"))
+	c.Assert(readFiles(c, sampleDir), qt.DeepEquals, map[string]string{
+		"generator-001a2b3c4d5e/log.sample": "log",
+	})
+
+	// The MAC address is retained when the meters are set again
+	// without it, so the sample worker isn't restarted.
+	c.Patch(&ndmeterGetNetworkSettings, func(ctx context.Context, host string) (ndmeter.NetworkSettings, error) {
+		c.Errorf("unexpected call to GetNetworkSettings")
+		return ndmeter.NetworkSettings{}, nil
+	})
+	err = w.SetMeters([]Meter{{
+		Name:     "meter1",
+		Location: hydroreport.LocGenerator,
+		Addr:     "meter1:80",
+	}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleDirs, qt.HasLen, 0)
+}
+
+type nopSampleWorker struct{}
+
+func (nopSampleWorker) Close() {}
+
+// writeFiles writes the given files, keyed by slash-separated
+// path relative to dir.
+func writeFiles(c *qt.C, dir string, files map[string]string) {
+	for path, content := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, qt.IsNil)
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+// readFiles returns all the files under dir in the same
+// form as that accepted by writeFiles.
+func readFiles(c *qt.C, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	return files
+}
+
+func TestSetMetersMigratesMovedMeter(t *testing.T) {
+	c := qt.New(t)
+	sampleDir := c.Mkdir()
+	sampleDirs := make(chan string, 10)
+	w, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   sampleDir,
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			sampleDirs <- p.SampleDir
+			return nopSampleWorker{}, nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	m := Meter{
+		Name:     "meter1",
+		Location: hydroreport.LocNeighbour,
+		Addr:     "meter1:80",
+	}
+	err = w.SetMeters([]Meter{m})
+	c.Assert(err, qt.IsNil)
+	c.Assert(<-sampleDirs, qt.Equals, filepath.Join(sampleDir, m.SampleDir()))
+	samples := []meterstat.Sample{{
+		Time:        time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		TotalEnergy: 1000,
+	}, {
+		Time:        time.Date(2020, 1, 2, 1, 0, 0, 0, time.UTC),
+		TotalEnergy: 2000,
+	}}
+	var buf bytes.Buffer
+	_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader(samples))
+	c.Assert(err, qt.IsNil)
+	writeFiles(c, sampleDir, map[string]string{
+		m.SampleDir() + "/log.sample": buf.String(),
+	})
+
+	// Move the meter and rename it.
+	m.Location = hydroreport.LocHere
+	m.Name = "meter one"
+	err = w.SetMeters([]Meter{m})
+	c.Assert(err, qt.IsNil)
+	// The sample worker is restarted to write to the new directory.
+	c.Assert(<-sampleDirs, qt.Equals, filepath.Join(sampleDir, "here-meter1·80"))
+
+	sd, err := meterstat.ReadSampleDir(filepath.Join(sampleDir, m.SampleDir()), "*.sample")
+	c.Assert(err, qt.IsNil)
+	r := sd.Open()
+	defer r.Close()
+	got, err := meterstat.ReadAllSamples(r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, samples)
+	_, err = os.Stat(filepath.Join(sampleDir, "neighbour-meter1·80"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestSampleDirMatchesSampleWorkerDir(t *testing.T) {
+	c := qt.New(t)
+	sampleDir := filepath.Join(c.Mkdir(), "samples")
+	workerDirs := make(chan string, 10)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   sampleDir,
+		TZ:              time.UTC,
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			// Write a sample file as a real sample worker would.
+			if err := os.MkdirAll(p.SampleDir, 0777); err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(filepath.Join(p.SampleDir, "x.sample"), nil, 0666); err != nil {
+				return nil, err
+			}
+			workerDirs <- p.SampleDir
+			return nopSampleWorker{}, nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	m := Meter{
+		Name:     "meter",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocHere,
+	}
+	err = mw.SetMeters([]Meter{m})
+	c.Assert(err, qt.IsNil)
+	c.Assert(<-workerDirs, qt.Equals, filepath.Join(sampleDir, m.SampleDir()))
+	infos, err := ioutil.ReadDir(sampleDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(infos, qt.HasLen, 1)
+	c.Assert(infos[0].Name(), qt.Equals, m.SampleDir())
+	_, err = os.Stat(filepath.Join(sampleDir, m.SampleDir(), "x.sample"))
+	c.Assert(err, qt.IsNil)
+}
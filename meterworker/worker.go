@@ -48,8 +48,77 @@ type Params struct {
 	// ReportPollInterval holds the interval at which to poll for new reports.
 	// If it's zero, the default will be chosen by the reportworker package.
 	ReportPollInterval time.Duration
+
+	// RecentStateCount holds the number of recent meter states
+	// that will be returned by RecentMeterStates.
+	// If it's zero, DefaultRecentStateCount will be used.
+	RecentStateCount int
+
+	// UseMACSampleDirs specifies that each meter's MAC address
+	// should be used to name its sample directory when it can be
+	// discovered. When a meter's MAC address is first discovered,
+	// any existing sample directory named after its network address
+	// is moved so that no samples are lost.
+	UseMACSampleDirs bool
+
+	// PowerBounds holds the range of plausible power readings
+	// for meters at each location. Readings outside that range
+	// are treated as failed reads. There are no bounds for
+	// locations without an entry.
+	PowerBounds map[hydroreport.MeterLocation]PowerBounds
+
+	// Now is used to query the current time. If it's nil, time.Now will be used.
+	Now func() time.Time
+
+	// FileMode holds the permissions used when creating the
+	// meter configuration file and sample files. If it's zero,
+	// 0666 is used for the configuration file and the sample
+	// files are left to the sample worker's default.
+	FileMode os.FileMode
+
+	// DirMode holds the permissions used when creating
+	// sample directories. If it's zero, the sample worker's
+	// default is used.
+	DirMode os.FileMode
+
+	// PowerSmoothing holds the smoothing factor of an exponential
+	// moving average applied to each meter's power readings
+	// before they're returned from ReadMeters. It must be between
+	// 0 and 1; smaller values give more smoothing. If it's zero,
+	// no smoothing is done. The meter state always holds
+	// the raw readings.
+	PowerSmoothing float64
+}
+
+// PowerBounds holds the range of plausible power readings (in W)
+// for a meter.
+type PowerBounds struct {
+	// Min holds the minimum plausible power.
+	Min float64
+	// Max holds the maximum plausible power.
+	// If it's zero, there's no maximum.
+	Max float64
 }
 
+// contains reports whether the given power is within the bounds.
+func (b PowerBounds) contains(power float64) bool {
+	return power >= b.Min && (b.Max == 0 || power <= b.Max)
+}
+
+// String returns the allowed range in a form
+// suitable for log messages.
+func (b PowerBounds) String() string {
+	if b.Max == 0 {
+		return fmt.Sprintf("%vW or more, with no maximum", b.Min)
+	}
+	return fmt.Sprintf("%vW to %vW", b.Min, b.Max)
+}
+
+// DefaultRecentStateCount holds the default number of recent
+// meter states that are kept. Meter states are usually acquired
+// about once a second, so this covers about an hour.
+const DefaultRecentStateCount = 3600
+
 // SampleWorkerParams holds the parameters for creating a new sample worker.
 type SampleWorkerParams struct {
 	// SampleDir holds the directory to store the samples in (in files
@@ -59,9 +128,17 @@ type SampleWorkerParams struct {
 	MeterAddr string
 	// TZ holds the time zone to use.
 	TZ *time.Location
+	// MeterTZ holds the time zone that the meter's clock is set to.
+	MeterTZ *time.Location
 	// SamplesChanged is a callback that can be used to notify the meterworker
 	// that the underlying samples have changed.
 	SamplesChanged func()
+	// FileMode holds the permissions to use for sample files.
+	// If it's zero, the sample worker should choose a default.
+	FileMode os.FileMode
+	// DirMode holds the permissions to use when creating SampleDir.
+	// If it's zero, the sample worker should choose a default.
+	DirMode os.FileMode
 }
 
 // SampleWorker represents a started sample worker.
@@ -112,6 +189,10 @@ type MeterSample struct {
 	// better decision as to whether to display the lag time for a
 	// sample or not.
 	AllowedLag time.Duration
+	// RoundTrip holds the moving average of the time taken by
+	// requests to the meter when the sample was acquired, or
+	// zero if it's not known.
+	RoundTrip time.Duration
 }
 
 // Meter holds a meter that can be read to find out what the system is doing.
@@ -120,16 +201,73 @@ type Meter struct {
 	Location   hydroreport.MeterLocation `json:"Location"`
 	Addr       string                    // host:port		`json:"Addr"`
 	AllowedLag time.Duration             `json:"AllowedLag"`
+	// Units holds the units that the meter reports in, to override
+	// the default units (kW and kWh) for meters that don't use them.
+	Units ndmeter.Units `json:"Units,omitempty"`
+	// MAC holds the MAC address of the meter if it's known
+	// (see Params.UseMACSampleDirs).
+	MAC string `json:"MAC,omitempty"`
+	// Disabled holds whether the meter is temporarily out of use
+	// (for example while it's being serviced). Disabled meters
+	// aren't read and their samples aren't gathered, but their
+	// configuration and existing samples are retained.
+	Disabled bool `json:"Disabled,omitempty"`
+	// TZ holds the name of the time zone that the meter's clock
+	// is set to, which is used to interpret the times of the samples
+	// in its energy log. If it's empty, Params.TZ is used.
+	// This doesn't affect the time zone that reports use.
+	TZ string `json:"TZ,omitempty"`
 }
 
 // SampleDir returns the name for the sample directory for the given meter (relative to the top level
-// sample directory).
+// sample directory). If the meter's MAC address is known, that's used
+// because it doesn't change when the meter's network address does.
 func (m Meter) SampleDir() string {
-	// TODO ideally we'd use a more resilient name for the meter, such
-	// as its mac address, but this'll do for now.
+	if m.MAC != "" {
+		return strings.ToLower(m.Location.String()) + "-" + strings.ReplaceAll(strings.ToLower(m.MAC), ":", "")
+	}
+	return m.addrSampleDir()
+}
+
+// addrSampleDir returns the name of the sample directory
+// for the meter based on its network address.
+func (m Meter) addrSampleDir() string {
 	return strings.ToLower(m.Location.String()) + "-" + strings.ReplaceAll(m.Addr, ":", "·")
 }
 
+// Validate checks that the meter is valid. In particular, it checks
+// that the meter's sample directory name is safe to use as a
+// single directory within the top level sample directory.
+func (m Meter) Validate() error {
+	if m.Addr == "" {
+		return errgo.Newf("meter %q has no address", m.Name)
+	}
+	name := m.SampleDir()
+	if strings.ContainsAny(name, "/\\\x00") {
+		return errgo.Newf("meter address %q does not produce a valid sample directory name (%q)", m.Addr, name)
+	}
+	if m.TZ != "" {
+		if _, err := time.LoadLocation(m.TZ); err != nil {
+			return errgo.Newf("meter %q has invalid time zone %q", m.Name, m.TZ)
+		}
+	}
+	return nil
+}
+
+// clockTZ returns the time zone of the meter's clock,
+// or def if it hasn't been specified.
+func (m Meter) clockTZ(def *time.Location) *time.Location {
+	if m.TZ == "" {
+		return def
+	}
+	tz, err := time.LoadLocation(m.TZ)
+	if err != nil {
+		// Can't happen because the meter has been validated.
+		return def
+	}
+	return tz
+}
+
 var _ hydroworker.MeterReader = (*Worker)(nil)
 
 type readMetersReq struct {
@@ -174,9 +312,37 @@ type Worker struct {
 	// to find available reports.
 	reportWorker *reportworker.Worker
 
+	// reportMeters holds the sample directories that the
+	// current report worker was started with.
+	reportMeters map[hydroreport.MeterLocation][]string
+
 	// sampleWorkers holds the currently running sample workers,
 	// keyed by meter address.
 	sampleWorkers map[string]SampleWorker
+
+	// sampleWorkerTZs holds the meter time zone that
+	// each sample worker was started with, keyed by
+	// meter address.
+	sampleWorkerTZs map[string]string
+
+	// smoothed holds the smoothed power readings for each
+	// meter, keyed by meter address. It's only used when
+	// Params.PowerSmoothing is non-zero.
+	smoothed map[string]*smoothedPower
+
+	// recentStates holds the most recently acquired meter states.
+	// It has its own lock, so can be used outside the run goroutine.
+	recentStates *stateRing
+}
+
+// smoothedPower holds the exponential moving average
+// of the power readings from a meter.
+type smoothedPower struct {
+	// time holds the time of the most recent sample
+	// that contributed to the average.
+	time       time.Time
+	power      float64
+	phasePower [3]float64
 }
 
 // meterConfig defines the format used to persistently store
@@ -193,6 +359,17 @@ func New(p Params) (*Worker, error) {
 	if err != nil && !os.IsNotExist(err) {
 		return nil, errgo.Notef(err, "cannot read config from %q", p.MeterConfigPath)
 	}
+	if p.PowerSmoothing < 0 || p.PowerSmoothing > 1 {
+		return nil, errgo.Newf("power smoothing factor %v out of range [0, 1]", p.PowerSmoothing)
+	}
+	if p.RecentStateCount == 0 {
+		p.RecentStateCount = DefaultRecentStateCount
+	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	sampler := ndmeter.NewSampler()
+	sampler.Now = p.Now
 	ctx, cancel := context.WithCancel(context.Background())
 	w := &Worker{
 		ctx:             ctx,
@@ -201,9 +378,12 @@ func New(p Params) (*Worker, error) {
 		setMetersC:      make(chan setMetersReq),
 		samplesChangedC: make(chan struct{}, 1),
 
-		sampler:       ndmeter.NewSampler(),
-		sampleWorkers: make(map[string]SampleWorker),
-		p:             p,
+		sampler:         sampler,
+		sampleWorkers:   make(map[string]SampleWorker),
+		sampleWorkerTZs: make(map[string]string),
+		smoothed:        make(map[string]*smoothedPower),
+		recentStates:    newStateRing(p.RecentStateCount),
+		p:               p,
 	}
 	w.wg.Add(1)
 	go w.run(mcfg.Meters)
@@ -217,11 +397,14 @@ func (w *Worker) Close() {
 }
 
 // ReadMeters implements hydroworker.MeterReader by reading the meters if
-// there are any. If there are none it assumes that all currently active
-// relays use their maximum power.
+// there are any. If there are none (or they're all disabled), it returns
+// hydroworker.ErrNoMeters.
 //
 // If the context is cancelled, it returns immediately with the
 // most recently obtainable readings.
+//
+// If some meters could not be read, it returns a *MeterReadError
+// holding their addresses.
 func (w *Worker) ReadMeters(ctx context.Context) (hydroctl.PowerUseSample, error) {
 	// Make a cancel context to avoid a persistent goroutine in ctxutil.Join if
 	// neither context is cancelled.
@@ -256,6 +439,13 @@ func (w *Worker) SetMeters(ms []Meter) error {
 	}
 }
 
+// RecentMeterStates returns the most recently acquired
+// meter states, oldest first. The caller must not mutate
+// any of the returned values.
+func (w *Worker) RecentMeterStates() []*MeterState {
+	return w.recentStates.all()
+}
+
 // SamplesChanged notifies that the sample data may have changed
 // and therefore it's worth checking to see if the available reports
 // have changed too.
@@ -308,6 +498,7 @@ func (w *Worker) stopWorkers() {
 	for addr, sw := range w.sampleWorkers {
 		sw.Close()
 		delete(w.sampleWorkers, addr)
+		delete(w.sampleWorkerTZs, addr)
 	}
 }
 
@@ -317,15 +508,17 @@ func (w *Worker) stopWorkers() {
 // Note that the context is a combination of the context from the ReadMeters call and the
 // context within the worker.
 func (w *Worker) readMeters(ctx context.Context) (_ hydroctl.PowerUseSample, meterStateChanged bool, _ error) {
-	if w.meters == nil {
+	meters := w.enabledMeters()
+	if len(meters) == 0 {
 		return hydroctl.PowerUseSample{}, false, hydroworker.ErrNoMeters
 	}
 
-	places := make([]ndmeter.SamplePlace, len(w.meters))
-	for i, m := range w.meters {
+	places := make([]ndmeter.SamplePlace, len(meters))
+	for i, m := range meters {
 		places[i] = ndmeter.SamplePlace{
 			Addr:       m.Addr,
 			AllowedLag: m.AllowedLag,
+			Units:      m.Units,
 		}
 	}
 	var failed []string
@@ -333,21 +526,35 @@ func (w *Worker) readMeters(ctx context.Context) (_ hydroctl.PowerUseSample, met
 	// Note that this might take some time and changing the meter addresses
 	// will block until it's done, but that doesn't seem too unreasonable.
 	samples := w.sampler.GetAll(ctx, places...)
-	now := time.Now()
+	now := w.p.Now()
+	for i, m := range meters {
+		sample := samples[i]
+		if sample == nil {
+			continue
+		}
+		if b, ok := w.p.PowerBounds[m.Location]; ok && !b.contains(sample.ActivePower) {
+			log.Printf("implausible power reading %vW from %v meter %q (allowed range %v); ignoring it", sample.ActivePower, m.Location, m.Addr, b)
+			samples[i] = nil
+		}
+	}
 	samplesByAddr := make(map[string]*MeterSample)
 	for i, sample := range samples {
 		if sample != nil {
 			samplesByAddr[places[i].Addr] = &MeterSample{
 				Sample:     sample,
 				AllowedLag: places[i].AllowedLag,
+				RoundTrip:  w.sampler.RoundTrip(places[i].Addr),
 			}
 		} else {
 			failed = append(failed, places[i].Addr)
 		}
 	}
 
+	// pu holds the power as used for decisions; raw holds
+	// the power as actually read from the meters.
 	var pu hydroctl.PowerUseSample
-	for i, m := range w.meters {
+	var raw hydroctl.PowerUse
+	for i, m := range meters {
 		sample := samples[i]
 		if sample == nil {
 			continue
@@ -358,45 +565,125 @@ func (w *Worker) readMeters(ctx context.Context) (_ hydroctl.PowerUseSample, met
 		if pu.T1.IsZero() || sample.Time.After(pu.T1) {
 			pu.T1 = sample.Time
 		}
-		switch m.Location {
-		case hydroreport.LocGenerator:
-			pu.Generated += sample.ActivePower
-		case hydroreport.LocHere:
-			pu.Here += sample.ActivePower
-		case hydroreport.LocNeighbour:
-			pu.Neighbour += sample.ActivePower
-		default:
-			log.Printf("unknown meter location %v", m.Location)
-		}
+		addPower(&raw, m.Location, sample.ActivePower, sample.PhasePower)
+		power, phasePower := w.smoothPower(m.Addr, sample)
+		addPower(&pu.PowerUse, m.Location, power, phasePower)
 	}
-	pc := hydroctl.ChargeablePower(pu.PowerUse)
+	pc := hydroctl.ChargeablePower(raw)
 	w.meterState = &MeterState{
 		Time:       now,
 		Chargeable: pc,
-		Use:        pu.PowerUse,
+		Use:        raw,
 		Meters:     w.meters,
 		Samples:    samplesByAddr,
 	}
+	w.recentStates.add(w.meterState)
 	if len(failed) > 0 {
-		return hydroctl.PowerUseSample{}, true, errgo.Newf("failed to get meter readings from %v", failed)
+		return hydroctl.PowerUseSample{}, true, &MeterReadError{
+			Failed: failed,
+		}
 	}
 	return pu, true, nil
 }
 
+// addPower adds the given power readings from a meter
+// at the given location to pu.
+func addPower(pu *hydroctl.PowerUse, loc hydroreport.MeterLocation, power float64, phasePower [3]float64) {
+	switch loc {
+	case hydroreport.LocGenerator:
+		pu.Generated += power
+		for i, p := range phasePower {
+			pu.Phases[i].Generated += p
+		}
+	case hydroreport.LocHere:
+		pu.Here += power
+		for i, p := range phasePower {
+			pu.Phases[i].Here += p
+		}
+	case hydroreport.LocNeighbour:
+		pu.Neighbour += power
+		for i, p := range phasePower {
+			pu.Phases[i].Neighbour += p
+		}
+	default:
+		log.Printf("unknown meter location %v", loc)
+	}
+}
+
+// smoothPower returns the power readings from the meter
+// with the given address to use for decisions, taking
+// into account Params.PowerSmoothing.
+func (w *Worker) smoothPower(addr string, sample *ndmeter.Sample) (float64, [3]float64) {
+	alpha := w.p.PowerSmoothing
+	if alpha == 0 {
+		return sample.ActivePower, sample.PhasePower
+	}
+	sp := w.smoothed[addr]
+	if sp == nil {
+		sp = &smoothedPower{
+			time:       sample.Time,
+			power:      sample.ActivePower,
+			phasePower: sample.PhasePower,
+		}
+		w.smoothed[addr] = sp
+	} else if !sample.Time.Equal(sp.time) {
+		// Only new samples contribute to the average; the
+		// sampler can return the same sample more than once.
+		sp.time = sample.Time
+		sp.power = alpha*sample.ActivePower + (1-alpha)*sp.power
+		for i, p := range sample.PhasePower {
+			sp.phasePower[i] = alpha*p + (1-alpha)*sp.phasePower[i]
+		}
+	}
+	return sp.power, sp.phasePower
+}
+
+// MeterReadError is the error returned by Worker.ReadMeters
+// when some meters could not be read.
+type MeterReadError struct {
+	// Failed holds the addresses of the meters that
+	// could not be read, in the same order as the
+	// meters were configured.
+	Failed []string
+}
+
+func (e *MeterReadError) Error() string {
+	return fmt.Sprintf("failed to get meter readings from %v", e.Failed)
+}
+
 // setMeters is the internal version of SetMeters, called from within the worker.run goroutine.
 // It reports whether the meter state was updated.
 func (w *Worker) setMeters(meters []Meter) (bool, error) {
-	if reflect.DeepEqual(meters, w.meters) {
-		return false, nil
+	// byAddr holds the name of the meter using each address,
+	// so that two meters can't share a sample worker's file.
+	byAddr := make(map[string]string)
+	for _, m := range meters {
+		if err := m.Validate(); err != nil {
+			return false, errgo.Mask(err)
+		}
+		if other, ok := byAddr[m.Addr]; ok {
+			return false, errgo.Newf("meter address %q is used by both %q and %q", m.Addr, other, m.Name)
+		}
+		byAddr[m.Addr] = m.Name
 	}
 	// Guard against races by making a copy of the meters slice.
 	meters = append([]Meter(nil), meters...)
+	w.setMACs(meters)
+	if reflect.DeepEqual(meters, w.meters) {
+		return false, nil
+	}
 
 	// TODO write config atomically.
-	if err := writeJSONFile(w.p.MeterConfigPath, meterConfig{meters}); err != nil {
+	if err := writeJSONFile(w.p.MeterConfigPath, meterConfig{meters}, w.configFileMode()); err != nil {
 		return false, err
 	}
+	w.migrateMovedMeters(meters)
 	w.meters = meters
+	for addr := range w.smoothed {
+		if _, ok := byAddr[addr]; !ok {
+			delete(w.smoothed, addr)
+		}
+	}
 	// TODO preserve some existing meter state.
 	w.meterState = &MeterState{
 		Meters: meters,
@@ -405,7 +692,7 @@ func (w *Worker) setMeters(meters []Meter) (bool, error) {
 		// No samples, no reports.
 		return true, nil
 	}
-	if err := w.restartReportWorker(); err != nil {
+	if err := w.ensureReportWorker(); err != nil {
 		return true, fmt.Errorf("cannot restart report worker: %v", err)
 	}
 	if err := w.ensureSampleWorkers(); err != nil {
@@ -416,14 +703,16 @@ func (w *Worker) setMeters(meters []Meter) (bool, error) {
 
 func (w *Worker) ensureSampleWorkers() error {
 	meters := make(map[string]Meter)
-	for _, m := range w.meters {
+	for _, m := range w.enabledMeters() {
 		meters[m.Addr] = m
 	}
-	// Stop any existing workers that aren't now included.
-	for addr := range w.sampleWorkers {
-		if _, ok := meters[addr]; !ok {
-			w.Close()
+	// Stop any existing workers that aren't now included
+	// or whose meter's clock has changed time zone.
+	for addr, sw := range w.sampleWorkers {
+		if m, ok := meters[addr]; !ok || m.TZ != w.sampleWorkerTZs[addr] {
+			sw.Close()
 			delete(w.sampleWorkers, addr)
+			delete(w.sampleWorkerTZs, addr)
 		}
 	}
 	// Start any new workers required.
@@ -435,27 +724,47 @@ func (w *Worker) ensureSampleWorkers() error {
 			SampleDir:      filepath.Join(w.p.SampleDirPath, m.SampleDir()),
 			MeterAddr:      addr,
 			TZ:             w.p.TZ,
+			MeterTZ:        m.clockTZ(w.p.TZ),
 			SamplesChanged: w.SamplesChanged,
+			FileMode:       w.p.FileMode,
+			DirMode:        w.p.DirMode,
 		})
 		if err != nil {
 			return fmt.Errorf("cannot start sample worker for %q: %v", addr, err)
 		}
 		w.sampleWorkers[addr] = sw
+		w.sampleWorkerTZs[addr] = m.TZ
 	}
 	return nil
 }
 
-func (w *Worker) restartReportWorker() error {
-	if w.reportWorker != nil {
-		w.reportWorker.Close()
-		w.reportWorker = nil
+// enabledMeters returns all the meters that aren't disabled.
+func (w *Worker) enabledMeters() []Meter {
+	var meters []Meter
+	for _, m := range w.meters {
+		if !m.Disabled {
+			meters = append(meters, m)
+		}
 	}
+	return meters
+}
+
+// ensureReportWorker starts the report worker if it isn't running
+// or restarts it if the meters' sample directories have changed.
+func (w *Worker) ensureReportWorker() error {
 	meterMap := make(map[hydroreport.MeterLocation][]string)
 	for _, m := range w.meters {
 		meterMap[m.Location] = append(meterMap[m.Location], m.SampleDir())
 	}
+	if w.reportWorker != nil {
+		if reflect.DeepEqual(meterMap, w.reportMeters) {
+			return nil
+		}
+		w.reportWorker.Close()
+		w.reportWorker = nil
+	}
 	// Start the report gatherer worker.
-	reportWorker, err := reportworker.New(reportworker.Params{
+	reportWorker, err := reportworkerNew(reportworker.Params{
 		SampleDir:              w.p.SampleDirPath,
 		Meters:                 meterMap,
 		TZ:                     w.p.TZ,
@@ -466,9 +775,23 @@ func (w *Worker) restartReportWorker() error {
 		return errgo.Notef(err, "cannot create report worker")
 	}
 	w.reportWorker = reportWorker
+	w.reportMeters = meterMap
 	return nil
 }
 
+// configFileMode returns the permissions to use
+// for the meter configuration file.
+func (w *Worker) configFileMode() os.FileMode {
+	if w.p.FileMode == 0 {
+		return 0666
+	}
+	return w.p.FileMode
+}
+
+// reportworkerNew is defined as a variable so that
+// it can be patched in tests.
+var reportworkerNew = reportworker.New
+
 func readJSONFile(path string, x interface{}) error {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -477,10 +800,10 @@ func readJSONFile(path string, x interface{}) error {
 	return json.Unmarshal(data, x)
 }
 
-func writeJSONFile(path string, x interface{}) error {
+func writeJSONFile(path string, x interface{}, mode os.FileMode) error {
 	data, err := json.Marshal(x)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, data, 0666)
+	return ioutil.WriteFile(path, data, mode)
 }
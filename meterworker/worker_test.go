@@ -1,19 +1,25 @@
 package meterworker
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/kr/fs"
+	"gopkg.in/errgo.v1"
 
+	"github.com/rogpeppe/hydro/hydroctl"
 	"github.com/rogpeppe/hydro/hydroreport"
 	"github.com/rogpeppe/hydro/logworker"
 	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/ndmeter"
 	"github.com/rogpeppe/hydro/ndmetertest"
+	"github.com/rogpeppe/hydro/reportworker"
 )
 
 func TestWorker(t *testing.T) {
@@ -116,6 +122,649 @@ loop:
 	}
 }
 
+func TestReadMetersRejectsImplausiblePower(t *testing.T) {
+	c := qt.New(t)
+	locations := []hydroreport.MeterLocation{
+		hydroreport.LocGenerator,
+		hydroreport.LocNeighbour,
+		hydroreport.LocHere,
+	}
+	meters := make([]Meter, len(locations))
+	servers := make([]*ndmetertest.Server, len(locations))
+	for i, loc := range locations {
+		srv, err := ndmetertest.NewServer("localhost:0")
+		c.Assert(err, qt.IsNil)
+		defer srv.Close()
+		servers[i] = srv
+		meters[i] = Meter{
+			Name:     fmt.Sprintf("meter %d", i),
+			Addr:     srv.Addr,
+			Location: loc,
+		}
+	}
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		PowerBounds: map[hydroreport.MeterLocation]PowerBounds{
+			hydroreport.LocGenerator: {Max: 200000},
+			hydroreport.LocHere:      {},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+
+	servers[0].SetPower(50000)
+	servers[1].SetPower(-2000)
+	servers[2].SetPower(3000)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pu, err := mw.ReadMeters(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pu.Generated, qt.Equals, 50000.0)
+	c.Assert(pu.Here, qt.Equals, 3000.0)
+	// There are no bounds for the neighbour meter,
+	// so negative power is allowed.
+	c.Assert(pu.Neighbour < 0, qt.IsTrue)
+
+	// An implausibly large generator reading and a negative
+	// reading for the local meter are both rejected.
+	servers[0].SetPower(1e9)
+	servers[2].SetPower(-3000)
+	_, err = mw.ReadMeters(ctx)
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`failed to get meter readings from \[%s %s\]`, servers[0].Addr, servers[2].Addr))
+	c.Assert(errgo.Cause(err), qt.DeepEquals, &MeterReadError{
+		Failed: []string{servers[0].Addr, servers[2].Addr},
+	})
+	samples := mw.RecentMeterStates()
+	ms := samples[len(samples)-1]
+	c.Assert(ms.Samples[servers[0].Addr], qt.IsNil)
+	c.Assert(ms.Samples[servers[1].Addr], qt.Not(qt.IsNil))
+	c.Assert(ms.Samples[servers[2].Addr], qt.IsNil)
+}
+
+var powerBoundsStringTests = []struct {
+	bounds PowerBounds
+	expect string
+}{{
+	bounds: PowerBounds{Min: -500, Max: 200000},
+	expect: "-500W to 200000W",
+}, {
+	bounds: PowerBounds{},
+	expect: "0W or more, with no maximum",
+}}
+
+func TestPowerBoundsString(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range powerBoundsStringTests {
+		c.Assert(test.bounds.String(), qt.Equals, test.expect)
+	}
+}
+
+func TestReadMetersUnreachableMeter(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	dead, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	dead.Close()
+
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "generator",
+		Addr:     srv.Addr,
+		Location: hydroreport.LocGenerator,
+	}, {
+		Name:     "here",
+		Addr:     dead.Addr,
+		Location: hydroreport.LocHere,
+	}})
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = mw.ReadMeters(ctx)
+	c.Assert(err, qt.Not(qt.IsNil))
+	readErr, ok := errgo.Cause(err).(*MeterReadError)
+	c.Assert(ok, qt.IsTrue, qt.Commentf("error %#v", err))
+	c.Assert(readErr.Failed, qt.DeepEquals, []string{dead.Addr})
+}
+
+func TestDisabledMeter(t *testing.T) {
+	c := qt.New(t)
+	gen, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer gen.Close()
+	here, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer here.Close()
+	gen.SetPower(4000)
+	here.SetPower(1000)
+
+	// running holds whether there's a running sample
+	// worker for each meter address. Sample workers are
+	// started and stopped synchronously by SetMeters,
+	// so there's no need for a mutex.
+	running := make(map[string]bool)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   c.Mkdir(),
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			running[p.MeterAddr] = true
+			return funcSampleWorker(func() {
+				running[p.MeterAddr] = false
+			}), nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	meters := []Meter{{
+		Name:     "generator",
+		Addr:     gen.Addr,
+		Location: hydroreport.LocGenerator,
+	}, {
+		Name:     "here",
+		Addr:     here.Addr,
+		Location: hydroreport.LocHere,
+	}}
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(running, qt.DeepEquals, map[string]bool{
+		gen.Addr:  true,
+		here.Addr: true,
+	})
+
+	meters[1].Disabled = true
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(running, qt.DeepEquals, map[string]bool{
+		gen.Addr:  true,
+		here.Addr: false,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pu, err := mw.ReadMeters(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pu.Generated, qt.Equals, 4000.0)
+	c.Assert(pu.Here, qt.Equals, 0.0)
+
+	// The disabled meter is still part of the configuration.
+	samples := mw.RecentMeterStates()
+	ms := samples[len(samples)-1]
+	c.Assert(ms.Meters, qt.DeepEquals, meters)
+	c.Assert(ms.Samples[here.Addr], qt.IsNil)
+
+	// Re-enabling the meter starts its sample worker again.
+	meters[1].Disabled = false
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(running[here.Addr], qt.IsTrue)
+	pu, err = mw.ReadMeters(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pu.Here, qt.Equals, 1000.0)
+}
+
+func TestSetMetersIdempotent(t *testing.T) {
+	c := qt.New(t)
+	reportWorkerStarts := 0
+	c.Patch(&reportworkerNew, func(p reportworker.Params) (*reportworker.Worker, error) {
+		reportWorkerStarts++
+		return reportworker.New(p)
+	})
+	// As in TestDisabledMeter, SetMeters starts and stops
+	// workers synchronously, so there's no need for a mutex
+	// for the worker counts, but the meter state updates can
+	// happen after SetMeters has returned.
+	sampleWorkerStarts := 0
+	updates := make(chan *MeterState, 10)
+	mw, err := New(Params{
+		Updater: funcUpdater{
+			updateMeterState: func(ms *MeterState) {
+				updates <- ms
+			},
+		},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   c.Mkdir(),
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			sampleWorkerStarts++
+			return funcSampleWorker(func() {}), nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	// Wait for the initial meter state.
+	<-updates
+	meters := []Meter{{
+		Name:     "generator",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocGenerator,
+	}, {
+		Name:     "here",
+		Addr:     "localhost:1235",
+		Location: hydroreport.LocHere,
+	}}
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleWorkerStarts, qt.Equals, 2)
+	c.Assert(reportWorkerStarts, qt.Equals, 1)
+	<-updates
+
+	// Setting an identical list of meters does nothing.
+	err = mw.SetMeters(append([]Meter(nil), meters...))
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleWorkerStarts, qt.Equals, 2)
+	c.Assert(reportWorkerStarts, qt.Equals, 1)
+
+	// A change that doesn't affect the sample directories
+	// updates the meter state without restarting any workers.
+	meters[1].AllowedLag = time.Second
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleWorkerStarts, qt.Equals, 2)
+	c.Assert(reportWorkerStarts, qt.Equals, 1)
+	ms := <-updates
+	c.Assert(ms.Meters, qt.DeepEquals, meters)
+
+	// There were no other meter state updates.
+	select {
+	case ms := <-updates:
+		c.Fatalf("unexpected meter state update %#v", ms)
+	default:
+	}
+
+	// Adding a meter starts its sample worker and
+	// restarts the report worker.
+	meters = append(meters, Meter{
+		Name:     "neighbour",
+		Addr:     "localhost:1236",
+		Location: hydroreport.LocNeighbour,
+	})
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleWorkerStarts, qt.Equals, 3)
+	c.Assert(reportWorkerStarts, qt.Equals, 2)
+}
+
+func TestSetMetersTZ(t *testing.T) {
+	c := qt.New(t)
+	reportWorkerStarts := 0
+	c.Patch(&reportworkerNew, func(p reportworker.Params) (*reportworker.Worker, error) {
+		reportWorkerStarts++
+		return reportworker.New(p)
+	})
+	// SetMeters starts and stops sample workers synchronously,
+	// so there's no need for a mutex.
+	meterTZs := make(map[string]string)
+	serverTZ := time.FixedZone("X", 2*60*60)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   c.Mkdir(),
+		TZ:              serverTZ,
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			// The report time zone is always the server's.
+			c.Check(p.TZ, qt.Equals, serverTZ)
+			meterTZs[p.MeterAddr] = p.MeterTZ.String()
+			return funcSampleWorker(func() {}), nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	meters := []Meter{{
+		Name:     "generator",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocGenerator,
+		TZ:       "Europe/Paris",
+	}, {
+		Name:     "here",
+		Addr:     "localhost:1235",
+		Location: hydroreport.LocHere,
+	}}
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(meterTZs, qt.DeepEquals, map[string]string{
+		"localhost:1234": "Europe/Paris",
+		"localhost:1235": "X",
+	})
+	c.Assert(reportWorkerStarts, qt.Equals, 1)
+
+	// Changing a meter's time zone restarts its sample
+	// worker but not the report worker.
+	delete(meterTZs, "localhost:1234")
+	meters[0].TZ = ""
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(meterTZs, qt.DeepEquals, map[string]string{
+		"localhost:1234": "X",
+		"localhost:1235": "X",
+	})
+	c.Assert(reportWorkerStarts, qt.Equals, 1)
+}
+
+func TestSetMetersIdempotentAfterRestart(t *testing.T) {
+	c := qt.New(t)
+	reportWorkerStarts := 0
+	c.Patch(&reportworkerNew, func(p reportworker.Params) (*reportworker.Worker, error) {
+		reportWorkerStarts++
+		return reportworker.New(p)
+	})
+	sampleWorkerStarts := 0
+	p := Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		SampleDirPath:   c.Mkdir(),
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			sampleWorkerStarts++
+			return funcSampleWorker(func() {}), nil
+		},
+	}
+	meters := []Meter{{
+		Name:       "generator",
+		Addr:       "localhost:1234",
+		Location:   hydroreport.LocGenerator,
+		AllowedLag: time.Second,
+		Units:      ndmeter.UnitsKilo,
+	}}
+	mw, err := New(p)
+	c.Assert(err, qt.IsNil)
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	mw.Close()
+
+	// The meters read from the configuration file when
+	// the worker starts compare equal to the same meters
+	// set again.
+	mw, err = New(p)
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	// Calling SetMeters waits until the initial meters have been set.
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sampleWorkerStarts, qt.Equals, 2)
+	c.Assert(reportWorkerStarts, qt.Equals, 2)
+}
+
+// funcSampleWorker implements SampleWorker by calling
+// the function when it's closed.
+type funcSampleWorker func()
+
+func (f funcSampleWorker) Close() {
+	f()
+}
+
+func TestReadMetersPhasePower(t *testing.T) {
+	c := qt.New(t)
+	locations := []hydroreport.MeterLocation{
+		hydroreport.LocGenerator,
+		hydroreport.LocNeighbour,
+		hydroreport.LocHere,
+		hydroreport.LocHere,
+	}
+	phasePower := [][3]float64{
+		{3000, 3000, 3000},
+		{100, 0, 200},
+		{500, 1000, 0},
+		{0, 2000, 1500},
+	}
+	meters := make([]Meter, len(locations))
+	for i, loc := range locations {
+		srv, err := ndmetertest.NewServer("localhost:0")
+		c.Assert(err, qt.IsNil)
+		defer srv.Close()
+		srv.SetPhasePower(phasePower[i])
+		meters[i] = Meter{
+			Name:     fmt.Sprintf("meter %d", i),
+			Addr:     srv.Addr,
+			Location: loc,
+		}
+	}
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters(meters)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pu, err := mw.ReadMeters(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pu.Phases, qt.DeepEquals, [hydroctl.MaxPhase]hydroctl.PhasePowerUse{{
+		Generated: 3000,
+		Neighbour: 100,
+		Here:      500,
+	}, {
+		Generated: 3000,
+		Neighbour: 0,
+		Here:      3000,
+	}, {
+		Generated: 3000,
+		Neighbour: 200,
+		Here:      1500,
+	}})
+}
+
+func TestReadMetersNow(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	srv.SetPower(1000)
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		Now: func() time.Time {
+			return now
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "meter",
+		Addr:     srv.Addr,
+		Location: hydroreport.LocHere,
+	}})
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pu, err := mw.ReadMeters(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(pu.T0, qt.Equals, now)
+	c.Assert(pu.T1, qt.Equals, now)
+	states := mw.RecentMeterStates()
+	c.Assert(states, qt.Not(qt.HasLen), 0)
+	ms := states[len(states)-1]
+	c.Assert(ms.Time, qt.Equals, now)
+	c.Assert(ms.Samples[srv.Addr].Time, qt.Equals, now)
+}
+
+func TestReadMetersPowerSmoothing(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		PowerSmoothing:  0.25,
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "meter",
+		Addr:     srv.Addr,
+		Location: hydroreport.LocGenerator,
+	}})
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	readMeters := func() (decided, raw float64) {
+		pu, err := mw.ReadMeters(ctx)
+		c.Assert(err, qt.IsNil)
+		states := mw.RecentMeterStates()
+		return pu.Generated, states[len(states)-1].Use.Generated
+	}
+	srv.SetPower(1000)
+	decided, raw := readMeters()
+	c.Assert(decided, qt.Equals, 1000.0)
+	c.Assert(raw, qt.Equals, 1000.0)
+
+	// A single-sample spike is dampened in the value used
+	// for decisions but not in the reported meter state.
+	srv.SetPower(9000)
+	decided, raw = readMeters()
+	c.Assert(decided, qt.Equals, 3000.0)
+	c.Assert(raw, qt.Equals, 9000.0)
+
+	// When the spike goes away, the smoothed value decays
+	// back towards the actual reading.
+	srv.SetPower(1000)
+	decided, raw = readMeters()
+	c.Assert(decided, qt.Equals, 2500.0)
+	c.Assert(raw, qt.Equals, 1000.0)
+}
+
+func TestNewRejectsBadPowerSmoothing(t *testing.T) {
+	c := qt.New(t)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+		PowerSmoothing:  1.5,
+	})
+	c.Assert(err, qt.ErrorMatches, `power smoothing factor 1.5 out of range \[0, 1\]`)
+	c.Assert(mw, qt.IsNil)
+}
+
+var meterValidateTests = []struct {
+	testName    string
+	meter       Meter
+	expectError string
+}{{
+	testName: "host-and-port",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocHere,
+	},
+}, {
+	testName: "ipv6-address",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     "[::1]:1234",
+		Location: hydroreport.LocHere,
+	},
+}, {
+	testName: "no-address",
+	meter: Meter{
+		Name:     "meter",
+		Location: hydroreport.LocHere,
+	},
+	expectError: `meter "meter" has no address`,
+}, {
+	testName: "address-with-slash",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     "../foo:1234",
+		Location: hydroreport.LocHere,
+	},
+	expectError: `meter address "../foo:1234" does not produce a valid sample directory name \("here-../foo·1234"\)`,
+}, {
+	testName: "address-with-backslash",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     `a\b:1234`,
+		Location: hydroreport.LocHere,
+	},
+	expectError: `meter address .* does not produce a valid sample directory name .*`,
+}, {
+	testName: "valid-time-zone",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocHere,
+		TZ:       "Europe/Paris",
+	},
+}, {
+	testName: "invalid-time-zone",
+	meter: Meter{
+		Name:     "meter",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocHere,
+		TZ:       "Nowhere/Special",
+	},
+	expectError: `meter "meter" has invalid time zone "Nowhere/Special"`,
+}}
+
+func TestMeterValidate(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range meterValidateTests {
+		c.Run(test.testName, func(c *qt.C) {
+			err := test.meter.Validate()
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+			} else {
+				c.Assert(err, qt.IsNil)
+			}
+		})
+	}
+}
+
+func TestSetMetersInvalidMeter(t *testing.T) {
+	c := qt.New(t)
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: filepath.Join(c.Mkdir(), "meterconfig.json"),
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "meter",
+		Addr:     "a/b:1234",
+		Location: hydroreport.LocHere,
+	}})
+	c.Assert(err, qt.ErrorMatches, `meter address "a/b:1234" does not produce a valid sample directory name .*`)
+}
+
+func TestSetMetersDuplicateAddress(t *testing.T) {
+	c := qt.New(t)
+	configPath := filepath.Join(c.Mkdir(), "meterconfig.json")
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: configPath,
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "Generator",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocGenerator,
+	}, {
+		Name:     "Drynoch",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocHere,
+	}})
+	c.Assert(err, qt.ErrorMatches, `meter address "localhost:1234" is used by both "Generator" and "Drynoch"`)
+	// The meter configuration isn't saved.
+	_, err = os.Stat(configPath)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
 type funcUpdater struct {
 	updateMeterState       func(ms *MeterState)
 	updateAvailableReports func(reports []*hydroreport.Report)
@@ -143,3 +792,34 @@ func mkSamples(t0, t1 time.Time, interval time.Duration, e0, e1 float64) []meter
 	}
 	return samples
 }
+
+func TestFileModes(t *testing.T) {
+	c := qt.New(t)
+	var sampleParams []SampleWorkerParams
+	configPath := filepath.Join(c.Mkdir(), "meterconfig.json")
+	mw, err := New(Params{
+		Updater:         funcUpdater{},
+		MeterConfigPath: configPath,
+		SampleDirPath:   c.Mkdir(),
+		FileMode:        0640,
+		DirMode:         0750,
+		NewSampleWorker: func(p SampleWorkerParams) (SampleWorker, error) {
+			sampleParams = append(sampleParams, p)
+			return funcSampleWorker(func() {}), nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer mw.Close()
+	err = mw.SetMeters([]Meter{{
+		Name:     "generator",
+		Addr:     "localhost:1234",
+		Location: hydroreport.LocGenerator,
+	}})
+	c.Assert(err, qt.IsNil)
+	info, err := os.Stat(configPath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0640))
+	c.Assert(sampleParams, qt.HasLen, 1)
+	c.Assert(sampleParams[0].FileMode, qt.Equals, os.FileMode(0640))
+	c.Assert(sampleParams[0].DirMode, qt.Equals, os.FileMode(0750))
+}
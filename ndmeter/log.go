@@ -16,8 +16,8 @@ import (
 
 const timeOffset = 315532800
 
-func postForm(ctx context.Context, url string, data url.Values) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+func postForm(ctx context.Context, host string, page string, data url.Values) (*http.Response, error) {
+	req, err := newMeterRequest(ctx, "POST", host, page, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -26,14 +26,23 @@ func postForm(ctx context.Context, url string, data url.Values) (*http.Response,
 }
 
 // OpenEnergyLog opens a log of energy readings from the meter at the
-// given host, requesting readings between t0 and t1.
+// given host (as for Get), requesting readings between t0 and t1.
 // Note that the meter software is buggy, so the actually returned readings
 // might not reflect the requested time range.
 // The returned value should be closed after use.
+//
+// The meter's clock is assumed to be set to UTC.
 func OpenEnergyLog(ctx context.Context, host string, t0, t1 time.Time) (*EnergyReader, error) {
-	resp, err := postForm(ctx, "http://"+host+"/Read_Energy.cgi", url.Values{
-		"From": {timeParam(t0)},
-		"To":   {timeParam(t1)},
+	return OpenEnergyLogInLocation(ctx, host, t0, t1, time.UTC)
+}
+
+// OpenEnergyLogInLocation is like OpenEnergyLog except that the meter's
+// clock is assumed to be set to the local time in the given location,
+// which is used to interpret the timestamps in the log.
+func OpenEnergyLogInLocation(ctx context.Context, host string, t0, t1 time.Time, loc *time.Location) (*EnergyReader, error) {
+	resp, err := postForm(ctx, host, "Read_Energy.cgi", url.Values{
+		"From": {timeParam(t0, loc)},
+		"To":   {timeParam(t1, loc)},
 		"Fmt":  {"csv"},
 	})
 	if err != nil {
@@ -53,12 +62,14 @@ func OpenEnergyLog(ctx context.Context, host string, t0, t1 time.Time) (*EnergyR
 		first:   true,
 		t0:      t0,
 		t1:      t1,
+		loc:     loc,
 	}, nil
 }
 
 type EnergyReader struct {
 	scanner *bufio.Scanner
 	t0, t1  time.Time
+	loc     *time.Location
 	rc      io.ReadCloser
 	first   bool
 }
@@ -105,7 +116,7 @@ func (r *EnergyReader) readSample() (meterstat.Sample, error) {
 	if len(fields) < 3 {
 		return meterstat.Sample{}, fmt.Errorf("too few fields on CSV line %q", line)
 	}
-	timestamp, err := time.Parse("02-01-2006 15:04:05", fields[0]+" "+fields[1])
+	timestamp, err := time.ParseInLocation("02-01-2006 15:04:05", fields[0]+" "+fields[1], r.loc)
 	if err != nil {
 		return meterstat.Sample{}, fmt.Errorf("invalid timestamp in line %q", line)
 	}
@@ -134,6 +145,9 @@ func csvFields(s string) []string {
 	return fields
 }
 
-func timeParam(t time.Time) string {
-	return fmt.Sprint(t.Unix() - timeOffset)
+// timeParam returns the meter's representation of t, which
+// counts seconds of local time in the given location.
+func timeParam(t time.Time, loc *time.Location) string {
+	_, offset := t.In(loc).Zone()
+	return fmt.Sprint(t.Unix() + int64(offset) - timeOffset)
 }
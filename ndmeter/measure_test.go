@@ -0,0 +1,79 @@
+package ndmeter_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/ndmeter"
+	"github.com/rogpeppe/hydro/ndmetertest"
+)
+
+var getTests = []struct {
+	testName  string
+	model     string
+	unitScale float64
+	units     ndmeter.Units
+	expect    ndmeter.Reading
+}{{
+	testName:  "default-units-are-kilo",
+	model:     "350",
+	unitScale: 1000,
+	units:     ndmeter.UnitsDefault,
+	expect: ndmeter.Reading{
+		Model:       "350",
+		ActivePower: 1500,
+		TotalEnergy: 25000,
+		PhasePower:  [3]float64{500, 1000, 300},
+	},
+}, {
+	testName:  "base-units-override",
+	model:     "999",
+	unitScale: 1,
+	units:     ndmeter.UnitsBase,
+	expect: ndmeter.Reading{
+		Model:       "999",
+		ActivePower: 1500,
+		TotalEnergy: 25000,
+		PhasePower:  [3]float64{500, 1000, 300},
+	},
+}, {
+	testName:  "kilo-units-override",
+	model:     "999",
+	unitScale: 1000,
+	units:     ndmeter.UnitsKilo,
+	expect: ndmeter.Reading{
+		Model:       "999",
+		ActivePower: 1500,
+		TotalEnergy: 25000,
+		PhasePower:  [3]float64{500, 1000, 300},
+	},
+}}
+
+func TestGet(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range getTests {
+		c.Run(test.testName, func(c *qt.C) {
+			srv, err := ndmetertest.NewServer("localhost:0")
+			c.Assert(err, qt.IsNil)
+			defer srv.Close()
+			srv.SetModel(test.model, test.unitScale)
+			srv.SetPower(1500)
+			srv.SetPhasePower([3]float64{500, 1000, 300})
+			srv.SetEnergy(25000)
+			reading, err := ndmeter.GetWithUnits(context.Background(), srv.Addr, test.units)
+			c.Assert(err, qt.IsNil)
+			c.Assert(reading, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestGetWithUnknownUnits(t *testing.T) {
+	c := qt.New(t)
+	srv, err := ndmetertest.NewServer("localhost:0")
+	c.Assert(err, qt.IsNil)
+	defer srv.Close()
+	_, err = ndmeter.GetWithUnits(context.Background(), srv.Addr, "MW")
+	c.Assert(err, qt.ErrorMatches, `unknown meter units "MW"`)
+}
@@ -3,6 +3,7 @@ package ndmeter
 import (
 	"context"
 	"log"
+	"net/http"
 	"sync"
 	"time"
 
@@ -11,17 +12,36 @@ import (
 
 func NewSampler() *Sampler {
 	return &Sampler{
-		recent: make(map[string]*Sample),
+		recent:     make(map[string]*Sample),
+		roundTrips: make(map[string]time.Duration),
 	}
 }
 
 // Sampler allows the sampling of a set of meters over time.
 type Sampler struct {
-	group  singleflight.Group
-	mu     sync.Mutex
+	// Client holds the HTTP client used to contact the meters
+	// when SamplePlace.Client isn't set. If it's nil,
+	// DefaultHTTPClient is used.
+	Client *http.Client
+
+	// Now is used to query the current time. If it's nil,
+	// time.Now will be used.
+	Now func() time.Time
+
+	group singleflight.Group
+	mu    sync.Mutex
+	// recent holds the most recent sample for each place,
+	// keyed by SamplePlace.key.
 	recent map[string]*Sample
+	// roundTrips holds the moving average of the round trip
+	// time of successful requests to each meter address.
+	roundTrips map[string]time.Duration
 }
 
+// roundTripWeight holds the inverse of the weight given to
+// each new round trip time in the moving average.
+const roundTripWeight = 4
+
 // Sample holds a meter reading that was received at
 // a particular time.
 type Sample struct {
@@ -38,13 +58,31 @@ type result struct {
 // SamplePlace holds where to get a sample from.
 type SamplePlace struct {
 	// Addr holds the address of the meter to contact to get the sample.
+	// See Get for the allowed forms.
 	Addr string
 
+	// Units holds the units that the meter reports in.
+	// If it's UnitsDefault, kW and kWh are assumed.
+	Units Units
+
 	// AllowedLag holds the allowed lag of a sample that GetAll may
 	// return. If there's a sample that's already available and not
 	// more than AllowedLag old when GetAll is called, it will be
 	// returned instead of making a new call.
 	AllowedLag time.Duration
+
+	// Client, if non-nil, holds the HTTP client used
+	// to contact the meter, overriding Sampler.Client.
+	// It should only affect how the meter is contacted,
+	// not the reading, because concurrent requests for
+	// the same address and units share a single request.
+	Client *http.Client
+}
+
+// key returns the key used to share samples between
+// places. Samples in different units can't be shared.
+func (p SamplePlace) key() string {
+	return p.Addr + " " + string(p.Units)
 }
 
 // GetAll tries to acquire a sample for the meters at all the given
@@ -61,11 +99,11 @@ func (sampler *Sampler) GetAll(ctx context.Context, places ...SamplePlace) []*Sa
 		i, place := i, place
 
 		sampler.mu.Lock()
-		oldSample, ok := sampler.recent[place.Addr]
+		oldSample, ok := sampler.recent[place.key()]
 		sampler.mu.Unlock()
 		var lag time.Duration
 		if ok {
-			lag = time.Since(oldSample.Time)
+			lag = sampler.now().Sub(oldSample.Time)
 			if lag < place.AllowedLag {
 				// We already have a sample that's within the allowed lag, so use that.
 				samples[i] = oldSample
@@ -74,11 +112,11 @@ func (sampler *Sampler) GetAll(ctx context.Context, places ...SamplePlace) []*Sa
 			}
 		}
 		go func() {
-			s := sampler.getOne(ctx, place.Addr)
+			s := sampler.getOne(ctx, place)
 			if s != nil {
 				sampler.mu.Lock()
 				defer sampler.mu.Unlock()
-				sampler.recent[place.Addr] = s
+				sampler.recent[place.key()] = s
 			}
 			results <- result{
 				index:  i,
@@ -94,7 +132,7 @@ func (sampler *Sampler) GetAll(ctx context.Context, places ...SamplePlace) []*Sa
 			defer sampler.mu.Unlock()
 			for i, s := range samples {
 				if s == nil {
-					samples[i] = sampler.recent[places[i].Addr]
+					samples[i] = sampler.recent[places[i].key()]
 				}
 			}
 			return samples
@@ -106,16 +144,26 @@ func (sampler *Sampler) GetAll(ctx context.Context, places ...SamplePlace) []*Sa
 	return samples
 }
 
-func (sampler *Sampler) getOne(ctx context.Context, addr string) *Sample {
+func (sampler *Sampler) getOne(ctx context.Context, place SamplePlace) *Sample {
+	addr := place.Addr
+	client := place.Client
+	if client == nil {
+		client = sampler.Client
+	}
 	retry := 100 * time.Millisecond
 	for ctx.Err() == nil {
 		t0 := time.Now()
-		sample0, err := sampler.group.Do(addr, func() (interface{}, error) {
+		sample0, err := sampler.group.Do(place.key(), func() (interface{}, error) {
 			// Note: ignore the outer context cancellation because we want to continue
 			// with the request regardless.
-			reading, err := Get(context.Background(), addr)
+			t0 := sampler.now()
+			reading, err := GetWithClient(context.Background(), client, addr, place.Units)
+			t1 := sampler.now()
+			if err == nil {
+				sampler.addRoundTrip(addr, t1.Sub(t0))
+			}
 			return &Sample{
-				Time:    time.Now(),
+				Time:    t1,
 				Reading: reading,
 			}, err
 		})
@@ -138,6 +186,31 @@ func (sampler *Sampler) getOne(ctx context.Context, addr string) *Sample {
 	return nil
 }
 
+// RoundTrip returns the moving average of the time taken
+// by successful requests to the meter at the given address,
+// or zero if there have been none.
+func (sampler *Sampler) RoundTrip(addr string) time.Duration {
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	return sampler.roundTrips[addr]
+}
+
+func (sampler *Sampler) addRoundTrip(addr string, d time.Duration) {
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	if avg, ok := sampler.roundTrips[addr]; ok {
+		d = avg + (d-avg)/roundTripWeight
+	}
+	sampler.roundTrips[addr] = d
+}
+
+func (sampler *Sampler) now() time.Time {
+	if sampler.Now != nil {
+		return sampler.Now()
+	}
+	return time.Now()
+}
+
 type temporary interface {
 	Temporary() bool
 }
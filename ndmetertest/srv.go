@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"sort"
@@ -26,15 +27,15 @@ var valuesTmpl = template.Must(template.New("").Parse(`
 	<td id='v1'>2501</td>
 	<td id='i1'>2</td>
 	<td id='pf1'>0</td>
-	<td id='p1'>0</td>
+	<td id='p1'>{{index .PhaseKW 0}}</td>
 	<td id='v2'>2510</td>
 	<td id='i2'>2</td>
 	<td id='pf2'>0</td>
-	<td id='p2'>0</td>
+	<td id='p2'>{{index .PhaseKW 1}}</td>
 	<td id='v3'>2595</td>
 	<td id='i3'>44</td>
 	<td id='pf3'>1000</td>
-	<td id='p3'>114</td>
+	<td id='p3'>{{index .PhaseKW 2}}</td>
 	<td id='ae'>{{.SystemKWh}}</td>
 	<td id='re'>25743</td>
 	<td id='ascale'>2</td>
@@ -43,7 +44,7 @@ var valuesTmpl = template.Must(template.New("").Parse(`
 	<td id='escale'>5</td>
 	<td id='ct'>150</td>
 	<td id='nv'>480</td>
-	<td id='model'>350</td>
+	<td id='model'>{{.Model}}</td>
     <td id='ps'>1</td>
 	<td>-----</td>
 </table>
@@ -55,8 +56,10 @@ const (
 )
 
 type liveValues struct {
+	Model     string
 	SystemKW  int
 	SystemKWh int
+	PhaseKW   [3]int
 }
 
 type Server struct {
@@ -67,6 +70,32 @@ type Server struct {
 	energy  float64
 	delay   time.Duration
 	samples sampleSlice
+	model   string
+	// unitScale holds the number of W or Wh in each
+	// of the meter's base units.
+	unitScale float64
+
+	// phasePower holds the power for each phase.
+	phasePower [3]float64
+
+	// tz holds the time zone of the meter's clock.
+	tz *time.Location
+
+	// now returns the current time of the meter's clock.
+	now func() time.Time
+
+	// integrate holds whether energy is integrated
+	// from the power over time.
+	integrate bool
+
+	// logInterval holds the interval between samples added to
+	// the energy log when integrating energy. If it's zero, no
+	// samples are added.
+	logInterval time.Duration
+
+	// integratedTime holds the time up until which
+	// energy has been integrated.
+	integratedTime time.Time
 }
 
 var reqServer = &httprequest.Server{}
@@ -77,8 +106,12 @@ func NewServer(addr string) (*Server, error) {
 		return nil, err
 	}
 	srv := &Server{
-		Addr: lis.Addr().String(),
-		lis:  lis,
+		Addr:      lis.Addr().String(),
+		lis:       lis,
+		model:     "350",
+		unitScale: 1000,
+		tz:        time.UTC,
+		now:       time.Now,
 	}
 	router := httprouter.New()
 	for _, h := range reqServer.Handlers(srv.handler) {
@@ -91,15 +124,109 @@ func NewServer(addr string) (*Server, error) {
 func (srv *Server) SetPower(power float64) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
+	// Integrate the energy used at the old power level
+	// before changing it.
+	srv.integrateEnergy()
 	srv.power = power
 }
 
+// SetPhasePower sets the power reported for each of
+// the three supply phases. By default, it's zero.
+func (srv *Server) SetPhasePower(power [3]float64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.phasePower = power
+}
+
 func (srv *Server) SetEnergy(energy float64) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
+	srv.integrateEnergy()
 	srv.energy = energy
 }
 
+// Energy returns the total energy currently reported
+// by the meter in Wh.
+func (srv *Server) Energy() float64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.integrateEnergy()
+	return srv.energy
+}
+
+// SetNow sets the function used to obtain the current
+// time of the meter's clock. By default, time.Now is used.
+func (srv *Server) SetNow(now func() time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.integrateEnergy()
+	srv.now = now
+	if srv.integrate {
+		srv.integratedTime = now()
+	}
+}
+
+// SetIntegrateEnergy sets whether the meter's energy total
+// advances over time according to the current power, as
+// measured by the meter's clock. Negative power doesn't
+// contribute to the total.
+//
+// If logInterval is non-zero, a sample is added to the energy
+// log whenever the clock passes a multiple of logInterval, as
+// a real meter would do.
+func (srv *Server) SetIntegrateEnergy(integrate bool, logInterval time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.integrateEnergy()
+	srv.integrate = integrate
+	srv.logInterval = logInterval
+	srv.integratedTime = srv.now()
+}
+
+// integrateEnergy brings the energy total up to date with
+// the current time when energy integration is enabled, adding
+// any samples to the energy log as required.
+// It's called with srv.mu held.
+func (srv *Server) integrateEnergy() {
+	if !srv.integrate {
+		return
+	}
+	now := srv.now()
+	if !now.After(srv.integratedTime) {
+		return
+	}
+	power := math.Max(srv.power, 0)
+	energyAt := func(t time.Time) float64 {
+		return srv.energy + power*t.Sub(srv.integratedTime).Hours()
+	}
+	if srv.logInterval > 0 {
+		added := false
+		for t := srv.integratedTime.Truncate(srv.logInterval).Add(srv.logInterval); !t.After(now); t = t.Add(srv.logInterval) {
+			srv.samples = append(srv.samples, meterstat.Sample{
+				Time:        t,
+				TotalEnergy: energyAt(t),
+			})
+			added = true
+		}
+		if added {
+			sort.Sort(srv.samples)
+		}
+	}
+	srv.energy = energyAt(now)
+	srv.integratedTime = now
+}
+
+// SetModel sets the model reported by the meter and the number
+// of W or Wh in each of the base units that it reports power and
+// energy in. By default, the model is "350", which reports
+// in kW and kWh.
+func (srv *Server) SetModel(model string, unitScale float64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.model = model
+	srv.unitScale = unitScale
+}
+
 func (srv *Server) SetDelay(delay float64) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
@@ -110,6 +237,15 @@ func (srv *Server) handler(p httprequest.Params) (handler, context.Context, erro
 	return handler{srv}, p.Context, nil
 }
 
+// SetTZ sets the time zone of the meter's clock, which
+// determines how times in the energy log are represented.
+// By default, the clock is set to UTC.
+func (srv *Server) SetTZ(tz *time.Location) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.tz = tz
+}
+
 func (srv *Server) AddSamples(samples []meterstat.Sample) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
@@ -138,16 +274,28 @@ func (h handler) LiveValues(p httprequest.Params, req *liveValuesReq) {
 	}
 	h.srv.mu.Lock()
 	defer h.srv.mu.Unlock()
+	h.srv.integrateEnergy()
 	p.Response.Header().Set("Content-Type", "text/html")
-	p.Response.Header().Set("Date", time.Now().UTC().Format("Mon, 2 Jan 2006 15:04:05 MST"))
-	if err := valuesTmpl.Execute(p.Response, liveValues{
-		SystemKW:  int(h.srv.power/10 + 0.5),
-		SystemKWh: int(h.srv.energy/100 + 0.5),
-	}); err != nil {
+	p.Response.Header().Set("Date", h.srv.now().UTC().Format("Mon, 2 Jan 2006 15:04:05 MST"))
+	vals := liveValues{
+		Model:     h.srv.model,
+		SystemKW:  h.srv.scaledPower(h.srv.power),
+		SystemKWh: int(h.srv.energy/h.srv.unitScale/math.Pow(10, escale-6) + 0.5),
+	}
+	for i, power := range h.srv.phasePower {
+		vals.PhaseKW[i] = h.srv.scaledPower(power)
+	}
+	if err := valuesTmpl.Execute(p.Response, vals); err != nil {
 		log.Printf("cannot execute template: %v", err)
 	}
 }
 
+// scaledPower returns the given power in W as
+// it's reported by the meter.
+func (srv *Server) scaledPower(power float64) int {
+	return int(power/srv.unitScale/math.Pow(10, pscale-6) + 0.5)
+}
+
 type energyLogReq struct {
 	httprequest.Route `httprequest:"POST /Read_Energy.cgi"`
 	From              timestamp `httprequest:"From,form"`
@@ -159,16 +307,17 @@ func (h handler) ReadEnergyLog(p httprequest.Params, req *energyLogReq) error {
 	if req.Fmt != "csv" {
 		return fmt.Errorf("unexpected format %q in energy log request", req.Fmt)
 	}
-	t0, t1 := req.From.t, req.To.t
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	h.srv.integrateEnergy()
+	t0, t1 := req.From.in(h.srv.tz), req.To.in(h.srv.tz)
 	if t0.After(t1) {
 		return fmt.Errorf("energy log read: From is before To")
 	}
-	h.srv.mu.Lock()
-	defer h.srv.mu.Unlock()
 	fmt.Fprintf(p.Response, "Date, Time, kWh, Export kWh, Counter 1, Counter 2, Counter 3\n")
 	for _, s := range h.srv.samples {
 		if !s.Time.Before(t0) && !s.Time.After(t1) {
-			fmt.Fprintf(p.Response, "%s,%f,0,0,0,0\n", s.Time.UTC().Round(time.Second).Format("02-01-2006,15:04:05"), s.TotalEnergy/1000)
+			fmt.Fprintf(p.Response, "%s,%f,0,0,0,0\n", s.Time.In(h.srv.tz).Round(time.Second).Format("02-01-2006,15:04:05"), s.TotalEnergy/1000)
 		}
 	}
 	return nil
@@ -189,6 +338,12 @@ func (t *timestamp) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// in returns the time represented by t when
+// the meter's clock is set to the given time zone.
+func (t timestamp) in(tz *time.Location) time.Time {
+	return time.Date(t.t.Year(), t.t.Month(), t.t.Day(), t.t.Hour(), t.t.Minute(), t.t.Second(), 0, tz)
+}
+
 func (t timestamp) MarshalText() ([]byte, error) {
 	return []byte(fmt.Sprint(t.t.Unix() - timeOffset)), nil
 }
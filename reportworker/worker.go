@@ -55,15 +55,7 @@ func New(p Params) (*Worker, error) {
 func (w *Worker) run() {
 	defer w.wg.Done()
 	for {
-		reports, err := hydroreport.AllReports(hydroreport.AllReportsParams{
-			SampleDir: w.p.SampleDir,
-			Meters:    w.p.Meters,
-			TZ:        w.p.TZ,
-		})
-		if err != nil {
-			log.Printf("cannot gather reports: %v", err)
-		}
-		w.p.UpdateAvailableReports(reports)
+		w.p.UpdateAvailableReports(w.allReports())
 		select {
 		case <-w.ctx.Done():
 			return
@@ -73,6 +65,30 @@ func (w *Worker) run() {
 	}
 }
 
+// allReports returns all the currently available reports.
+// When there are no meters at some location, no reports
+// are possible, so it returns no reports.
+func (w *Worker) allReports() []*hydroreport.Report {
+	for _, loc := range []hydroreport.MeterLocation{
+		hydroreport.LocGenerator,
+		hydroreport.LocHere,
+		hydroreport.LocNeighbour,
+	} {
+		if len(w.p.Meters[loc]) == 0 {
+			return nil
+		}
+	}
+	reports, err := hydroreport.AllReports(hydroreport.AllReportsParams{
+		SampleDir: w.p.SampleDir,
+		Meters:    w.p.Meters,
+		TZ:        w.p.TZ,
+	})
+	if err != nil {
+		log.Printf("cannot gather reports: %v", err)
+	}
+	return reports
+}
+
 // SamplesChanged notifies that the sample data may have changed
 // and therefore it's worth checking to see if the available reports
 // have changed too.
@@ -0,0 +1,235 @@
+package reportworker_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/rogpeppe/hydro/hydroreport"
+	"github.com/rogpeppe/hydro/meterstat"
+	"github.com/rogpeppe/hydro/reportworker"
+)
+
+type reportInfo struct {
+	T0, T1  time.Time
+	Partial bool
+}
+
+var discoverReportsTests = []struct {
+	testName string
+	tz       *time.Location
+	t0, t1   time.Time
+	expect   []reportInfo
+}{{
+	testName: "partial-then-full-month",
+	tz:       time.UTC,
+	t0:       time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC),
+	t1:       time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+	expect: []reportInfo{{
+		T0:      time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC),
+		T1:      time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+		Partial: true,
+	}, {
+		T0: time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+		T1: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+	}},
+}, {
+	testName: "full-month-then-partial",
+	tz:       time.UTC,
+	t0:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	t1:       time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC),
+	expect: []reportInfo{{
+		T0: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		T1: time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+	}, {
+		T0:      time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+		T1:      time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC),
+		Partial: true,
+	}},
+}, {
+	testName: "month-boundaries-in-time-zone",
+	tz:       time.FixedZone("X", 2*60*60),
+	// Exactly January and February in the time zone.
+	t0: time.Date(2019, 12, 31, 22, 0, 0, 0, time.UTC),
+	t1: time.Date(2020, 2, 29, 22, 0, 0, 0, time.UTC),
+	expect: []reportInfo{{
+		T0: time.Date(2020, 1, 1, 0, 0, 0, 0, time.FixedZone("X", 2*60*60)),
+		T1: time.Date(2020, 2, 1, 0, 0, 0, 0, time.FixedZone("X", 2*60*60)),
+	}, {
+		T0: time.Date(2020, 2, 1, 0, 0, 0, 0, time.FixedZone("X", 2*60*60)),
+		T1: time.Date(2020, 3, 1, 0, 0, 0, 0, time.FixedZone("X", 2*60*60)),
+	}},
+}}
+
+func TestDiscoverReports(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range discoverReportsTests {
+		c.Run(test.testName, func(c *qt.C) {
+			dir := c.Mkdir()
+			meters := map[hydroreport.MeterLocation][]string{
+				hydroreport.LocGenerator: {"generator"},
+				hydroreport.LocHere:      {"here"},
+				hydroreport.LocNeighbour: {"neighbour"},
+			}
+			for _, names := range meters {
+				writeSamples(c, filepath.Join(dir, names[0], "1.sample"), test.t0, test.t1)
+			}
+			reportsC := make(chan []*hydroreport.Report, 1)
+			w, err := reportworker.New(reportworker.Params{
+				SampleDir:    dir,
+				Meters:       meters,
+				TZ:           test.tz,
+				PollInterval: 10 * time.Millisecond,
+				UpdateAvailableReports: func(reports []*hydroreport.Report) {
+					select {
+					case reportsC <- reports:
+					default:
+					}
+				},
+			})
+			c.Assert(err, qt.IsNil)
+			defer w.Close()
+
+			var reports []*hydroreport.Report
+			select {
+			case reports = <-reportsC:
+			case <-time.After(5 * time.Second):
+				c.Fatalf("no reports found")
+			}
+			got := make([]reportInfo, len(reports))
+			for i, r := range reports {
+				got[i] = reportInfo{
+					T0:      r.Range.T0,
+					T1:      r.Range.T1,
+					Partial: r.Partial,
+				}
+				// The report range is in the report's time zone.
+				c.Assert(r.Range.T0.Location(), qt.Equals, test.tz)
+			}
+			c.Assert(got, qt.HasLen, len(test.expect))
+			for i := range got {
+				c.Assert(got[i].T0.Equal(test.expect[i].T0), qt.IsTrue, qt.Commentf("report %d; got %v want %v", i, got[i].T0, test.expect[i].T0))
+				c.Assert(got[i].T1.Equal(test.expect[i].T1), qt.IsTrue, qt.Commentf("report %d; got %v want %v", i, got[i].T1, test.expect[i].T1))
+				c.Assert(got[i].Partial, qt.Equals, test.expect[i].Partial, qt.Commentf("report %d", i))
+			}
+		})
+	}
+}
+
+func TestSamplesChanged(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	meters := map[hydroreport.MeterLocation][]string{
+		hydroreport.LocGenerator: {"generator"},
+		hydroreport.LocHere:      {"here"},
+		hydroreport.LocNeighbour: {"neighbour"},
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, names := range meters {
+		writeSamples(c, filepath.Join(dir, names[0], "1.sample"), t0, t0.AddDate(0, 0, 10))
+	}
+	reportsC := make(chan []*hydroreport.Report)
+	w, err := reportworker.New(reportworker.Params{
+		SampleDir: dir,
+		Meters:    meters,
+		TZ:        time.UTC,
+		// Use a long poll interval so that only
+		// SamplesChanged causes a new poll.
+		PollInterval: time.Hour,
+		UpdateAvailableReports: func(reports []*hydroreport.Report) {
+			reportsC <- reports
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer func() {
+		go func() {
+			for range reportsC {
+			}
+		}()
+		w.Close()
+		close(reportsC)
+	}()
+	reports := <-reportsC
+	c.Assert(reports, qt.HasLen, 1)
+
+	// Add samples into the next month for all meters.
+	for _, names := range meters {
+		writeSamples(c, filepath.Join(dir, names[0], "2.sample"), t0.AddDate(0, 0, 10), t0.AddDate(0, 1, 10))
+	}
+	w.SamplesChanged()
+	reports = <-reportsC
+	c.Assert(reports, qt.HasLen, 2)
+	c.Assert(reports[1].Range.T0.Equal(t0.AddDate(0, 1, 0)), qt.IsTrue)
+	c.Assert(reports[1].Partial, qt.IsTrue)
+}
+
+var noReportsTests = []struct {
+	testName string
+	meters   map[hydroreport.MeterLocation][]string
+}{{
+	testName: "empty-sample-dir",
+	meters: map[hydroreport.MeterLocation][]string{
+		hydroreport.LocGenerator: {"generator"},
+		hydroreport.LocHere:      {"here"},
+		hydroreport.LocNeighbour: {"neighbour"},
+	},
+}, {
+	testName: "no-meters",
+}, {
+	testName: "missing-location",
+	meters: map[hydroreport.MeterLocation][]string{
+		hydroreport.LocGenerator: {"generator"},
+		hydroreport.LocHere:      {"here"},
+	},
+}}
+
+func TestNoReports(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range noReportsTests {
+		c.Run(test.testName, func(c *qt.C) {
+			reportsC := make(chan []*hydroreport.Report, 1)
+			w, err := reportworker.New(reportworker.Params{
+				SampleDir:    c.Mkdir(),
+				Meters:       test.meters,
+				TZ:           time.UTC,
+				PollInterval: time.Hour,
+				UpdateAvailableReports: func(reports []*hydroreport.Report) {
+					reportsC <- reports
+				},
+			})
+			c.Assert(err, qt.IsNil)
+			defer w.Close()
+			select {
+			case reports := <-reportsC:
+				c.Assert(reports, qt.HasLen, 0)
+			case <-time.After(5 * time.Second):
+				c.Fatalf("available reports never updated")
+			}
+		})
+	}
+}
+
+// writeSamples writes hourly samples covering the time range
+// [t0, t1] to the given file, as if from a meter with
+// a constant 1kW power use.
+func writeSamples(c *qt.C, path string, t0, t1 time.Time) {
+	var samples []meterstat.Sample
+	for t := t0; !t.After(t1); t = t.Add(time.Hour) {
+		samples = append(samples, meterstat.Sample{
+			Time:        t,
+			TotalEnergy: float64(t.Unix()) / 3.6,
+		})
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	c.Assert(err, qt.IsNil)
+	var buf bytes.Buffer
+	_, err = meterstat.WriteSamples(&buf, meterstat.NewMemSampleReader(samples))
+	c.Assert(err, qt.IsNil)
+	err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+	c.Assert(err, qt.IsNil)
+}
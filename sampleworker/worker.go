@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"sync"
@@ -28,6 +29,23 @@ type Params struct {
 	// Interval holds the sampling interval.
 	// If it's zero, DefaultInterval will be used.
 	Interval time.Duration
+	// Jitter holds the maximum random amount of time added
+	// to each interval so that several workers started together
+	// don't all poll their meters at the same moment.
+	// If it's zero, a tenth of the interval will be used.
+	Jitter time.Duration
+	// TZ holds the time zone to use when calculating day boundaries
+	// to use for the sample file names. If it's nil, UTC will be used.
+	TZ *time.Location
+	// SamplesChanged is called if non-nil to notify that a new sample
+	// has been added.
+	SamplesChanged func()
+	// FileMode holds the permissions used when creating sample files.
+	// If it's zero, 0666 is used.
+	FileMode os.FileMode
+	// DirMode holds the permissions used when creating SampleDir.
+	// If it's zero, 0777 is used.
+	DirMode os.FileMode
 }
 
 const DefaultInterval = 30 * time.Second
@@ -47,6 +65,24 @@ func New(p Params) (*Worker, error) {
 	if p.Interval == 0 {
 		p.Interval = DefaultInterval
 	}
+	if p.Jitter == 0 {
+		p.Jitter = p.Interval / 10
+	}
+	if p.TZ == nil {
+		p.TZ = time.UTC
+	}
+	if p.SamplesChanged == nil {
+		p.SamplesChanged = func() {}
+	}
+	if p.FileMode == 0 {
+		p.FileMode = 0666
+	}
+	if p.DirMode == 0 {
+		p.DirMode = 0777
+	}
+	if err := os.MkdirAll(p.SampleDir, p.DirMode); err != nil {
+		return nil, fmt.Errorf("cannot create sample directory: %v", err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	w := &Worker{
 		p:     p,
@@ -92,7 +128,7 @@ func (w *Worker) run() error {
 		if !ok {
 			return nil
 		}
-		now := w.p.Now()
+		now := w.p.Now().In(w.p.TZ)
 		if !samePeriod(prevSampleTime, now) || outf == nil {
 			if outf != nil {
 				if err := outf.Close(); err != nil {
@@ -100,7 +136,7 @@ func (w *Worker) run() error {
 				}
 				outf = nil
 			}
-			f, err := os.Create(w.filename(now))
+			f, err := os.OpenFile(w.filename(now), os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.p.FileMode)
 			if err != nil {
 				return err
 			}
@@ -108,15 +144,27 @@ func (w *Worker) run() error {
 		}
 		if _, err := fmt.Fprintf(outf, "%d,%g\n", now.UnixNano()/1e6, totalEnergy); err != nil {
 			log.Printf("cannot write sample to %q: %v", outf.Name(), err)
+		} else {
+			w.p.SamplesChanged()
 		}
+		prevSampleTime = now
 		select {
-		case <-time.After(w.p.Interval):
+		case <-time.After(w.interval()):
 		case <-w.ctx.Done():
 			return nil
 		}
 	}
 }
 
+// interval returns the length of time to wait
+// before taking the next sample.
+func (w *Worker) interval() time.Duration {
+	if w.p.Jitter <= 0 {
+		return w.p.Interval
+	}
+	return w.p.Interval + time.Duration(rand.Int63n(int64(w.p.Jitter)))
+}
+
 // timeFormat is the format we use for the time in the filenames.
 // We omit colons so that it's compatible with windows filesystems.
 const timeFormat = "2006-01-02T150405.000Z0700"
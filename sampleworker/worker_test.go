@@ -81,6 +81,46 @@ func TestWorkerDayRollover(t *testing.T) {
 	})
 }
 
+func TestWorkerSeveralIntervals(t *testing.T) {
+	c := qt.New(t)
+	ndsrv, err := ndmetertest.NewServer(":0")
+	c.Assert(err, qt.IsNil)
+	timeReq := make(chan chan<- time.Time)
+	changed := make(chan struct{}, 10)
+	p := Params{
+		SampleDir: filepath.Join(c.Mkdir(), "samples"),
+		MeterAddr: ndsrv.Addr,
+		Prefix:    "foo-",
+		Now: func() time.Time {
+			tc := make(chan time.Time)
+			timeReq <- tc
+			return <-tc
+		},
+		Interval: 10 * time.Millisecond,
+		SamplesChanged: func() {
+			changed <- struct{}{}
+		},
+	}
+	w, err := New(p)
+	c.Assert(err, qt.IsNil)
+	for i := 0; i < 3; i++ {
+		tc := waitTimeReq(c, timeReq)
+		// Set the energy for the next reading.
+		ndsrv.SetEnergy(float64(12300 + (i+1)*100))
+		tc <- epoch.Add(time.Duration(i) * time.Minute)
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for samples-changed notification")
+		}
+	}
+	w.Close()
+	// All the samples from the same day go into the same file.
+	assertDirContents(c, p.SampleDir, map[string]string{
+		"foo-2000-01-02T120000.000Z": "946814400000,0\n946814460000,12400\n946814520000,12500\n",
+	})
+}
+
 func assertDirContents(c *qt.C, dir string, expectContents map[string]string) {
 	infos, err := ioutil.ReadDir(dir)
 	c.Assert(err, qt.IsNil)
@@ -21,12 +21,12 @@ var Relays = React.createClass({
 	render: function() {
 		return <table class="relays">
 			<thead>
-				<tr><th>Cohort</th><th>Relay</th><th>Status</th><th>Since</th></tr>
+				<tr><th>Cohort</th><th>Relay</th><th>Status</th><th>Since</th><th>Position</th><th>Note</th></tr>
 			</thead>
 			<tbody>
 			{
 				this.props.relays && this.props.relays.map(function(relay){
-					return <tr><td>{relay.Cohort}</td><td><a href={"/relay/" + relay.Relay}>{relay.Relay}</a></td><td>{relay.On ? "on" : "off"}</td><td>{relay.Since}</td></tr>
+					return <tr><td>{relay.Cohort}</td><td><a href={"/relay/" + relay.Relay}>{relay.Relay}</a></td><td>{relay.On ? "on" : "off"}</td><td>{relay.Since}</td><td>{relay.Position}</td><td>{relay.Note}</td></tr>
 				})
 			}
 			</tbody>
@@ -53,7 +53,7 @@ var Meters = React.createClass({
 			<p/>
 			<table class="meters">
 			<thead>
-				<tr><th>Meter name</th><th>Address</th><th>Current power (kW)</th><th>Total energy (kWh)</th><th>Time lag</th></tr>
+				<tr><th>Meter name</th><th>Address</th><th>Current power (kW)</th><th>Total energy (kWh)</th><th>Time lag</th><th>Round trip</th></tr>
 			</thead>
 			<tbody>
 			{
@@ -69,6 +69,7 @@ var Meters = React.createClass({
 						<td>{sample ? kWfmt(sample.Power) : "n/a"}</td>
 						<td>{sample ? kWhfmt(sample.TotalEnergy) : "n/a"}</td>
 						<td>{sample ? sample.TimeLag : ""}</td>
+						<td>{sample ? sample.RoundTrip : ""}</td>
 					</tr>
 				})
 			}
@@ -119,6 +120,8 @@ socket.onmessage = function(event) {
 			<a href="/config">Change configuration</a>
 			<p/>
 			<a href="/history.html">Relay history</a>
+			<p/>
+			<footer>Hydro version {m.Version}</footer>
 		</div>, toplev);
 };
 